@@ -0,0 +1,199 @@
+package cbyge
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Directions of packets in a capture.
+const (
+	// CaptureIn is a packet sent by the client (e.g. the app) to the server.
+	CaptureIn = "in"
+
+	// CaptureOut is a packet sent by the server to the client.
+	CaptureOut = "out"
+)
+
+// A CaptureRecord is a single packet in a capture.
+//
+// Captures are stored as JSON lines, with one record per line.
+type CaptureRecord struct {
+	Time       time.Time `json:"time"`
+	ConnID     int       `json:"conn_id"`
+	Direction  string    `json:"direction"`
+	Type       uint8     `json:"type"`
+	IsResponse bool      `json:"is_response"`
+	Data       HexData   `json:"data"`
+
+	// Summary is a human-readable description of the packet. It is ignored
+	// when reading captures.
+	Summary string `json:"summary,omitempty"`
+}
+
+// NewCaptureRecord creates a record for a packet sent now.
+func NewCaptureRecord(connID int, direction string, p *Packet) *CaptureRecord {
+	return &CaptureRecord{
+		Time:       time.Now(),
+		ConnID:     connID,
+		Direction:  direction,
+		Type:       p.Type,
+		IsResponse: p.IsResponse,
+		Data:       append(HexData{}, p.Data...),
+		Summary:    SummarizePacket(p),
+	}
+}
+
+// Packet gets the packet stored in the record.
+func (c *CaptureRecord) Packet() *Packet {
+	return &Packet{
+		Type:       c.Type,
+		IsResponse: c.IsResponse,
+		Data:       append([]byte{}, c.Data...),
+	}
+}
+
+// HexData is binary data which is encoded in JSON as a hex string.
+type HexData []byte
+
+func (h HexData) MarshalJSON() ([]byte, error) {
+	return json.Marshal(hex.EncodeToString(h))
+}
+
+func (h *HexData) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	decoded, err := hex.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	*h = decoded
+	return nil
+}
+
+// A CaptureWriter writes capture records to a stream.
+//
+// It is safe to call methods on a CaptureWriter from multiple Goroutines.
+type CaptureWriter struct {
+	lock sync.Mutex
+	w    io.Writer
+}
+
+// NewCaptureWriter creates a CaptureWriter which writes to w.
+func NewCaptureWriter(w io.Writer) *CaptureWriter {
+	return &CaptureWriter{w: w}
+}
+
+// Write writes a record.
+func (c *CaptureWriter) Write(record *CaptureRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return errors.Wrap(err, "write capture")
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if _, err := c.w.Write(append(data, '\n')); err != nil {
+		return errors.Wrap(err, "write capture")
+	}
+	return nil
+}
+
+// WritePacket writes a record for a packet sent now.
+func (c *CaptureWriter) WritePacket(connID int, direction string, p *Packet) error {
+	return c.Write(NewCaptureRecord(connID, direction, p))
+}
+
+// A CaptureReader reads capture records from a stream.
+type CaptureReader struct {
+	r    *bufio.Reader
+	line int
+}
+
+// NewCaptureReader creates a CaptureReader which reads from r.
+func NewCaptureReader(r io.Reader) *CaptureReader {
+	return &CaptureReader{r: bufio.NewReader(r)}
+}
+
+// Read reads the next record, returning io.EOF at the end of the stream.
+func (c *CaptureReader) Read() (*CaptureRecord, error) {
+	for {
+		line, err := c.r.ReadBytes('\n')
+		if err != nil && (err != io.EOF || len(line) == 0) {
+			if err == io.EOF {
+				return nil, err
+			}
+			return nil, errors.Wrap(err, "read capture")
+		}
+		c.line++
+		if len(strings.TrimSpace(string(line))) == 0 {
+			continue
+		}
+		var record CaptureRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("read capture: line %d", c.line))
+		}
+		return &record, nil
+	}
+}
+
+// ReadPacket reads the packet from the next record.
+func (c *CaptureReader) ReadPacket() (*Packet, error) {
+	record, err := c.Read()
+	if err != nil {
+		return nil, err
+	}
+	return record.Packet(), nil
+}
+
+// ReadCapture reads every record in a capture.
+func ReadCapture(r io.Reader) ([]*CaptureRecord, error) {
+	reader := NewCaptureReader(r)
+	var res []*CaptureRecord
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return res, nil
+		} else if err != nil {
+			return nil, err
+		}
+		res = append(res, record)
+	}
+}
+
+// ReadCaptureFile reads every record in a capture file.
+func ReadCaptureFile(path string) ([]*CaptureRecord, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "read capture")
+	}
+	defer f.Close()
+	return ReadCapture(f)
+}
+
+// CapturePackets gets the packets sent in one direction from a list of
+// records, or in both directions if direction is "".
+func CapturePackets(records []*CaptureRecord, direction string) []*Packet {
+	var res []*Packet
+	for _, r := range records {
+		if direction == "" || r.Direction == direction {
+			res = append(res, r.Packet())
+		}
+	}
+	return res
+}
+
+// SummarizePacket creates a short, human-readable description of a packet,
+// decoding the fields of the packet types that are understood.
+func SummarizePacket(p *Packet) string {
+	return DecodePacket(p).String()
+}
@@ -0,0 +1,209 @@
+package cbyge
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Redacted replaces secrets in recorded HTTP exchanges.
+const Redacted = "REDACTED"
+
+// redactedHeaders and redactedFields are the HTTP headers and JSON fields
+// which hold credentials. They are compared case-insensitively.
+var (
+	redactedHeaders = []string{"access-token", "authorization", "cookie", "set-cookie"}
+	redactedFields  = []string{"password", "access_token", "refresh_token", "authorize",
+		"authorize_code", "two_factor"}
+)
+
+// A CassetteInteraction is one recorded HTTP request and its response.
+type CassetteInteraction struct {
+	Method         string            `json:"method"`
+	Path           string            `json:"path"`
+	RequestHeader  map[string]string `json:"request_header,omitempty"`
+	RequestBody    string            `json:"request_body,omitempty"`
+	Status         int               `json:"status"`
+	ResponseHeader map[string]string `json:"response_header,omitempty"`
+	ResponseBody   string            `json:"response_body"`
+}
+
+// Redact replaces access tokens, passwords, and other credentials in the
+// headers and JSON bodies of the interaction.
+func (c *CassetteInteraction) Redact() {
+	for _, h := range []map[string]string{c.RequestHeader, c.ResponseHeader} {
+		for name := range h {
+			for _, redacted := range redactedHeaders {
+				if strings.EqualFold(name, redacted) {
+					h[name] = Redacted
+				}
+			}
+		}
+	}
+	c.RequestBody = redactJSON(c.RequestBody)
+	c.ResponseBody = redactJSON(c.ResponseBody)
+}
+
+// A Cassette is a list of recorded HTTP API calls, which can be replayed to
+// use the API offline, e.g. for test fixtures.
+//
+// To serve a cassette, pass it to an http.Server or httptest.NewServer(), and
+// set APIBaseURL to the server's URL.
+//
+// It is safe to use a Cassette from multiple Goroutines.
+type Cassette struct {
+	lock         sync.Mutex
+	interactions []*CassetteInteraction
+	replayed     map[*CassetteInteraction]bool
+}
+
+// LoadCassette reads a cassette from a JSON file.
+func LoadCassette(path string) (*Cassette, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "load cassette")
+	}
+	var obj struct {
+		Interactions []*CassetteInteraction `json:"interactions"`
+	}
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return nil, errors.Wrap(err, "load cassette")
+	}
+	return &Cassette{interactions: obj.Interactions}, nil
+}
+
+// Save writes the cassette to a JSON file.
+func (c *Cassette) Save(path string) error {
+	c.lock.Lock()
+	data, err := json.MarshalIndent(map[string]interface{}{
+		"interactions": c.interactions,
+	}, "", "  ")
+	c.lock.Unlock()
+	if err != nil {
+		return errors.Wrap(err, "save cassette")
+	}
+
+	// Write atomically so that the cassette is never left half-written.
+	tmpPath := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err := os.WriteFile(tmpPath, append(data, '\n'), 0600); err != nil {
+		return errors.Wrap(err, "save cassette")
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return errors.Wrap(err, "save cassette")
+	}
+	return nil
+}
+
+// Add redacts an interaction and appends it to the cassette.
+func (c *Cassette) Add(interaction *CassetteInteraction) {
+	interaction.Redact()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.interactions = append(c.interactions, interaction)
+}
+
+// Interactions gets the recorded interactions.
+func (c *Cassette) Interactions() []*CassetteInteraction {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return append([]*CassetteInteraction{}, c.interactions...)
+}
+
+// Find finds the recorded response to a request with the given method and
+// path (including the query string).
+//
+// Repeated requests get the recorded responses in order, and the last one is
+// reused once they run out.
+func (c *Cassette) Find(method, path string) (*CassetteInteraction, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	var last *CassetteInteraction
+	for _, x := range c.interactions {
+		if x.Method != method || x.Path != path {
+			continue
+		}
+		last = x
+		if !c.replayed[x] {
+			if c.replayed == nil {
+				c.replayed = map[*CassetteInteraction]bool{}
+			}
+			c.replayed[x] = true
+			return x, true
+		}
+	}
+	return last, last != nil
+}
+
+// ServeHTTP serves recorded responses.
+//
+// Requests which were not recorded get a 404 with an API error, so that the
+// API functions return a *RemoteError.
+func (c *Cassette) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	interaction, ok := c.Find(r.Method, r.URL.RequestURI())
+	if !ok {
+		w.Header().Set("content-type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error": map[string]interface{}{
+				"msg":  "no recorded response for " + r.Method + " " + r.URL.RequestURI(),
+				"code": 0,
+			},
+		})
+		return
+	}
+	for name, value := range interaction.ResponseHeader {
+		w.Header().Set(name, value)
+	}
+	w.WriteHeader(interaction.Status)
+	w.Write([]byte(interaction.ResponseBody))
+}
+
+// redactJSON replaces the values of credential fields in a JSON document. If
+// the document is not valid JSON, it is returned unchanged.
+func redactJSON(doc string) string {
+	if doc == "" {
+		return doc
+	}
+	// Keep numbers as they are, since IDs may not fit in a float64.
+	decoder := json.NewDecoder(strings.NewReader(doc))
+	decoder.UseNumber()
+	var obj interface{}
+	if err := decoder.Decode(&obj); err != nil {
+		return doc
+	}
+	data, err := json.Marshal(redactValue(obj))
+	if err != nil {
+		return doc
+	}
+	return string(data)
+}
+
+func redactValue(obj interface{}) interface{} {
+	switch obj := obj.(type) {
+	case map[string]interface{}:
+		for key, value := range obj {
+			redacted := false
+			for _, field := range redactedFields {
+				if strings.EqualFold(key, field) {
+					redacted = true
+				}
+			}
+			if redacted {
+				obj[key] = Redacted
+			} else {
+				obj[key] = redactValue(value)
+			}
+		}
+	case []interface{}:
+		for i, value := range obj {
+			obj[i] = redactValue(value)
+		}
+	}
+	return obj
+}
@@ -0,0 +1,154 @@
+package cbyge
+
+import (
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCassetteRedact(t *testing.T) {
+	interaction := &CassetteInteraction{
+		Method:        "POST",
+		Path:          "/v2/user_auth",
+		RequestHeader: map[string]string{"Access-Token": "secret", "content-type": "application/json"},
+		RequestBody:   `{"email":"a@b.c","password":"hunter2","nested":[{"Authorize":"x"}]}`,
+		Status:        200,
+		ResponseBody:  `{"access_token":"t1","refresh_token":"t2","user_id":12345678901234567}`,
+	}
+	interaction.Redact()
+	if interaction.RequestHeader["Access-Token"] != Redacted ||
+		interaction.RequestHeader["content-type"] != "application/json" {
+		t.Errorf("unexpected headers: %v", interaction.RequestHeader)
+	}
+	expectedReq := `{"email":"a@b.c","nested":[{"Authorize":"REDACTED"}],"password":"REDACTED"}`
+	if interaction.RequestBody != expectedReq {
+		t.Errorf("unexpected request body: %s", interaction.RequestBody)
+	}
+	expectedResp := `{"access_token":"REDACTED","refresh_token":"REDACTED","user_id":12345678901234567}`
+	if interaction.ResponseBody != expectedResp {
+		t.Errorf("unexpected response body: %s", interaction.ResponseBody)
+	}
+}
+
+func TestCassetteReplay(t *testing.T) {
+	cassette := &Cassette{}
+	for _, x := range []*CassetteInteraction{
+		{
+			Method:       "POST",
+			Path:         "/v2/user_auth",
+			Status:       200,
+			ResponseBody: `{"access_token":"token","refresh_token":"r","user_id":123,"expire_in":100,"authorize":"code"}`,
+		},
+		{
+			Method:       "GET",
+			Path:         "/v2/user/123",
+			Status:       200,
+			ResponseBody: `{"id":123,"email":"a@b.c","nickname":"me","active_date":""}`,
+		},
+		{
+			Method:       "GET",
+			Path:         "/v2/user/123/subscribe/devices",
+			Status:       200,
+			ResponseBody: `[{"id":555,"name":"Kitchen","product_id":"abc","is_online":true}]`,
+		},
+		{
+			Method: "GET",
+			Path:   "/v2/product/abc/device/555/property",
+			Status: 200,
+			ResponseBody: `{"bulbsArray":[{"deviceID":555001,"displayName":"Lamp","switchID":42}],` +
+				`"groupsArray":[{"groupID":1,"displayName":"Room","deviceIDArray":[555001]}]}`,
+		},
+		{
+			Method:       "GET",
+			Path:         "/v2/product/abc/device/556/property",
+			Status:       404,
+			ResponseBody: `{"error":{"msg":"property not exists","code":4041009}}`,
+		},
+	} {
+		cassette.Add(x)
+	}
+
+	// Replay from a saved copy, to cover the file format.
+	path := filepath.Join(t.TempDir(), "api.json")
+	if err := cassette.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	cassette, err := LoadCassette(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(cassette)
+	defer server.Close()
+	APIBaseURL = server.URL
+	defer func() {
+		APIBaseURL = DefaultAPIBaseURL
+	}()
+
+	info, err := Login("a@b.c", "password", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Secrets were redacted while recording.
+	if info.UserID != 123 || info.AccessToken != Redacted || info.Authorize != Redacted {
+		t.Errorf("unexpected session: %+v", info)
+	}
+
+	user, err := GetUserInfo(info.UserID, info.AccessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.ID != 123 || user.Email != "a@b.c" || user.ActiveDate.Date != nil {
+		t.Errorf("unexpected user info: %+v", user)
+	}
+
+	devices, err := GetDevices(info.UserID, info.AccessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 1 || devices[0].ID != 555 || devices[0].Name != "Kitchen" {
+		t.Fatalf("unexpected devices: %+v", devices)
+	}
+
+	props, err := GetDeviceProperties(info.AccessToken, devices[0].ProductID, devices[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(props.Bulbs) != 1 || props.Bulbs[0].SwitchID != 42 || len(props.Groups) != 1 ||
+		props.Groups[0].DisplayName != "Room" {
+		t.Errorf("unexpected properties: %+v", props)
+	}
+
+	_, err = GetDeviceProperties(info.AccessToken, "abc", 556)
+	if !IsPropertyNotExistsError(err) {
+		t.Errorf("expected property error, but got %v", err)
+	}
+
+	// Requests which were not recorded get an API error.
+	_, err = GetUserInfo(456, info.AccessToken)
+	if _, ok := err.(*RemoteError); !ok || !strings.Contains(err.Error(), "no recorded response") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestCassetteFind(t *testing.T) {
+	cassette := &Cassette{}
+	for _, body := range []string{"1", "2"} {
+		cassette.Add(&CassetteInteraction{Method: "GET", Path: "/a", ResponseBody: body})
+	}
+	var bodies []string
+	for i := 0; i < 3; i++ {
+		x, ok := cassette.Find("GET", "/a")
+		if !ok {
+			t.Fatal("interaction not found")
+		}
+		bodies = append(bodies, x.ResponseBody)
+	}
+	if strings.Join(bodies, ",") != "1,2,2" {
+		t.Errorf("unexpected replay order: %v", bodies)
+	}
+	if _, ok := cassette.Find("POST", "/a"); ok {
+		t.Error("unexpected match for a different method")
+	}
+}
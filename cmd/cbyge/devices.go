@@ -0,0 +1,348 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/unixpickle/cbyge"
+)
+
+// A DeviceList is the set of devices and groups on an account.
+type DeviceList struct {
+	Devices []*cbyge.ControllerDevice
+	Groups  []*cbyge.ControllerGroup
+}
+
+// LoadDeviceList enumerates the devices on an account.
+func LoadDeviceList(ctrl *cbyge.Controller) (*DeviceList, error) {
+	devs, groups, err := ctrl.DevicesAndGroups()
+	if err != nil {
+		if cbyge.IsAccessTokenError(err) {
+			return nil, errors.New("session has expired (run 'cbyge login' again)")
+		}
+		return nil, err
+	}
+	return &DeviceList{Devices: devs, Groups: groups}, nil
+}
+
+// Find resolves device arguments, each of which may be a device ID, a device
+// name, a room name, or "all". Names are matched ignoring case.
+//
+// Each device is included once, in the order it was first matched.
+func (d *DeviceList) Find(args []string) ([]*cbyge.ControllerDevice, error) {
+	var res []*cbyge.ControllerDevice
+	seen := map[*cbyge.ControllerDevice]bool{}
+	add := func(dev *cbyge.ControllerDevice) {
+		if !seen[dev] {
+			seen[dev] = true
+			res = append(res, dev)
+		}
+	}
+	for _, arg := range args {
+		var found bool
+		for _, dev := range d.Devices {
+			if arg == "all" || dev.DeviceID() == arg || strings.EqualFold(dev.Name(), arg) {
+				add(dev)
+				found = true
+			}
+		}
+		for _, g := range d.Groups {
+			if g.GroupID() == arg || strings.EqualFold(g.Name(), arg) {
+				for _, dev := range g.Devices() {
+					add(dev)
+				}
+				found = true
+			}
+		}
+		if !found {
+			return nil, errors.New("no device or room matches: " + arg)
+		}
+	}
+	return res, nil
+}
+
+// Rooms gets the names of the groups containing a device.
+func (d *DeviceList) Rooms(dev *cbyge.ControllerDevice) []string {
+	res := []string{}
+	for _, g := range d.Groups {
+		for _, gd := range g.Devices() {
+			if gd == dev {
+				res = append(res, g.Name())
+				break
+			}
+		}
+	}
+	return res
+}
+
+func CmdDevices(args []string) error {
+	var common CommonFlags
+	fs := newFlagSet("devices", "")
+	common.Add(fs)
+	fs.Parse(args)
+
+	ctrl, err := common.Controller()
+	if err != nil {
+		return err
+	}
+	list, err := LoadDeviceList(ctrl)
+	if err != nil {
+		return err
+	}
+	if common.JSON {
+		res := []interface{}{}
+		for _, dev := range list.Devices {
+			res = append(res, map[string]interface{}{
+				"id":    dev.DeviceID(),
+				"name":  dev.Name(),
+				"rooms": list.Rooms(dev),
+			})
+		}
+		return printJSON(res)
+	}
+	table := NewTable("ID", "NAME", "ROOMS")
+	for _, dev := range list.Devices {
+		table.Add(dev.DeviceID(), dev.Name(), strings.Join(list.Rooms(dev), ", "))
+	}
+	return table.Print()
+}
+
+func CmdStatus(args []string) error {
+	var common CommonFlags
+	fs := newFlagSet("status", "[DEVICE...]")
+	common.Add(fs)
+	fs.Parse(args)
+
+	ctrl, devs, err := controllerAndDevices(&common, fs.Args(), true)
+	if err != nil {
+		return err
+	}
+	statuses, errs := ctrl.DeviceStatuses(devs)
+
+	var failed bool
+	if common.JSON {
+		res := []interface{}{}
+		for i, dev := range devs {
+			obj := map[string]interface{}{"id": dev.DeviceID(), "name": dev.Name()}
+			if errs[i] != nil {
+				obj["error"] = errs[i].Error()
+				failed = true
+			} else {
+				obj["status"] = statuses[i].Encode()
+			}
+			res = append(res, obj)
+		}
+		if err := printJSON(res); err != nil {
+			return err
+		}
+	} else {
+		table := NewTable("ID", "NAME", "ONLINE", "POWER", "BRIGHTNESS", "COLOR")
+		for i, dev := range devs {
+			if errs[i] != nil {
+				table.Add(dev.DeviceID(), dev.Name(), "error: "+errs[i].Error())
+				failed = true
+			} else {
+				table.Add(append([]string{dev.DeviceID(), dev.Name()},
+					formatStatus(statuses[i])...)...)
+			}
+		}
+		if err := table.Print(); err != nil {
+			return err
+		}
+	}
+	if failed {
+		return errFailed
+	}
+	return nil
+}
+
+func CmdOn(args []string) error {
+	on := true
+	return runSetter("on", "DEVICE...", args, 0, func([]string) (cbyge.DeviceState, error) {
+		return cbyge.DeviceState{On: &on}, nil
+	})
+}
+
+func CmdOff(args []string) error {
+	on := false
+	return runSetter("off", "DEVICE...", args, 0, func([]string) (cbyge.DeviceState, error) {
+		return cbyge.DeviceState{On: &on}, nil
+	})
+}
+
+func CmdBrightness(args []string) error {
+	return runSetter("brightness", "PERCENT DEVICE...", args, 1,
+		func(values []string) (cbyge.DeviceState, error) {
+			value, err := strconv.Atoi(values[0])
+			if err != nil {
+				return cbyge.DeviceState{}, errors.New("invalid brightness: " + values[0])
+			}
+			return cbyge.DeviceState{Brightness: &value}, nil
+		})
+}
+
+func CmdTone(args []string) error {
+	return runSetter("tone", "TONE DEVICE...", args, 1,
+		func(values []string) (cbyge.DeviceState, error) {
+			value, err := strconv.Atoi(values[0])
+			if err != nil {
+				return cbyge.DeviceState{}, errors.New("invalid color tone: " + values[0])
+			}
+			return cbyge.DeviceState{ColorTone: &value}, nil
+		})
+}
+
+func CmdRGB(args []string) error {
+	return runSetter("rgb", "COLOR DEVICE...", args, 1,
+		func(values []string) (cbyge.DeviceState, error) {
+			rgb, err := ParseColor(values[0])
+			if err != nil {
+				return cbyge.DeviceState{}, err
+			}
+			return cbyge.DeviceState{RGB: &rgb}, nil
+		})
+}
+
+// runSetter implements a command which applies a state change to devices.
+//
+// The first numValues positional arguments are passed to makeState, and the
+// remaining ones select the devices.
+func runSetter(name, usage string, args []string, numValues int,
+	makeState func(values []string) (cbyge.DeviceState, error)) error {
+	var common CommonFlags
+	var async bool
+	fs := newFlagSet(name, usage)
+	common.Add(fs)
+	fs.BoolVar(&async, "async", false, "do not wait for devices to acknowledge the change")
+	fs.Parse(args)
+
+	if fs.NArg() <= numValues {
+		fs.Usage()
+		return errors.New("no devices specified (use \"all\" for every device)")
+	}
+	state, err := makeState(fs.Args()[:numValues])
+	if err != nil {
+		return err
+	}
+	if err := state.Validate(); err != nil {
+		return err
+	}
+	ctrl, devs, err := controllerAndDevices(&common, fs.Args()[numValues:], false)
+	if err != nil {
+		return err
+	}
+	errs := make([]error, len(devs))
+	for i, dev := range devs {
+		if async {
+			errs[i] = ctrl.SetDeviceStateAsync(dev, state)
+		} else {
+			errs[i] = ctrl.SetDeviceState(dev, state)
+		}
+	}
+	return printResults(&common, devs, errs)
+}
+
+// controllerAndDevices creates a controller and resolves device arguments.
+// If allByDefault is true, no arguments selects every device.
+func controllerAndDevices(common *CommonFlags, args []string,
+	allByDefault bool) (*cbyge.Controller, []*cbyge.ControllerDevice, error) {
+	ctrl, err := common.Controller()
+	if err != nil {
+		return nil, nil, err
+	}
+	list, err := LoadDeviceList(ctrl)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(args) == 0 && allByDefault {
+		return ctrl, list.Devices, nil
+	}
+	devs, err := list.Find(args)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ctrl, devs, nil
+}
+
+// printResults prints the outcome of a command for each device, returning
+// errFailed if any of them failed.
+func printResults(common *CommonFlags, devs []*cbyge.ControllerDevice, errs []error) error {
+	var failed bool
+	if common.JSON {
+		res := []interface{}{}
+		for i, dev := range devs {
+			obj := map[string]interface{}{"id": dev.DeviceID(), "name": dev.Name()}
+			if errs[i] != nil {
+				obj["error"] = errs[i].Error()
+				failed = true
+			}
+			res = append(res, obj)
+		}
+		if err := printJSON(res); err != nil {
+			return err
+		}
+	} else {
+		table := NewTable("ID", "NAME", "RESULT")
+		for i, dev := range devs {
+			result := "ok"
+			if errs[i] != nil {
+				result = "error: " + errs[i].Error()
+				failed = true
+			}
+			table.Add(dev.DeviceID(), dev.Name(), result)
+		}
+		if err := table.Print(); err != nil {
+			return err
+		}
+	}
+	if failed {
+		return errFailed
+	}
+	return nil
+}
+
+// ParseColor parses a color like "ff8800", "#ff8800", or "255,136,0".
+func ParseColor(s string) ([3]uint8, error) {
+	var res [3]uint8
+	if parts := strings.Split(s, ","); len(parts) == 3 {
+		for i, part := range parts {
+			x, err := strconv.ParseUint(strings.TrimSpace(part), 10, 8)
+			if err != nil {
+				return res, errors.New("invalid color: " + s)
+			}
+			res[i] = uint8(x)
+		}
+		return res, nil
+	}
+	hex := strings.TrimPrefix(s, "#")
+	if len(hex) != 6 {
+		return res, errors.New("invalid color: " + s)
+	}
+	for i := range res {
+		x, err := strconv.ParseUint(hex[i*2:i*2+2], 16, 8)
+		if err != nil {
+			return res, errors.New("invalid color: " + s)
+		}
+		res[i] = uint8(x)
+	}
+	return res, nil
+}
+
+// formatStatus formats the online, power, brightness, and color columns of
+// a status table.
+func formatStatus(s cbyge.ControllerDeviceStatus) []string {
+	if !s.IsOnline {
+		return []string{"no", "-", "-", "-"}
+	}
+	power := "off"
+	if s.IsOn {
+		power = "on"
+	}
+	color := fmt.Sprintf("tone %d", s.ColorTone)
+	if s.UseRGB {
+		color = fmt.Sprintf("#%02x%02x%02x", s.RGB[0], s.RGB[1], s.RGB[2])
+	}
+	return []string{"yes", power, strconv.Itoa(int(s.Brightness)) + "%", color}
+}
@@ -0,0 +1,114 @@
+// Command cbyge lists and controls C by GE devices from the command line.
+//
+// Run "cbyge login" once to save a session, and then use the other
+// subcommands to query and change devices. Every subcommand accepts -json to
+// produce machine-readable output.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/unixpickle/cbyge"
+	"github.com/unixpickle/essentials"
+)
+
+type command struct {
+	Name  string
+	Args  string
+	Usage string
+	Run   func(args []string) error
+}
+
+var commands []command
+
+func init() {
+	commands = []command{
+		{"login", "", "sign in and save a session", CmdLogin},
+		{"devices", "", "list devices and their rooms", CmdDevices},
+		{"status", "[DEVICE...]", "get the status of devices", CmdStatus},
+		{"on", "DEVICE...", "turn devices on", CmdOn},
+		{"off", "DEVICE...", "turn devices off", CmdOff},
+		{"brightness", "PERCENT DEVICE...", "set the brightness (1-100)", CmdBrightness},
+		{"tone", "TONE DEVICE...", "set the color tone (0-100)", CmdTone},
+		{"rgb", "COLOR DEVICE...", "set an RGB color, like ff8800 or 255,136,0", CmdRGB},
+		{"scene", "NAME", "apply, save, or list scenes", CmdScene},
+		{"watch", "[DEVICE...]", "print status changes as they happen", CmdWatch},
+		{"tui", "[DEVICE...]", "control devices from an interactive dashboard", CmdTUI},
+		{"replay", "CAPTURE", "replay a proxy capture and compare the responses", CmdReplay},
+	}
+}
+
+func main() {
+	if len(os.Args) < 2 || os.Args[1] == "help" || os.Args[1] == "-help" ||
+		os.Args[1] == "--help" || os.Args[1] == "-h" {
+		printUsage()
+		os.Exit(2)
+	}
+	for _, c := range commands {
+		if c.Name == os.Args[1] {
+			if err := c.Run(os.Args[2:]); err != nil {
+				if err == errFailed {
+					os.Exit(1)
+				}
+				essentials.Die(err)
+			}
+			return
+		}
+	}
+	fmt.Fprintln(os.Stderr, "Unknown command:", os.Args[1])
+	printUsage()
+	os.Exit(2)
+}
+
+func printUsage() {
+	fmt.Fprintln(os.Stderr, "Usage: cbyge <command> [flags] [args]")
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "Commands:")
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-30s %s\n", c.Name+" "+c.Args, c.Usage)
+	}
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "A DEVICE is a device ID, a device name, a room name, or \"all\".")
+	fmt.Fprintln(os.Stderr, "Run 'cbyge <command> -help' for a command's flags.")
+}
+
+// errFailed is returned by commands which have already reported their
+// failure, e.g. in a table of per-device results.
+var errFailed = errors.New("command failed")
+
+// CommonFlags are the flags accepted by every subcommand.
+type CommonFlags struct {
+	JSON        bool
+	SessionPath string
+	Timeout     time.Duration
+}
+
+func (c *CommonFlags) Add(fs *flag.FlagSet) {
+	fs.BoolVar(&c.JSON, "json", false, "print output as JSON")
+	fs.StringVar(&c.SessionPath, "session", DefaultSessionPath(), "path to the saved session")
+	fs.DurationVar(&c.Timeout, "timeout", cbyge.DefaultTimeout, "timeout for device commands")
+}
+
+// Controller creates a controller from the saved session.
+func (c *CommonFlags) Controller() (*cbyge.Controller, error) {
+	info, err := LoadSession(c.SessionPath)
+	if err != nil {
+		return nil, err
+	}
+	return cbyge.NewController(info, c.Timeout), nil
+}
+
+// newFlagSet creates a FlagSet for a subcommand with a usage message that
+// lists its arguments.
+func newFlagSet(name, args string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: cbyge %s [flags] %s\n", name, args)
+		fs.PrintDefaults()
+	}
+	return fs
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+// A Table is a list of rows to print with aligned columns.
+type Table struct {
+	header []string
+	rows   [][]string
+}
+
+func NewTable(header ...string) *Table {
+	return &Table{header: header}
+}
+
+// Add adds a row, which may have fewer columns than the header.
+func (t *Table) Add(row ...string) {
+	t.rows = append(t.rows, row)
+}
+
+// Print writes the table to stdout.
+func (t *Table) Print() error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, strings.Join(t.header, "\t"))
+	for _, row := range t.rows {
+		fmt.Fprintln(w, strings.Join(row, "\t"))
+	}
+	return w.Flush()
+}
+
+func printJSON(obj interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(obj)
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/unixpickle/cbyge"
+)
+
+// CmdReplay sends the requests from a capture on a new connection, and
+// compares the responses to the recorded ones.
+func CmdReplay(args []string) error {
+	var common CommonFlags
+	var server string
+	var useTLS bool
+	var connID int
+	var types string
+	var subtypes string
+	var speed float64
+	var wait time.Duration
+	fs := newFlagSet("replay", "CAPTURE")
+	common.Add(fs)
+	fs.StringVar(&server, "server", cbyge.DefaultPacketConnHost, "address of the server")
+	fs.BoolVar(&useTLS, "tls", false, "connect to the server with TLS")
+	fs.IntVar(&connID, "conn", -1, "connection ID to replay (defaults to the first in the capture)")
+	fs.StringVar(&types, "type", "", "only replay these packet types (comma-separated, e.g. pipe)")
+	fs.StringVar(&subtypes, "subtype", "",
+		"only replay pipe packets with these subtypes (comma-separated, e.g. set_lum,0x52)")
+	fs.Float64Var(&speed, "speed", 1, "timing scale, where 2 is twice as fast and 0 sends without delays")
+	fs.DurationVar(&wait, "wait", time.Second*5, "time to wait for responses after the last request")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("expected a capture file")
+	}
+
+	records, err := cbyge.ReadCaptureFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	filter, err := newReplayFilter(types, subtypes)
+	if err != nil {
+		return err
+	}
+	steps := replaySteps(records, connID, filter)
+	if len(steps) == 0 {
+		return errors.New("no requests to replay")
+	}
+
+	info, err := LoadSession(common.SessionPath)
+	if err != nil {
+		return err
+	}
+	var tlsConfig *tls.Config
+	if useTLS {
+		tlsConfig = &tls.Config{}
+	}
+	conn, err := cbyge.NewPacketConnAddr(server, tlsConfig)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := conn.Auth(info.UserID, info.Authorize, common.Timeout); err != nil {
+		return err
+	}
+
+	r := &replayer{conn: conn, steps: steps, seqs: map[uint16]*replayStep{}}
+	readDone := make(chan struct{})
+	go func() {
+		defer close(readDone)
+		r.ReadLoop()
+	}()
+	if err := r.Send(speed); err != nil {
+		return err
+	}
+	r.Wait(wait)
+	conn.Close()
+	<-readDone
+
+	if common.JSON {
+		if err := printJSON(r.Results()); err != nil {
+			return err
+		}
+	} else {
+		r.Print()
+	}
+	for _, s := range steps {
+		if !s.Matches() {
+			return errFailed
+		}
+	}
+	return nil
+}
+
+// A replayStep is a request from a capture, along with the responses that
+// were recorded and received for it.
+type replayStep struct {
+	Record   *cbyge.CaptureRecord
+	Seq      uint16
+	HasSeq   bool
+	Expected []*cbyge.Packet
+	Received []*cbyge.Packet
+}
+
+// Matches checks if the received responses are the same as the recorded
+// ones, ignoring sequence numbers.
+func (r *replayStep) Matches() bool {
+	missing, extra := r.Diff()
+	return len(missing) == 0 && len(extra) == 0
+}
+
+// Diff finds the recorded responses which were not received, and the
+// received responses which were not recorded.
+func (r *replayStep) Diff() (missing, extra []*cbyge.Packet) {
+	extra = append(extra, r.Received...)
+	for _, expected := range r.Expected {
+		found := false
+		for i, got := range extra {
+			if bytes.Equal(normalizedPacket(expected), normalizedPacket(got)) {
+				extra = append(extra[:i], extra[i+1:]...)
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, expected)
+		}
+	}
+	return missing, extra
+}
+
+// replaySteps finds the requests sent by the client in one connection, and
+// the responses to each pipe request.
+//
+// Responses are matched to requests by sequence number and switch ID. When
+// the client reuses a sequence number, later responses belong to the later
+// request.
+//
+// Auth packets are skipped, since the replay authenticates with a fresh
+// session instead.
+func replaySteps(records []*cbyge.CaptureRecord, connID int, filter *replayFilter) []*replayStep {
+	var steps []*replayStep
+	pending := map[replayKey]*replayStep{}
+	for _, r := range records {
+		if connID == -1 {
+			connID = r.ConnID
+		}
+		if r.ConnID != connID {
+			continue
+		}
+		packet := r.Packet()
+		key, hasKey := newReplayKey(packet)
+		if r.Direction == cbyge.CaptureOut {
+			if step, ok := pending[key]; ok && hasKey && packet.IsResponse {
+				step.Expected = append(step.Expected, packet)
+			}
+			continue
+		}
+		if packet.IsResponse || packet.Type == cbyge.PacketTypeAuth {
+			continue
+		}
+		if hasKey {
+			// Even requests which are not replayed take over their
+			// sequence number, so that their responses are not
+			// attributed to an earlier request.
+			for k := range pending {
+				if k.Seq == key.Seq {
+					delete(pending, k)
+				}
+			}
+		}
+		if !filter.Matches(packet) {
+			continue
+		}
+		step := &replayStep{Record: r}
+		if hasKey {
+			step.Seq = key.Seq
+			step.HasSeq = true
+			pending[key] = step
+		}
+		steps = append(steps, step)
+	}
+	return steps
+}
+
+// A replayKey identifies the request that a pipe response belongs to.
+type replayKey struct {
+	Seq    uint16
+	Switch uint32
+}
+
+func newReplayKey(p *cbyge.Packet) (replayKey, bool) {
+	seq, err := p.Seq()
+	if err != nil {
+		return replayKey{}, false
+	}
+	return replayKey{Seq: seq, Switch: binary.BigEndian.Uint32(p.Data)}, true
+}
+
+// A replayer sends requests on a connection and collects the responses.
+type replayer struct {
+	conn  *cbyge.PacketConn
+	steps []*replayStep
+
+	lock      sync.Mutex
+	seqs      map[uint16]*replayStep
+	unmatched []*cbyge.Packet
+}
+
+// Send writes each request, with new sequence numbers, using the recorded
+// timing scaled by 1/speed.
+func (r *replayer) Send(speed float64) error {
+	start := time.Now()
+	firstTime := r.steps[0].Record.Time
+	nextSeq := uint16(1)
+	for _, step := range r.steps {
+		if speed > 0 {
+			offset := time.Duration(float64(step.Record.Time.Sub(firstTime)) / speed)
+			time.Sleep(time.Until(start.Add(offset)))
+		}
+		packet := step.Record.Packet()
+		if step.HasSeq {
+			r.lock.Lock()
+			r.seqs[nextSeq] = step
+			r.lock.Unlock()
+			packet.SetSeq(nextSeq)
+			nextSeq++
+		}
+		if err := r.conn.Write(packet); err != nil {
+			return errors.Wrap(err, "replay")
+		}
+	}
+	return nil
+}
+
+// ReadLoop collects responses until the connection is closed.
+func (r *replayer) ReadLoop() {
+	for {
+		packet, err := r.conn.Read()
+		if err != nil {
+			return
+		}
+		if !packet.IsResponse {
+			continue
+		}
+		r.lock.Lock()
+		seq, err := packet.Seq()
+		if step, ok := r.seqs[seq]; ok && err == nil {
+			step.Received = append(step.Received, packet)
+		} else {
+			r.unmatched = append(r.unmatched, packet)
+		}
+		r.lock.Unlock()
+	}
+}
+
+// Wait waits until every request has as many responses as were recorded, or
+// until the timeout.
+func (r *replayer) Wait(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		r.lock.Lock()
+		done := true
+		for _, step := range r.steps {
+			if len(step.Received) < len(step.Expected) {
+				done = false
+				break
+			}
+		}
+		r.lock.Unlock()
+		if done {
+			return
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+}
+
+// Results creates a JSON-friendly description of each step.
+func (r *replayer) Results() []map[string]interface{} {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	var res []map[string]interface{}
+	for _, step := range r.steps {
+		missing, extra := step.Diff()
+		obj := map[string]interface{}{
+			"request":  cbyge.SummarizePacket(step.Record.Packet()),
+			"time":     step.Record.Time,
+			"expected": summarizePackets(step.Expected),
+			"received": summarizePackets(step.Received),
+			"missing":  summarizePackets(missing),
+			"extra":    summarizePackets(extra),
+			"match":    len(missing) == 0 && len(extra) == 0,
+		}
+		if step.HasSeq {
+			obj["seq"] = step.Seq
+		}
+		res = append(res, obj)
+	}
+	return res
+}
+
+// Print prints each request, followed by a diff of its responses.
+func (r *replayer) Print() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, step := range r.steps {
+		missing, extra := step.Diff()
+		status := "ok"
+		if len(missing) > 0 || len(extra) > 0 {
+			status = "differs"
+		}
+		fmt.Printf("%s: %s\n", cbyge.SummarizePacket(step.Record.Packet()), status)
+		for _, p := range missing {
+			fmt.Println("  - " + cbyge.SummarizePacket(p))
+		}
+		for _, p := range extra {
+			fmt.Println("  + " + cbyge.SummarizePacket(p))
+		}
+	}
+	if len(r.unmatched) > 0 {
+		fmt.Printf("%d responses did not match a request\n", len(r.unmatched))
+	}
+}
+
+// normalizedPacket encodes a packet without its sequence number.
+func normalizedPacket(p *cbyge.Packet) []byte {
+	p = &cbyge.Packet{Type: p.Type, IsResponse: p.IsResponse, Data: append([]byte{}, p.Data...)}
+	p.SetSeq(0)
+	return p.Encode()
+}
+
+func summarizePackets(packets []*cbyge.Packet) []string {
+	res := []string{}
+	for _, p := range packets {
+		res = append(res, cbyge.SummarizePacket(p))
+	}
+	return res
+}
+
+// A replayFilter selects which requests to replay.
+type replayFilter struct {
+	types    []uint8
+	subtypes []uint8
+}
+
+func newReplayFilter(types, subtypes string) (*replayFilter, error) {
+	res := &replayFilter{}
+	var err error
+	res.types, err = parseProtocolNames(types, cbyge.Protocol.ParsePacketType)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse -type")
+	}
+	res.subtypes, err = parseProtocolNames(subtypes, cbyge.Protocol.ParsePipeType)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse -subtype")
+	}
+	return res, nil
+}
+
+func (r *replayFilter) Matches(p *cbyge.Packet) bool {
+	if len(r.types) > 0 && !bytes.Contains(r.types, []byte{p.Type}) {
+		return false
+	}
+	if len(r.subtypes) > 0 {
+		d := cbyge.DecodePacket(p)
+		return d.IsPipeCommand && bytes.Contains(r.subtypes, []byte{d.Subtype})
+	}
+	return true
+}
+
+// parseProtocolNames parses a comma-separated list of numbers or names, such
+// as "pipe,8" or "set_lum,0x52", using a parser like
+// cbyge.Protocol.ParsePacketType.
+func parseProtocolNames(list string, parse func(string) (uint8, error)) ([]uint8, error) {
+	var res []uint8
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		n, err := parse(s)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, n)
+	}
+	return res, nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/binary"
+	"reflect"
+	"testing"
+
+	"github.com/unixpickle/cbyge"
+)
+
+func TestReplaySteps(t *testing.T) {
+	const switchA, switchB = 0x1111, 0x2222
+	auth := cbyge.NewCaptureRecord(1, cbyge.CaptureIn, &cbyge.Packet{Type: cbyge.PacketTypeAuth})
+	testCases := []struct {
+		name     string
+		records  []*cbyge.CaptureRecord
+		connID   int
+		subtypes string
+
+		// expected lists the number of recorded responses for each step.
+		expected []int
+	}{
+		{
+			name: "Basic",
+			records: []*cbyge.CaptureRecord{
+				auth,
+				testRequest(1, 1, switchA), testResponse(1, 1, switchA, 0),
+				testRequest(1, 2, switchA), testResponse(1, 2, switchA, 0), testResponse(1, 2, switchA, 0),
+			},
+			connID:   -1,
+			expected: []int{1, 2},
+		},
+		{
+			name: "ReusedSeq",
+			records: []*cbyge.CaptureRecord{
+				testRequest(1, 7, switchA), testResponse(1, 7, switchA, 0),
+				testRequest(1, 7, switchA), testResponse(1, 7, switchA, 0), testResponse(1, 7, switchA, 0),
+			},
+			connID:   -1,
+			expected: []int{1, 2},
+		},
+		{
+			name: "ReusedSeqOtherSwitch",
+			records: []*cbyge.CaptureRecord{
+				testRequest(1, 7, switchA),
+				testRequest(1, 7, switchB),
+				testResponse(1, 7, switchA, 0),
+				testResponse(1, 7, switchB, 0),
+			},
+			connID:   -1,
+			expected: []int{0, 1},
+		},
+		{
+			name: "WrongSwitch",
+			records: []*cbyge.CaptureRecord{
+				testRequest(1, 3, switchA), testResponse(1, 3, switchB, 0),
+			},
+			connID:   -1,
+			expected: []int{0},
+		},
+		{
+			name: "Connection",
+			records: []*cbyge.CaptureRecord{
+				testRequest(1, 1, switchA), testResponse(1, 1, switchA, 0),
+				testRequest(2, 1, switchA), testResponse(2, 1, switchA, 0), testResponse(2, 1, switchA, 0),
+			},
+			connID:   2,
+			expected: []int{2},
+		},
+		{
+			name: "FilteredRequestTakesSeq",
+			records: []*cbyge.CaptureRecord{
+				testRequest(1, 4, switchA),
+				cbyge.NewCaptureRecord(1, cbyge.CaptureIn, cbyge.NewPacketGetStatusPaginated(switchA, 4)),
+				testResponse(1, 4, switchA, 0),
+			},
+			connID:   -1,
+			subtypes: "set_lum",
+			expected: []int{0},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			filter, err := newReplayFilter("", tc.subtypes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var counts []int
+			for _, step := range replaySteps(tc.records, tc.connID, filter) {
+				counts = append(counts, len(step.Expected))
+			}
+			if !reflect.DeepEqual(counts, tc.expected) {
+				t.Errorf("expected responses %v but got %v", tc.expected, counts)
+			}
+		})
+	}
+}
+
+func TestReplayStepDiff(t *testing.T) {
+	response := func(seq uint16, status byte) *cbyge.Packet {
+		return testResponse(1, seq, 0x1234, status).Packet()
+	}
+	sync := &cbyge.Packet{Type: cbyge.PacketTypeSync, Data: []byte{1, 2, 3}}
+	testCases := []struct {
+		name     string
+		expected []*cbyge.Packet
+		received []*cbyge.Packet
+		missing  int
+		extra    int
+	}{
+		{"Same", []*cbyge.Packet{response(1, 0)}, []*cbyge.Packet{response(9, 0)}, 0, 0},
+		{"Status", []*cbyge.Packet{response(1, 0)}, []*cbyge.Packet{response(1, 1)}, 1, 1},
+		{"Missing", []*cbyge.Packet{response(1, 0), sync}, []*cbyge.Packet{response(9, 0)}, 1, 0},
+		{"Extra", []*cbyge.Packet{response(1, 0)}, []*cbyge.Packet{sync, response(9, 0)}, 0, 1},
+		{"Duplicate", []*cbyge.Packet{sync}, []*cbyge.Packet{sync, sync}, 0, 1},
+		{"Empty", nil, nil, 0, 0},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			step := &replayStep{Expected: tc.expected, Received: tc.received}
+			missing, extra := step.Diff()
+			if len(missing) != tc.missing || len(extra) != tc.extra {
+				t.Errorf("expected %d missing and %d extra, but got %d and %d", tc.missing,
+					tc.extra, len(missing), len(extra))
+			}
+			if step.Matches() != (tc.missing == 0 && tc.extra == 0) {
+				t.Error("Matches() is inconsistent with Diff()")
+			}
+		})
+	}
+}
+
+func testRequest(connID int, seq uint16, switchID uint32) *cbyge.CaptureRecord {
+	return cbyge.NewCaptureRecord(connID, cbyge.CaptureIn, cbyge.NewPacketSetLum(switchID, seq, 3, 50))
+}
+
+func testResponse(connID int, seq uint16, switchID uint32, status byte) *cbyge.CaptureRecord {
+	data := binary.BigEndian.AppendUint32(nil, switchID)
+	data = binary.BigEndian.AppendUint16(data, seq)
+	data = append(data, status)
+	packet := &cbyge.Packet{Type: cbyge.PacketTypePipe, IsResponse: true, Data: data}
+	return cbyge.NewCaptureRecord(connID, cbyge.CaptureOut, packet)
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/pkg/errors"
+	"github.com/unixpickle/cbyge"
+)
+
+// A Scene is a saved state for a set of devices.
+type Scene []SceneDevice
+
+type SceneDevice struct {
+	DeviceID string            `json:"device_id"`
+	Name     string            `json:"name,omitempty"`
+	State    cbyge.DeviceState `json:"state"`
+}
+
+// LoadScenes reads the scenes file, which is empty if it does not exist.
+func LoadScenes(path string) (map[string]Scene, error) {
+	scenes := map[string]Scene{}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return scenes, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "load scenes")
+	}
+	if err := json.Unmarshal(data, &scenes); err != nil {
+		return nil, errors.Wrap(err, "load scenes")
+	}
+	return scenes, nil
+}
+
+func SaveScenes(path string, scenes map[string]Scene) error {
+	data, err := json.MarshalIndent(scenes, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "save scenes")
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return errors.Wrap(err, "save scenes")
+	}
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return errors.Wrap(err, "save scenes")
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return errors.Wrap(err, "save scenes")
+	}
+	return nil
+}
+
+// CmdScene applies a scene, or manages the saved scenes.
+//
+// Scenes are saved from the current state of devices with
+// "scene -save NAME DEVICE...".
+func CmdScene(args []string) error {
+	var common CommonFlags
+	var scenesPath string
+	var save bool
+	var list bool
+	var del bool
+	fs := newFlagSet("scene", "NAME | -save NAME DEVICE... | -delete NAME | -list")
+	common.Add(fs)
+	fs.StringVar(&scenesPath, "scenes", filepath.Join(ConfigDir(), "scenes.json"),
+		"path to the saved scenes")
+	fs.BoolVar(&save, "save", false, "save the current state of devices as a scene")
+	fs.BoolVar(&list, "list", false, "list the saved scenes")
+	fs.BoolVar(&del, "delete", false, "delete a scene")
+	fs.Parse(args)
+
+	scenes, err := LoadScenes(scenesPath)
+	if err != nil {
+		return err
+	}
+	if list {
+		return listScenes(&common, scenes)
+	}
+
+	if fs.NArg() < 1 || (!save && fs.NArg() != 1) {
+		fs.Usage()
+		return errors.New("unexpected arguments")
+	}
+	name := fs.Arg(0)
+	if del {
+		if _, ok := scenes[name]; !ok {
+			return errors.New("no such scene: " + name)
+		}
+		delete(scenes, name)
+		return SaveScenes(scenesPath, scenes)
+	} else if save {
+		if fs.NArg() < 2 {
+			fs.Usage()
+			return errors.New("no devices specified (use \"all\" for every device)")
+		}
+		scene, err := captureScene(&common, fs.Args()[1:])
+		if err != nil {
+			return err
+		}
+		scenes[name] = scene
+		if err := SaveScenes(scenesPath, scenes); err != nil {
+			return err
+		}
+		if !common.JSON {
+			fmt.Printf("Saved scene %q with %d devices.\n", name, len(scene))
+			return nil
+		}
+		return printJSON(scene)
+	}
+
+	scene, ok := scenes[name]
+	if !ok {
+		return errors.New("no such scene: " + name)
+	}
+	return applyScene(&common, scene)
+}
+
+func listScenes(common *CommonFlags, scenes map[string]Scene) error {
+	if common.JSON {
+		return printJSON(scenes)
+	}
+	var names []string
+	for name := range scenes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	table := NewTable("NAME", "DEVICES")
+	for _, name := range names {
+		table.Add(name, fmt.Sprint(len(scenes[name])))
+	}
+	return table.Print()
+}
+
+// captureScene creates a scene from the current status of devices.
+func captureScene(common *CommonFlags, args []string) (Scene, error) {
+	ctrl, devs, err := controllerAndDevices(common, args, false)
+	if err != nil {
+		return nil, err
+	}
+	statuses, errs := ctrl.DeviceStatuses(devs)
+	var scene Scene
+	for i, dev := range devs {
+		if errs[i] != nil {
+			return nil, errors.Wrap(errs[i], "get status of "+dev.Name())
+		}
+		status := statuses[i]
+		if !status.IsOnline {
+			return nil, errors.New("device is offline: " + dev.Name())
+		}
+		on := status.IsOn
+		state := cbyge.DeviceState{On: &on}
+		if on {
+			if status.Brightness > 0 {
+				brightness := int(status.Brightness)
+				state.Brightness = &brightness
+			}
+			if status.UseRGB {
+				rgb := status.RGB
+				state.RGB = &rgb
+			} else {
+				tone := int(status.ColorTone)
+				state.ColorTone = &tone
+			}
+		}
+		scene = append(scene, SceneDevice{
+			DeviceID: dev.DeviceID(),
+			Name:     dev.Name(),
+			State:    state,
+		})
+	}
+	return scene, nil
+}
+
+func applyScene(common *CommonFlags, scene Scene) error {
+	ctrl, err := common.Controller()
+	if err != nil {
+		return err
+	}
+	list, err := LoadDeviceList(ctrl)
+	if err != nil {
+		return err
+	}
+	var devs []*cbyge.ControllerDevice
+	var errs []error
+	for _, entry := range scene {
+		found, err := list.Find([]string{entry.DeviceID})
+		if err != nil {
+			return errors.Wrap(err, "scene device "+entry.Name)
+		}
+		dev := found[0]
+		devs = append(devs, dev)
+		errs = append(errs, ctrl.SetDeviceState(dev, entry.State))
+	}
+	return printResults(common, devs, errs)
+}
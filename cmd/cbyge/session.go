@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/unixpickle/cbyge"
+)
+
+// ConfigDir gets the directory for the saved session and scenes, which can
+// be overridden with the CBYGE_CONFIG_DIR environment variable.
+func ConfigDir() string {
+	if dir := os.Getenv("CBYGE_CONFIG_DIR"); dir != "" {
+		return dir
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ".cbyge"
+	}
+	return filepath.Join(dir, "cbyge")
+}
+
+// DefaultSessionPath gets the default path of the saved session.
+func DefaultSessionPath() string {
+	return filepath.Join(ConfigDir(), "session.json")
+}
+
+// LoadSession reads a session saved by SaveSession, or by the login_2fa
+// command.
+func LoadSession(path string) (*cbyge.SessionInfo, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, errors.New("no saved session at " + path + " (run 'cbyge login' first)")
+	} else if err != nil {
+		return nil, errors.Wrap(err, "load session")
+	}
+	var info cbyge.SessionInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		return nil, errors.Wrap(err, "load session")
+	}
+	return &info, nil
+}
+
+// SaveSession writes a session so that only the current user can read it.
+func SaveSession(path string, info *cbyge.SessionInfo) error {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return errors.Wrap(err, "save session")
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return errors.Wrap(err, "save session")
+	}
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return errors.Wrap(err, "save session")
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return errors.Wrap(err, "save session")
+	}
+	return nil
+}
+
+func CmdLogin(args []string) error {
+	var common CommonFlags
+	var email string
+	var password string
+	var no2FA bool
+	fs := newFlagSet("login", "")
+	common.Add(fs)
+	fs.StringVar(&email, "email", "", "account email (prompted if empty)")
+	fs.StringVar(&password, "password", "", "account password (prompted if empty)")
+	fs.BoolVar(&no2FA, "no-2fa", false, "use the legacy login without a verification code")
+	fs.Parse(args)
+
+	stdin := bufio.NewReader(os.Stdin)
+	var err error
+	if email == "" {
+		email, err = prompt(stdin, "Email: ", false)
+		if err != nil {
+			return err
+		}
+	}
+	if password == "" {
+		password, err = prompt(stdin, "Password: ", true)
+		if err != nil {
+			return err
+		}
+	}
+
+	var info *cbyge.SessionInfo
+	if no2FA {
+		info, err = cbyge.Login(email, password, "")
+	} else {
+		if err := cbyge.Login2FAStage1(email, ""); err != nil {
+			return err
+		}
+		var code string
+		code, err = prompt(stdin, "Enter verification code: ", false)
+		if err != nil {
+			return err
+		}
+		info, err = cbyge.Login2FAStage2(email, password, "", code)
+	}
+	if err != nil {
+		return err
+	}
+	if err := SaveSession(common.SessionPath, info); err != nil {
+		return err
+	}
+	if common.JSON {
+		return printJSON(info)
+	}
+	fmt.Println("Saved session to", common.SessionPath)
+	return nil
+}
+
+// prompt reads a line from stdin, disabling terminal echo if secret is set.
+func prompt(r *bufio.Reader, message string, secret bool) (string, error) {
+	fmt.Fprint(os.Stderr, message)
+	if secret && stty("-echo") == nil {
+		defer func() {
+			stty("echo")
+			fmt.Fprintln(os.Stderr)
+		}()
+	}
+	line, err := r.ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		return "", errors.Wrap(err, "read input")
+	}
+	return strings.TrimSpace(line), nil
+}
+
+// stty changes the settings of the terminal attached to stdin.
+func stty(args ...string) error {
+	return execStty(args...).Run()
+}
+
+func execStty(args ...string) *exec.Cmd {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = os.Stdin
+	return cmd
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/unixpickle/cbyge"
+)
+
+const tuiHelp = "↑/↓ select  space toggle  ←/→ dim  [/] tone  c color  r refresh  q quit"
+
+var tuiColors = [][3]uint8{
+	{255, 255, 255},
+	{255, 0, 0},
+	{255, 128, 0},
+	{255, 255, 0},
+	{0, 255, 0},
+	{0, 255, 255},
+	{0, 0, 255},
+	{160, 0, 255},
+}
+
+// CmdTUI runs an interactive dashboard in the terminal.
+func CmdTUI(args []string) error {
+	var common CommonFlags
+	var interval time.Duration
+	fs := newFlagSet("tui", "[DEVICE...]")
+	common.Add(fs)
+	fs.DurationVar(&interval, "interval", time.Second*10, "interval for refreshing device status")
+	fs.Parse(args)
+
+	ctrl, devs, err := controllerAndDevices(&common, fs.Args(), true)
+	if err != nil {
+		return err
+	}
+	if len(devs) == 0 {
+		return errors.New("no devices to show")
+	}
+
+	oldState, err := sttyOutput("-g")
+	if err != nil {
+		return errors.Wrap(err, "tui: stdin is not a terminal")
+	}
+	if err := stty("raw", "-echo"); err != nil {
+		return errors.Wrap(err, "tui")
+	}
+	// Hide the cursor and switch to the alternate screen.
+	fmt.Print("\x1b[?1049h\x1b[?25l")
+	defer func() {
+		fmt.Print("\x1b[?25h\x1b[?1049l")
+		stty(oldState)
+	}()
+
+	t := &TUI{
+		ctrl:    ctrl,
+		devices: devs,
+		redraw:  make(chan struct{}, 1),
+		message: "Loading status...",
+	}
+	go t.refreshLoop(interval)
+	keys := make(chan string)
+	go readKeys(keys)
+
+	t.draw()
+	for {
+		select {
+		case key, ok := <-keys:
+			if !ok || !t.handleKey(key) {
+				return nil
+			}
+		case <-t.redraw:
+		}
+		t.draw()
+	}
+}
+
+// A TUI is the state of the interactive dashboard.
+type TUI struct {
+	ctrl    *cbyge.Controller
+	devices []*cbyge.ControllerDevice
+	redraw  chan struct{}
+
+	lock     sync.Mutex
+	selected int
+	message  string
+}
+
+func (t *TUI) setMessage(msg string) {
+	t.lock.Lock()
+	t.message = msg
+	t.lock.Unlock()
+	select {
+	case t.redraw <- struct{}{}:
+	default:
+	}
+}
+
+// handleKey applies a key press, returning false to quit.
+func (t *TUI) handleKey(key string) bool {
+	t.lock.Lock()
+	dev := t.devices[t.selected]
+	switch key {
+	case "q", "\x03", "\x1b":
+		t.lock.Unlock()
+		return false
+	case "up", "k":
+		t.selected = (t.selected + len(t.devices) - 1) % len(t.devices)
+	case "down", "j":
+		t.selected = (t.selected + 1) % len(t.devices)
+	}
+	t.lock.Unlock()
+
+	status := dev.LastStatus()
+	var state cbyge.DeviceState
+	switch key {
+	case " ", "\r":
+		on := !status.IsOn
+		state.On = &on
+	case "left", "h", "right", "l":
+		delta := 10
+		if key == "left" || key == "h" {
+			delta = -10
+		}
+		brightness := clamp(int(status.Brightness)+delta, 1, 100)
+		state.Brightness = &brightness
+	case "[", "]":
+		delta := 10
+		if key == "[" {
+			delta = -10
+		}
+		tone := clamp(int(status.ColorTone)+delta, 0, 100)
+		state.ColorTone = &tone
+	case "c":
+		rgb := tuiColors[0]
+		for i, c := range tuiColors {
+			if status.UseRGB && c == status.RGB {
+				rgb = tuiColors[(i+1)%len(tuiColors)]
+			}
+		}
+		state.RGB = &rgb
+	case "r":
+		go t.refreshStatuses()
+		return true
+	default:
+		return true
+	}
+	if !status.IsOnline {
+		t.setMessage(dev.Name() + " is offline")
+		return true
+	}
+	go t.apply(dev, state)
+	return true
+}
+
+func (t *TUI) apply(dev *cbyge.ControllerDevice, state cbyge.DeviceState) {
+	t.setMessage("Updating " + dev.Name() + "...")
+	if err := t.ctrl.SetDeviceState(dev, state); err != nil {
+		t.setMessage("Error updating " + dev.Name() + ": " + err.Error())
+		return
+	}
+	if _, err := t.ctrl.DeviceStatus(dev); err != nil {
+		t.setMessage("Updated " + dev.Name() + ", but could not get its status: " + err.Error())
+		return
+	}
+	t.setMessage("Updated " + dev.Name())
+}
+
+func (t *TUI) refreshLoop(interval time.Duration) {
+	for {
+		t.refreshStatuses()
+		time.Sleep(interval)
+	}
+}
+
+func (t *TUI) refreshStatuses() {
+	_, errs := t.ctrl.DeviceStatuses(t.devices)
+	var numErrors int
+	for _, err := range errs {
+		if err != nil {
+			numErrors++
+		}
+	}
+	msg := "Refreshed at " + time.Now().Format("15:04:05")
+	if numErrors > 0 {
+		msg += fmt.Sprintf(" (%d devices unreachable)", numErrors)
+	}
+	t.setMessage(msg)
+}
+
+func (t *TUI) draw() {
+	t.lock.Lock()
+	selected := t.selected
+	message := t.message
+	t.lock.Unlock()
+
+	var b strings.Builder
+	b.WriteString("\x1b[H\x1b[2J")
+	fmt.Fprintf(&b, "\x1b[1m  %-24s %-7s %-6s %-12s %-14s %s\x1b[0m\r\n",
+		"NAME", "POWER", "LEVEL", "COLOR", "SWITCH", "HEALTH")
+	for i, dev := range t.devices {
+		status := dev.LastStatus()
+		info := t.ctrl.DeviceSwitchInfo(dev)
+		if i == selected {
+			b.WriteString("\x1b[7m> ")
+		} else {
+			b.WriteString("  ")
+		}
+		fmt.Fprintf(&b, "%-24s ", truncate(dev.Name(), 24))
+		if !status.IsOnline {
+			fmt.Fprintf(&b, "%-7s %-6s %-12s ", "offline", "-", "-")
+		} else {
+			power := "off"
+			if status.IsOn {
+				power = "on"
+			}
+			color := fmt.Sprintf("tone %d", status.ColorTone)
+			if status.UseRGB {
+				color = fmt.Sprintf("#%02x%02x%02x", status.RGB[0], status.RGB[1], status.RGB[2])
+			}
+			fmt.Fprintf(&b, "%-7s %-6s %-12s ", power, fmt.Sprintf("%d%%", status.Brightness), color)
+		}
+		fmt.Fprintf(&b, "%-14s %s", formatSwitch(info), formatHealth(info))
+		if i == selected {
+			b.WriteString("\x1b[0m")
+		}
+		b.WriteString("\r\n")
+	}
+	fmt.Fprintf(&b, "\r\n%s\r\n\x1b[2m%s\x1b[0m", message, tuiHelp)
+	os.Stdout.WriteString(b.String())
+}
+
+func formatSwitch(info cbyge.DeviceSwitchInfo) string {
+	if len(info.Switches) == 0 {
+		return "none"
+	}
+	res := fmt.Sprintf("%08x", info.Current)
+	if info.IsOwnSwitch {
+		res += " own"
+	} else {
+		res += " mesh"
+	}
+	return res
+}
+
+func formatHealth(info cbyge.DeviceSwitchInfo) string {
+	if len(info.Switches) == 0 {
+		return "-"
+	}
+	h := info.Health
+	res := fmt.Sprintf("%d ok, %d failed, %d switches", h.Successes, h.Failures, len(info.Switches))
+	if !h.Healthy() {
+		res = "\x1b[31m" + res + "\x1b[39m"
+	}
+	return res
+}
+
+// readKeys reads key presses from stdin (in raw mode) and sends them to ch,
+// converting arrow key escape sequences to "up", "down", "left", and
+// "right".
+func readKeys(ch chan<- string) {
+	defer close(ch)
+	buf := make([]byte, 16)
+	for {
+		n, err := os.Stdin.Read(buf)
+		if err != nil {
+			return
+		}
+		data := string(buf[:n])
+		switch data {
+		case "\x1b[A":
+			ch <- "up"
+		case "\x1b[B":
+			ch <- "down"
+		case "\x1b[C":
+			ch <- "right"
+		case "\x1b[D":
+			ch <- "left"
+		default:
+			if strings.HasPrefix(data, "\x1b[") {
+				continue
+			}
+			for _, r := range data {
+				ch <- string(r)
+			}
+		}
+	}
+}
+
+func sttyOutput(args ...string) (string, error) {
+	cmd := execStty(args...)
+	out, err := cmd.Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+func truncate(s string, n int) string {
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+	return string(r[:n-1]) + "…"
+}
+
+func clamp(x, min, max int) int {
+	if x < min {
+		return min
+	} else if x > max {
+		return max
+	}
+	return x
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/unixpickle/cbyge"
+)
+
+// CmdWatch polls devices and prints a line whenever a status changes.
+func CmdWatch(args []string) error {
+	var common CommonFlags
+	var interval time.Duration
+	fs := newFlagSet("watch", "[DEVICE...]")
+	common.Add(fs)
+	fs.DurationVar(&interval, "interval", time.Second*10, "interval for polling device status")
+	fs.Parse(args)
+
+	ctrl, devs, err := controllerAndDevices(&common, fs.Args(), true)
+	if err != nil {
+		return err
+	}
+
+	last := map[string]cbyge.ControllerDeviceStatus{}
+	for {
+		statuses, errs := ctrl.DeviceStatuses(devs)
+		now := time.Now()
+		for i, dev := range devs {
+			if errs[i] != nil {
+				fmt.Fprintln(os.Stderr, "Error getting status of", dev.Name()+":", errs[i])
+				continue
+			}
+			if old, ok := last[dev.DeviceID()]; ok && old == statuses[i] {
+				continue
+			}
+			last[dev.DeviceID()] = statuses[i]
+			if common.JSON {
+				// One object per line, so that the output can be streamed.
+				data, _ := json.Marshal(map[string]interface{}{
+					"time":   now,
+					"id":     dev.DeviceID(),
+					"name":   dev.Name(),
+					"status": statuses[i].Encode(),
+				})
+				fmt.Println(string(data))
+			} else {
+				fields := formatStatus(statuses[i])
+				fmt.Printf("%s  %s  %s  online=%s power=%s brightness=%s color=%q\n",
+					now.Format("15:04:05"), dev.DeviceID(), dev.Name(),
+					fields[0], fields[1], fields[2], fields[3])
+			}
+		}
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,323 @@
+// Command gen-dissector generates a Wireshark Lua dissector from the protocol
+// description in the cbyge package (cbyge.Protocol).
+//
+// Copy the output into Wireshark's plugin directory (see "About Wireshark"
+// -> "Folders" -> "Personal Lua Plugins") to decode traffic on port 23778.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/unixpickle/cbyge"
+	"github.com/unixpickle/essentials"
+)
+
+func main() {
+	var outputPath string
+	flag.StringVar(&outputPath, "output", "", "output path (defaults to stdout)")
+	flag.Parse()
+
+	code := GenerateDissector(cbyge.Protocol)
+	if outputPath == "" {
+		_, err := io.WriteString(os.Stdout, code)
+		essentials.Must(err)
+	} else {
+		essentials.Must(os.WriteFile(outputPath, []byte(code), 0644))
+	}
+}
+
+// GenerateDissector creates the Lua source code of a dissector for the
+// protocol.
+func GenerateDissector(p *cbyge.ProtocolDescription) string {
+	g := &generator{
+		fields: []string{"f_type", "f_response", "f_length", "f_records"},
+	}
+
+	g.printf("local request_fields = {\n")
+	for _, t := range p.PacketTypes {
+		if len(t.Request) > 0 {
+			g.printf("  [%d] = %s,\n", t.Type, g.fieldList("  ", t.Name+".request", t.Request))
+		}
+	}
+	g.printf("}\n\n")
+	g.printf("local response_fields = {\n")
+	for _, t := range p.PacketTypes {
+		if len(t.Response) > 0 {
+			g.printf("  [%d] = %s,\n", t.Type, g.fieldList("  ", t.Name+".response", t.Response))
+		}
+	}
+	g.printf("}\n\n")
+
+	g.printf("local pipe_header = %s\n", g.fieldList("", "pipe", p.PipeHeader))
+	g.printf("local pipe_ack = %s\n\n", g.fieldList("", "pipe_ack", p.PipeAck))
+
+	g.printf("local pipe_types = {\n")
+	for _, t := range p.PipeTypes {
+		g.printf("  [0x%02x] = {\n    name = %q,\n", t.Subtype, t.Name)
+		if len(t.Request) > 0 {
+			g.printf("    request = %s,\n", g.fieldList("    ", t.Name+".request", t.Request))
+		}
+		if len(t.Response) > 0 {
+			g.printf("    response = %s,\n", g.fieldList("    ", t.Name+".response", t.Response))
+		}
+		if r := t.ResponseRecords; r != nil {
+			g.printf("    records = {\n      name = %q,\n      offset = %d,\n      size = %d,\n",
+				r.Name, r.Offset, r.Size)
+			g.printf("      fields = %s,\n    },\n", g.fieldList("      ", t.Name+"."+r.Name, r.Fields))
+		}
+		g.printf("  },\n")
+	}
+	g.printf("}\n\n")
+
+	g.printf("proto.fields = {\n")
+	for _, f := range g.fields {
+		g.printf("  %s,\n", f)
+	}
+	g.printf("}\n\n")
+	g.writeRuntime(p)
+
+	var res strings.Builder
+	res.WriteString("-- Wireshark dissector for the C by GE protocol.\n")
+	res.WriteString("-- Code generated by cmd/gen-dissector from cbyge.Protocol. DO NOT EDIT.\n\n")
+	res.WriteString("local proto = Proto(\"cbyge\", \"C by GE\")\n\n")
+	res.WriteString("local packet_types = {\n")
+	for _, t := range p.PacketTypes {
+		fmt.Fprintf(&res, "  [%d] = %q,\n", t.Type, t.Name)
+	}
+	res.WriteString("}\n\n")
+	res.WriteString("local f_type = ProtoField.uint8(\"cbyge.type\", \"Type\", base.DEC, packet_types, 0xf0)\n")
+	fmt.Fprintf(&res, "local f_response = ProtoField.bool(\"cbyge.response\", \"Response\", 8, nil, 0x%02x)\n",
+		p.ResponseFlag)
+	res.WriteString("local f_length = ProtoField.uint32(\"cbyge.length\", \"Length\", base.DEC)\n")
+	res.WriteString("local f_records = ProtoField.none(\"cbyge.records\", \"Records\")\n")
+	res.WriteString(g.decls.String())
+	res.WriteString("\n")
+	res.WriteString(g.body.String())
+	return res.String()
+}
+
+func (g *generator) writeRuntime(p *cbyge.ProtocolDescription) {
+	g.printf("local PORT = %d\n", p.Port)
+	g.printf("local HEADER_SIZE = %d\n", p.HeaderSize)
+	g.printf("local RESPONSE_FLAG = 0x%02x\n", p.ResponseFlag)
+	g.printf("local PIPE_TYPE = %d\n", cbyge.PacketTypePipe)
+	g.printf("local PIPE_HEADER_SIZE = %d\n", p.PipeHeaderSize)
+	g.printf("local PIPE_PAYLOAD_OFFSET = %d\n", p.PipePayloadOffset)
+	g.printf("%s", luaRuntime)
+}
+
+// A generator accumulates ProtoField declarations separately from the code
+// which refers to them, since the declarations must come first.
+type generator struct {
+	decls  strings.Builder
+	body   strings.Builder
+	fields []string
+}
+
+func (g *generator) printf(format string, args ...interface{}) {
+	fmt.Fprintf(&g.body, format, args...)
+}
+
+// fieldList declares ProtoFields for a list of fields and returns a Lua
+// table describing them, for a line with the given indentation.
+func (g *generator) fieldList(indent, group string, fields []cbyge.ProtocolField) string {
+	var entries []string
+	for _, f := range fields {
+		varName := "f_" + strings.NewReplacer(".", "_", "-", "_").Replace(group) + "_" + f.Name
+		abbrev := "cbyge." + group + "." + f.Name
+		fmt.Fprintf(&g.decls, "local %s = %s\n", varName, protoField(abbrev, f))
+		g.fields = append(g.fields, varName)
+
+		kind := "uint"
+		if f.Kind == cbyge.FieldBytes {
+			kind = "bytes"
+		} else if f.Kind == cbyge.FieldString {
+			kind = "string"
+		}
+		entry := fmt.Sprintf("{ field = %s, name = %q, kind = %q, offset = %d, size = %d",
+			varName, f.Name, kind, f.Offset, f.Size)
+		if f.SizeField != "" {
+			entry += fmt.Sprintf(", size_field = %q", f.SizeField)
+		}
+		if f.WhenField != "" {
+			entry += fmt.Sprintf(", when = %q, when_value = %d", f.WhenField, f.WhenValue)
+		}
+		entries = append(entries, entry+" }")
+	}
+	var res strings.Builder
+	res.WriteString("{\n")
+	for _, entry := range entries {
+		res.WriteString(indent + "  " + entry + ",\n")
+	}
+	res.WriteString(indent + "}")
+	return res.String()
+}
+
+func protoField(abbrev string, f cbyge.ProtocolField) string {
+	switch f.Kind {
+	case cbyge.FieldBytes:
+		return fmt.Sprintf("ProtoField.bytes(%q, %q)", abbrev, f.Label)
+	case cbyge.FieldString:
+		return fmt.Sprintf("ProtoField.string(%q, %q)", abbrev, f.Label)
+	}
+	var fieldType string
+	switch f.Size {
+	case 1:
+		fieldType = "uint8"
+	case 2:
+		fieldType = "uint16"
+	case 3:
+		fieldType = "uint24"
+	case 4:
+		fieldType = "uint32"
+	default:
+		essentials.Die("unsupported integer size for field " + f.Name)
+	}
+	base := "base.DEC"
+	if f.Hex {
+		base = "base.HEX"
+	}
+	values := "nil"
+	if len(f.Values) > 0 {
+		var keys []uint64
+		for k := range f.Values {
+			keys = append(keys, k)
+		}
+		sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+		var parts []string
+		for _, k := range keys {
+			parts = append(parts, fmt.Sprintf("[%d] = %q", k, f.Values[k]))
+		}
+		values = "{ " + strings.Join(parts, ", ") + " }"
+	}
+	return fmt.Sprintf("ProtoField.%s(%q, %q, %s, %s)", fieldType, abbrev, f.Label, base, values)
+}
+
+// luaRuntime interprets the field tables generated above.
+const luaRuntime = `
+-- Add the fields in defs to a tree, for a structure at [start, stop) in buf.
+-- Returns the values of the integer fields by name.
+local function dissect_fields(buf, tree, start, stop, defs)
+  local values = {}
+  for _, d in ipairs(defs) do
+    local offset = d.offset
+    if offset < 0 then
+      offset = stop - start + offset
+    end
+    local size = d.size
+    if d.size_field ~= nil then
+      size = values[d.size_field] or 0
+    elseif size == 0 then
+      size = stop - start - offset
+    end
+    local present = d.when == nil or values[d.when] == d.when_value
+    if present and offset >= 0 and size > 0 and start + offset + size <= stop then
+      local range = buf(start + offset, size)
+      tree:add(d.field, range)
+      if d.kind == "uint" and size <= 4 then
+        values[d.name] = range:uint()
+      end
+    end
+  end
+  return values
+end
+
+-- Dissect one packet, returning a summary for the info column.
+local function dissect_packet(buf, tree)
+  local type_byte = buf(0, 1):uint()
+  local packet_type = bit.rshift(type_byte, 4)
+  local is_response = bit.band(type_byte, RESPONSE_FLAG) ~= 0
+  local length = buf(1, 4):uint()
+  local stop = HEADER_SIZE + length
+
+  local item = tree:add(proto, buf(0, stop))
+  item:add(f_type, buf(0, 1))
+  item:add(f_response, buf(0, 1))
+  item:add(f_length, buf(1, 4))
+
+  local summary = packet_types[packet_type] or ("type " .. packet_type)
+  if is_response then
+    summary = summary .. " response"
+  end
+  local defs = request_fields[packet_type]
+  if is_response then
+    defs = response_fields[packet_type]
+  end
+  if defs ~= nil then
+    dissect_fields(buf, item, HEADER_SIZE, stop, defs)
+  end
+
+  if packet_type == PIPE_TYPE and length >= PIPE_HEADER_SIZE then
+    local header = dissect_fields(buf, item, HEADER_SIZE, stop, pipe_header)
+    local payload_start = HEADER_SIZE + PIPE_PAYLOAD_OFFSET
+    local payload_stop = math.min(stop, payload_start + header.payload_length)
+    local sub = pipe_types[header.subtype]
+    if sub == nil then
+      return summary .. string.format(" 0x%02x", header.subtype)
+    end
+    summary = summary .. " " .. sub.name .. " seq=" .. header.seq
+    local sub_defs = sub.request
+    if is_response then
+      sub_defs = sub.response
+    end
+    if sub_defs ~= nil then
+      local values = dissect_fields(buf, item, payload_start, payload_stop, sub_defs)
+      for _, d in ipairs(sub_defs) do
+        if values[d.name] ~= nil then
+          summary = summary .. " " .. d.name .. "=" .. values[d.name]
+        end
+      end
+    end
+    local records = sub.records
+    if is_response and records ~= nil then
+      local offset = payload_start + records.offset
+      local count = 0
+      while offset + records.size <= payload_stop do
+        local subtree = item:add(f_records, buf(offset, records.size))
+        subtree:set_text(records.name .. " " .. count)
+        dissect_fields(buf, subtree, offset, offset + records.size, records.fields)
+        offset = offset + records.size
+        count = count + 1
+      end
+      summary = summary .. " (" .. count .. " records)"
+    end
+  elseif packet_type == PIPE_TYPE then
+    local values = dissect_fields(buf, item, HEADER_SIZE, stop, pipe_ack)
+    if values.seq ~= nil then
+      summary = summary .. " ack seq=" .. values.seq
+    end
+  end
+  return summary
+end
+
+function proto.dissector(buf, pinfo, tree)
+  pinfo.cols.protocol = "CBYGE"
+  local offset = 0
+  local summaries = {}
+  while offset < buf:len() do
+    local remaining = buf:len() - offset
+    if remaining < HEADER_SIZE then
+      pinfo.desegment_offset = offset
+      pinfo.desegment_len = DESEGMENT_ONE_MORE_SEGMENT
+      return
+    end
+    local length = buf(offset + 1, 4):uint()
+    if remaining < HEADER_SIZE + length then
+      pinfo.desegment_offset = offset
+      pinfo.desegment_len = HEADER_SIZE + length - remaining
+      return
+    end
+    local packet = buf(offset, HEADER_SIZE + length):tvb()
+    summaries[#summaries + 1] = dissect_packet(packet, tree)
+    offset = offset + HEADER_SIZE + length
+  end
+  pinfo.cols.info = table.concat(summaries, "; ")
+end
+
+DissectorTable.get("tcp.port"):add(PORT, proto)
+`
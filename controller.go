@@ -2,6 +2,7 @@ package cbyge
 
 import (
 	"encoding/binary"
+	"fmt"
 	"math/rand"
 	"strconv"
 	"sync"
@@ -21,6 +22,23 @@ type ControllerDeviceStatus struct {
 	IsOnline bool
 }
 
+// Encode converts the status into a JSON-friendly object, as used by the
+// command-line tool and the web server.
+func (c ControllerDeviceStatus) Encode() map[string]interface{} {
+	return map[string]interface{}{
+		"is_online":  c.IsOnline,
+		"is_on":      c.IsOn,
+		"brightness": c.Brightness,
+		"color_tone": c.ColorTone,
+		"use_rgb":    c.UseRGB,
+		"rgb":        c.RGB,
+	}
+}
+
+// A StatusListener is called whenever a Controller receives a status for a
+// device.
+type StatusListener func(d *ControllerDevice, status ControllerDeviceStatus)
+
 type ControllerDevice struct {
 	deviceID string
 	switchID uint64
@@ -63,6 +81,28 @@ func (c *ControllerDevice) deviceIndex() int {
 	return int(parsed % 1000)
 }
 
+// A ControllerGroup is a named group of devices, such as a room.
+type ControllerGroup struct {
+	groupID string
+	name    string
+	devices []*ControllerDevice
+}
+
+// GroupID gets a unique identifier for the group.
+func (c *ControllerGroup) GroupID() string {
+	return c.groupID
+}
+
+// Name gets the user-assigned name of the group.
+func (c *ControllerGroup) Name() string {
+	return c.name
+}
+
+// Devices gets the devices in the group.
+func (c *ControllerGroup) Devices() []*ControllerDevice {
+	return c.devices
+}
+
 // A Controller is a high-level API for manipulating C by GE devices.
 type Controller struct {
 	sessionInfoLock sync.RWMutex
@@ -75,14 +115,25 @@ type Controller struct {
 	switchMappingLock sync.RWMutex
 	switches          map[string][]uint32
 	switchIndices     map[string]int
+	switchHealth      map[uint32]*SwitchHealth
 
 	// Prevent multiple PacketConns at once, since the server boots
 	// off one connection when anoher is made.
 	packetConnLock sync.Mutex
 
+	// dial opens a connection to the server. It is only replaced in tests.
+	dial func() (*PacketConn, error)
+
 	// We continually increment our sent sequence ID.
 	seqIDLock sync.Mutex
 	seqID     uint16
+
+	// Optional hooks for observing what the controller does.
+	observeLock    sync.RWMutex
+	logger         Logger
+	tracer         Tracer
+	listeners      map[int]StatusListener
+	nextListenerID int
 }
 
 // NewController creates a Controller using a pre-created session and a
@@ -100,6 +151,7 @@ func NewController(s *SessionInfo, timeout time.Duration) *Controller {
 
 		switches:      map[string][]uint32{},
 		switchIndices: map[string]int{},
+		switchHealth:  map[uint32]*SwitchHealth{},
 
 		seqID: uint16(rng.Int63()),
 	}
@@ -128,16 +180,71 @@ func (c *Controller) Login(email, password string) error {
 	return nil
 }
 
+// SetLogger sets a Logger which receives structured events about
+// connections, packets, switch fail-overs and timeouts.
+//
+// Pass nil to disable logging.
+func (c *Controller) SetLogger(l Logger) {
+	c.observeLock.Lock()
+	defer c.observeLock.Unlock()
+	c.logger = l
+}
+
+// SetTracer sets a Tracer which is used to create a span for every
+// high-level operation, such as DeviceStatus() or SetDeviceLum().
+//
+// Pass nil to disable tracing.
+func (c *Controller) SetTracer(t Tracer) {
+	c.observeLock.Lock()
+	defer c.observeLock.Unlock()
+	c.tracer = t
+}
+
+// AddStatusListener registers a function to be called every time a device's
+// status is received, e.g. from DeviceStatus() or DeviceStatuses().
+//
+// Listeners are called synchronously, so they should not block.
+//
+// The returned function removes the listener.
+func (c *Controller) AddStatusListener(f StatusListener) func() {
+	c.observeLock.Lock()
+	defer c.observeLock.Unlock()
+	if c.listeners == nil {
+		c.listeners = map[int]StatusListener{}
+	}
+	id := c.nextListenerID
+	c.nextListenerID++
+	c.listeners[id] = f
+	return func() {
+		c.observeLock.Lock()
+		defer c.observeLock.Unlock()
+		delete(c.listeners, id)
+	}
+}
+
 // Devices enumerates the devices available to the account.
 //
 // Each device's status is available through its LastStatus() method.
 func (c *Controller) Devices() ([]*ControllerDevice, error) {
+	devs, _, err := c.DevicesAndGroups()
+	return devs, err
+}
+
+// DevicesAndGroups is like Devices(), but also enumerates the groups (e.g.
+// rooms) that the devices are organized into.
+func (c *Controller) DevicesAndGroups() (results []*ControllerDevice,
+	groups []*ControllerGroup, err error) {
+	span := c.startSpan("Devices")
+	defer func() {
+		span.SetAttrs(Attr{"num_devices", len(results)}, Attr{"num_groups", len(groups)})
+		span.End(err)
+	}()
+
 	sessInfo := c.getSessionInfo()
 	devicesResponse, err := GetDevices(sessInfo.UserID, sessInfo.AccessToken)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	var results []*ControllerDevice
 	for _, dev := range devicesResponse {
 		if !dev.IsOnline && !dev.IsActive {
 			// Some devices have no bulbs array, and can cause
@@ -148,10 +255,11 @@ func (c *Controller) Devices() ([]*ControllerDevice, error) {
 		props, err := GetDeviceProperties(sessInfo.AccessToken, dev.ProductID, dev.ID)
 		if err != nil {
 			if !IsPropertyNotExistsError(err) {
-				return nil, err
+				return nil, nil, err
 			}
 			continue
 		}
+		idToDevice := map[int64]*ControllerDevice{}
 		for _, bulb := range props.Bulbs {
 			cd := &ControllerDevice{
 				deviceID: strconv.FormatInt(bulb.DeviceID, 10),
@@ -159,12 +267,28 @@ func (c *Controller) Devices() ([]*ControllerDevice, error) {
 				name:     bulb.DisplayName,
 			}
 			results = append(results, cd)
+			idToDevice[bulb.DeviceID] = cd
+			idToDevice[bulb.DeviceID%1000] = cd
+		}
+		for _, group := range props.Groups {
+			cg := &ControllerGroup{
+				groupID: fmt.Sprintf("%d-%d", dev.ID, group.GroupID),
+				name:    group.DisplayName,
+			}
+			for _, id := range group.DeviceIDs {
+				// Groups may refer to bulbs by their index within
+				// the home rather than by their full ID.
+				if cd, ok := idToDevice[id]; ok {
+					cg.devices = append(cg.devices, cd)
+				}
+			}
+			groups = append(groups, cg)
 		}
 	}
 	// Update device status. If this fails, we swallow the error
 	// because the device(s) are automatically marked offline.
 	c.DeviceStatuses(results)
-	return results, nil
+	return results, groups, nil
 }
 
 // DeviceStatus gets the status for a previously enumerated device.
@@ -172,6 +296,15 @@ func (c *Controller) Devices() ([]*ControllerDevice, error) {
 // If no error occurs, the status is updated in d.LastStatus() in addition to
 // being returned.
 func (c *Controller) DeviceStatus(d *ControllerDevice) (ControllerDeviceStatus, error) {
+	return c.deviceStatus(d, true)
+}
+
+// deviceStatus implements DeviceStatus. If switchFailures is false, a failed
+// query does not move the device on to its next switch.
+func (c *Controller) deviceStatus(d *ControllerDevice, switchFailures bool) (status ControllerDeviceStatus, err error) {
+	span := c.startSpan("DeviceStatus", Attr{"device", d.deviceID})
+	defer func() { span.End(err) }()
+
 	var packets []*Packet
 	seqIDs := map[uint16]bool{}
 	c.switchMappingLock.RLock()
@@ -191,9 +324,10 @@ func (c *Controller) DeviceStatus(d *ControllerDevice) (ControllerDeviceStatus,
 	}
 
 	var responsePacket *StatusPaginatedResponse
+	var responseSwitch uint32
 	var decodeErr error
 	var numResponses int
-	err := c.callAndWait(packets, false, func(p *Packet) bool {
+	err = c.callAndWait(span, packets, false, func(p *Packet) bool {
 		if seq, err := p.Seq(); err == nil && p.IsResponse && !seqIDs[seq] {
 			// This is a response to a packet we did not send.
 			return false
@@ -217,6 +351,7 @@ func (c *Controller) DeviceStatus(d *ControllerDevice) (ControllerDeviceStatus,
 							// Doing &resp references the for-loop variable.
 							responsePacket = new(StatusPaginatedResponse)
 							*responsePacket = resp
+							responseSwitch = switchID
 							if isPrimary {
 								return true
 							}
@@ -237,13 +372,12 @@ func (c *Controller) DeviceStatus(d *ControllerDevice) (ControllerDeviceStatus,
 	})
 
 	if responsePacket != nil {
-		status := ControllerDeviceStatus{
+		status = ControllerDeviceStatus{
 			StatusPaginatedResponse: *responsePacket,
 			IsOnline:                true,
 		}
-		d.lastStatusLock.Lock()
-		d.lastStatus = status
-		d.lastStatusLock.Unlock()
+		c.recordSwitchResult(responseSwitch, true)
+		c.updateStatus(d, status)
 		return status, nil
 	}
 
@@ -252,7 +386,9 @@ func (c *Controller) DeviceStatus(d *ControllerDevice) (ControllerDeviceStatus,
 	} else if err == nil {
 		err = UnreachableError
 	}
-	c.switchFailed(d)
+	if switchFailures {
+		c.switchFailed(d)
+	}
 	return ControllerDeviceStatus{}, errors.Wrap(err, "lookup device status")
 }
 
@@ -264,6 +400,24 @@ func (c *Controller) DeviceStatus(d *ControllerDevice) (ControllerDeviceStatus,
 // Each device's status is updated in d.LastStatus() if no error occurred for
 // that device.
 func (c *Controller) DeviceStatuses(devs []*ControllerDevice) ([]ControllerDeviceStatus, []error) {
+	span := c.startSpan("DeviceStatuses", Attr{"num_devices", len(devs)})
+	statuses, errs := c.deviceStatuses(span, devs)
+	numErrors := 0
+	for _, err := range errs {
+		if err != nil {
+			numErrors++
+		}
+	}
+	span.SetAttrs(Attr{"num_errors", numErrors})
+	if numErrors == len(devs) && len(devs) > 0 {
+		span.End(errs[0])
+	} else {
+		span.End(nil)
+	}
+	return statuses, errs
+}
+
+func (c *Controller) deviceStatuses(span Span, devs []*ControllerDevice) ([]ControllerDeviceStatus, []error) {
 	hasResponses := make([]bool, 0, len(devs))
 	packets := make([]*Packet, 0, len(devs))
 	devIndexToDev := map[int]*ControllerDevice{}
@@ -289,7 +443,7 @@ func (c *Controller) DeviceStatuses(devs []*ControllerDevice) ([]ControllerDevic
 	}
 
 	devToStatus := map[*ControllerDevice]ControllerDeviceStatus{}
-	err := c.callAndWait(packets, false, func(p *Packet) bool {
+	err := c.callAndWait(span, packets, false, func(p *Packet) bool {
 		if seq, err := p.Seq(); err == nil && p.IsResponse && !seqIDs[seq] {
 			// This is a response to a packet we did not send.
 			return false
@@ -302,6 +456,7 @@ func (c *Controller) DeviceStatuses(devs []*ControllerDevice) ([]ControllerDevic
 			}
 			hasResponses[devIdx] = true
 			responses, err := DecodeStatusPaginatedResponse(p)
+			c.recordSwitchResult(switchID, err == nil)
 			if err == nil {
 				for _, resp := range responses {
 					dev, ok := devIndexToDev[resp.Device]
@@ -321,6 +476,7 @@ func (c *Controller) DeviceStatuses(devs []*ControllerDevice) ([]ControllerDevic
 			packetIdx, ok := switchToPacketIndex[switchID]
 			if ok && !hasResponses[packetIdx] {
 				hasResponses[packetIdx] = true
+				c.recordSwitchResult(switchID, false)
 			}
 		}
 		for _, hasResponse := range hasResponses {
@@ -343,9 +499,7 @@ func (c *Controller) DeviceStatuses(devs []*ControllerDevice) ([]ControllerDevic
 	for i, dev := range devs {
 		status, ok := devToStatus[dev]
 		if ok {
-			devs[i].lastStatusLock.Lock()
-			devs[i].lastStatus = status
-			devs[i].lastStatusLock.Unlock()
+			c.updateStatus(dev, status)
 			deviceStatuses[i] = status
 		} else {
 			deviceErrors[i] = err
@@ -366,7 +520,11 @@ func (c *Controller) SetDeviceStatusAsync(d *ControllerDevice, status bool) erro
 	return c.setDeviceStatus(d, status, true)
 }
 
-func (c *Controller) setDeviceStatus(d *ControllerDevice, status, async bool) error {
+func (c *Controller) setDeviceStatus(d *ControllerDevice, status, async bool) (err error) {
+	span := c.startSpan("SetDeviceStatus", Attr{"device", d.deviceID}, Attr{"status", status},
+		Attr{"async", async})
+	defer func() { span.End(err) }()
+
 	switchID, err := c.currentSwitch(d)
 	if err != nil {
 		return errors.Wrap(err, "set device status")
@@ -376,7 +534,8 @@ func (c *Controller) setDeviceStatus(d *ControllerDevice, status, async bool) er
 		statusInt = 1
 	}
 	packet := NewPacketSetDeviceStatus(switchID, c.nextSeqID(), d.deviceIndex(), statusInt)
-	return c.checkedSwitch(d, c.callAndWaitSimple(packet, "set device status", async))
+	span.SetAttrs(Attr{"switch", switchID})
+	return c.checkedSwitch(d, switchID, c.callAndWaitSimple(span, []*Packet{packet}, "set device status", async))
 }
 
 // BlastDeviceStatuses asynchronously turns on or off many devices in bulk.
@@ -384,7 +543,11 @@ func (c *Controller) setDeviceStatus(d *ControllerDevice, status, async bool) er
 // some switches are not connected.
 // If numSwitches is 0, one switch will be used per device.
 func (c *Controller) BlastDeviceStatuses(ds []*ControllerDevice, statuses []bool,
-	numSwitches int) error {
+	numSwitches int) (err error) {
+	span := c.startSpan("BlastDeviceStatuses", Attr{"num_devices", len(ds)},
+		Attr{"num_switches", numSwitches})
+	defer func() { span.End(err) }()
+
 	var packets []*Packet
 	for i, d := range ds {
 		switchIDs, err := c.randomSwitches(d, numSwitches)
@@ -400,7 +563,8 @@ func (c *Controller) BlastDeviceStatuses(ds []*ControllerDevice, statuses []bool
 			packets = append(packets, packet)
 		}
 	}
-	if err := c.blastPackets(packets); err != nil {
+	span.SetAttrs(Attr{"num_packets", len(packets)})
+	if err := c.blastPackets(span, packets); err != nil {
 		return errors.Wrap(err, "blast device statuses")
 	}
 	return nil
@@ -419,13 +583,18 @@ func (c *Controller) SetDeviceLumAsync(d *ControllerDevice, lum int) error {
 	return c.setDeviceLum(d, lum, true)
 }
 
-func (c *Controller) setDeviceLum(d *ControllerDevice, lum int, async bool) error {
+func (c *Controller) setDeviceLum(d *ControllerDevice, lum int, async bool) (err error) {
+	span := c.startSpan("SetDeviceLum", Attr{"device", d.deviceID}, Attr{"lum", lum},
+		Attr{"async", async})
+	defer func() { span.End(err) }()
+
 	switchID, err := c.currentSwitch(d)
 	if err != nil {
 		return errors.Wrap(err, "set device luminance")
 	}
 	packet := NewPacketSetLum(switchID, c.nextSeqID(), d.deviceIndex(), lum)
-	return c.checkedSwitch(d, c.callAndWaitSimple(packet, "set device luminance", async))
+	span.SetAttrs(Attr{"switch", switchID})
+	return c.checkedSwitch(d, switchID, c.callAndWaitSimple(span, []*Packet{packet}, "set device luminance", async))
 }
 
 // SetDeviceRGB changes a device's RGB.
@@ -439,13 +608,18 @@ func (c *Controller) SetDeviceRGBAsync(d *ControllerDevice, r, g, b uint8) error
 	return c.setDeviceRGB(d, r, g, b, true)
 }
 
-func (c *Controller) setDeviceRGB(d *ControllerDevice, r, g, b uint8, async bool) error {
+func (c *Controller) setDeviceRGB(d *ControllerDevice, r, g, b uint8, async bool) (err error) {
+	span := c.startSpan("SetDeviceRGB", Attr{"device", d.deviceID}, Attr{"rgb", [3]uint8{r, g, b}},
+		Attr{"async", async})
+	defer func() { span.End(err) }()
+
 	switchID, err := c.currentSwitch(d)
 	if err != nil {
 		return errors.Wrap(err, "set device RGB")
 	}
 	packet := NewPacketSetRGB(switchID, c.nextSeqID(), d.deviceIndex(), r, g, b)
-	return c.checkedSwitch(d, c.callAndWaitSimple(packet, "set device RGB", async))
+	span.SetAttrs(Attr{"switch", switchID})
+	return c.checkedSwitch(d, switchID, c.callAndWaitSimple(span, []*Packet{packet}, "set device RGB", async))
 }
 
 // SetDeviceCT changes a device's color tone.
@@ -461,13 +635,34 @@ func (c *Controller) SetDeviceCTAsync(d *ControllerDevice, ct int) error {
 	return c.setDeviceCT(d, ct, true)
 }
 
-func (c *Controller) setDeviceCT(d *ControllerDevice, ct int, async bool) error {
+func (c *Controller) setDeviceCT(d *ControllerDevice, ct int, async bool) (err error) {
+	span := c.startSpan("SetDeviceCT", Attr{"device", d.deviceID}, Attr{"ct", ct},
+		Attr{"async", async})
+	defer func() { span.End(err) }()
+
 	switchID, err := c.currentSwitch(d)
 	if err != nil {
 		return errors.Wrap(err, "set device color tone")
 	}
 	packet := NewPacketSetCT(switchID, c.nextSeqID(), d.deviceIndex(), ct)
-	return c.checkedSwitch(d, c.callAndWaitSimple(packet, "set device color tone", async))
+	span.SetAttrs(Attr{"switch", switchID})
+	return c.checkedSwitch(d, switchID, c.callAndWaitSimple(span, []*Packet{packet}, "set device color tone", async))
+}
+
+func (c *Controller) updateStatus(d *ControllerDevice, status ControllerDeviceStatus) {
+	d.lastStatusLock.Lock()
+	d.lastStatus = status
+	d.lastStatusLock.Unlock()
+
+	c.observeLock.RLock()
+	listeners := make([]StatusListener, 0, len(c.listeners))
+	for _, l := range c.listeners {
+		listeners = append(listeners, l)
+	}
+	c.observeLock.RUnlock()
+	for _, l := range listeners {
+		l(d, status)
+	}
 }
 
 func (c *Controller) addSwitchMapping(dev *ControllerDevice, switchID uint32) {
@@ -504,9 +699,11 @@ func (c *Controller) currentSwitch(dev *ControllerDevice) (uint32, error) {
 	return switches[c.switchIndices[dev.deviceID]], nil
 }
 
-func (c *Controller) checkedSwitch(dev *ControllerDevice, err error) error {
+func (c *Controller) checkedSwitch(dev *ControllerDevice, switchID uint32, err error) error {
 	if err != nil {
 		c.switchFailed(dev)
+	} else {
+		c.recordSwitchResult(switchID, true)
 	}
 	return err
 }
@@ -516,7 +713,18 @@ func (c *Controller) switchFailed(dev *ControllerDevice) {
 	defer c.switchMappingLock.Unlock()
 	// Round-robin through supported switches.
 	switches := c.switches[dev.deviceID]
-	c.switchIndices[dev.deviceID] = (c.switchIndices[dev.deviceID] + 1) % len(switches)
+	if len(switches) == 0 {
+		return
+	}
+	oldIndex := c.switchIndices[dev.deviceID]
+	newIndex := (oldIndex + 1) % len(switches)
+	c.switchIndices[dev.deviceID] = newIndex
+	c.recordSwitchResultLocked(switches[oldIndex], false)
+	c.log(LogLevelWarn, EventSwitchFailover, "switch failed for device", nil,
+		Attr{"device", dev.deviceID},
+		Attr{"old_switch", switches[oldIndex]},
+		Attr{"new_switch", switches[newIndex]},
+		Attr{"num_switches", len(switches)})
 }
 
 func (c *Controller) randomSwitches(dev *ControllerDevice, max int) ([]uint32, error) {
@@ -537,10 +745,14 @@ func (c *Controller) randomSwitches(dev *ControllerDevice, max int) ([]uint32, e
 	return append(res, shuffled[:essentials.MinInt(len(shuffled), max-1)]...), nil
 }
 
-func (c *Controller) callAndWaitSimple(p *Packet, context string, async bool) error {
-	seq, err := p.Seq()
-	if err != nil {
-		return err
+func (c *Controller) callAndWaitSimple(span Span, ps []*Packet, context string, async bool) error {
+	pending := map[uint16]bool{}
+	for _, p := range ps {
+		seq, err := p.Seq()
+		if err != nil {
+			return err
+		}
+		pending[seq] = true
 	}
 	// Currently, I have not found a fool-proof way to wait
 	// until a status update has completed, aside from polling
@@ -557,15 +769,18 @@ func (c *Controller) callAndWaitSimple(p *Packet, context string, async bool) er
 	// packet from a previous request (for example, if we are
 	// changing many lights in a row). Other times, we apparently
 	// never receive a sync packet and the call times out.
-	gotResponse := false
+	//
+	// When sending multiple packets, we wait for a response to
+	// every packet, but only for a single sync packet.
 	gotSync := false
-	err = c.callAndWait([]*Packet{p}, true, func(p *Packet) bool {
-		seq1, err := p.Seq()
-		if err == nil && seq == seq1 && p.IsResponse {
-			gotResponse = true
+	err := c.callAndWait(span, ps, true, func(p *Packet) bool {
+		seq, err := p.Seq()
+		if err == nil && pending[seq] && p.IsResponse {
+			delete(pending, seq)
 		} else if p.Type == PacketTypeSync {
 			gotSync = true
 		}
+		gotResponse := len(pending) == 0
 		if async && gotResponse {
 			return true
 		}
@@ -579,7 +794,8 @@ func (c *Controller) callAndWaitSimple(p *Packet, context string, async bool) er
 
 // callAndWait sends packets on a new PacketConn and waits until f returns
 // true on a response, or waits for a timeout.
-func (c *Controller) callAndWait(p []*Packet, checkError bool, f func(*Packet) bool) error {
+func (c *Controller) callAndWait(span Span, p []*Packet, checkError bool,
+	f func(*Packet) bool) error {
 	c.packetConnLock.Lock()
 	defer c.packetConnLock.Unlock()
 
@@ -590,17 +806,12 @@ func (c *Controller) callAndWait(p []*Packet, checkError bool, f func(*Packet) b
 		}
 	}
 
-	conn, err := NewPacketConn()
+	conn, err := c.openConn(span)
 	if err != nil {
 		return err
 	}
 	defer conn.Close()
 
-	sessInfo := c.getSessionInfo()
-	if err := conn.Auth(sessInfo.UserID, sessInfo.Authorize, c.timeout); err != nil {
-		return err
-	}
-
 	// Prevent the bg thread from blocking on a
 	// channel send forever.
 	doneChan := make(chan struct{}, 1)
@@ -638,6 +849,7 @@ func (c *Controller) callAndWait(p []*Packet, checkError bool, f func(*Packet) b
 			return err
 		}
 	}
+	span.AddEvent("sent", Attr{"num_packets", len(p)})
 
 	timeout := time.After(c.timeout)
 	for {
@@ -652,47 +864,98 @@ func (c *Controller) callAndWait(p []*Packet, checkError bool, f func(*Packet) b
 					return errors.New("connection closed")
 				}
 			}
+			span.AddEvent("receive", Attr{"type", packet.Type}, Attr{"response", packet.IsResponse})
 			if f(packet) {
 				return nil
 			}
 		case err := <-errChan:
 			return err
 		case <-timeout:
-			return errors.New("timeout waiting for response")
+			span.AddEvent("timeout")
+			c.log(LogLevelWarn, EventTimeout, "timeout waiting for response", TimeoutError,
+				Attr{"timeout", c.timeout}, Attr{"num_packets", len(p)})
+			return TimeoutError
 		}
 	}
 }
 
-func (c *Controller) blastPackets(p []*Packet) error {
+func (c *Controller) blastPackets(span Span, p []*Packet) error {
 	c.packetConnLock.Lock()
 	defer c.packetConnLock.Unlock()
 
-	checkSeqs := map[uint16]bool{}
-	for _, packet := range p {
-		if seq, err := packet.Seq(); err == nil {
-			checkSeqs[seq] = true
+	conn, err := c.openConn(span)
+	if err != nil {
+		return err
+	}
+
+	for _, subPacket := range p {
+		if err := conn.Write(subPacket); err != nil {
+			conn.Close()
+			return err
 		}
 	}
+	span.AddEvent("sent", Attr{"num_packets", len(p)})
+
+	return conn.Close()
+}
 
-	conn, err := NewPacketConn()
+// openConn creates an authenticated PacketConn.
+//
+// The caller should hold packetConnLock.
+func (c *Controller) openConn(span Span) (*PacketConn, error) {
+	start := time.Now()
+	dial := c.dial
+	if dial == nil {
+		dial = NewPacketConn
+	}
+	conn, err := dial()
 	if err != nil {
-		return err
+		c.log(LogLevelError, EventConnect, "failed to connect", err,
+			Attr{"host", DefaultPacketConnHost})
+		return nil, err
 	}
+	c.log(LogLevelInfo, EventConnect, "connected", nil, Attr{"host", DefaultPacketConnHost},
+		Attr{"duration", time.Since(start)})
+	span.AddEvent("connect", Attr{"duration", time.Since(start)})
+
+	c.observeLock.RLock()
+	conn.SetLogger(c.logger)
+	c.observeLock.RUnlock()
 
 	sessInfo := c.getSessionInfo()
 	if err := conn.Auth(sessInfo.UserID, sessInfo.Authorize, c.timeout); err != nil {
 		conn.Close()
-		return err
+		return nil, err
 	}
+	span.AddEvent("auth")
+	return conn, nil
+}
 
-	for _, subPacket := range p {
-		if err := conn.Write(subPacket); err != nil {
-			conn.Close()
-			return err
-		}
+func (c *Controller) log(level LogLevel, kind EventKind, msg string, err error, attrs ...Attr) {
+	c.observeLock.RLock()
+	logger := c.logger
+	c.observeLock.RUnlock()
+	if logger == nil {
+		return
 	}
+	logger.Log(&Event{
+		Time:    time.Now(),
+		Level:   level,
+		Kind:    kind,
+		Message: msg,
+		Err:     err,
+		Attrs:   attrs,
+	})
+}
 
-	return conn.Close()
+func (c *Controller) startSpan(name string, attrs ...Attr) Span {
+	c.observeLock.RLock()
+	tracer := c.tracer
+	c.observeLock.RUnlock()
+	if tracer == nil {
+		return noopSpan{}
+	}
+	return tracer.StartSpan(name, attrs...)
 }
 
 func (c *Controller) getSessionInfo() *SessionInfo {
@@ -0,0 +1,260 @@
+package cbyge
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// A DecodedField is the value of a ProtocolField in a packet.
+type DecodedField struct {
+	Field ProtocolField
+
+	// Offset is the position of the field in the packet's data.
+	Offset int
+
+	// Value is set for integer fields.
+	Value uint64
+
+	// Data is the raw contents of the field.
+	Data []byte
+}
+
+// String formats the value, using the name of the value if it has one.
+func (d DecodedField) String() string {
+	switch d.Field.Kind {
+	case FieldBytes:
+		return hex.EncodeToString(d.Data)
+	case FieldString:
+		return strconv.Quote(string(d.Data))
+	}
+	if name, ok := d.Field.Values[d.Value]; ok {
+		return name
+	} else if d.Field.Hex {
+		return fmt.Sprintf("0x%x", d.Value)
+	}
+	return strconv.FormatUint(d.Value, 10)
+}
+
+// A DecodedPacket is a packet broken down into the fields described by a
+// ProtocolDescription.
+type DecodedPacket struct {
+	Type       uint8
+	TypeName   string
+	IsResponse bool
+	Length     int
+
+	// Fields contains the fields of the packet type, followed by the pipe
+	// header or acknowledgement for pipe packets.
+	Fields []DecodedField
+
+	// For pipe packets with a header, IsPipeCommand is set, and the payload
+	// is decoded according to the subtype. If the payload has no known
+	// fields, RawPayload contains its data.
+	IsPipeCommand bool
+	Subtype       uint8
+	SubtypeName   string
+	Payload       []DecodedField
+	RawPayload    []byte
+	RecordsName   string
+	Records       [][]DecodedField
+}
+
+// DecodePacket decodes a packet using Protocol.
+func DecodePacket(p *Packet) *DecodedPacket {
+	return Protocol.Decode(p)
+}
+
+// Decode breaks down a packet into its known fields.
+//
+// Decoding never fails; fields which do not fit in the packet are omitted.
+func (p *ProtocolDescription) Decode(packet *Packet) *DecodedPacket {
+	res := &DecodedPacket{
+		Type:       packet.Type,
+		TypeName:   p.PacketTypeName(packet.Type),
+		IsResponse: packet.IsResponse,
+		Length:     len(packet.Data),
+	}
+	if t := p.PacketType(packet.Type); t != nil {
+		if packet.IsResponse {
+			res.Fields = decodeFields(packet.Data, 0, t.Response)
+		} else {
+			res.Fields = decodeFields(packet.Data, 0, t.Request)
+		}
+	}
+	if packet.Type != PacketTypePipe {
+		return res
+	}
+	if len(packet.Data) < p.PipeHeaderSize {
+		res.Fields = append(res.Fields, decodeFields(packet.Data, 0, p.PipeAck)...)
+		return res
+	}
+
+	header := decodeFields(packet.Data, 0, p.PipeHeader)
+	res.Fields = append(res.Fields, header...)
+	res.IsPipeCommand = true
+	payload := packet.Data[p.PipePayloadOffset:]
+	for _, f := range header {
+		switch f.Field.Name {
+		case "subtype":
+			res.Subtype = uint8(f.Value)
+		case "payload_length":
+			if int(f.Value) < len(payload) {
+				payload = payload[:f.Value]
+			}
+		}
+	}
+	res.SubtypeName = p.PipeTypeName(res.Subtype)
+
+	pipeType := p.PipeType(res.Subtype)
+	if pipeType == nil {
+		res.RawPayload = payload
+		return res
+	}
+	if packet.IsResponse {
+		res.Payload = decodeFields(payload, p.PipePayloadOffset, pipeType.Response)
+		if r := pipeType.ResponseRecords; r != nil {
+			res.RecordsName = r.Name
+			for i := r.Offset; i+r.Size <= len(payload); i += r.Size {
+				record := decodeFields(payload[i:i+r.Size], p.PipePayloadOffset+i, r.Fields)
+				res.Records = append(res.Records, record)
+			}
+			return res
+		}
+	} else {
+		res.Payload = decodeFields(payload, p.PipePayloadOffset, pipeType.Request)
+	}
+	if len(res.Payload) == 0 {
+		res.RawPayload = payload
+	}
+	return res
+}
+
+// SetField changes the value of a field in a packet, given the decoded
+// packet. Integer values are encoded big-endian, and other values must have
+// the same length as the existing field.
+func (d *DecodedPacket) SetField(p *Packet, name string, value []byte) error {
+	f, ok := d.Field(name)
+	if !ok {
+		return errors.New("set field: packet has no field: " + name)
+	}
+	if f.Field.Kind == FieldUint && len(value) < len(f.Data) {
+		value = append(make([]byte, len(f.Data)-len(value)), value...)
+	}
+	if len(value) != len(f.Data) {
+		return errors.Errorf("set field: %s must be %d bytes", name, len(f.Data))
+	}
+	copy(p.Data[f.Offset:], value)
+	return nil
+}
+
+// Field finds a field in the packet or its pipe payload by name.
+func (d *DecodedPacket) Field(name string) (DecodedField, bool) {
+	for _, fields := range [][]DecodedField{d.Payload, d.Fields} {
+		for _, f := range fields {
+			if f.Field.Name == name {
+				return f, true
+			}
+		}
+	}
+	return DecodedField{}, false
+}
+
+// Devices gets the device indices that the packet refers to, either in a
+// pipe command or in the records of a response.
+func (d *DecodedPacket) Devices() []int {
+	var res []int
+	if f, ok := d.Field("device"); ok {
+		res = append(res, int(f.Value))
+	}
+	for _, record := range d.Records {
+		for _, f := range record {
+			if f.Field.Name == "device" {
+				res = append(res, int(f.Value))
+			}
+		}
+	}
+	return res
+}
+
+// Failed checks if the packet is a response with a non-zero status.
+func (d *DecodedPacket) Failed() bool {
+	f, ok := d.Field("status")
+	return ok && d.IsResponse && f.Field.Kind == FieldUint && f.Value != 0
+}
+
+// String creates a short, human-readable summary of the packet, such as
+// "pipe request set_lum switch_id=0x1234 seq=7 device=3 brightness=50".
+func (d *DecodedPacket) String() string {
+	parts := []string{d.TypeName, "request"}
+	if d.IsResponse {
+		parts[1] = "response"
+	}
+	if d.IsPipeCommand {
+		parts = append(parts, d.SubtypeName)
+	}
+	parts = appendFieldSummaries(parts, d.Fields)
+	parts = appendFieldSummaries(parts, d.Payload)
+	if len(d.RawPayload) > 0 {
+		parts = append(parts, "payload="+hex.EncodeToString(d.RawPayload))
+	}
+	if d.RecordsName != "" {
+		var records []string
+		for _, r := range d.Records {
+			records = append(records, strings.Join(appendFieldSummaries(nil, r), " "))
+		}
+		parts = append(parts, d.RecordsName+"=["+strings.Join(records, "; ")+"]")
+	}
+	if len(d.Fields) == 0 {
+		parts = append(parts, fmt.Sprintf("len=%d", d.Length))
+	}
+	return strings.Join(parts, " ")
+}
+
+func appendFieldSummaries(parts []string, fields []DecodedField) []string {
+	for _, f := range fields {
+		if !f.Field.Quiet {
+			parts = append(parts, f.Field.Name+"="+f.String())
+		}
+	}
+	return parts
+}
+
+// decodeFields decodes the fields of a structure which starts at the given
+// offset in the packet.
+func decodeFields(data []byte, start int, fields []ProtocolField) []DecodedField {
+	var res []DecodedField
+	values := map[string]uint64{}
+	for _, f := range fields {
+		if f.WhenField != "" {
+			if v, ok := values[f.WhenField]; !ok || v != f.WhenValue {
+				continue
+			}
+		}
+		offset := f.Offset
+		if offset < 0 {
+			offset += len(data)
+		}
+		size := f.Size
+		if f.SizeField != "" {
+			size = int(values[f.SizeField])
+		} else if size == 0 {
+			size = len(data) - offset
+		}
+		if offset < 0 || size <= 0 || offset+size > len(data) {
+			continue
+		}
+		decoded := DecodedField{Field: f, Offset: start + offset, Data: data[offset : offset+size]}
+		if f.Kind == FieldUint {
+			for _, b := range decoded.Data {
+				decoded.Value = (decoded.Value << 8) | uint64(b)
+			}
+			values[f.Name] = decoded.Value
+		}
+		res = append(res, decoded)
+	}
+	return res
+}
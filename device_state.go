@@ -0,0 +1,110 @@
+package cbyge
+
+import (
+	"github.com/pkg/errors"
+)
+
+// A DeviceState describes attributes to change on a device.
+//
+// Fields which are nil are left unchanged. At most one of ColorTone and RGB
+// may be set.
+type DeviceState struct {
+	On         *bool     `json:"on,omitempty"`
+	Brightness *int      `json:"brightness,omitempty"`
+	ColorTone  *int      `json:"color_tone,omitempty"`
+	RGB        *[3]uint8 `json:"rgb,omitempty"`
+}
+
+// Validate checks that the state changes at least one attribute, and that
+// all of the attributes are in range.
+func (d *DeviceState) Validate() error {
+	if d.On == nil && d.Brightness == nil && d.ColorTone == nil && d.RGB == nil {
+		return errors.New("no attributes to change")
+	}
+	if d.Brightness != nil && (*d.Brightness < 1 || *d.Brightness > 100) {
+		return errors.New("brightness out of range [1, 100]")
+	}
+	if d.ColorTone != nil && (*d.ColorTone < 0 || *d.ColorTone > 100) {
+		return errors.New("color tone out of range [0, 100]")
+	}
+	if d.ColorTone != nil && d.RGB != nil {
+		return errors.New("cannot set both color tone and RGB")
+	}
+	return nil
+}
+
+// packets creates the packets to send to a switch for this state change, in
+// the order they should be sent.
+func (d *DeviceState) packets(switchID uint32, device int, nextSeq func() uint16) []*Packet {
+	var res []*Packet
+	if d.On != nil && !*d.On {
+		// Turn off first, so that other changes are not visible.
+		res = append(res, NewPacketSetDeviceStatus(switchID, nextSeq(), device, 0))
+	}
+	if d.Brightness != nil {
+		res = append(res, NewPacketSetLum(switchID, nextSeq(), device, *d.Brightness))
+	}
+	if d.ColorTone != nil {
+		res = append(res, NewPacketSetCT(switchID, nextSeq(), device, *d.ColorTone))
+	}
+	if d.RGB != nil {
+		r, g, b := d.RGB[0], d.RGB[1], d.RGB[2]
+		res = append(res, NewPacketSetRGB(switchID, nextSeq(), device, r, g, b))
+	}
+	if d.On != nil && *d.On {
+		// Turn on last, so that the device does not flash its old
+		// brightness or color.
+		res = append(res, NewPacketSetDeviceStatus(switchID, nextSeq(), device, 1))
+	}
+	return res
+}
+
+func (d *DeviceState) attrs() []Attr {
+	var res []Attr
+	if d.On != nil {
+		res = append(res, Attr{"status", *d.On})
+	}
+	if d.Brightness != nil {
+		res = append(res, Attr{"lum", *d.Brightness})
+	}
+	if d.ColorTone != nil {
+		res = append(res, Attr{"ct", *d.ColorTone})
+	}
+	if d.RGB != nil {
+		res = append(res, Attr{"rgb", *d.RGB})
+	}
+	return res
+}
+
+// SetDeviceState changes several attributes of a device at once.
+//
+// All of the changes are sent over a single connection, and the call waits
+// once for the device to apply all of them. This is faster than calling
+// SetDeviceStatus(), SetDeviceLum(), etc. individually, and avoids flickering
+// through intermediate states.
+func (c *Controller) SetDeviceState(d *ControllerDevice, state DeviceState) error {
+	return c.setDeviceState(d, state, false)
+}
+
+// SetDeviceStateAsync is like SetDeviceState, but does not wait for the
+// device's status to change.
+func (c *Controller) SetDeviceStateAsync(d *ControllerDevice, state DeviceState) error {
+	return c.setDeviceState(d, state, true)
+}
+
+func (c *Controller) setDeviceState(d *ControllerDevice, state DeviceState, async bool) (err error) {
+	attrs := append([]Attr{{"device", d.deviceID}, {"async", async}}, state.attrs()...)
+	span := c.startSpan("SetDeviceState", attrs...)
+	defer func() { span.End(err) }()
+
+	if err := state.Validate(); err != nil {
+		return errors.Wrap(err, "set device state")
+	}
+	switchID, err := c.currentSwitch(d)
+	if err != nil {
+		return errors.Wrap(err, "set device state")
+	}
+	packets := state.packets(switchID, d.deviceIndex(), c.nextSeqID)
+	span.SetAttrs(Attr{"switch", switchID}, Attr{"num_packets", len(packets)})
+	return c.checkedSwitch(d, switchID, c.callAndWaitSimple(span, packets, "set device state", async))
+}
@@ -21,6 +21,14 @@ var RemoteCallError = errors.New("the server returned with an error")
 // through any wifi-connected switch.
 var UnreachableError = errors.New("the device cannot be reached")
 
+// A TimeoutError is triggered when the packet server does not respond to a
+// request before the Controller's timeout.
+var TimeoutError = errors.New("timeout waiting for response")
+
+// An UnverifiedError is triggered when a verified write does not observe
+// the requested state on the device before its deadline.
+var UnverifiedError = errors.New("the device did not report the requested state")
+
 // A RemoteError is an error message returned by the HTTPS API server.
 type RemoteError struct {
 	Msg     string `json:"msg"`
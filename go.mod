@@ -1,6 +1,6 @@
 module github.com/unixpickle/cbyge
 
-go 1.14
+go 1.24
 
 require (
 	github.com/pkg/errors v0.9.1
@@ -2,28 +2,73 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"flag"
-	"io/ioutil"
+	"io"
+	"io/fs"
 	"log"
 	"net/http"
 	"net/url"
 
+	"github.com/unixpickle/cbyge"
 	"github.com/unixpickle/essentials"
 )
 
 var TargetURL url.URL
 
+// Cassette and CassettePath are set when recording.
+var Cassette *cbyge.Cassette
+var CassettePath string
+
+// forwardedRequestHeaders and forwardedResponseHeaders are the headers which
+// the proxy passes along, and records in cassettes.
+var (
+	forwardedRequestHeaders  = []string{"content-type", "access-token", "cookie"}
+	forwardedResponseHeaders = []string{"content-type", "set-cookie"}
+)
+
 func main() {
 	var target string
 	var addr string
-	flag.StringVar(&target, "target", "https://api.gelighting.com", "target URL base")
+	var recordPath string
+	var replayPath string
+	flag.StringVar(&target, "target", cbyge.DefaultAPIBaseURL, "target URL base")
 	flag.StringVar(&addr, "addr", ":8080", "listen address")
+	flag.StringVar(&recordPath, "record", "",
+		"record exchanges to a cassette file, with credentials redacted")
+	flag.StringVar(&replayPath, "replay", "",
+		"serve recorded responses from a cassette file instead of proxying")
 	flag.Parse()
 
+	if recordPath != "" && replayPath != "" {
+		essentials.Die("cannot pass both -record and -replay")
+	}
+
+	if replayPath != "" {
+		cassette, err := cbyge.LoadCassette(replayPath)
+		essentials.Must(err)
+		log.Printf("replaying %d recorded exchanges", len(cassette.Interactions()))
+		http.Handle("/", logRequests(cassette))
+		essentials.Must(http.ListenAndServe(addr, nil))
+		return
+	}
+
 	targetURL, err := url.Parse(target)
 	essentials.Must(err)
 	TargetURL = *targetURL
 
+	if recordPath != "" {
+		// Append to an existing cassette, so that recordings can be made
+		// over several sessions.
+		CassettePath = recordPath
+		Cassette, err = cbyge.LoadCassette(recordPath)
+		if errors.Is(err, fs.ErrNotExist) {
+			Cassette = &cbyge.Cassette{}
+		} else {
+			essentials.Must(err)
+		}
+	}
+
 	http.HandleFunc("/", ProxyRequest)
 	essentials.Must(http.ListenAndServe(addr, nil))
 }
@@ -31,10 +76,12 @@ func main() {
 func ProxyRequest(w http.ResponseWriter, r *http.Request) {
 	var data []byte
 	if r.Body != nil {
-		data, _ = ioutil.ReadAll(r.Body)
+		data, _ = io.ReadAll(r.Body)
 	}
 
-	log.Printf("%s <- %s", r.URL.String(), string(data))
+	if Cassette == nil {
+		log.Printf("%s <- %s", r.URL.String(), string(data))
+	}
 
 	tu := *r.URL
 	tu.Host = TargetURL.Host
@@ -42,16 +89,68 @@ func ProxyRequest(w http.ResponseWriter, r *http.Request) {
 	proxyReq, err := http.NewRequest(r.Method, tu.String(), bytes.NewReader(data))
 	if err != nil {
 		log.Println(err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
 		return
 	}
-	proxyReq.Header.Set("content-type", r.Header.Get("content-type"))
-	proxyReq.Header.Set("access-token", r.Header.Get("access-token"))
-	proxyReq.Header.Set("cookie", r.Header.Get("cookie"))
+	for _, name := range forwardedRequestHeaders {
+		if value := r.Header.Get(name); value != "" {
+			proxyReq.Header.Set(name, value)
+		}
+	}
 	resp, err := (&http.Client{}).Do(proxyReq)
-	data, _ = ioutil.ReadAll(resp.Body)
-	log.Printf("%s (%s) -> %s", r.URL.String(), resp.Status, string(data))
-	w.Header().Set("set-cookie", resp.Header.Get("cookie"))
-	w.Header().Set("content-type", resp.Header.Get("content-type"))
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	respData, _ := io.ReadAll(resp.Body)
+	for _, name := range forwardedResponseHeaders {
+		if value := resp.Header.Get(name); value != "" {
+			w.Header().Set(name, value)
+		}
+	}
 	w.WriteHeader(resp.StatusCode)
-	w.Write(data)
+	w.Write(respData)
+
+	if Cassette == nil {
+		log.Printf("%s (%s) -> %s", r.URL.String(), resp.Status, string(respData))
+		return
+	}
+
+	interaction := &cbyge.CassetteInteraction{
+		Method:         r.Method,
+		Path:           r.URL.RequestURI(),
+		RequestHeader:  headerMap(r.Header, forwardedRequestHeaders),
+		RequestBody:    string(data),
+		Status:         resp.StatusCode,
+		ResponseHeader: headerMap(resp.Header, forwardedResponseHeaders),
+		ResponseBody:   string(respData),
+	}
+	Cassette.Add(interaction)
+
+	// Only log the redacted bodies, so that recordings never leave
+	// credentials in the log.
+	log.Printf("%s <- %s", r.URL.String(), interaction.RequestBody)
+	log.Printf("%s (%s) -> %s", r.URL.String(), resp.Status, interaction.ResponseBody)
+	if err := Cassette.Save(CassettePath); err != nil {
+		log.Println(err)
+	}
+}
+
+func headerMap(h http.Header, names []string) map[string]string {
+	res := map[string]string{}
+	for _, name := range names {
+		if value := h.Get(name); value != "" {
+			res[name] = value
+		}
+	}
+	return res
+}
+
+func logRequests(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("%s %s", r.Method, r.URL.String())
+		h.ServeHTTP(w, r)
+	})
 }
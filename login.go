@@ -15,13 +15,21 @@ import (
 // DefaultCorpID is the corporation ID used by the C by GE app.
 const DefaultCorpID = "1007d2ad150c4000"
 
+// DefaultAPIBaseURL is the base URL of the HTTP API used by the C by GE app.
+const DefaultAPIBaseURL = "https://api.gelighting.com"
+
+// APIBaseURL is the base URL for HTTP API calls, such as Login() and
+// GetDevices(). It may be changed to use a proxy or a recorded cassette (see
+// Cassette) instead of the real server.
+var APIBaseURL = DefaultAPIBaseURL
+
 const (
-	authURL           = "https://api.gelighting.com/v2/user_auth"
-	verifyCodeURL     = "https://api.gelighting.com/v2/two_factor/email/verifycode"
-	twoFactorURL      = "https://api.gelighting.com/v2/user_auth/two_factor"
-	userInfoURL       = "https://api.gelighting.com/v2/user/%d"
-	devicesURL        = "https://api.gelighting.com/v2/user/%d/subscribe/devices"
-	devicePropertyURL = "https://api.gelighting.com/v2/product/%s/device/%d/property"
+	authPath           = "/v2/user_auth"
+	verifyCodePath     = "/v2/two_factor/email/verifycode"
+	twoFactorPath      = "/v2/user_auth/two_factor"
+	userInfoPath       = "/v2/user/%d"
+	devicesPath        = "/v2/user/%d/subscribe/devices"
+	devicePropertyPath = "/v2/product/%s/device/%d/property"
 )
 
 type OptionalDate struct {
@@ -99,6 +107,32 @@ type DeviceProperties struct {
 		DisplayName string `json:"displayName"`
 		SwitchID    uint64 `json:"switchID"`
 	} `json:"bulbsArray"`
+	Groups DeviceGroupList `json:"groupsArray"`
+}
+
+// DeviceGroupInfo describes a group of bulbs, such as a room, which was
+// created in the app.
+type DeviceGroupInfo struct {
+	GroupID     int64   `json:"groupID"`
+	DisplayName string  `json:"displayName"`
+	DeviceIDs   []int64 `json:"deviceIDArray"`
+}
+
+// DeviceGroupList is a list of groups which decodes to an empty list if the
+// JSON does not have the expected format.
+//
+// Group information is optional, and should never prevent a device's bulbs
+// from being listed.
+type DeviceGroupList []DeviceGroupInfo
+
+func (d *DeviceGroupList) UnmarshalJSON(data []byte) error {
+	var groups []DeviceGroupInfo
+	if err := json.Unmarshal(data, &groups); err != nil {
+		*d = nil
+	} else {
+		*d = groups
+	}
+	return nil
 }
 
 // Login authenticates with the server to create a new session.
@@ -113,7 +147,7 @@ func Login(email, password, corpID string) (*SessionInfo, error) {
 		corpID = DefaultCorpID
 	}
 	jsonObj := map[string]string{"email": email, "password": password, "corp_id": corpID}
-	return doLoginRequest(authURL, jsonObj)
+	return doLoginRequest(APIBaseURL+authPath, jsonObj)
 }
 
 // Login2FA authenticates using two-factor authentication, which is required
@@ -142,7 +176,7 @@ func Login2FAStage1(email, corpID string) error {
 		"corp_id":    corpID,
 	}
 	data, _ := json.Marshal(jsonObj)
-	resp, err := http.Post(verifyCodeURL, "application/json", bytes.NewReader(data))
+	resp, err := http.Post(APIBaseURL+verifyCodePath, "application/json", bytes.NewReader(data))
 	if err != nil {
 		return errors.Wrap(err, "login")
 	}
@@ -167,7 +201,7 @@ func Login2FAStage2(email, password, corpID, code string) (*SessionInfo, error)
 		"corp_id":    corpID,
 		"resource":   randomLoginResource(),
 	}
-	return doLoginRequest(twoFactorURL, jsonObj)
+	return doLoginRequest(APIBaseURL+twoFactorPath, jsonObj)
 }
 
 func doLoginRequest(url string, obj interface{}) (*SessionInfo, error) {
@@ -201,7 +235,7 @@ func randomLoginResource() string {
 
 // GetUserInfo gets UserInfo using information from Login.
 func GetUserInfo(userID uint32, accessToken string) (*UserInfo, error) {
-	urlStr := fmt.Sprintf(userInfoURL, userID)
+	urlStr := APIBaseURL + fmt.Sprintf(userInfoPath, userID)
 	var response UserInfo
 	if err := makeAPICall(urlStr, accessToken, &response, "get user info"); err != nil {
 		return nil, err
@@ -211,7 +245,7 @@ func GetUserInfo(userID uint32, accessToken string) (*UserInfo, error) {
 
 // GetDevices gets the devices using information from Login.
 func GetDevices(userID uint32, accessToken string) ([]*DeviceInfo, error) {
-	urlStr := fmt.Sprintf(devicesURL, userID)
+	urlStr := APIBaseURL + fmt.Sprintf(devicesPath, userID)
 	var response []*DeviceInfo
 	if err := makeAPICall(urlStr, accessToken, &response, "get devices"); err != nil {
 		return nil, err
@@ -224,7 +258,7 @@ func GetDevices(userID uint32, accessToken string) ([]*DeviceInfo, error) {
 // The resulting error can be checked with IsPropertyNotExistsError(), to
 // check if the device has no properties.
 func GetDeviceProperties(accessToken, productID string, deviceID uint32) (*DeviceProperties, error) {
-	urlStr := fmt.Sprintf(devicePropertyURL, productID, deviceID)
+	urlStr := APIBaseURL + fmt.Sprintf(devicePropertyPath, productID, deviceID)
 	var response DeviceProperties
 	if err := makeAPICall(urlStr, accessToken, &response, "get device properties"); err != nil {
 		// Ignore JSON errors, since JSON parsing fails for some
@@ -0,0 +1,282 @@
+package cbyge
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultLatencyBuckets are the histogram buckets, in seconds, used by
+// Metrics for command latencies.
+var DefaultLatencyBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// Metrics collects operational statistics about a Controller.
+//
+// A Metrics object is both a Logger and a Tracer, and should be attached to
+// a Controller with SetLogger() and SetTracer(), possibly alongside other
+// hooks using MultiLogger() and MultiTracer().
+//
+// The collected metrics can be exported in the Prometheus text format with
+// WritePrometheus().
+type Metrics struct {
+	lock sync.Mutex
+
+	commands     map[string]*commandStats
+	timeouts     uint64
+	remoteErrors uint64
+	failovers    uint64
+	connects     uint64
+	connectErrs  uint64
+	authErrs     uint64
+
+	devices []*ControllerDevice
+}
+
+type commandStats struct {
+	results map[string]uint64
+	latency *Histogram
+}
+
+// NewMetrics creates an empty Metrics object.
+func NewMetrics() *Metrics {
+	return &Metrics{commands: map[string]*commandStats{}}
+}
+
+// SetDevices sets the devices whose last known statuses are reported as
+// gauges by WritePrometheus().
+func (m *Metrics) SetDevices(devs []*ControllerDevice) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.devices = append([]*ControllerDevice{}, devs...)
+}
+
+// Log records counters for timeouts, fail-overs, and connections.
+func (m *Metrics) Log(e *Event) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	switch e.Kind {
+	case EventTimeout:
+		m.timeouts++
+	case EventSwitchFailover:
+		m.failovers++
+	case EventConnect:
+		if e.Err != nil {
+			m.connectErrs++
+		} else {
+			m.connects++
+		}
+	case EventAuth:
+		if e.Err != nil {
+			m.authErrs++
+		}
+	}
+}
+
+// StartSpan creates a span which records the latency and result of a
+// Controller command once it ends.
+func (m *Metrics) StartSpan(name string, attrs ...Attr) Span {
+	return &metricsSpan{metrics: m, name: name, start: time.Now()}
+}
+
+// WritePrometheus writes all of the metrics in the Prometheus text
+// exposition format.
+func (m *Metrics) WritePrometheus(w io.Writer) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	bw := bufio.NewWriter(w)
+
+	WritePrometheusHeader(bw, "cbyge_commands_total", "counter",
+		"Controller commands by result.")
+	for _, name := range sortedKeys(m.commands) {
+		stats := m.commands[name]
+		for _, result := range sortedKeys(stats.results) {
+			fmt.Fprintf(bw, "cbyge_commands_total{command=%s,result=%s} %d\n",
+				PrometheusLabel(name), PrometheusLabel(result), stats.results[result])
+		}
+	}
+
+	WritePrometheusHeader(bw, "cbyge_command_duration_seconds", "histogram",
+		"Latency of Controller commands.")
+	for _, name := range sortedKeys(m.commands) {
+		m.commands[name].latency.WritePrometheus(bw, "cbyge_command_duration_seconds",
+			"command="+PrometheusLabel(name))
+	}
+
+	counters := []struct {
+		name  string
+		help  string
+		value uint64
+	}{
+		{"cbyge_timeouts_total", "Timeouts waiting for the packet server.", m.timeouts},
+		{"cbyge_remote_call_errors_total", "Error responses from the packet server.",
+			m.remoteErrors},
+		{"cbyge_switch_failovers_total", "Times a device was moved to a different switch.",
+			m.failovers},
+		{"cbyge_connections_total", "Connections made to the packet server.", m.connects},
+		{"cbyge_connection_errors_total", "Failed connections to the packet server.",
+			m.connectErrs},
+		{"cbyge_auth_errors_total", "Failed authentications with the packet server.",
+			m.authErrs},
+	}
+	for _, c := range counters {
+		WritePrometheusHeader(bw, c.name, "counter", c.help)
+		fmt.Fprintf(bw, "%s %d\n", c.name, c.value)
+	}
+
+	gauges := []struct {
+		name  string
+		help  string
+		value func(s ControllerDeviceStatus) float64
+	}{
+		{"cbyge_device_online", "Whether the device was reachable in its last status.",
+			func(s ControllerDeviceStatus) float64 { return boolGauge(s.IsOnline) }},
+		{"cbyge_device_on", "Whether the device was on in its last status.",
+			func(s ControllerDeviceStatus) float64 { return boolGauge(s.IsOnline && s.IsOn) }},
+		{"cbyge_device_brightness", "Brightness of the device in its last status.",
+			func(s ControllerDeviceStatus) float64 { return float64(s.Brightness) }},
+	}
+	for _, g := range gauges {
+		WritePrometheusHeader(bw, g.name, "gauge", g.help)
+		for _, d := range m.devices {
+			fmt.Fprintf(bw, "%s{device=%s,name=%s} %g\n", g.name, PrometheusLabel(d.DeviceID()),
+				PrometheusLabel(d.Name()), g.value(d.LastStatus()))
+		}
+	}
+
+	return bw.Flush()
+}
+
+func (m *Metrics) recordCommand(name string, d time.Duration, err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	stats, ok := m.commands[name]
+	if !ok {
+		stats = &commandStats{
+			results: map[string]uint64{},
+			latency: NewHistogram(DefaultLatencyBuckets),
+		}
+		m.commands[name] = stats
+	}
+	stats.results[commandResult(err)]++
+	stats.latency.Observe(d.Seconds())
+	if errors.Is(err, RemoteCallError) {
+		m.remoteErrors++
+	}
+}
+
+type metricsSpan struct {
+	metrics *Metrics
+	name    string
+	start   time.Time
+	once    sync.Once
+}
+
+func (m *metricsSpan) SetAttrs(attrs ...Attr)              {}
+func (m *metricsSpan) AddEvent(name string, attrs ...Attr) {}
+
+func (m *metricsSpan) End(err error) {
+	m.once.Do(func() {
+		m.metrics.recordCommand(m.name, time.Since(m.start), err)
+	})
+}
+
+func commandResult(err error) string {
+	switch {
+	case err == nil:
+		return "ok"
+	case errors.Is(err, TimeoutError):
+		return "timeout"
+	case errors.Is(err, RemoteCallError):
+		return "remote_error"
+	case errors.Is(err, UnreachableError):
+		return "unreachable"
+	}
+	return "error"
+}
+
+// A Histogram counts observations in cumulative buckets, in the style of a
+// Prometheus histogram.
+//
+// A Histogram is not safe for concurrent use.
+type Histogram struct {
+	Buckets []float64
+	Counts  []uint64
+	Count   uint64
+	Sum     float64
+}
+
+// NewHistogram creates a histogram with the given upper bounds, which must
+// be sorted in ascending order.
+func NewHistogram(buckets []float64) *Histogram {
+	return &Histogram{
+		Buckets: buckets,
+		Counts:  make([]uint64, len(buckets)),
+	}
+}
+
+// Observe adds a value to the histogram.
+func (h *Histogram) Observe(x float64) {
+	for i, b := range h.Buckets {
+		if x <= b {
+			h.Counts[i]++
+		}
+	}
+	h.Count++
+	h.Sum += x
+}
+
+// WritePrometheus writes the bucket, sum, and count series of the histogram.
+//
+// The labels string is a pre-formatted, comma-separated list of labels, or
+// "" for no labels.
+func (h *Histogram) WritePrometheus(w io.Writer, name, labels string) {
+	prefix := ""
+	suffix := ""
+	if labels != "" {
+		prefix = labels + ","
+		suffix = "{" + labels + "}"
+	}
+	for i, b := range h.Buckets {
+		fmt.Fprintf(w, "%s_bucket{%sle=\"%g\"} %d\n", name, prefix, b, h.Counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{%sle=\"+Inf\"} %d\n", name, prefix, h.Count)
+	fmt.Fprintf(w, "%s_sum%s %g\n", name, suffix, h.Sum)
+	fmt.Fprintf(w, "%s_count%s %d\n", name, suffix, h.Count)
+}
+
+// WritePrometheusHeader writes the HELP and TYPE lines for a metric.
+func WritePrometheusHeader(w io.Writer, name, metricType, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, metricType)
+}
+
+// PrometheusLabel quotes and escapes a label value.
+func PrometheusLabel(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, "\n", `\n`)
+	value = strings.ReplaceAll(value, `"`, `\"`)
+	return `"` + value + `"`
+}
+
+func boolGauge(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
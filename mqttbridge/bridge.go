@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/unixpickle/cbyge"
+)
+
+// Color temperature range, in Kelvin, which is mapped onto color tones in
+// [0, 100], where 0 is the warmest tone and 100 is the coolest.
+const (
+	MinKelvin = 2700
+	MaxKelvin = 6500
+)
+
+// A Bridge mirrors the state of C by GE devices onto MQTT topics.
+type Bridge struct {
+	Controller *cbyge.Controller
+	Client     *MQTTClient
+
+	// Prefix is the root of all state and command topics.
+	Prefix string
+
+	// DiscoveryPrefix is the Home Assistant discovery prefix, or "" to
+	// disable discovery messages.
+	DiscoveryPrefix string
+
+	devicesLock sync.RWMutex
+	devices     map[string]*cbyge.ControllerDevice
+
+	publishedLock sync.Mutex
+	published     map[string][]byte
+
+	commands chan bridgeCommand
+}
+
+type bridgeCommand struct {
+	Device  *cbyge.ControllerDevice
+	Payload []byte
+}
+
+// LightState is the Home Assistant JSON schema representation of a light.
+type LightState struct {
+	State      string    `json:"state,omitempty"`
+	Brightness *int      `json:"brightness,omitempty"`
+	ColorMode  string    `json:"color_mode,omitempty"`
+	ColorTemp  *int      `json:"color_temp,omitempty"`
+	Color      *LightRGB `json:"color,omitempty"`
+}
+
+type LightRGB struct {
+	R int `json:"r"`
+	G int `json:"g"`
+	B int `json:"b"`
+}
+
+func NewBridge(ctrl *cbyge.Controller, client *MQTTClient, prefix,
+	discoveryPrefix string) *Bridge {
+	return &Bridge{
+		Controller:      ctrl,
+		Client:          client,
+		Prefix:          prefix,
+		DiscoveryPrefix: discoveryPrefix,
+		devices:         map[string]*cbyge.ControllerDevice{},
+		published:       map[string][]byte{},
+		commands:        make(chan bridgeCommand, 16),
+	}
+}
+
+// AvailabilityTopic is the topic where the bridge publishes "online" or
+// "offline".
+func (b *Bridge) AvailabilityTopic() string {
+	return b.Prefix + "/bridge/availability"
+}
+
+// SetDevices updates the list of bridged devices, publishing discovery
+// messages and subscribing to command topics for each of them.
+func (b *Bridge) SetDevices(devs []*cbyge.ControllerDevice) error {
+	b.devicesLock.Lock()
+	b.devices = map[string]*cbyge.ControllerDevice{}
+	for _, d := range devs {
+		b.devices[d.DeviceID()] = d
+	}
+	b.devicesLock.Unlock()
+
+	for _, d := range devs {
+		if b.DiscoveryPrefix != "" {
+			if err := b.publishDiscovery(d); err != nil {
+				return err
+			}
+		}
+		if err := b.Client.Subscribe(b.deviceTopic(d, "set")); err != nil {
+			return err
+		}
+		if err := b.PublishStatus(d, d.LastStatus()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Run processes commands and polls device statuses until the MQTT connection
+// fails.
+func (b *Bridge) Run(pollInterval time.Duration) error {
+	if err := b.Client.Publish(b.AvailabilityTopic(), []byte("online"), true); err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go b.commandLoop(done)
+	go b.pollLoop(done, pollInterval)
+
+	return b.Client.Run(b.handleMessage)
+}
+
+// PublishStatus publishes a device's state and availability, if they have
+// changed since they were last published.
+func (b *Bridge) PublishStatus(d *cbyge.ControllerDevice, status cbyge.ControllerDeviceStatus) error {
+	availability := "offline"
+	if status.IsOnline {
+		availability = "online"
+	}
+	if err := b.publishIfChanged(b.deviceTopic(d, "availability"),
+		[]byte(availability)); err != nil {
+		return err
+	}
+	if !status.IsOnline {
+		return nil
+	}
+	data, _ := json.Marshal(encodeLightState(status))
+	return b.publishIfChanged(b.deviceTopic(d, "state"), data)
+}
+
+func (b *Bridge) publishIfChanged(topic string, payload []byte) error {
+	b.publishedLock.Lock()
+	defer b.publishedLock.Unlock()
+	if old, ok := b.published[topic]; ok && bytes.Equal(old, payload) {
+		return nil
+	}
+	if err := b.Client.Publish(topic, payload, true); err != nil {
+		return err
+	}
+	b.published[topic] = payload
+	return nil
+}
+
+func (b *Bridge) publishDiscovery(d *cbyge.ControllerDevice) error {
+	topic, data := b.discoveryMessage(d.DeviceID(), d.Name())
+	return b.Client.Publish(topic, data, true)
+}
+
+// discoveryMessage creates the Home Assistant discovery topic and config for
+// a device.
+func (b *Bridge) discoveryMessage(deviceID, name string) (string, []byte) {
+	uniqueID := "cbyge_" + deviceID
+	config := map[string]interface{}{
+		"name":                  nil,
+		"unique_id":             uniqueID,
+		"object_id":             uniqueID,
+		"schema":                "json",
+		"state_topic":           b.topic(deviceID, "state"),
+		"command_topic":         b.topic(deviceID, "set"),
+		"brightness":            true,
+		"brightness_scale":      100,
+		"supported_color_modes": []string{"color_temp", "rgb"},
+		"color_temp_kelvin":     true,
+		"min_kelvin":            MinKelvin,
+		"max_kelvin":            MaxKelvin,
+		"availability_mode":     "all",
+		"availability": []map[string]string{
+			{"topic": b.AvailabilityTopic()},
+			{"topic": b.topic(deviceID, "availability")},
+		},
+		"device": map[string]interface{}{
+			"identifiers":  []string{uniqueID},
+			"name":         name,
+			"manufacturer": "GE Lighting",
+			"model":        "C by GE",
+		},
+	}
+	data, _ := json.Marshal(config)
+	return b.DiscoveryPrefix + "/light/" + uniqueID + "/config", data
+}
+
+func (b *Bridge) handleMessage(topic string, payload []byte) {
+	if !strings.HasPrefix(topic, b.Prefix+"/") || !strings.HasSuffix(topic, "/set") {
+		return
+	}
+	id := strings.TrimSuffix(strings.TrimPrefix(topic, b.Prefix+"/"), "/set")
+	b.devicesLock.RLock()
+	d, ok := b.devices[id]
+	b.devicesLock.RUnlock()
+	if !ok {
+		log.Printf("command for unknown device: %s", id)
+		return
+	}
+	select {
+	case b.commands <- bridgeCommand{Device: d, Payload: payload}:
+	default:
+		log.Printf("dropping command for device %s: too many pending commands", id)
+	}
+}
+
+func (b *Bridge) commandLoop(done <-chan struct{}) {
+	for {
+		select {
+		case cmd := <-b.commands:
+			if err := b.applyCommand(cmd.Device, cmd.Payload); err != nil {
+				log.Printf("command for device %s failed: %s", cmd.Device.DeviceID(), err)
+			}
+			status, err := b.Controller.DeviceStatus(cmd.Device)
+			if err != nil {
+				log.Printf("status for device %s failed: %s", cmd.Device.DeviceID(), err)
+				status = cmd.Device.LastStatus()
+			}
+			if err := b.PublishStatus(cmd.Device, status); err != nil {
+				log.Printf("publish failed: %s", err)
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+func (b *Bridge) applyCommand(d *cbyge.ControllerDevice, payload []byte) error {
+	var state LightState
+	if err := json.Unmarshal(payload, &state); err != nil {
+		return errors.Wrap(err, "decode command")
+	}
+	var change cbyge.DeviceState
+	if state.State == "OFF" || (state.Brightness != nil && *state.Brightness <= 0) {
+		off := false
+		change.On = &off
+		return b.Controller.SetDeviceState(d, change)
+	}
+	if state.State == "ON" {
+		on := true
+		change.On = &on
+	}
+	if state.Brightness != nil {
+		lum := *state.Brightness
+		if lum > 100 {
+			lum = 100
+		}
+		change.Brightness = &lum
+	}
+	if state.ColorTemp != nil {
+		tone := kelvinToTone(*state.ColorTemp)
+		change.ColorTone = &tone
+	} else if state.Color != nil {
+		change.RGB = &[3]uint8{
+			clampByte(state.Color.R), clampByte(state.Color.G), clampByte(state.Color.B),
+		}
+	}
+	if change.Validate() != nil {
+		// Nothing to change, e.g. an empty command.
+		return nil
+	}
+	return b.Controller.SetDeviceState(d, change)
+}
+
+func (b *Bridge) pollLoop(done <-chan struct{}, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			b.devicesLock.RLock()
+			devs := make([]*cbyge.ControllerDevice, 0, len(b.devices))
+			for _, d := range b.devices {
+				devs = append(devs, d)
+			}
+			b.devicesLock.RUnlock()
+
+			statuses, errs := b.Controller.DeviceStatuses(devs)
+			for i, d := range devs {
+				status := cbyge.ControllerDeviceStatus{}
+				if errs[i] == nil {
+					status = statuses[i]
+				}
+				if err := b.PublishStatus(d, status); err != nil {
+					log.Printf("publish failed: %s", err)
+				}
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+func (b *Bridge) deviceTopic(d *cbyge.ControllerDevice, name string) string {
+	return b.topic(d.DeviceID(), name)
+}
+
+func (b *Bridge) topic(deviceID, name string) string {
+	return b.Prefix + "/" + deviceID + "/" + name
+}
+
+func encodeLightState(s cbyge.ControllerDeviceStatus) *LightState {
+	state := "OFF"
+	if s.IsOn {
+		state = "ON"
+	}
+	brightness := int(s.Brightness)
+	res := &LightState{State: state, Brightness: &brightness}
+	if s.UseRGB {
+		res.ColorMode = "rgb"
+		res.Color = &LightRGB{R: int(s.RGB[0]), G: int(s.RGB[1]), B: int(s.RGB[2])}
+	} else {
+		kelvin := toneToKelvin(int(s.ColorTone))
+		res.ColorMode = "color_temp"
+		res.ColorTemp = &kelvin
+	}
+	return res
+}
+
+func toneToKelvin(tone int) int {
+	return MinKelvin + tone*(MaxKelvin-MinKelvin)/100
+}
+
+func kelvinToTone(kelvin int) int {
+	tone := (kelvin - MinKelvin) * 100 / (MaxKelvin - MinKelvin)
+	if tone < 0 {
+		return 0
+	} else if tone > 100 {
+		return 100
+	}
+	return tone
+}
+
+func clampByte(x int) uint8 {
+	if x < 0 {
+		return 0
+	} else if x > 0xff {
+		return 0xff
+	}
+	return uint8(x)
+}
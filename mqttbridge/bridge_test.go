@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/unixpickle/cbyge"
+)
+
+func TestDiscoveryMessage(t *testing.T) {
+	b := &Bridge{Prefix: "cbyge", DiscoveryPrefix: "homeassistant"}
+	topic, data := b.discoveryMessage("123", "Desk Lamp")
+	if topic != "homeassistant/light/cbyge_123/config" {
+		t.Errorf("unexpected topic: %s", topic)
+	}
+	for _, expected := range []string{
+		`"unique_id":"cbyge_123"`,
+		`"schema":"json"`,
+		`"state_topic":"cbyge/123/state"`,
+		`"command_topic":"cbyge/123/set"`,
+		`"name":null`,
+		`"name":"Desk Lamp"`,
+		`{"topic":"cbyge/bridge/availability"}`,
+		`{"topic":"cbyge/123/availability"}`,
+		`"supported_color_modes":["color_temp","rgb"]`,
+	} {
+		if !strings.Contains(string(data), expected) {
+			t.Errorf("missing %s in %s", expected, data)
+		}
+	}
+}
+
+func TestEncodeLightState(t *testing.T) {
+	testCases := []struct {
+		name   string
+		status cbyge.StatusPaginatedResponse
+		want   string
+	}{
+		{
+			name:   "Off",
+			status: cbyge.StatusPaginatedResponse{Brightness: 20, ColorTone: 0},
+			want:   `{"state":"OFF","brightness":20,"color_mode":"color_temp","color_temp":2700}`,
+		},
+		{
+			name:   "Tone",
+			status: cbyge.StatusPaginatedResponse{IsOn: true, Brightness: 100, ColorTone: 100},
+			want:   `{"state":"ON","brightness":100,"color_mode":"color_temp","color_temp":6500}`,
+		},
+		{
+			name: "RGB",
+			status: cbyge.StatusPaginatedResponse{IsOn: true, Brightness: 50, ColorTone: 0xfe,
+				UseRGB: true, RGB: [3]uint8{1, 2, 3}},
+			want: `{"state":"ON","brightness":50,"color_mode":"rgb","color":{"r":1,"g":2,"b":3}}`,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			status := cbyge.ControllerDeviceStatus{StatusPaginatedResponse: tc.status, IsOnline: true}
+			data, _ := json.Marshal(encodeLightState(status))
+			if string(data) != tc.want {
+				t.Errorf("expected %s but got %s", tc.want, data)
+			}
+		})
+	}
+}
+
+func TestKelvinTone(t *testing.T) {
+	for tone := 0; tone <= 100; tone += 25 {
+		if actual := kelvinToTone(toneToKelvin(tone)); actual != tone {
+			t.Errorf("tone %d became %d", tone, actual)
+		}
+	}
+	if kelvinToTone(1000) != 0 || kelvinToTone(10000) != 100 {
+		t.Error("kelvin is not clamped")
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"log"
+	"net"
+	"sync"
+)
+
+// A Broker is a minimal, in-process MQTT 3.1.1 broker.
+//
+// It supports QoS 0 delivery (QoS 1 publishes are acknowledged but delivered
+// at QoS 0), retained messages, wildcards, and last will messages. It has no
+// authentication, and is meant for local testing of the bridge without an
+// external broker.
+type Broker struct {
+	lock     sync.Mutex
+	clients  map[*brokerClient]bool
+	retained map[string][]byte
+}
+
+type brokerClient struct {
+	conn      net.Conn
+	writeLock sync.Mutex
+	filters   map[string]bool
+
+	clientID string
+	username string
+
+	willTopic   string
+	willPayload []byte
+	willRetain  bool
+}
+
+func NewBroker() *Broker {
+	return &Broker{
+		clients:  map[*brokerClient]bool{},
+		retained: map[string][]byte{},
+	}
+}
+
+// ListenAndServe accepts MQTT connections on addr until an error occurs.
+func (b *Broker) ListenAndServe(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return b.Serve(listener)
+}
+
+// Serve accepts MQTT connections from a listener until an error occurs.
+func (b *Broker) Serve(listener net.Listener) error {
+	defer listener.Close()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go b.handleConn(conn)
+	}
+}
+
+func (b *Broker) handleConn(conn net.Conn) {
+	defer conn.Close()
+	client := &brokerClient{conn: conn, filters: map[string]bool{}}
+	r := bufio.NewReader(conn)
+
+	packet, err := readMQTTPacket(r)
+	if err != nil {
+		return
+	}
+	if packet.Type != mqttConnect {
+		return
+	}
+	if err := client.decodeConnect(packet); err != nil {
+		log.Printf("broker: bad CONNECT from %s: %s", conn.RemoteAddr(), err)
+		return
+	}
+	if client.write(&mqttPacket{Type: mqttConnAck, Body: []byte{0, 0}}) != nil {
+		return
+	}
+
+	b.lock.Lock()
+	b.clients[client] = true
+	b.lock.Unlock()
+
+	graceful := false
+	defer func() {
+		b.lock.Lock()
+		delete(b.clients, client)
+		b.lock.Unlock()
+		if !graceful && client.willTopic != "" {
+			b.publish(client.willTopic, client.willPayload, client.willRetain)
+		}
+	}()
+
+	for {
+		packet, err := readMQTTPacket(r)
+		if err != nil {
+			return
+		}
+		switch packet.Type {
+		case mqttPublish:
+			msg, err := decodePublish(packet)
+			if err != nil {
+				return
+			}
+			if msg.QoS == 1 {
+				ack := binary.BigEndian.AppendUint16(nil, msg.PacketID)
+				if client.write(&mqttPacket{Type: mqttPubAck, Body: ack}) != nil {
+					return
+				}
+			}
+			b.publish(msg.Topic, msg.Payload, msg.Retain)
+		case mqttSubscribe:
+			if err := b.handleSubscribe(client, packet); err != nil {
+				return
+			}
+		case mqttUnsubscribe:
+			if len(packet.Body) < 2 {
+				return
+			}
+			data := packet.Body[2:]
+			b.lock.Lock()
+			for len(data) > 0 {
+				var filter string
+				filter, data, err = readMQTTString(data)
+				if err != nil {
+					break
+				}
+				delete(client.filters, filter)
+			}
+			b.lock.Unlock()
+			ack := &mqttPacket{Type: mqttUnsubAck, Body: packet.Body[:2]}
+			if client.write(ack) != nil {
+				return
+			}
+		case mqttPingReq:
+			if client.write(&mqttPacket{Type: mqttPingResp}) != nil {
+				return
+			}
+		case mqttDisconnect:
+			graceful = true
+			return
+		}
+	}
+}
+
+func (b *Broker) handleSubscribe(client *brokerClient, packet *mqttPacket) error {
+	id, filters, err := decodeSubscribe(packet)
+	if err != nil {
+		return err
+	}
+	ack := binary.BigEndian.AppendUint16(nil, id)
+	for range filters {
+		ack = append(ack, 0)
+	}
+
+	b.lock.Lock()
+	var retained []*mqttPacket
+	for _, filter := range filters {
+		client.filters[filter] = true
+		for topic, payload := range b.retained {
+			if topicMatches(filter, topic) {
+				retained = append(retained, encodePublish(topic, payload, true))
+			}
+		}
+	}
+	b.lock.Unlock()
+
+	if err := client.write(&mqttPacket{Type: mqttSubAck, Body: ack}); err != nil {
+		return err
+	}
+	for _, p := range retained {
+		if err := client.write(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *Broker) publish(topic string, payload []byte, retain bool) {
+	b.lock.Lock()
+	if retain {
+		if len(payload) == 0 {
+			delete(b.retained, topic)
+		} else {
+			b.retained[topic] = payload
+		}
+	}
+	var targets []*brokerClient
+	for client := range b.clients {
+		for filter := range client.filters {
+			if topicMatches(filter, topic) {
+				targets = append(targets, client)
+				break
+			}
+		}
+	}
+	b.lock.Unlock()
+
+	packet := encodePublish(topic, payload, false)
+	for _, client := range targets {
+		client.write(packet)
+	}
+}
+
+func (c *brokerClient) decodeConnect(p *mqttPacket) error {
+	protocol, data, err := readMQTTString(p.Body)
+	if err != nil {
+		return err
+	}
+	if protocol != "MQTT" || len(data) < 4 || data[0] != 4 {
+		return errors.New("unsupported protocol version")
+	}
+	flags := data[1]
+	data = data[4:]
+	if c.clientID, data, err = readMQTTString(data); err != nil {
+		return err
+	}
+	if flags&4 != 0 {
+		var payload string
+		if c.willTopic, data, err = readMQTTString(data); err != nil {
+			return err
+		}
+		if payload, data, err = readMQTTString(data); err != nil {
+			return err
+		}
+		c.willPayload = []byte(payload)
+		c.willRetain = flags&0x20 != 0
+	}
+	if flags&0x80 != 0 {
+		if c.username, _, err = readMQTTString(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *brokerClient) write(p *mqttPacket) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	_, err := c.conn.Write(p.Encode())
+	return err
+}
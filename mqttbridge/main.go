@@ -0,0 +1,94 @@
+// Command mqttbridge publishes the state of C by GE devices to an MQTT broker
+// and applies commands received over MQTT, with optional Home Assistant
+// discovery.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log"
+	"time"
+
+	"github.com/unixpickle/cbyge"
+	"github.com/unixpickle/essentials"
+)
+
+func main() {
+	var email string
+	var password string
+	var sessInfo string
+	var mqttOpts MQTTOptions
+	var prefix string
+	var discoveryPrefix string
+	var pollInterval time.Duration
+	var embeddedBroker string
+	flag.StringVar(&email, "email", "", "C by GE account email")
+	flag.StringVar(&password, "password", "", "C by GE account password")
+	flag.StringVar(&sessInfo, "sessinfo", "", "Cync session info from 2FA login")
+	flag.StringVar(&mqttOpts.Addr, "broker", "", "MQTT broker address (host:port)")
+	flag.StringVar(&mqttOpts.ClientID, "client-id", "cbyge-bridge", "MQTT client ID")
+	flag.StringVar(&mqttOpts.Username, "mqtt-username", "", "MQTT user name")
+	flag.StringVar(&mqttOpts.Password, "mqtt-password", "", "MQTT password")
+	flag.StringVar(&prefix, "prefix", "cbyge", "root MQTT topic")
+	flag.StringVar(&discoveryPrefix, "discovery-prefix", "homeassistant",
+		"Home Assistant discovery prefix (empty to disable discovery)")
+	flag.DurationVar(&pollInterval, "poll", time.Second*30, "interval for polling device status")
+	flag.StringVar(&embeddedBroker, "embedded-broker", "",
+		"run a local MQTT broker on this address (for testing)")
+	flag.Parse()
+
+	if sessInfo == "" && (email == "" || password == "") {
+		essentials.Die("Must provide -email and -password flags, or the -sessinfo flag. See -help.")
+	}
+	if embeddedBroker != "" {
+		broker := NewBroker()
+		go func() {
+			essentials.Must(broker.ListenAndServe(embeddedBroker))
+		}()
+		if mqttOpts.Addr == "" {
+			mqttOpts.Addr = embeddedBroker
+		}
+	}
+	if mqttOpts.Addr == "" {
+		essentials.Die("Must provide -broker or -embedded-broker flag. See -help.")
+	}
+
+	var ctrl *cbyge.Controller
+	if sessInfo != "" {
+		var info cbyge.SessionInfo
+		if err := json.Unmarshal([]byte(sessInfo), &info); err != nil {
+			essentials.Die("Invalid -sessinfo argument: " + err.Error())
+		}
+		ctrl = cbyge.NewController(&info, 0)
+	} else {
+		var err error
+		ctrl, err = cbyge.NewControllerLogin(email, password)
+		essentials.Must(err)
+	}
+
+	devs, err := ctrl.Devices()
+	essentials.Must(err)
+	log.Printf("found %d devices", len(devs))
+
+	mqttOpts.WillTopic = prefix + "/bridge/availability"
+	mqttOpts.WillPayload = []byte("offline")
+	for {
+		client, err := DialMQTT(mqttOpts)
+		if err != nil {
+			log.Printf("failed to connect to broker: %s", err)
+			time.Sleep(time.Second * 10)
+			continue
+		}
+		log.Printf("connected to broker at %s", mqttOpts.Addr)
+		bridge := NewBridge(ctrl, client, prefix, discoveryPrefix)
+		if err := bridge.SetDevices(devs); err != nil {
+			log.Printf("failed to publish devices: %s", err)
+			client.Close()
+			time.Sleep(time.Second * 10)
+			continue
+		}
+		err = bridge.Run(pollInterval)
+		log.Printf("disconnected from broker: %s", err)
+		time.Sleep(time.Second)
+	}
+}
@@ -0,0 +1,449 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MQTT 3.1.1 control packet types.
+const (
+	mqttConnect     = 1
+	mqttConnAck     = 2
+	mqttPublish     = 3
+	mqttPubAck      = 4
+	mqttSubscribe   = 8
+	mqttSubAck      = 9
+	mqttUnsubscribe = 10
+	mqttUnsubAck    = 11
+	mqttPingReq     = 12
+	mqttPingResp    = 13
+	mqttDisconnect  = 14
+)
+
+const mqttMaxPacketSize = 1 << 20
+
+// mqttAckTimeout is how long to wait for the broker to acknowledge a
+// CONNECT or SUBSCRIBE.
+const mqttAckTimeout = time.Second * 10
+
+type mqttPacket struct {
+	Type  byte
+	Flags byte
+	Body  []byte
+}
+
+func readMQTTPacket(r *bufio.Reader) (*mqttPacket, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	length := 0
+	for i := 0; ; i++ {
+		if i == 4 {
+			return nil, errors.New("mqtt: malformed remaining length")
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		length |= int(b&0x7f) << (7 * i)
+		if b&0x80 == 0 {
+			break
+		}
+	}
+	if length > mqttMaxPacketSize {
+		return nil, errors.New("mqtt: packet is unreasonably large")
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	return &mqttPacket{Type: header >> 4, Flags: header & 0xf, Body: body}, nil
+}
+
+func (m *mqttPacket) Encode() []byte {
+	var buf bytes.Buffer
+	buf.WriteByte(m.Type<<4 | m.Flags)
+	length := len(m.Body)
+	for {
+		b := byte(length & 0x7f)
+		length >>= 7
+		if length > 0 {
+			b |= 0x80
+		}
+		buf.WriteByte(b)
+		if length == 0 {
+			break
+		}
+	}
+	buf.Write(m.Body)
+	return buf.Bytes()
+}
+
+func appendMQTTString(buf []byte, s string) []byte {
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(s)))
+	return append(buf, s...)
+}
+
+func readMQTTString(data []byte) (string, []byte, error) {
+	if len(data) < 2 {
+		return "", nil, errors.New("mqtt: string buffer underflow")
+	}
+	length := int(binary.BigEndian.Uint16(data))
+	if len(data) < 2+length {
+		return "", nil, errors.New("mqtt: string buffer underflow")
+	}
+	return string(data[2 : 2+length]), data[2+length:], nil
+}
+
+// A publishMessage is the decoded contents of a PUBLISH packet.
+type publishMessage struct {
+	Topic    string
+	Payload  []byte
+	QoS      byte
+	Retain   bool
+	PacketID uint16
+}
+
+func decodePublish(p *mqttPacket) (*publishMessage, error) {
+	topic, rest, err := readMQTTString(p.Body)
+	if err != nil {
+		return nil, err
+	}
+	msg := &publishMessage{
+		Topic:  topic,
+		QoS:    (p.Flags >> 1) & 3,
+		Retain: p.Flags&1 != 0,
+	}
+	if msg.QoS > 0 {
+		if len(rest) < 2 {
+			return nil, errors.New("mqtt: missing packet identifier")
+		}
+		msg.PacketID = binary.BigEndian.Uint16(rest)
+		rest = rest[2:]
+	}
+	msg.Payload = rest
+	return msg, nil
+}
+
+// encodeSubscribe creates a SUBSCRIBE packet for one filter at QoS 0.
+func encodeSubscribe(id uint16, filter string) *mqttPacket {
+	body := binary.BigEndian.AppendUint16(nil, id)
+	body = appendMQTTString(body, filter)
+	body = append(body, 0)
+	return &mqttPacket{Type: mqttSubscribe, Flags: 2, Body: body}
+}
+
+// decodeSubscribe gets the packet identifier and topic filters of a
+// SUBSCRIBE packet.
+func decodeSubscribe(p *mqttPacket) (uint16, []string, error) {
+	if len(p.Body) < 2 {
+		return 0, nil, errors.New("mqtt: missing packet identifier")
+	}
+	id := binary.BigEndian.Uint16(p.Body)
+	data := p.Body[2:]
+	var filters []string
+	for len(data) > 0 {
+		filter, rest, err := readMQTTString(data)
+		if err != nil || len(rest) < 1 {
+			return 0, nil, errors.New("mqtt: malformed subscription")
+		}
+		data = rest[1:]
+		filters = append(filters, filter)
+	}
+	if len(filters) == 0 {
+		return 0, nil, errors.New("mqtt: subscription has no topic filters")
+	}
+	return id, filters, nil
+}
+
+func encodePublish(topic string, payload []byte, retain bool) *mqttPacket {
+	var flags byte
+	if retain {
+		flags = 1
+	}
+	body := appendMQTTString(nil, topic)
+	body = append(body, payload...)
+	return &mqttPacket{Type: mqttPublish, Flags: flags, Body: body}
+}
+
+// topicMatches checks if an MQTT topic matches a subscription filter, which
+// may include the '+' and '#' wildcards.
+func topicMatches(filter, topic string) bool {
+	filterParts := strings.Split(filter, "/")
+	topicParts := strings.Split(topic, "/")
+	for i, f := range filterParts {
+		if f == "#" {
+			return true
+		}
+		if i >= len(topicParts) {
+			return false
+		}
+		if f != "+" && f != topicParts[i] {
+			return false
+		}
+	}
+	return len(filterParts) == len(topicParts)
+}
+
+// MQTTOptions configures an MQTTClient.
+type MQTTOptions struct {
+	Addr      string
+	ClientID  string
+	Username  string
+	Password  string
+	KeepAlive time.Duration
+
+	// If WillTopic is set, the broker publishes WillPayload (retained) to
+	// it when the client disconnects unexpectedly.
+	WillTopic   string
+	WillPayload []byte
+}
+
+// An MQTTClient is a minimal MQTT 3.1.1 client supporting QoS 0.
+type MQTTClient struct {
+	conn      net.Conn
+	reader    *bufio.Reader
+	keepAlive time.Duration
+
+	writeLock sync.Mutex
+	idLock    sync.Mutex
+	nextID    uint16
+	subAcks   map[uint16]chan []byte
+
+	// Received messages are buffered until Run() is called. The read error
+	// is set before messages is closed.
+	messages chan *publishMessage
+	readErr  error
+	readDone chan struct{}
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// DialMQTT connects to a broker and performs the CONNECT handshake.
+func DialMQTT(opts MQTTOptions) (*MQTTClient, error) {
+	conn, err := net.DialTimeout("tcp", opts.Addr, mqttAckTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if opts.KeepAlive == 0 {
+		opts.KeepAlive = time.Minute
+	}
+	c := &MQTTClient{
+		conn:      conn,
+		reader:    bufio.NewReader(conn),
+		keepAlive: opts.KeepAlive,
+		nextID:    1,
+		subAcks:   map[uint16]chan []byte{},
+		messages:  make(chan *publishMessage, 64),
+		readDone:  make(chan struct{}),
+		closed:    make(chan struct{}),
+	}
+
+	conn.SetDeadline(time.Now().Add(mqttAckTimeout))
+	if err := c.write(encodeConnect(opts)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp, err := readMQTTPacket(c.reader)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	if resp.Type != mqttConnAck || len(resp.Body) != 2 {
+		conn.Close()
+		return nil, errors.New("mqtt: unexpected response to CONNECT")
+	}
+	if resp.Body[1] != 0 {
+		conn.Close()
+		return nil, errors.New("mqtt: connection refused: " + connAckReason(resp.Body[1]))
+	}
+
+	go c.readLoop()
+	go c.pingLoop()
+	return c, nil
+}
+
+// encodeConnect creates the CONNECT packet for a set of options.
+func encodeConnect(opts MQTTOptions) *mqttPacket {
+	flags := byte(2) // Clean session
+	body := appendMQTTString(nil, "MQTT")
+	body = append(body, 4)
+	flagsIdx := len(body)
+	body = append(body, 0)
+	body = binary.BigEndian.AppendUint16(body, uint16(opts.KeepAlive/time.Second))
+	body = appendMQTTString(body, opts.ClientID)
+	if opts.WillTopic != "" {
+		flags |= 4 | 0x20 // Will flag, will retain
+		body = appendMQTTString(body, opts.WillTopic)
+		body = appendMQTTString(body, string(opts.WillPayload))
+	}
+	if opts.Username != "" {
+		flags |= 0x80
+		body = appendMQTTString(body, opts.Username)
+	}
+	if opts.Password != "" {
+		flags |= 0x40
+		body = appendMQTTString(body, opts.Password)
+	}
+	body[flagsIdx] = flags
+	return &mqttPacket{Type: mqttConnect, Body: body}
+}
+
+// Publish sends a QoS 0 message.
+func (c *MQTTClient) Publish(topic string, payload []byte, retain bool) error {
+	return c.write(encodePublish(topic, payload, retain))
+}
+
+// Subscribe subscribes to a topic filter at QoS 0, and waits for the broker
+// to acknowledge the subscription.
+//
+// Messages are delivered to the handler passed to Run().
+func (c *MQTTClient) Subscribe(filter string) error {
+	ack := make(chan []byte, 1)
+	c.idLock.Lock()
+	id := c.nextID
+	c.nextID++
+	if c.nextID == 0 {
+		c.nextID = 1
+	}
+	c.subAcks[id] = ack
+	c.idLock.Unlock()
+	defer func() {
+		c.idLock.Lock()
+		delete(c.subAcks, id)
+		c.idLock.Unlock()
+	}()
+
+	if err := c.write(encodeSubscribe(id, filter)); err != nil {
+		return err
+	}
+	select {
+	case codes := <-ack:
+		if len(codes) != 1 || codes[0] == 0x80 {
+			return errors.New("mqtt: subscription rejected by broker")
+		}
+		return nil
+	case <-c.readDone:
+		if c.readErr != nil {
+			return c.readErr
+		}
+		return errors.New("mqtt: connection closed")
+	case <-time.After(mqttAckTimeout):
+		return errors.New("mqtt: timeout waiting for SUBACK")
+	}
+}
+
+// Run calls handler for every received message, until the connection fails.
+func (c *MQTTClient) Run(handler func(topic string, payload []byte)) error {
+	defer c.Close()
+	for msg := range c.messages {
+		handler(msg.Topic, msg.Payload)
+	}
+	if c.readErr != nil {
+		return c.readErr
+	}
+	return errors.New("mqtt: connection closed")
+}
+
+func (c *MQTTClient) readLoop() {
+	defer close(c.readDone)
+	defer close(c.messages)
+	for {
+		packet, err := readMQTTPacket(c.reader)
+		if err != nil {
+			c.readErr = err
+			return
+		}
+		switch packet.Type {
+		case mqttPublish:
+			msg, err := decodePublish(packet)
+			if err != nil {
+				c.readErr = err
+				return
+			}
+			if msg.QoS == 1 {
+				ack := binary.BigEndian.AppendUint16(nil, msg.PacketID)
+				if err := c.write(&mqttPacket{Type: mqttPubAck, Body: ack}); err != nil {
+					c.readErr = err
+					return
+				}
+			}
+			select {
+			case c.messages <- msg:
+			case <-c.closed:
+				return
+			}
+		case mqttSubAck:
+			if len(packet.Body) < 2 {
+				c.readErr = errors.New("mqtt: malformed SUBACK")
+				return
+			}
+			c.idLock.Lock()
+			ack, ok := c.subAcks[binary.BigEndian.Uint16(packet.Body)]
+			c.idLock.Unlock()
+			if ok {
+				ack <- packet.Body[2:]
+			}
+		}
+	}
+}
+
+// Close disconnects from the broker.
+func (c *MQTTClient) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.write(&mqttPacket{Type: mqttDisconnect})
+		err = c.conn.Close()
+	})
+	return err
+}
+
+func (c *MQTTClient) write(p *mqttPacket) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	_, err := c.conn.Write(p.Encode())
+	return err
+}
+
+func (c *MQTTClient) pingLoop() {
+	ticker := time.NewTicker(c.keepAlive / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if c.write(&mqttPacket{Type: mqttPingReq}) != nil {
+				c.Close()
+				return
+			}
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+func connAckReason(code byte) string {
+	switch code {
+	case 1:
+		return "unacceptable protocol version"
+	case 2:
+		return "identifier rejected"
+	case 3:
+		return "server unavailable"
+	case 4:
+		return "bad user name or password"
+	case 5:
+		return "not authorized"
+	}
+	return "unknown error"
+}
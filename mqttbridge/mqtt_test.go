@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMQTTPacketEncoding(t *testing.T) {
+	for _, size := range []int{0, 1, 127, 128, 16383, 16384, 100000} {
+		packet := &mqttPacket{Type: mqttPublish, Flags: 3, Body: bytes.Repeat([]byte{7}, size)}
+		decoded, err := readMQTTPacket(bufio.NewReader(bytes.NewReader(packet.Encode())))
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		if !reflect.DeepEqual(decoded, packet) && !(size == 0 && len(decoded.Body) == 0) {
+			t.Errorf("size %d: packet changed after decoding", size)
+		}
+	}
+}
+
+func TestConnectRoundTrip(t *testing.T) {
+	testCases := []struct {
+		name string
+		opts MQTTOptions
+	}{
+		{
+			name: "Minimal",
+			opts: MQTTOptions{ClientID: "cbyge", KeepAlive: time.Minute},
+		},
+		{
+			name: "WillAndCredentials",
+			opts: MQTTOptions{
+				ClientID:    "bridge",
+				Username:    "user",
+				Password:    "pass",
+				KeepAlive:   time.Second * 30,
+				WillTopic:   "cbyge/bridge/availability",
+				WillPayload: []byte("offline"),
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			packet := roundTrip(t, encodeConnect(tc.opts))
+			if packet.Type != mqttConnect {
+				t.Fatalf("unexpected type: %d", packet.Type)
+			}
+			var client brokerClient
+			if err := client.decodeConnect(packet); err != nil {
+				t.Fatal(err)
+			}
+			if client.clientID != tc.opts.ClientID || client.username != tc.opts.Username {
+				t.Errorf("unexpected client ID %q or username %q", client.clientID, client.username)
+			}
+			if client.willTopic != tc.opts.WillTopic ||
+				string(client.willPayload) != string(tc.opts.WillPayload) ||
+				client.willRetain != (tc.opts.WillTopic != "") {
+				t.Errorf("unexpected will: %q %q %v", client.willTopic, client.willPayload,
+					client.willRetain)
+			}
+		})
+	}
+}
+
+func TestPublishRoundTrip(t *testing.T) {
+	testCases := []struct {
+		name    string
+		topic   string
+		payload []byte
+		retain  bool
+	}{
+		{"Empty", "a/b", nil, false},
+		{"Retained", "cbyge/123/state", []byte(`{"state":"ON"}`), true},
+		{"Large", "x", bytes.Repeat([]byte("z"), 70000), false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			msg, err := decodePublish(roundTrip(t, encodePublish(tc.topic, tc.payload, tc.retain)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if msg.Topic != tc.topic || !bytes.Equal(msg.Payload, tc.payload) ||
+				msg.Retain != tc.retain || msg.QoS != 0 {
+				t.Errorf("unexpected message: %+v", msg)
+			}
+		})
+	}
+}
+
+func TestSubscribeRoundTrip(t *testing.T) {
+	for _, filter := range []string{"cbyge/+/set", "#", "a/b/c"} {
+		id, filters, err := decodeSubscribe(roundTrip(t, encodeSubscribe(1234, filter)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id != 1234 || !reflect.DeepEqual(filters, []string{filter}) {
+			t.Errorf("unexpected subscription: %d %v", id, filters)
+		}
+	}
+	for _, body := range [][]byte{{}, {0, 1}, {0, 1, 0, 5, 'a'}, {0, 1, 0, 1, 'a'}} {
+		if _, _, err := decodeSubscribe(&mqttPacket{Type: mqttSubscribe, Body: body}); err == nil {
+			t.Errorf("expected error for body %v", body)
+		}
+	}
+}
+
+func TestTopicMatches(t *testing.T) {
+	testCases := []struct {
+		filter string
+		topic  string
+		match  bool
+	}{
+		{"a/b", "a/b", true},
+		{"a/b", "a/c", false},
+		{"a/+", "a/b", true},
+		{"a/+", "a/b/c", false},
+		{"a/#", "a/b/c", true},
+		{"#", "a", true},
+		{"a/+/c", "a/b/c", true},
+		{"a/b/c", "a/b", false},
+	}
+	for _, tc := range testCases {
+		if topicMatches(tc.filter, tc.topic) != tc.match {
+			t.Errorf("filter %s, topic %s: expected %v", tc.filter, tc.topic, tc.match)
+		}
+	}
+}
+
+func TestBrokerLoopback(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go NewBroker().Serve(listener)
+	addr := listener.Addr().String()
+
+	publisher, err := DialMQTT(MQTTOptions{
+		Addr:        addr,
+		ClientID:    "publisher",
+		WillTopic:   "bridge/availability",
+		WillPayload: []byte("offline"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer publisher.Close()
+
+	// A retained message which is delivered on subscription.
+	if err := publisher.Publish("dev/1/state", []byte("ON"), true); err != nil {
+		t.Fatal(err)
+	}
+
+	subscriber, err := DialMQTT(MQTTOptions{Addr: addr, ClientID: "subscriber"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer subscriber.Close()
+	for _, filter := range []string{"dev/+/state", "bridge/#"} {
+		if err := subscriber.Subscribe(filter); err != nil {
+			t.Fatal(err)
+		}
+	}
+	messages := make(chan string, 16)
+	go subscriber.Run(func(topic string, payload []byte) {
+		messages <- topic + "=" + string(payload)
+	})
+
+	expectMessage := func(expected string) {
+		select {
+		case msg := <-messages:
+			if msg != expected {
+				t.Fatalf("expected %s but got %s", expected, msg)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatalf("timeout waiting for %s", expected)
+		}
+	}
+	expectMessage("dev/1/state=ON")
+
+	// Subscriptions are in place once Subscribe() returns.
+	if err := publisher.Publish("other/topic", []byte("ignored"), false); err != nil {
+		t.Fatal(err)
+	}
+	if err := publisher.Publish("dev/2/state", []byte("OFF"), false); err != nil {
+		t.Fatal(err)
+	}
+	expectMessage("dev/2/state=OFF")
+
+	// An unexpected disconnect publishes the will.
+	publisher.conn.Close()
+	expectMessage("bridge/availability=offline")
+
+	select {
+	case msg := <-messages:
+		t.Fatalf("unexpected message: %s", msg)
+	default:
+	}
+}
+
+func TestSubscribeClosed(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		// Accept the connection, but close it after CONNACK.
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		readMQTTPacket(bufio.NewReader(conn))
+		conn.Write((&mqttPacket{Type: mqttConnAck, Body: []byte{0, 0}}).Encode())
+		conn.Close()
+	}()
+	client, err := DialMQTT(MQTTOptions{Addr: listener.Addr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if err := client.Subscribe("a/b"); err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func roundTrip(t *testing.T, p *mqttPacket) *mqttPacket {
+	res, err := readMQTTPacket(bufio.NewReader(bytes.NewReader(p.Encode())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
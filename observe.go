@@ -0,0 +1,258 @@
+package cbyge
+
+import (
+	"sync"
+	"time"
+)
+
+// A LogLevel indicates the severity of an Event.
+type LogLevel int
+
+const (
+	LogLevelDebug LogLevel = iota
+	LogLevelInfo
+	LogLevelWarn
+	LogLevelError
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LogLevelDebug:
+		return "debug"
+	case LogLevelInfo:
+		return "info"
+	case LogLevelWarn:
+		return "warn"
+	case LogLevelError:
+		return "error"
+	}
+	return "unknown"
+}
+
+// An EventKind identifies what an Event describes.
+type EventKind string
+
+const (
+	EventConnect        EventKind = "connect"
+	EventAuth           EventKind = "auth"
+	EventPacketSend     EventKind = "packet_send"
+	EventPacketReceive  EventKind = "packet_receive"
+	EventSwitchFailover EventKind = "switch_failover"
+	EventTimeout        EventKind = "timeout"
+)
+
+// An Attr is a key-value pair attached to an Event or a Span.
+type Attr struct {
+	Key   string
+	Value interface{}
+}
+
+// An Event is a structured log record emitted by a Controller or a
+// PacketConn.
+type Event struct {
+	Time    time.Time
+	Level   LogLevel
+	Kind    EventKind
+	Message string
+	Err     error
+	Attrs   []Attr
+}
+
+// A Logger receives structured events.
+//
+// Implementations must be safe to call from multiple goroutines.
+type Logger interface {
+	Log(e *Event)
+}
+
+// A LoggerFunc is a Logger implemented by a function.
+type LoggerFunc func(e *Event)
+
+// Log calls l(e).
+func (l LoggerFunc) Log(e *Event) {
+	l(e)
+}
+
+// A Tracer creates spans which describe the lifetime of high-level operations,
+// such as a Controller call.
+//
+// Implementations must be safe to call from multiple goroutines.
+type Tracer interface {
+	StartSpan(name string, attrs ...Attr) Span
+}
+
+// A Span is a single traced operation created by a Tracer.
+type Span interface {
+	SetAttrs(attrs ...Attr)
+	AddEvent(name string, attrs ...Attr)
+
+	// End finishes the span, recording the error (if any) which caused the
+	// operation to fail.
+	End(err error)
+}
+
+type noopSpan struct{}
+
+func (n noopSpan) SetAttrs(attrs ...Attr)              {}
+func (n noopSpan) AddEvent(name string, attrs ...Attr) {}
+func (n noopSpan) End(err error)                       {}
+
+// A SpanRecord is a finished span recorded by a MemoryTracer.
+type SpanRecord struct {
+	Name   string
+	Start  time.Time
+	End    time.Time
+	Attrs  []Attr
+	Events []SpanEvent
+	Err    error
+}
+
+// Duration gets the amount of time the span was running.
+func (s *SpanRecord) Duration() time.Duration {
+	return s.End.Sub(s.Start)
+}
+
+// Attr looks up the last value of an attribute, or returns nil if the
+// attribute was not set.
+func (s *SpanRecord) Attr(key string) interface{} {
+	var res interface{}
+	for _, a := range s.Attrs {
+		if a.Key == key {
+			res = a.Value
+		}
+	}
+	return res
+}
+
+// A SpanEvent is a timestamped annotation on a SpanRecord.
+type SpanEvent struct {
+	Name  string
+	Time  time.Time
+	Attrs []Attr
+}
+
+// A MemoryTracer is a Tracer which keeps finished spans in memory.
+//
+// This is useful for tests and debugging, where spans can be inspected after
+// running some Controller operations.
+type MemoryTracer struct {
+	lock  sync.Mutex
+	spans []SpanRecord
+}
+
+// NewMemoryTracer creates an empty MemoryTracer.
+func NewMemoryTracer() *MemoryTracer {
+	return &MemoryTracer{}
+}
+
+// StartSpan creates a new span which is recorded once it ends.
+func (m *MemoryTracer) StartSpan(name string, attrs ...Attr) Span {
+	return &memorySpan{
+		tracer: m,
+		record: SpanRecord{
+			Name:  name,
+			Start: time.Now(),
+			Attrs: append([]Attr{}, attrs...),
+		},
+	}
+}
+
+// Spans gets all of the finished spans, in the order they ended.
+func (m *MemoryTracer) Spans() []SpanRecord {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return append([]SpanRecord{}, m.spans...)
+}
+
+// Reset removes all of the recorded spans.
+func (m *MemoryTracer) Reset() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.spans = nil
+}
+
+type memorySpan struct {
+	tracer *MemoryTracer
+	lock   sync.Mutex
+	record SpanRecord
+	ended  bool
+}
+
+func (m *memorySpan) SetAttrs(attrs ...Attr) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.record.Attrs = append(m.record.Attrs, attrs...)
+}
+
+func (m *memorySpan) AddEvent(name string, attrs ...Attr) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.record.Events = append(m.record.Events, SpanEvent{
+		Name:  name,
+		Time:  time.Now(),
+		Attrs: append([]Attr{}, attrs...),
+	})
+}
+
+func (m *memorySpan) End(err error) {
+	m.lock.Lock()
+	if m.ended {
+		m.lock.Unlock()
+		return
+	}
+	m.ended = true
+	m.record.End = time.Now()
+	m.record.Err = err
+	record := m.record
+	m.lock.Unlock()
+
+	m.tracer.lock.Lock()
+	m.tracer.spans = append(m.tracer.spans, record)
+	m.tracer.lock.Unlock()
+}
+
+// MultiLogger creates a Logger which forwards every event to all of the
+// given loggers.
+func MultiLogger(loggers ...Logger) Logger {
+	return LoggerFunc(func(e *Event) {
+		for _, l := range loggers {
+			l.Log(e)
+		}
+	})
+}
+
+// MultiTracer creates a Tracer which creates a span on every one of the given
+// tracers, and forwards all span updates to each of them.
+func MultiTracer(tracers ...Tracer) Tracer {
+	return multiTracer(tracers)
+}
+
+type multiTracer []Tracer
+
+func (m multiTracer) StartSpan(name string, attrs ...Attr) Span {
+	spans := make(multiSpan, len(m))
+	for i, t := range m {
+		spans[i] = t.StartSpan(name, attrs...)
+	}
+	return spans
+}
+
+type multiSpan []Span
+
+func (m multiSpan) SetAttrs(attrs ...Attr) {
+	for _, s := range m {
+		s.SetAttrs(attrs...)
+	}
+}
+
+func (m multiSpan) AddEvent(name string, attrs ...Attr) {
+	for _, s := range m {
+		s.AddEvent(name, attrs...)
+	}
+}
+
+func (m multiSpan) End(err error) {
+	for _, s := range m {
+		s.End(err)
+	}
+}
@@ -0,0 +1,274 @@
+package cbyge
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestControllerObservability(t *testing.T) {
+	setLum := func(c *Controller, d *ControllerDevice) error {
+		return c.SetDeviceLumAsync(d, 50)
+	}
+	getStatus := func(c *Controller, d *ControllerDevice) error {
+		_, err := c.DeviceStatus(d)
+		return err
+	}
+	testCases := []struct {
+		name       string
+		call       func(c *Controller, d *ControllerDevice) error
+		server     *fakeServer
+		wantSpan   string
+		wantErr    error
+		wantEvents []EventKind
+		wantSpanEv []string
+	}{
+		{
+			name:       "SetLum",
+			call:       setLum,
+			server:     &fakeServer{Respond: respondStatus(0)},
+			wantSpan:   "SetDeviceLum",
+			wantEvents: []EventKind{EventConnect, EventAuth},
+			wantSpanEv: []string{"connect", "auth", "sent", "receive"},
+		},
+		{
+			name:       "SetLumRemoteError",
+			call:       setLum,
+			server:     &fakeServer{Respond: respondStatus(1)},
+			wantSpan:   "SetDeviceLum",
+			wantErr:    RemoteCallError,
+			wantEvents: []EventKind{EventConnect, EventAuth, EventSwitchFailover},
+			wantSpanEv: []string{"connect", "auth", "sent"},
+		},
+		{
+			name:       "SetLumTimeout",
+			call:       setLum,
+			server:     &fakeServer{},
+			wantSpan:   "SetDeviceLum",
+			wantErr:    TimeoutError,
+			wantEvents: []EventKind{EventConnect, EventAuth, EventTimeout, EventSwitchFailover},
+			wantSpanEv: []string{"connect", "auth", "sent", "timeout"},
+		},
+		{
+			name:       "AuthRejected",
+			call:       setLum,
+			server:     &fakeServer{RejectAuth: true},
+			wantSpan:   "SetDeviceLum",
+			wantEvents: []EventKind{EventConnect, EventAuth, EventSwitchFailover},
+			wantSpanEv: []string{"connect"},
+		},
+		{
+			name:       "DeviceStatus",
+			call:       getStatus,
+			server:     &fakeServer{Respond: respondDeviceStatus},
+			wantSpan:   "DeviceStatus",
+			wantEvents: []EventKind{EventConnect, EventAuth},
+			wantSpanEv: []string{"connect", "auth", "sent", "receive"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctrl, dev := testController(tc.server)
+			tracer := NewMemoryTracer()
+			logger := &eventRecorder{}
+			ctrl.SetTracer(tracer)
+			ctrl.SetLogger(logger)
+
+			err := tc.call(ctrl, dev)
+			if tc.wantErr != nil && !errors.Is(err, tc.wantErr) {
+				t.Fatalf("expected error %v but got %v", tc.wantErr, err)
+			} else if tc.server.RejectAuth && err == nil {
+				t.Fatal("expected an authentication error")
+			} else if tc.wantErr == nil && !tc.server.RejectAuth && err != nil {
+				t.Fatal(err)
+			}
+
+			if kinds := logger.Kinds(LogLevelInfo); !reflect.DeepEqual(kinds, tc.wantEvents) {
+				t.Errorf("expected events %v but got %v", tc.wantEvents, kinds)
+			}
+			if logger.Count(EventPacketSend) == 0 || (err == nil && logger.Count(EventPacketReceive) == 0) {
+				t.Error("missing packet events")
+			}
+
+			spans := tracer.Spans()
+			if len(spans) != 1 {
+				t.Fatalf("expected 1 span but got %d", len(spans))
+			}
+			span := spans[0]
+			if span.Name != tc.wantSpan {
+				t.Errorf("expected span %s but got %s", tc.wantSpan, span.Name)
+			}
+			if span.Attr("device") != dev.DeviceID() {
+				t.Errorf("unexpected device attribute: %v", span.Attr("device"))
+			}
+			if (span.Err == nil) != (err == nil) {
+				t.Errorf("span error %v does not match %v", span.Err, err)
+			}
+			var spanEvents []string
+			for _, e := range span.Events {
+				spanEvents = append(spanEvents, e.Name)
+			}
+			if !reflect.DeepEqual(spanEvents, tc.wantSpanEv) {
+				t.Errorf("expected span events %v but got %v", tc.wantSpanEv, spanEvents)
+			}
+		})
+	}
+}
+
+func TestMemoryTracer(t *testing.T) {
+	tracer1 := NewMemoryTracer()
+	tracer2 := NewMemoryTracer()
+	span := MultiTracer(tracer1, tracer2).StartSpan("op", Attr{"a", 1})
+	span.SetAttrs(Attr{"a", 2}, Attr{"b", "x"})
+	span.AddEvent("step", Attr{"n", 3})
+	testErr := errors.New("failed")
+	span.End(testErr)
+	span.End(nil)
+
+	for _, tracer := range []*MemoryTracer{tracer1, tracer2} {
+		spans := tracer.Spans()
+		if len(spans) != 1 {
+			t.Fatalf("expected 1 span but got %d", len(spans))
+		}
+		s := spans[0]
+		if s.Name != "op" || s.Err != testErr || s.Duration() < 0 {
+			t.Errorf("unexpected span: %+v", s)
+		}
+		if s.Attr("a") != 2 || s.Attr("b") != "x" || s.Attr("c") != nil {
+			t.Errorf("unexpected attributes: %v", s.Attrs)
+		}
+		if len(s.Events) != 1 || s.Events[0].Name != "step" {
+			t.Errorf("unexpected events: %v", s.Events)
+		}
+		tracer.Reset()
+		if len(tracer.Spans()) != 0 {
+			t.Error("spans remain after reset")
+		}
+	}
+}
+
+func TestMultiLogger(t *testing.T) {
+	l1, l2 := &eventRecorder{}, &eventRecorder{}
+	MultiLogger(l1, l2).Log(&Event{Level: LogLevelWarn, Kind: EventTimeout})
+	for _, l := range []*eventRecorder{l1, l2} {
+		if kinds := l.Kinds(LogLevelDebug); !reflect.DeepEqual(kinds, []EventKind{EventTimeout}) {
+			t.Errorf("unexpected events: %v", kinds)
+		}
+	}
+}
+
+// testController creates a Controller which talks to a fake server, along
+// with a device that is reachable through one switch.
+func testController(server *fakeServer) (*Controller, *ControllerDevice) {
+	ctrl := NewController(&SessionInfo{UserID: 5, Authorize: "code"}, time.Millisecond*100)
+	ctrl.dial = server.Dial
+	dev := &ControllerDevice{deviceID: "1000003", switchID: 0x1234, name: "Lamp"}
+	ctrl.switches[dev.deviceID] = []uint32{0x1234}
+	return ctrl, dev
+}
+
+// A fakeServer answers a Controller's connections over in-memory pipes.
+type fakeServer struct {
+	// RejectAuth causes authentication to fail.
+	RejectAuth bool
+
+	// Respond creates the responses to each non-auth packet.
+	Respond func(p *Packet) []*Packet
+}
+
+func (f *fakeServer) Dial() (*PacketConn, error) {
+	client, server := net.Pipe()
+	go f.serve(NewPacketConnWrap(server))
+	return NewPacketConnWrap(client), nil
+}
+
+func (f *fakeServer) serve(conn *PacketConn) {
+	defer conn.Close()
+	for {
+		packet, err := conn.Read()
+		if err != nil {
+			return
+		}
+		var responses []*Packet
+		if packet.Type == PacketTypeAuth {
+			result := []byte{0, 0}
+			if f.RejectAuth {
+				result = []byte{0, 1}
+			}
+			responses = []*Packet{{Type: PacketTypeAuth, IsResponse: true, Data: result}}
+		} else if f.Respond != nil {
+			responses = f.Respond(packet)
+		}
+		for _, r := range responses {
+			if conn.Write(r) != nil {
+				return
+			}
+		}
+	}
+}
+
+// respondStatus creates a function which answers pipe requests with a
+// response packet that has the given status code.
+func respondStatus(status byte) func(p *Packet) []*Packet {
+	return func(p *Packet) []*Packet {
+		data := append(append([]byte{}, p.Data[:6]...), status)
+		return []*Packet{{Type: PacketTypePipe, IsResponse: true, Data: data}}
+	}
+}
+
+// respondDeviceStatus answers a paginated status request with the status of
+// device index 3.
+func respondDeviceStatus(p *Packet) []*Packet {
+	seq, _ := p.Seq()
+	record := make([]byte, 24)
+	record[1] = 3
+	record[9] = 1
+	record[13] = 50
+	payload := append(make([]byte, 6), record...)
+	res := NewPacketPipe(binary.BigEndian.Uint32(p.Data), seq, PacketPipeTypeGetStatusPaginated,
+		payload)
+	res.IsResponse = true
+	return []*Packet{res}
+}
+
+// An eventRecorder is a Logger which keeps every event.
+type eventRecorder struct {
+	lock   sync.Mutex
+	events []*Event
+}
+
+func (e *eventRecorder) Log(event *Event) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.events = append(e.events, event)
+}
+
+// Kinds gets the kinds of the events at or above a level.
+func (e *eventRecorder) Kinds(minLevel LogLevel) []EventKind {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	var res []EventKind
+	for _, event := range e.events {
+		if event.Level >= minLevel {
+			res = append(res, event.Kind)
+		}
+	}
+	return res
+}
+
+// Count counts the events of a kind.
+func (e *eventRecorder) Count(kind EventKind) int {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	var res int
+	for _, event := range e.events {
+		if event.Kind == kind {
+			res++
+		}
+	}
+	return res
+}
@@ -38,6 +38,15 @@ func (p *Packet) Seq() (uint16, error) {
 	return binary.BigEndian.Uint16(p.Data[4:6]), nil
 }
 
+// SetSeq changes the sequence number of a pipe packet.
+func (p *Packet) SetSeq(seq uint16) error {
+	if p.Type != PacketTypePipe || len(p.Data) < 6 {
+		return errors.New("packet has no seq number")
+	}
+	binary.BigEndian.PutUint16(p.Data[4:6], seq)
+	return nil
+}
+
 // NewPacketPipe creates a "pipe buffer" packet with a given subtype.
 func NewPacketPipe(deviceID uint32, seq uint16, subtype uint8, data []byte) *Packet {
 	if len(data) > 0xff {
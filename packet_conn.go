@@ -2,6 +2,7 @@ package cbyge
 
 import (
 	"bytes"
+	"crypto/tls"
 	"io"
 	"net"
 	"time"
@@ -13,16 +14,28 @@ const DefaultPacketConnHost = "cm.gelighting.com:23778"
 const PacketConnTimeout = time.Second * 10
 
 type PacketConn struct {
-	conn net.Conn
+	conn   net.Conn
+	logger Logger
 }
 
 // NewPacketConn creates a PacketConn connected to the default server.
 func NewPacketConn() (*PacketConn, error) {
-	remoteAddr, err := net.ResolveTCPAddr("tcp", DefaultPacketConnHost)
-	if err != nil {
-		return nil, err
+	return NewPacketConnAddr(DefaultPacketConnHost, nil)
+}
+
+// NewPacketConnAddr creates a PacketConn connected to the server at addr,
+// such as a proxy or a local test server.
+//
+// If tlsConfig is non-nil, the connection uses TLS.
+func NewPacketConnAddr(addr string, tlsConfig *tls.Config) (*PacketConn, error) {
+	dialer := &net.Dialer{Timeout: PacketConnTimeout}
+	var conn net.Conn
+	var err error
+	if tlsConfig != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
 	}
-	conn, err := net.DialTimeout("tcp", remoteAddr.String(), PacketConnTimeout)
 	if err != nil {
 		return nil, err
 	}
@@ -34,6 +47,14 @@ func NewPacketConnWrap(conn net.Conn) *PacketConn {
 	return &PacketConn{conn: conn}
 }
 
+// SetLogger sets a Logger which receives events for every packet sent or
+// received on the connection.
+//
+// This should be called before the connection is used.
+func (p *PacketConn) SetLogger(l Logger) {
+	p.logger = l
+}
+
 func (p *PacketConn) Read() (*Packet, error) {
 	header := make([]byte, 5)
 	_, err := io.ReadFull(p.conn, header)
@@ -42,7 +63,7 @@ func (p *PacketConn) Read() (*Packet, error) {
 	}
 	typeByte := header[0]
 	length := (int(header[1]) << 24) | (int(header[2]) << 16) | (int(header[3]) << 8) | int(header[4])
-	if length > 0x100000 {
+	if length > maxPacketLength {
 		return nil, errors.New("packet is unreasonably large")
 	}
 	data := make([]byte, length)
@@ -50,14 +71,17 @@ func (p *PacketConn) Read() (*Packet, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &Packet{
+	packet := &Packet{
 		Type:       typeByte >> 4,
 		IsResponse: (typeByte & 8) != 0,
 		Data:       data,
-	}, nil
+	}
+	p.logPacket(EventPacketReceive, "received packet", packet)
+	return packet, nil
 }
 
 func (p *PacketConn) Write(packet *Packet) error {
+	p.logPacket(EventPacketSend, "sending packet", packet)
 	data := packet.Encode()
 	for len(data) > 0 {
 		n, err := p.conn.Write(data)
@@ -96,6 +120,26 @@ func (p *PacketConn) Auth(userId uint32, code string, timeout time.Duration) err
 		Type: PacketTypeAuth,
 		Data: data.Bytes(),
 	}
+	err := p.auth(packet)
+	if p.logger != nil {
+		e := &Event{
+			Time:    time.Now(),
+			Level:   LogLevelInfo,
+			Kind:    EventAuth,
+			Message: "authenticated",
+			Attrs:   []Attr{{"user_id", userId}},
+		}
+		if err != nil {
+			e.Level = LogLevelError
+			e.Message = "authentication failed"
+			e.Err = err
+		}
+		p.logger.Log(e)
+	}
+	return err
+}
+
+func (p *PacketConn) auth(packet *Packet) error {
 	if err := p.Write(packet); err != nil {
 		return errors.Wrap(err, "authenticate")
 	}
@@ -111,3 +155,25 @@ func (p *PacketConn) Auth(userId uint32, code string, timeout time.Duration) err
 	}
 	return nil
 }
+
+func (p *PacketConn) logPacket(kind EventKind, msg string, packet *Packet) {
+	if p.logger == nil {
+		return
+	}
+	attrs := []Attr{
+		{"type", packet.Type},
+		{"response", packet.IsResponse},
+		{"length", len(packet.Data)},
+	}
+	if seq, err := packet.Seq(); err == nil {
+		attrs = append(attrs, Attr{"seq", seq})
+	}
+	attrs = append(attrs, Attr{"packet", packet.String()})
+	p.logger.Log(&Event{
+		Time:    time.Now(),
+		Level:   LogLevelDebug,
+		Kind:    kind,
+		Message: msg,
+		Attrs:   attrs,
+	})
+}
@@ -0,0 +1,258 @@
+package cbyge
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// PacketConnPort is the TCP port that the C by GE server listens on.
+const PacketConnPort = 23778
+
+const (
+	pcapngBlockSHB  = 0x0a0d0d0a
+	pcapngBlockIDB  = 1
+	pcapngBlockSPB  = 3
+	pcapngBlockEPB  = 6
+	pcapngByteOrder = 0x1a2b3c4d
+
+	linkTypeNull     = 0
+	linkTypeEthernet = 1
+	linkTypeRaw      = 101
+	linkTypeLinuxSLL = 113
+	linkTypeIPv4     = 228
+	linkTypeIPv6     = 229
+
+	tcpFlagFIN = 0x01
+	tcpFlagSYN = 0x02
+	tcpFlagRST = 0x04
+	tcpFlagPSH = 0x08
+	tcpFlagACK = 0x10
+
+	pcapMaxSegment = 1460
+)
+
+var (
+	pcapClientIP  = net.IPv4(10, 0, 0, 2).To4()
+	pcapServerIP  = net.IPv4(10, 0, 0, 1).To4()
+	pcapClientMAC = []byte{0x02, 0, 0, 0, 0, 2}
+	pcapServerMAC = []byte{0x02, 0, 0, 0, 0, 1}
+)
+
+// A PcapngWriter writes packets to a pcapng file which can be opened in
+// Wireshark.
+//
+// Since the packets are captured above the TCP layer, the writer synthesizes
+// Ethernet, IPv4 and TCP headers for them. Each connection ID becomes a TCP
+// stream between 10.0.0.2 and port 23778 of 10.0.0.1, with a handshake
+// before its first packet.
+//
+// It is safe to call methods on a PcapngWriter from multiple Goroutines.
+type PcapngWriter struct {
+	lock  sync.Mutex
+	w     io.Writer
+	conns map[int]*pcapngConn
+}
+
+type pcapngConn struct {
+	clientPort uint16
+	clientSeq  uint32
+	serverSeq  uint32
+}
+
+// NewPcapngWriter writes the pcapng header and returns a writer for the
+// packets.
+func NewPcapngWriter(w io.Writer) (*PcapngWriter, error) {
+	var shb []byte
+	shb = binary.LittleEndian.AppendUint32(shb, pcapngByteOrder)
+	shb = binary.LittleEndian.AppendUint16(shb, 1)
+	shb = binary.LittleEndian.AppendUint16(shb, 0)
+	shb = binary.LittleEndian.AppendUint64(shb, 0xffffffffffffffff)
+	if err := writePcapngBlock(w, pcapngBlockSHB, shb); err != nil {
+		return nil, err
+	}
+
+	var idb []byte
+	idb = binary.LittleEndian.AppendUint16(idb, linkTypeEthernet)
+	idb = binary.LittleEndian.AppendUint16(idb, 0)
+	idb = binary.LittleEndian.AppendUint32(idb, 0)
+	if err := writePcapngBlock(w, pcapngBlockIDB, idb); err != nil {
+		return nil, err
+	}
+	return &PcapngWriter{w: w, conns: map[int]*pcapngConn{}}, nil
+}
+
+// WritePacket writes a packet sent in the given direction (CaptureIn or
+// CaptureOut) on a connection.
+func (p *PcapngWriter) WritePacket(t time.Time, connID int, direction string, packet *Packet) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	conn, err := p.conn(t, connID)
+	if err != nil {
+		return err
+	}
+	data := packet.Encode()
+	for len(data) > 0 {
+		n := len(data)
+		if n > pcapMaxSegment {
+			n = pcapMaxSegment
+		}
+		if err := p.writeSegment(t, conn, direction == CaptureIn, tcpFlagPSH|tcpFlagACK, data[:n]); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+// WriteRecord writes the packet from a capture record.
+func (p *PcapngWriter) WriteRecord(r *CaptureRecord) error {
+	return p.WritePacket(r.Time, r.ConnID, r.Direction, r.Packet())
+}
+
+// CloseConn writes the end of a connection's TCP stream.
+func (p *PcapngWriter) CloseConn(t time.Time, connID int) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	conn, ok := p.conns[connID]
+	if !ok {
+		return nil
+	}
+	delete(p.conns, connID)
+	if err := p.writeSegment(t, conn, true, tcpFlagFIN|tcpFlagACK, nil); err != nil {
+		return err
+	}
+	conn.clientSeq++
+	if err := p.writeSegment(t, conn, false, tcpFlagFIN|tcpFlagACK, nil); err != nil {
+		return err
+	}
+	conn.serverSeq++
+	return p.writeSegment(t, conn, true, tcpFlagACK, nil)
+}
+
+func (p *PcapngWriter) conn(t time.Time, connID int) (*pcapngConn, error) {
+	if conn, ok := p.conns[connID]; ok {
+		return conn, nil
+	}
+	conn := &pcapngConn{
+		clientPort: uint16(40000 + connID%20000),
+		clientSeq:  1000,
+		serverSeq:  5000,
+	}
+	p.conns[connID] = conn
+
+	// Three-way handshake, so that Wireshark sees a complete stream.
+	if err := p.writeSegment(t, conn, true, tcpFlagSYN, nil); err != nil {
+		return nil, err
+	}
+	conn.clientSeq++
+	if err := p.writeSegment(t, conn, false, tcpFlagSYN|tcpFlagACK, nil); err != nil {
+		return nil, err
+	}
+	conn.serverSeq++
+	if err := p.writeSegment(t, conn, true, tcpFlagACK, nil); err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (p *PcapngWriter) writeSegment(t time.Time, conn *pcapngConn, fromClient bool,
+	flags uint8, payload []byte) error {
+	srcIP, dstIP := pcapServerIP, pcapClientIP
+	srcMAC, dstMAC := pcapServerMAC, pcapClientMAC
+	srcPort, dstPort := uint16(PacketConnPort), conn.clientPort
+	seq, ack := &conn.serverSeq, conn.clientSeq
+	if fromClient {
+		srcIP, dstIP = dstIP, srcIP
+		srcMAC, dstMAC = dstMAC, srcMAC
+		srcPort, dstPort = dstPort, srcPort
+		seq, ack = &conn.clientSeq, conn.serverSeq
+	}
+	if flags&tcpFlagSYN != 0 && flags&tcpFlagACK == 0 {
+		ack = 0
+	}
+
+	tcp := make([]byte, 20, 20+len(payload))
+	binary.BigEndian.PutUint16(tcp[0:], srcPort)
+	binary.BigEndian.PutUint16(tcp[2:], dstPort)
+	binary.BigEndian.PutUint32(tcp[4:], *seq)
+	binary.BigEndian.PutUint32(tcp[8:], ack)
+	tcp[12] = 5 << 4
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:], 0xffff)
+	tcp = append(tcp, payload...)
+	binary.BigEndian.PutUint16(tcp[16:], tcpChecksum(srcIP, dstIP, tcp))
+	*seq += uint32(len(payload))
+
+	ip := make([]byte, 20, 20+len(tcp))
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:], uint16(20+len(tcp)))
+	ip[6] = 0x40 // Don't fragment
+	ip[8] = 64
+	ip[9] = 6
+	copy(ip[12:], srcIP)
+	copy(ip[16:], dstIP)
+	binary.BigEndian.PutUint16(ip[10:], internetChecksum(ip, 0))
+	ip = append(ip, tcp...)
+
+	frame := make([]byte, 0, 14+len(ip))
+	frame = append(frame, dstMAC...)
+	frame = append(frame, srcMAC...)
+	frame = append(frame, 0x08, 0x00)
+	frame = append(frame, ip...)
+
+	micros := uint64(t.UnixNano() / 1000)
+	var epb []byte
+	epb = binary.LittleEndian.AppendUint32(epb, 0)
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(micros>>32))
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(micros))
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(len(frame)))
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(len(frame)))
+	epb = append(epb, frame...)
+	return writePcapngBlock(p.w, pcapngBlockEPB, epb)
+}
+
+func writePcapngBlock(w io.Writer, blockType uint32, body []byte) error {
+	for len(body)%4 != 0 {
+		body = append(body, 0)
+	}
+	length := uint32(12 + len(body))
+	var block []byte
+	block = binary.LittleEndian.AppendUint32(block, blockType)
+	block = binary.LittleEndian.AppendUint32(block, length)
+	block = append(block, body...)
+	block = binary.LittleEndian.AppendUint32(block, length)
+	if _, err := w.Write(block); err != nil {
+		return errors.Wrap(err, "write pcapng")
+	}
+	return nil
+}
+
+func tcpChecksum(srcIP, dstIP net.IP, segment []byte) uint16 {
+	var sum uint32
+	for _, ip := range []net.IP{srcIP, dstIP} {
+		for i := 0; i+1 < len(ip); i += 2 {
+			sum += uint32(ip[i])<<8 | uint32(ip[i+1])
+		}
+	}
+	sum += 6
+	sum += uint32(len(segment))
+	return internetChecksum(segment, sum)
+}
+
+func internetChecksum(data []byte, sum uint32) uint16 {
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint32(data[i])<<8 | uint32(data[i+1])
+	}
+	if len(data)%2 == 1 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return ^uint16(sum)
+}
@@ -0,0 +1,420 @@
+package cbyge
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const maxPacketLength = 0x100000
+
+// ReadPcap reads a pcap or pcapng file (such as one written by tcpdump or
+// Wireshark), reassembles the TCP streams to the given server port, and
+// decodes the streams into packets.
+//
+// If port is 0, PacketConnPort is used. Each TCP connection is given its own
+// ConnID, in the order that connections appear. Packets sent to the port
+// have the direction CaptureIn, and packets sent from it have the direction
+// CaptureOut.
+//
+// If a stream cannot be decoded, for example because the capture started in
+// the middle of a packet, the rest of that stream is skipped.
+func ReadPcap(r io.Reader, port int) ([]*CaptureRecord, error) {
+	if port == 0 {
+		port = PacketConnPort
+	}
+	reassembler := &tcpReassembler{port: uint16(port), flows: map[string]*tcpFlow{}}
+	if err := readPcapFrames(bufio.NewReader(r), reassembler.addFrame); err != nil {
+		return nil, errors.Wrap(err, "read pcap")
+	}
+	return reassembler.records, nil
+}
+
+// ReadPcapFile is like ReadPcap, but reads from a file.
+func ReadPcapFile(path string, port int) ([]*CaptureRecord, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "read pcap")
+	}
+	defer f.Close()
+	return ReadPcap(f, port)
+}
+
+type frameFunc func(t time.Time, linkType int, frame []byte)
+
+func readPcapFrames(r *bufio.Reader, f frameFunc) error {
+	magic, err := r.Peek(4)
+	if err != nil {
+		return err
+	}
+	if binary.LittleEndian.Uint32(magic) == pcapngBlockSHB {
+		return readPcapngFrames(r, f)
+	}
+	return readClassicPcapFrames(r, f)
+}
+
+func readClassicPcapFrames(r io.Reader, f frameFunc) error {
+	header := make([]byte, 24)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return err
+	}
+	var order binary.ByteOrder
+	var nanos bool
+	switch binary.LittleEndian.Uint32(header) {
+	case 0xa1b2c3d4:
+		order = binary.LittleEndian
+	case 0xa1b23c4d:
+		order, nanos = binary.LittleEndian, true
+	case 0xd4c3b2a1:
+		order = binary.BigEndian
+	case 0x4d3cb2a1:
+		order, nanos = binary.BigEndian, true
+	default:
+		return errors.New("unknown file format")
+	}
+	linkType := int(order.Uint32(header[20:]) & 0xffff)
+
+	recordHeader := make([]byte, 16)
+	for {
+		if _, err := io.ReadFull(r, recordHeader); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		sec := int64(order.Uint32(recordHeader))
+		frac := int64(order.Uint32(recordHeader[4:]))
+		length := order.Uint32(recordHeader[8:])
+		if length > maxPacketLength {
+			return errors.New("frame is unreasonably large")
+		}
+		frame := make([]byte, length)
+		if _, err := io.ReadFull(r, frame); err != nil {
+			return err
+		}
+		if !nanos {
+			frac *= 1000
+		}
+		f(time.Unix(sec, frac), linkType, frame)
+	}
+}
+
+type pcapngInterface struct {
+	linkType int
+	// Timestamp units per second.
+	resolution uint64
+}
+
+func readPcapngFrames(r io.Reader, f frameFunc) error {
+	var order binary.ByteOrder = binary.LittleEndian
+	var interfaces []pcapngInterface
+	for {
+		header := make([]byte, 8)
+		if _, err := io.ReadFull(r, header); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		blockType := order.Uint32(header)
+		if blockType == pcapngBlockSHB {
+			// The byte order of a section is given by the byte-order magic,
+			// which follows the block length.
+			bom := make([]byte, 4)
+			if _, err := io.ReadFull(r, bom); err != nil {
+				return err
+			}
+			if binary.BigEndian.Uint32(bom) == pcapngByteOrder {
+				order = binary.BigEndian
+			} else {
+				order = binary.LittleEndian
+			}
+			interfaces = nil
+			header = append(header, bom...)
+		}
+		length := order.Uint32(header[4:])
+		if length < uint32(len(header))+4 || length > maxPacketLength+64 {
+			return errors.New("invalid pcapng block length")
+		}
+		body := make([]byte, int(length)-len(header))
+		if _, err := io.ReadFull(r, body); err != nil {
+			return err
+		}
+		body = body[:len(body)-4]
+
+		switch blockType {
+		case pcapngBlockIDB:
+			if len(body) < 8 {
+				return errors.New("invalid interface description block")
+			}
+			iface := pcapngInterface{
+				linkType:   int(order.Uint16(body)),
+				resolution: pcapngResolution(order, body[8:]),
+			}
+			interfaces = append(interfaces, iface)
+		case pcapngBlockEPB:
+			if len(body) < 20 {
+				return errors.New("invalid enhanced packet block")
+			}
+			ifaceID := int(order.Uint32(body))
+			if ifaceID >= len(interfaces) {
+				return errors.New("packet block refers to unknown interface")
+			}
+			iface := interfaces[ifaceID]
+			ts := uint64(order.Uint32(body[4:]))<<32 | uint64(order.Uint32(body[8:]))
+			capLen := int(order.Uint32(body[12:]))
+			if capLen > len(body)-20 {
+				return errors.New("invalid enhanced packet block")
+			}
+			sec := ts / iface.resolution
+			nanos := (ts % iface.resolution) * 1e9 / iface.resolution
+			f(time.Unix(int64(sec), int64(nanos)), iface.linkType, body[20:20+capLen])
+		case pcapngBlockSPB:
+			if len(interfaces) == 0 || len(body) < 4 {
+				return errors.New("invalid simple packet block")
+			}
+			origLen := int(order.Uint32(body))
+			frame := body[4:]
+			if origLen < len(frame) {
+				frame = frame[:origLen]
+			}
+			f(time.Time{}, interfaces[0].linkType, frame)
+		}
+	}
+}
+
+// pcapngResolution reads the if_tsresol option of an interface, which
+// defaults to microseconds.
+func pcapngResolution(order binary.ByteOrder, options []byte) uint64 {
+	for len(options) >= 4 {
+		code := order.Uint16(options)
+		length := int(order.Uint16(options[2:]))
+		if len(options) < 4+length {
+			break
+		}
+		if code == 9 && length >= 1 {
+			value := options[4]
+			res := uint64(1)
+			for i := 0; i < int(value&0x7f); i++ {
+				if value&0x80 != 0 {
+					res *= 2
+				} else {
+					res *= 10
+				}
+			}
+			return res
+		} else if code == 0 {
+			break
+		}
+		options = options[4+(length+3)/4*4:]
+	}
+	return 1000000
+}
+
+type tcpReassembler struct {
+	port    uint16
+	flows   map[string]*tcpFlow
+	nextID  int
+	records []*CaptureRecord
+}
+
+type tcpFlow struct {
+	connID  int
+	hasData bool
+	streams [2]tcpStream
+}
+
+type tcpStream struct {
+	started bool
+	broken  bool
+	next    uint32
+	pending map[uint32][]byte
+	buf     []byte
+}
+
+func (t *tcpReassembler) addFrame(ts time.Time, linkType int, frame []byte) {
+	srcIP, dstIP, segment, ok := decodeIPFrame(linkType, frame)
+	if !ok || len(segment) < 20 {
+		return
+	}
+	srcPort := binary.BigEndian.Uint16(segment)
+	dstPort := binary.BigEndian.Uint16(segment[2:])
+	seq := binary.BigEndian.Uint32(segment[4:])
+	dataOffset := int(segment[12]>>4) * 4
+	flags := segment[13]
+	if dataOffset < 20 || dataOffset > len(segment) {
+		return
+	}
+	payload := segment[dataOffset:]
+
+	var direction int
+	var key string
+	if dstPort == t.port {
+		direction = 0
+		key = fmt.Sprintf("%s:%d-%s", srcIP, srcPort, dstIP)
+	} else if srcPort == t.port {
+		direction = 1
+		key = fmt.Sprintf("%s:%d-%s", dstIP, dstPort, srcIP)
+	} else {
+		return
+	}
+
+	flow := t.flows[key]
+	if flow == nil || (flags&tcpFlagSYN != 0 && flags&tcpFlagACK == 0 && flow.hasData) {
+		flow = &tcpFlow{connID: t.nextID}
+		t.nextID++
+		t.flows[key] = flow
+	}
+	stream := &flow.streams[direction]
+	if flags&tcpFlagSYN != 0 {
+		stream.started = true
+		stream.next = seq + 1
+		stream.pending = map[uint32][]byte{}
+		return
+	}
+	if len(payload) == 0 || stream.broken {
+		return
+	}
+	if !stream.started {
+		// The capture began after the handshake.
+		stream.started = true
+		stream.next = seq
+		stream.pending = map[uint32][]byte{}
+	}
+	flow.hasData = true
+	stream.add(seq, payload)
+
+	dirName := CaptureIn
+	if direction == 1 {
+		dirName = CaptureOut
+	}
+	for !stream.broken {
+		packet, n, err := parsePacket(stream.buf)
+		if err != nil {
+			stream.broken = true
+			stream.buf = nil
+			break
+		} else if packet == nil {
+			break
+		}
+		stream.buf = stream.buf[n:]
+		record := NewCaptureRecord(flow.connID, dirName, packet)
+		record.Time = ts
+		t.records = append(t.records, record)
+	}
+}
+
+// add adds a segment to the stream, buffering it if it arrived out of order
+// and trimming data that was retransmitted.
+func (t *tcpStream) add(seq uint32, payload []byte) {
+	if int32(seq-t.next) > 0 {
+		t.pending[seq] = append([]byte{}, payload...)
+		return
+	}
+	t.appendSegment(seq, payload)
+	for progress := true; progress; {
+		progress = false
+		for pendingSeq, data := range t.pending {
+			if int32(pendingSeq-t.next) <= 0 {
+				delete(t.pending, pendingSeq)
+				t.appendSegment(pendingSeq, data)
+				progress = true
+			}
+		}
+	}
+}
+
+func (t *tcpStream) appendSegment(seq uint32, payload []byte) {
+	overlap := t.next - seq
+	if int(overlap) >= len(payload) {
+		return
+	}
+	payload = payload[overlap:]
+	t.buf = append(t.buf, payload...)
+	t.next += uint32(len(payload))
+}
+
+// parsePacket decodes a packet from the start of a buffer, returning the
+// packet and its encoded size. If the buffer does not contain a full packet,
+// it returns nil with no error.
+func parsePacket(buf []byte) (*Packet, int, error) {
+	if len(buf) < 5 {
+		return nil, 0, nil
+	}
+	length := int(binary.BigEndian.Uint32(buf[1:5]))
+	if length > maxPacketLength {
+		return nil, 0, errors.New("packet is unreasonably large")
+	}
+	if len(buf) < 5+length {
+		return nil, 0, nil
+	}
+	return &Packet{
+		Type:       buf[0] >> 4,
+		IsResponse: buf[0]&8 != 0,
+		Data:       append([]byte{}, buf[5:5+length]...),
+	}, 5 + length, nil
+}
+
+// decodeIPFrame extracts the addresses and TCP segment from a link-layer
+// frame, returning false if it is not an unfragmented TCP packet.
+func decodeIPFrame(linkType int, frame []byte) (src, dst net.IP, segment []byte, ok bool) {
+	switch linkType {
+	case linkTypeEthernet:
+		if len(frame) < 14 {
+			return
+		}
+		etherType := binary.BigEndian.Uint16(frame[12:])
+		frame = frame[14:]
+		for etherType == 0x8100 && len(frame) >= 4 {
+			etherType = binary.BigEndian.Uint16(frame[2:])
+			frame = frame[4:]
+		}
+		if etherType != 0x0800 && etherType != 0x86dd {
+			return
+		}
+	case linkTypeNull:
+		if len(frame) < 4 {
+			return
+		}
+		frame = frame[4:]
+	case linkTypeLinuxSLL:
+		if len(frame) < 16 {
+			return
+		}
+		frame = frame[16:]
+	case linkTypeRaw, linkTypeIPv4, linkTypeIPv6:
+	default:
+		return
+	}
+	if len(frame) < 1 {
+		return
+	}
+	switch frame[0] >> 4 {
+	case 4:
+		if len(frame) < 20 {
+			return
+		}
+		headerLen := int(frame[0]&0xf) * 4
+		totalLen := int(binary.BigEndian.Uint16(frame[2:]))
+		fragment := binary.BigEndian.Uint16(frame[6:])
+		if frame[9] != 6 || fragment&0x3fff != 0 || headerLen < 20 ||
+			totalLen < headerLen || totalLen > len(frame) {
+			return
+		}
+		return net.IP(frame[12:16]), net.IP(frame[16:20]), frame[headerLen:totalLen], true
+	case 6:
+		if len(frame) < 40 || frame[6] != 6 {
+			return
+		}
+		payloadLen := int(binary.BigEndian.Uint16(frame[4:]))
+		if 40+payloadLen > len(frame) {
+			return
+		}
+		return net.IP(frame[8:24]), net.IP(frame[24:40]), frame[40 : 40+payloadLen], true
+	}
+	return
+}
@@ -0,0 +1,274 @@
+package cbyge
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+//go:generate go run ./cmd/gen-dissector -output wireshark/cbyge.lua
+
+// A FieldKind determines how a ProtocolField is interpreted.
+type FieldKind int
+
+const (
+	FieldUint FieldKind = iota
+	FieldBytes
+	FieldString
+)
+
+// A ProtocolField describes a field in a packet, at a fixed offset in the
+// structure that contains it.
+type ProtocolField struct {
+	// Name is a short identifier, such as "seq".
+	Name  string
+	Label string
+	Kind  FieldKind
+
+	// Offset is relative to the start of the enclosing structure, or to its
+	// end if negative.
+	Offset int
+
+	// Size is the size in bytes. If it is 0, the field extends to the end of
+	// the enclosing structure, unless SizeField is set, in which case the size
+	// is the value of the earlier field named by SizeField.
+	Size      int
+	SizeField string
+
+	// Hex indicates that integers are best displayed in hexadecimal.
+	Hex bool
+
+	// Values optionally names the values of an integer field.
+	Values map[uint64]string
+
+	// Quiet fields, such as lengths and credentials, are left out of
+	// summaries.
+	Quiet bool
+
+	// If WhenField is set, the field is only present if the earlier field
+	// named WhenField has the value WhenValue.
+	WhenField string
+	WhenValue uint64
+}
+
+// A ProtocolPacketType describes the data of a top-level packet type.
+type ProtocolPacketType struct {
+	Type     uint8
+	Name     string
+	Request  []ProtocolField
+	Response []ProtocolField
+}
+
+// A ProtocolPipeType describes the payload of a pipe packet subtype.
+type ProtocolPipeType struct {
+	Subtype  uint8
+	Name     string
+	Request  []ProtocolField
+	Response []ProtocolField
+
+	// ResponseRecords optionally describes a list of records in the response
+	// payload.
+	ResponseRecords *ProtocolRecords
+}
+
+// ProtocolRecords describes a list of fixed-size records which extends to
+// the end of a payload.
+type ProtocolRecords struct {
+	Name   string
+	Offset int
+	Size   int
+	Fields []ProtocolField
+}
+
+// A ProtocolDescription describes the packet format, as far as it is known.
+//
+// This is the single source of truth for tools which decode packets, such
+// as the generated Wireshark dissector (see cmd/gen-dissector).
+type ProtocolDescription struct {
+	Port int
+
+	// Each packet starts with a header of HeaderSize bytes: the type in the
+	// top four bits of the first byte, a response flag in ResponseFlag, and a
+	// big-endian data length in the remaining four bytes.
+	HeaderSize   int
+	ResponseFlag uint8
+
+	PacketTypes []ProtocolPacketType
+
+	// Pipe packets of at least PipeHeaderSize bytes begin with PipeHeader,
+	// which includes "subtype" and "payload_length" fields, followed by a
+	// subtype-specific payload at PipePayloadOffset. Shorter pipe responses
+	// are acknowledgements described by PipeAck.
+	PipeHeaderSize    int
+	PipeHeader        []ProtocolField
+	PipePayloadOffset int
+	PipeAck           []ProtocolField
+	PipeTypes         []ProtocolPipeType
+}
+
+// PacketType finds the description of a packet type, or returns nil.
+func (p *ProtocolDescription) PacketType(t uint8) *ProtocolPacketType {
+	for i, x := range p.PacketTypes {
+		if x.Type == t {
+			return &p.PacketTypes[i]
+		}
+	}
+	return nil
+}
+
+// PipeType finds the description of a pipe subtype, or returns nil.
+func (p *ProtocolDescription) PipeType(subtype uint8) *ProtocolPipeType {
+	for i, x := range p.PipeTypes {
+		if x.Subtype == subtype {
+			return &p.PipeTypes[i]
+		}
+	}
+	return nil
+}
+
+// PacketTypeName gets the name of a packet type, such as "pipe".
+func (p *ProtocolDescription) PacketTypeName(t uint8) string {
+	if x := p.PacketType(t); x != nil {
+		return x.Name
+	}
+	return fmt.Sprintf("type_%d", t)
+}
+
+// PipeTypeName gets the name of a pipe subtype, such as "set_lum".
+func (p *ProtocolDescription) PipeTypeName(subtype uint8) string {
+	if x := p.PipeType(subtype); x != nil {
+		return x.Name
+	}
+	return fmt.Sprintf("0x%02x", subtype)
+}
+
+// ParsePacketType parses a packet type given by name, as returned by
+// PacketTypeName, or by number (in decimal or with a 0x prefix).
+func (p *ProtocolDescription) ParsePacketType(s string) (uint8, error) {
+	if n, err := strconv.ParseUint(strings.TrimPrefix(s, "type_"), 0, 8); err == nil {
+		return uint8(n), nil
+	}
+	for _, x := range p.PacketTypes {
+		if x.Name == s {
+			return x.Type, nil
+		}
+	}
+	return 0, errors.New("unknown packet type: " + s)
+}
+
+// ParsePipeType parses a pipe subtype given by name, as returned by
+// PipeTypeName, or by number (in decimal or with a 0x prefix).
+func (p *ProtocolDescription) ParsePipeType(s string) (uint8, error) {
+	if n, err := strconv.ParseUint(s, 0, 8); err == nil {
+		return uint8(n), nil
+	}
+	for _, x := range p.PipeTypes {
+		if x.Name == s {
+			return x.Subtype, nil
+		}
+	}
+	return 0, errors.New("unknown pipe subtype: " + s)
+}
+
+// deviceIndexField is the device index in the payload of pipe commands.
+var deviceIndexField = ProtocolField{
+	Name:   "device",
+	Label:  "Device index",
+	Offset: 5,
+	Size:   2,
+}
+
+// Protocol describes the packets sent to and from the C by GE server.
+var Protocol = &ProtocolDescription{
+	Port:         PacketConnPort,
+	HeaderSize:   5,
+	ResponseFlag: 8,
+	PacketTypes: []ProtocolPacketType{
+		{
+			Type: PacketTypeAuth,
+			Name: "auth",
+			Request: []ProtocolField{
+				{Name: "user_id", Label: "User ID", Offset: 1, Size: 4},
+				{Name: "code_length", Label: "Authorize code length", Offset: 6, Size: 1,
+					Quiet: true},
+				{Name: "code", Label: "Authorize code", Kind: FieldString, Offset: 7,
+					SizeField: "code_length", Quiet: true},
+			},
+			Response: []ProtocolField{
+				{Name: "status", Label: "Status", Offset: 0, Size: 2,
+					Values: map[uint64]string{0: "ok"}},
+			},
+		},
+		{Type: PacketTypeSync, Name: "sync"},
+		{Type: PacketTypePipe, Name: "pipe"},
+		{Type: PacketTypePipeSync, Name: "pipe_sync"},
+	},
+	PipeHeaderSize: 15,
+	PipeHeader: []ProtocolField{
+		{Name: "switch_id", Label: "Switch ID", Offset: 0, Size: 4, Hex: true},
+		{Name: "seq", Label: "Sequence number", Offset: 4, Size: 2},
+		{Name: "marker", Label: "Marker", Offset: 7, Size: 1, Hex: true, Quiet: true},
+		{Name: "subtype", Label: "Subtype", Offset: 13, Size: 1, Hex: true, Quiet: true},
+		{Name: "payload_length", Label: "Payload length", Offset: 14, Size: 1, Quiet: true},
+	},
+	PipePayloadOffset: 15,
+	PipeAck: []ProtocolField{
+		{Name: "switch_id", Label: "Switch ID", Offset: 0, Size: 4, Hex: true},
+		{Name: "seq", Label: "Sequence number", Offset: 4, Size: 2},
+		{Name: "status", Label: "Status", Offset: -1, Size: 1,
+			Values: map[uint64]string{0: "ok"}},
+	},
+	PipeTypes: []ProtocolPipeType{
+		{
+			Subtype: PacketPipeTypeSetStatus,
+			Name:    "set_status",
+			Request: []ProtocolField{
+				deviceIndexField,
+				{Name: "on", Label: "On", Offset: 11, Size: 1,
+					Values: map[uint64]string{0: "off", 1: "on"}},
+			},
+		},
+		{
+			Subtype: PacketPipeTypeSetLum,
+			Name:    "set_lum",
+			Request: []ProtocolField{
+				deviceIndexField,
+				{Name: "brightness", Label: "Brightness", Offset: 11, Size: 1},
+			},
+		},
+		{
+			Subtype: PacketPipeTypeSetCT,
+			Name:    "set_ct",
+			Request: []ProtocolField{
+				deviceIndexField,
+				{Name: "mode", Label: "Mode", Offset: 11, Size: 1,
+					Values: map[uint64]string{4: "rgb", 5: "tone"}},
+				{Name: "color_tone", Label: "Color tone", Offset: 12, Size: 1,
+					WhenField: "mode", WhenValue: 5},
+				{Name: "rgb", Label: "RGB", Kind: FieldBytes, Offset: 12, Size: 3,
+					WhenField: "mode", WhenValue: 4},
+			},
+		},
+		{Subtype: PacketPipeTypeGetStatus, Name: "get_status"},
+		{
+			Subtype: PacketPipeTypeGetStatusPaginated,
+			Name:    "get_status_paginated",
+			ResponseRecords: &ProtocolRecords{
+				Name:   "status",
+				Offset: 6,
+				Size:   24,
+				Fields: []ProtocolField{
+					{Name: "device", Label: "Device index", Offset: 1, Size: 1},
+					{Name: "on", Label: "On", Offset: 9, Size: 1,
+						Values: map[uint64]string{0: "off", 1: "on"}},
+					{Name: "brightness", Label: "Brightness", Offset: 13, Size: 1},
+					{Name: "color_tone", Label: "Color tone", Offset: 17, Size: 1,
+						Values: map[uint64]string{0xfe: "rgb"}},
+					{Name: "rgb", Label: "RGB", Kind: FieldBytes, Offset: 21, Size: 3},
+				},
+			},
+		},
+	},
+}
@@ -0,0 +1,48 @@
+package cbyge
+
+import "testing"
+
+func TestProtocolParseNames(t *testing.T) {
+	for i := 0; i < 0x100; i++ {
+		if x, err := Protocol.ParsePacketType(Protocol.PacketTypeName(uint8(i))); err != nil {
+			t.Fatal(err)
+		} else if x != uint8(i) {
+			t.Errorf("packet type %d parsed as %d", i, x)
+		}
+		if x, err := Protocol.ParsePipeType(Protocol.PipeTypeName(uint8(i))); err != nil {
+			t.Fatal(err)
+		} else if x != uint8(i) {
+			t.Errorf("pipe subtype %d parsed as %d", i, x)
+		}
+	}
+
+	testCases := []struct {
+		name    string
+		parse   func(string) (uint8, error)
+		s       string
+		value   uint8
+		invalid bool
+	}{
+		{"PacketName", Protocol.ParsePacketType, "pipe", PacketTypePipe, false},
+		{"PacketNumber", Protocol.ParsePacketType, "7", 7, false},
+		{"PacketHex", Protocol.ParsePacketType, "0xd", 0xd, false},
+		{"PacketUnknown", Protocol.ParsePacketType, "set_lum", 0, true},
+		{"PacketTooLarge", Protocol.ParsePacketType, "256", 0, true},
+		{"PipeName", Protocol.ParsePipeType, "set_lum", 0xd2, false},
+		{"PipeHex", Protocol.ParsePipeType, "0x52", 0x52, false},
+		{"PipeUnknown", Protocol.ParsePipeType, "pipe", 0, true},
+		{"PipeEmpty", Protocol.ParsePipeType, "", 0, true},
+	}
+	for _, tc := range testCases {
+		value, err := tc.parse(tc.s)
+		if tc.invalid {
+			if err == nil {
+				t.Errorf("%s: expected an error", tc.name)
+			}
+		} else if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+		} else if value != tc.value {
+			t.Errorf("%s: expected %d but got %d", tc.name, tc.value, value)
+		}
+	}
+}
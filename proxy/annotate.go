@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/unixpickle/cbyge"
+)
+
+const (
+	colorReset = "\x1b[0m"
+	colorIn    = "\x1b[36m"
+	colorOut   = "\x1b[32m"
+	colorError = "\x1b[31m"
+	colorRaw   = "\x1b[2m"
+)
+
+// A PacketFilter matches packets by type, pipe subtype and device, to decide
+// which packets are logged or rewritten.
+//
+// Empty lists match every packet.
+type PacketFilter struct {
+	Types    []uint8
+	Subtypes []uint8
+	Devices  []int
+}
+
+// ParsePacketFilter creates a filter from comma-separated lists of packet
+// types, pipe subtypes and device indices. Types and subtypes may be given by
+// name (e.g. "pipe" or "set_lum") or number (e.g. "7" or "0xd2").
+func ParsePacketFilter(types, subtypes, devices string) (*PacketFilter, error) {
+	res := &PacketFilter{}
+	for _, name := range splitList(types) {
+		t, err := cbyge.Protocol.ParsePacketType(name)
+		if err != nil {
+			return nil, errors.Wrap(err, "parse type filter")
+		}
+		res.Types = append(res.Types, t)
+	}
+	for _, name := range splitList(subtypes) {
+		t, err := cbyge.Protocol.ParsePipeType(name)
+		if err != nil {
+			return nil, errors.Wrap(err, "parse subtype filter")
+		}
+		res.Subtypes = append(res.Subtypes, t)
+	}
+	for _, s := range splitList(devices) {
+		device, err := strconv.Atoi(s)
+		if err != nil {
+			return nil, errors.Wrap(err, "parse device filter")
+		}
+		res.Devices = append(res.Devices, device)
+	}
+	return res, nil
+}
+
+// Matches checks if a decoded packet should be logged.
+func (l *PacketFilter) Matches(d *cbyge.DecodedPacket) bool {
+	if len(l.Types) > 0 && !containsUint8(l.Types, d.Type) {
+		return false
+	}
+	if len(l.Subtypes) > 0 && (!d.IsPipeCommand || !containsUint8(l.Subtypes, d.Subtype)) {
+		return false
+	}
+	if len(l.Devices) > 0 {
+		for _, device := range d.Devices() {
+			for _, x := range l.Devices {
+				if x == device {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// A PacketLogger logs decoded packets which match a filter.
+type PacketLogger struct {
+	Filter *PacketFilter
+
+	// Color enables ANSI colors: one for each direction, and another for
+	// responses with an error status.
+	Color bool
+
+	// Raw includes the hex data of each packet.
+	Raw bool
+}
+
+// Log logs a packet if it matches the filter.
+func (p *PacketLogger) Log(connID int, direction string, packet *cbyge.Packet) {
+	d := cbyge.DecodePacket(packet)
+	if p.Filter != nil && !p.Filter.Matches(d) {
+		return
+	}
+	color := colorOut
+	if d.Failed() {
+		color = colorError
+	} else if direction == cbyge.CaptureIn {
+		color = colorIn
+	}
+	line := p.colorize(color, fmt.Sprintf("conn=%d direction=%s %s", connID, direction, d))
+	if p.Raw {
+		line += "\n  " + p.colorize(colorRaw, packet.String())
+	}
+	log.Print(line)
+}
+
+// Note logs a message about a connection.
+func (p *PacketLogger) Note(connID int, format string, args ...interface{}) {
+	log.Printf("conn=%d: %s", connID, fmt.Sprintf(format, args...))
+}
+
+func (p *PacketLogger) colorize(color, s string) string {
+	if !p.Color {
+		return s
+	}
+	return color + s + colorReset
+}
+
+func splitList(s string) []string {
+	var res []string
+	for _, x := range strings.Split(s, ",") {
+		if x = strings.TrimSpace(x); x != "" {
+			res = append(res, x)
+		}
+	}
+	return res
+}
+
+func containsUint8(list []uint8, x uint8) bool {
+	for _, y := range list {
+		if y == x {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/binary"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/unixpickle/cbyge"
+)
+
+// A proxyConn is a connection which is being forwarded by a Proxy.
+type proxyConn struct {
+	ID         int
+	RemoteAddr string
+	Created    time.Time
+
+	proxy   *Proxy
+	client  *cbyge.PacketConn
+	server  *cbyge.PacketConn
+	capture *cbyge.CaptureWriter
+
+	// Writes are serialized so that injected packets are never interleaved
+	// with forwarded ones.
+	clientLock sync.Mutex
+	serverLock sync.Mutex
+
+	// When renumbering is enabled, pipe requests from the client are sent to
+	// the server with our own sequence numbers, so that injected requests
+	// never collide with the client's.
+	seqLock sync.Mutex
+	nextSeq uint16
+	hasSeq  bool
+	seqs    map[uint16]seqOrigin
+
+	// lastSwitch is the switch ID of the client's latest pipe request.
+	lastSwitch uint32
+	hasSwitch  bool
+
+	reportOnce sync.Once
+}
+
+// seqOrigin records where a pipe request sent to the server came from.
+type seqOrigin struct {
+	ClientSeq uint16
+	Injected  bool
+}
+
+// Forward reads packets from one side of the connection and sends them to
+// the other, until either side is closed.
+func (c *proxyConn) Forward(direction string) {
+	source, dest := c.client, c.server
+	if direction == cbyge.CaptureOut {
+		source, dest = c.server, c.client
+	}
+	defer dest.Close()
+	for {
+		packet, err := source.Read()
+		if err != nil {
+			return
+		}
+		keep, err := Rewrite(c.proxy.Rules, direction, packet)
+		if err != nil {
+			c.proxy.Logger.Note(c.ID, "%v", err)
+		}
+		if !keep {
+			c.proxy.Logger.Note(c.ID, "dropped packet: %s", cbyge.SummarizePacket(packet))
+			continue
+		}
+		if c.proxy.Renumber && direction == cbyge.CaptureIn {
+			c.renumberRequest(packet, false)
+		}
+		// Captures always use the server's sequence numbers.
+		c.record(direction, packet)
+		if c.proxy.Renumber && direction == cbyge.CaptureOut && !c.restoreSeq(packet) {
+			c.proxy.Logger.Note(c.ID, "not forwarding response to injected packet")
+			continue
+		}
+		if c.write(direction, packet) != nil {
+			return
+		}
+	}
+}
+
+// Inject sends a packet in the given direction, as if it came from the
+// client ("in") or the server ("out").
+//
+// Pipe requests sent to the server are given a fresh sequence number when
+// renumbering is enabled, and the responses are not forwarded to the client.
+func (c *proxyConn) Inject(direction string, packet *cbyge.Packet) error {
+	if direction == cbyge.CaptureIn && c.proxy.Renumber {
+		c.renumberRequest(packet, true)
+	}
+	c.proxy.Logger.Note(c.ID, "injecting packet")
+	c.record(direction, packet)
+	return c.write(direction, packet)
+}
+
+func (c *proxyConn) write(direction string, packet *cbyge.Packet) error {
+	if direction == cbyge.CaptureIn {
+		c.serverLock.Lock()
+		defer c.serverLock.Unlock()
+		return c.server.Write(packet)
+	}
+	c.clientLock.Lock()
+	defer c.clientLock.Unlock()
+	return c.client.Write(packet)
+}
+
+func (c *proxyConn) record(direction string, packet *cbyge.Packet) {
+	record := cbyge.NewCaptureRecord(c.ID, direction, packet)
+	if err := c.capture.Write(record); err != nil {
+		c.report(err)
+	}
+	if c.proxy.Pcap != nil {
+		if err := c.proxy.Pcap.WriteRecord(record); err != nil {
+			c.report(err)
+		}
+	}
+	c.proxy.Logger.Log(c.ID, direction, packet)
+}
+
+func (c *proxyConn) report(err error) {
+	c.reportOnce.Do(func() {
+		c.proxy.Logger.Note(c.ID, "recording failed: %v", err)
+	})
+}
+
+// renumberRequest gives a pipe request the next sequence number on the
+// server side of the connection.
+func (c *proxyConn) renumberRequest(packet *cbyge.Packet, injected bool) {
+	if packet.IsResponse {
+		return
+	}
+	seq, err := packet.Seq()
+	if err != nil {
+		return
+	}
+	c.seqLock.Lock()
+	defer c.seqLock.Unlock()
+	if !c.hasSeq {
+		// Start where the client started, so that nothing changes until a
+		// packet is injected.
+		c.nextSeq = seq
+		c.hasSeq = true
+		c.seqs = map[uint16]seqOrigin{}
+	}
+	if !injected && len(packet.Data) >= 4 {
+		c.lastSwitch = binary.BigEndian.Uint32(packet.Data)
+		c.hasSwitch = true
+	}
+	newSeq := c.nextSeq
+	c.nextSeq++
+	c.seqs[newSeq] = seqOrigin{ClientSeq: seq, Injected: injected}
+	packet.SetSeq(newSeq)
+}
+
+// LastSwitch gets the switch ID of the client's latest pipe request.
+func (c *proxyConn) LastSwitch() (uint32, bool) {
+	c.seqLock.Lock()
+	defer c.seqLock.Unlock()
+	return c.lastSwitch, c.hasSwitch
+}
+
+// restoreSeq translates the sequence number of a pipe response from the
+// server back to the client's numbering.
+//
+// It returns false if the response is for an injected request.
+func (c *proxyConn) restoreSeq(packet *cbyge.Packet) bool {
+	if !packet.IsResponse {
+		return true
+	}
+	seq, err := packet.Seq()
+	if err != nil {
+		return true
+	}
+	c.seqLock.Lock()
+	origin, ok := c.seqs[seq]
+	c.seqLock.Unlock()
+	if !ok {
+		return true
+	}
+	if origin.Injected {
+		return false
+	}
+	packet.SetSeq(origin.ClientSeq)
+	return true
+}
+
+// connRegistry tracks the live connections of a Proxy.
+type connRegistry struct {
+	lock  sync.Mutex
+	conns map[int]*proxyConn
+}
+
+func (c *connRegistry) Add(conn *proxyConn) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.conns == nil {
+		c.conns = map[int]*proxyConn{}
+	}
+	c.conns[conn.ID] = conn
+}
+
+func (c *connRegistry) Remove(conn *proxyConn) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.conns, conn.ID)
+}
+
+func (c *connRegistry) Get(id int) (*proxyConn, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if conn, ok := c.conns[id]; ok {
+		return conn, nil
+	}
+	return nil, errors.New("no such connection")
+}
+
+func (c *connRegistry) List() []*proxyConn {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	var res []*proxyConn
+	for _, conn := range c.conns {
+		res = append(res, conn)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].ID < res[j].ID
+	})
+	return res
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/unixpickle/cbyge"
+)
+
+// ControlHandler creates an HTTP handler for inspecting live connections and
+// injecting packets into them.
+//
+// The handler has no authentication, and anyone who can reach it can write
+// arbitrary packets into authenticated sessions, so it should only be served
+// on a loopback address.
+//
+// GET /conns lists the connections.
+//
+// POST /conns/{id}/inject sends a packet on a connection. The form value
+// "direction" is "in" (to the server, the default) or "out" (to the client).
+// Either give "subtype" and a hex "payload" for a pipe command, which is sent
+// with the switch ID (optionally "switch_id") of the client's latest pipe
+// request, or give a "type", a hex "data" and an optional "response" flag
+// for an arbitrary packet.
+func (p *Proxy) ControlHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /conns", p.handleListConns)
+	mux.HandleFunc("POST /conns/{id}/inject", p.handleInject)
+	return mux
+}
+
+// isLoopbackAddr checks if a listen address only accepts local connections.
+func isLoopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func (p *Proxy) handleListConns(w http.ResponseWriter, r *http.Request) {
+	type connInfo struct {
+		ID         int       `json:"id"`
+		RemoteAddr string    `json:"remote_addr"`
+		Created    time.Time `json:"created"`
+		SwitchID   *uint32   `json:"switch_id,omitempty"`
+	}
+	res := []connInfo{}
+	for _, c := range p.conns.List() {
+		info := connInfo{ID: c.ID, RemoteAddr: c.RemoteAddr, Created: c.Created}
+		if id, ok := c.LastSwitch(); ok {
+			info.SwitchID = &id
+		}
+		res = append(res, info)
+	}
+	serveObject(w, res)
+}
+
+func (p *Proxy) handleInject(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		serveError(w, http.StatusBadRequest, errors.New("invalid connection ID"))
+		return
+	}
+	conn, err := p.conns.Get(id)
+	if err != nil {
+		serveError(w, http.StatusNotFound, err)
+		return
+	}
+
+	direction := r.FormValue("direction")
+	if direction == "" {
+		direction = cbyge.CaptureIn
+	} else if direction != cbyge.CaptureIn && direction != cbyge.CaptureOut {
+		serveError(w, http.StatusBadRequest, errors.New("invalid direction: "+direction))
+		return
+	}
+
+	packet, err := injectedPacket(r, conn)
+	if err != nil {
+		serveError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := conn.Inject(direction, packet); err != nil {
+		serveError(w, http.StatusBadGateway, err)
+		return
+	}
+	serveObject(w, map[string]string{"summary": cbyge.SummarizePacket(packet)})
+}
+
+func injectedPacket(r *http.Request, conn *proxyConn) (*cbyge.Packet, error) {
+	if subtypeName := r.FormValue("subtype"); subtypeName != "" {
+		subtype, err := cbyge.Protocol.ParsePipeType(subtypeName)
+		if err != nil {
+			return nil, err
+		}
+		payload, err := hex.DecodeString(r.FormValue("payload"))
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid payload")
+		} else if len(payload) > 0xff {
+			return nil, errors.New("payload is too long")
+		}
+		switchID, ok := conn.LastSwitch()
+		if s := r.FormValue("switch_id"); s != "" {
+			parsed, err := strconv.ParseUint(s, 0, 32)
+			if err != nil {
+				return nil, errors.Wrap(err, "invalid switch_id")
+			}
+			switchID, ok = uint32(parsed), true
+		}
+		if !ok {
+			return nil, errors.New("no switch_id given, and the client has not sent one yet")
+		}
+		// The sequence number is assigned by the connection.
+		return cbyge.NewPacketPipe(switchID, 0, subtype, payload), nil
+	}
+
+	packetType, err := cbyge.Protocol.ParsePacketType(r.FormValue("type"))
+	if err != nil {
+		return nil, err
+	}
+	data, err := hex.DecodeString(r.FormValue("data"))
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid data")
+	}
+	isResponse, _ := strconv.ParseBool(r.FormValue("response"))
+	return &cbyge.Packet{Type: packetType, IsResponse: isResponse, Data: data}, nil
+}
+
+func serveObject(w http.ResponseWriter, obj interface{}) {
+	w.Header().Set("content-type", "application/json")
+	if err := json.NewEncoder(w).Encode(obj); err != nil {
+		log.Printf("failed to write response: %v", err)
+	}
+}
+
+func serveError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
@@ -1,112 +1,305 @@
 package main
 
 import (
+	"crypto/tls"
 	"flag"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"net"
+	"net/http"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
+	"github.com/pkg/errors"
 	"github.com/unixpickle/cbyge"
 	"github.com/unixpickle/essentials"
 )
 
 func main() {
 	var listenAddr string
-	var outputDir string
-	flag.StringVar(&listenAddr, "-source", ":23778", "address to listen on")
-	flag.StringVar(&outputDir, "-output", "saved-packets", "output directory")
+	var tlsCert string
+	var tlsKey string
+	var upstreamTLS bool
+	var upstreamInsecure bool
+	var pcapPath string
+	var readPcapPath string
+	var typeFilter string
+	var subtypeFilter string
+	var deviceFilter string
+	var logger PacketLogger
+	var rulesPath string
+	var controlAddr string
+	var controlPublic bool
+	proxy := &Proxy{Logger: &logger}
+	flag.StringVar(&listenAddr, "listen", ":23778", "address to listen on")
+	flag.StringVar(&tlsCert, "tls-cert", "", "certificate file for accepting TLS connections")
+	flag.StringVar(&tlsKey, "tls-key", "", "private key file for accepting TLS connections")
+	flag.StringVar(&proxy.Upstream, "upstream", cbyge.DefaultPacketConnHost,
+		"address of the server to forward connections to")
+	flag.BoolVar(&upstreamTLS, "upstream-tls", false, "connect to the upstream server with TLS")
+	flag.BoolVar(&upstreamInsecure, "upstream-insecure", false,
+		"do not verify the upstream server's TLS certificate")
+	flag.StringVar(&proxy.OutputDir, "output", "saved-packets", "output directory")
+	flag.StringVar(&pcapPath, "pcap", "", "also write packets from all connections to a pcapng file")
+	flag.StringVar(&readPcapPath, "read-pcap", "",
+		"convert a pcap or pcapng file to a JSONL capture on stdout, instead of proxying")
+	flag.StringVar(&typeFilter, "type", "", "only log these packet types (comma-separated, e.g. pipe)")
+	flag.StringVar(&subtypeFilter, "subtype", "",
+		"only log pipe packets with these subtypes (comma-separated, e.g. set_lum,0x52)")
+	flag.StringVar(&deviceFilter, "device", "",
+		"only log pipe packets for these device indices (comma-separated)")
+	flag.StringVar(&rulesPath, "rules", "", "JSON file of rules for rewriting packets")
+	flag.StringVar(&controlAddr, "control", "",
+		"address for an unauthenticated HTTP endpoint to list connections and inject packets "+
+			"(e.g. 127.0.0.1:8081)")
+	flag.BoolVar(&controlPublic, "control-public", false,
+		"allow -control to listen on an address other than loopback")
+	flag.BoolVar(&logger.Color, "color", false, "colorize logged packets")
+	flag.BoolVar(&logger.Raw, "raw", false, "log the hex data of each packet")
 	flag.Parse()
 
-	tcpAddr, err := net.ResolveTCPAddr("tcp", listenAddr)
-	essentials.Must(err)
-	listener, err := net.ListenTCP("tcp", tcpAddr)
-	essentials.Must(err)
+	filter, err := ParsePacketFilter(typeFilter, subtypeFilter, deviceFilter)
+	if err != nil {
+		essentials.Die(err)
+	}
+	logger.Filter = filter
+
+	if readPcapPath != "" {
+		ConvertPcap(readPcapPath)
+		return
+	}
+
+	if rulesPath != "" {
+		proxy.Rules, err = LoadRewriteRules(rulesPath)
+		if err != nil {
+			essentials.Die(err)
+		}
+	}
+
+	if upstreamTLS || upstreamInsecure {
+		proxy.UpstreamTLS = &tls.Config{InsecureSkipVerify: upstreamInsecure}
+	}
+
+	if controlAddr != "" && !controlPublic && !isLoopbackAddr(controlAddr) {
+		essentials.Die("-control endpoint has no authentication and can inject packets into " +
+			"live sessions; use a loopback address such as 127.0.0.1:8081, or pass -control-public")
+	}
+
+	if err := os.MkdirAll(proxy.OutputDir, 0755); err != nil {
+		essentials.Die(err)
+	}
+
+	if pcapPath != "" {
+		f, err := os.Create(pcapPath)
+		if err != nil {
+			essentials.Die(err)
+		}
+		defer f.Close()
+		proxy.Pcap, err = cbyge.NewPcapngWriter(f)
+		if err != nil {
+			essentials.Die(err)
+		}
+	}
+
+	listener, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		essentials.Die(err)
+	}
+	if tlsCert != "" || tlsKey != "" {
+		cert, err := tls.LoadX509KeyPair(tlsCert, tlsKey)
+		if err != nil {
+			essentials.Die(err)
+		}
+		listener = tls.NewListener(listener, &tls.Config{Certificates: []tls.Certificate{cert}})
+	}
 	defer listener.Close()
 
-	for {
-		conn, err := listener.Accept()
-		essentials.Must(err)
-		connDir, connID := MakeOutputDir(outputDir)
-		go HandleConn(conn, connID, connDir)
+	if controlAddr != "" {
+		proxy.Renumber = true
+		go func() {
+			log.Printf("control endpoint listening on %s", controlAddr)
+			essentials.Die(http.ListenAndServe(controlAddr, proxy.ControlHandler()))
+		}()
 	}
+
+	log.Printf("forwarding connections on %s to %s", listenAddr, proxy.Upstream)
+	if err := proxy.Serve(listener); err != nil {
+		essentials.Die(err)
+	}
+}
+
+// ConvertPcap decodes the packets in a pcap or pcapng file and prints them
+// as a JSONL capture.
+func ConvertPcap(path string) {
+	records, err := cbyge.ReadPcapFile(path, 0)
+	if err != nil {
+		essentials.Die(err)
+	}
+	w := cbyge.NewCaptureWriter(os.Stdout)
+	for _, r := range records {
+		essentials.Must(w.Write(r))
+	}
+}
+
+// A Proxy forwards connections to an upstream server, recording the packets
+// sent in each direction.
+type Proxy struct {
+	// Upstream is the address of the server, and UpstreamTLS is an optional
+	// TLS configuration for connecting to it.
+	Upstream    string
+	UpstreamTLS *tls.Config
+
+	// OutputDir is where capture files are written.
+	OutputDir string
+
+	// Pcap optionally records every connection to a pcapng file.
+	Pcap *cbyge.PcapngWriter
+
+	Logger *PacketLogger
+
+	// Rules rewrite or drop packets before they are forwarded.
+	Rules []*RewriteRule
+
+	// Renumber enables sequence number translation, so that pipe requests
+	// can be injected into live connections (see ControlHandler).
+	Renumber bool
+
+	conns connRegistry
+
+	// nextID is the ID of the next capture file, found by scanning the
+	// output directory once.
+	idLock  sync.Mutex
+	scanned bool
+	nextID  int
 }
 
-func MakeOutputDir(root string) (string, int) {
-	for i := 0; true; i++ {
-		newDir := filepath.Join(root, strconv.Itoa(i))
-		if _, err := os.Stat(newDir); err == nil {
+// Serve accepts connections until the listener is closed.
+func (p *Proxy) Serve(listener net.Listener) error {
+	var delay time.Duration
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return errors.Wrap(err, "accept")
+			}
+			// Back off from other errors, such as running out of file
+			// descriptors, like net/http does.
+			if delay == 0 {
+				delay = 5 * time.Millisecond
+			} else if delay *= 2; delay > time.Second {
+				delay = time.Second
+			}
+			log.Printf("accept error: %v; retrying in %v", err, delay)
+			time.Sleep(delay)
 			continue
 		}
-		if err := os.MkdirAll(newDir, 0755); err == nil {
-			return newDir, i
-		} else if !os.IsExist(err) {
-			essentials.Must(err)
-		}
+		delay = 0
+		go p.HandleConn(conn)
 	}
-	panic("unreachable")
 }
 
-func HandleConn(conn net.Conn, id int, outDir string) {
-	log.Printf("connection created with ID: %d", id)
-	defer log.Printf("connection terminated: %d", id)
-
+// HandleConn forwards packets between a client and the upstream server,
+// recording them to a capture file and an optional pcapng writer.
+//
+// Errors are logged, and only affect this connection.
+func (p *Proxy) HandleConn(conn net.Conn) {
 	clientConn := cbyge.NewPacketConnWrap(conn)
 	defer clientConn.Close()
 
-	serverConn, err := cbyge.NewPacketConn()
-	essentials.Must(err)
+	serverConn, err := cbyge.NewPacketConnAddr(p.Upstream, p.UpstreamTLS)
+	if err != nil {
+		log.Printf("failed to connect to upstream for %s: %v", conn.RemoteAddr(), err)
+		return
+	}
 	defer serverConn.Close()
 
-	var packetLock sync.Mutex
+	captureFile, id, err := p.createCaptureFile()
+	if err != nil {
+		log.Printf("failed to create capture file: %v", err)
+		return
+	}
+	defer captureFile.Close()
+
+	log.Printf("connection created with ID: %d", id)
+	defer log.Printf("connection terminated: %d", id)
+
+	pc := &proxyConn{
+		ID:         id,
+		RemoteAddr: conn.RemoteAddr().String(),
+		Created:    time.Now(),
+		proxy:      p,
+		client:     clientConn,
+		server:     serverConn,
+		capture:    cbyge.NewCaptureWriter(captureFile),
+	}
+	p.conns.Add(pc)
+	defer p.conns.Remove(pc)
 
 	var wg sync.WaitGroup
 	wg.Add(2)
+	for _, direction := range []string{cbyge.CaptureIn, cbyge.CaptureOut} {
+		go func(direction string) {
+			defer wg.Done()
+			pc.Forward(direction)
+		}(direction)
+	}
+	wg.Wait()
 
-	forward := func(direction string, source, dest *cbyge.PacketConn) {
-		defer wg.Done()
-		defer dest.Close()
-		for {
-			packet, err := source.Read()
-			if err != nil {
-				return
-			}
-			packetLock.Lock()
-			WritePacket(outDir, direction, packet)
-			packetLock.Unlock()
-			log.Printf("conn=%d direction=%s packet=%s", id, direction, packet)
-			if dest.Write(packet) != nil {
-				return
-			}
+	if p.Pcap != nil {
+		if err := p.Pcap.CloseConn(time.Now(), id); err != nil {
+			pc.report(err)
 		}
 	}
-	go forward("in", clientConn, serverConn)
-	go forward("out", serverConn, clientConn)
+}
 
-	wg.Wait()
+// createCaptureFile creates a capture file for the next connection ID in the
+// output directory.
+//
+// IDs continue after the highest one in the directory when the first file is
+// created, so a file is only skipped if it was created by another process.
+func (p *Proxy) createCaptureFile() (*os.File, int, error) {
+	p.idLock.Lock()
+	defer p.idLock.Unlock()
+	if !p.scanned {
+		next, err := nextCaptureID(p.OutputDir)
+		if err != nil {
+			return nil, 0, err
+		}
+		p.nextID, p.scanned = next, true
+	}
+	for {
+		id := p.nextID
+		p.nextID++
+		path := filepath.Join(p.OutputDir, fmt.Sprintf("%06d.jsonl", id))
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			return f, id, nil
+		} else if !os.IsExist(err) {
+			return nil, 0, errors.Wrap(err, "create capture file")
+		}
+	}
 }
 
-func WritePacket(outDir, direction string, packet *cbyge.Packet) {
-	listing, err := ioutil.ReadDir(outDir)
-	essentials.Must(err)
-	nextIdx := 0
-	for _, entry := range listing {
-		name := entry.Name()
-		parts := strings.Split(name, "_")
-		if len(parts) != 2 {
+// nextCaptureID finds the ID after the highest one used by a capture file in
+// a directory.
+func nextCaptureID(root string) (int, error) {
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return 0, errors.Wrap(err, "scan capture files")
+	}
+	var next int
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), ".jsonl")
+		if !ok {
 			continue
 		}
-		x, err := strconv.Atoi(parts[0])
-		if err == nil {
-			nextIdx = essentials.MaxInt(nextIdx, x+1)
+		if id, err := strconv.Atoi(name); err == nil && id >= next {
+			next = id + 1
 		}
 	}
-	outName := fmt.Sprintf("%06d_%s", nextIdx, direction)
-	outFile := filepath.Join(outDir, outName)
-	essentials.Must(ioutil.WriteFile(outFile, packet.Encode(), 0644))
+	return next, nil
 }
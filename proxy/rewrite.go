@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"github.com/unixpickle/cbyge"
+)
+
+// A RewriteRule modifies or drops packets which match a filter.
+//
+// Rules are loaded from a JSON file containing a list of rules, such as
+//
+//	[{"direction": "in", "subtype": "set_lum", "device": "3", "set": {"brightness": 10}}]
+type RewriteRule struct {
+	// Direction is "in", "out", or empty to match both directions.
+	Direction string `json:"direction"`
+
+	// Type, Subtype and Device are comma-separated lists, as taken by
+	// ParsePacketFilter.
+	Type    string `json:"type"`
+	Subtype string `json:"subtype"`
+	Device  string `json:"device"`
+
+	// Set changes the values of fields by name. Values are numbers for
+	// integer fields, or hex strings for other fields.
+	Set map[string]interface{} `json:"set"`
+
+	// Replace replaces byte sequences in the packet data.
+	Replace []ByteReplacement `json:"replace"`
+
+	// Drop causes packets to be dropped rather than forwarded.
+	Drop bool `json:"drop"`
+
+	filter *PacketFilter
+}
+
+// A ByteReplacement replaces every occurrence of one byte sequence with
+// another of the same length, so that length fields in the packet stay
+// valid.
+type ByteReplacement struct {
+	Find    cbyge.HexData `json:"find"`
+	Replace cbyge.HexData `json:"replace"`
+}
+
+// LoadRewriteRules reads rules from a JSON file.
+func LoadRewriteRules(path string) ([]*RewriteRule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "load rewrite rules")
+	}
+	var rules []*RewriteRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, errors.Wrap(err, "load rewrite rules")
+	}
+	for i, r := range rules {
+		if r.Direction != "" && r.Direction != cbyge.CaptureIn && r.Direction != cbyge.CaptureOut {
+			return nil, errors.Errorf("load rewrite rules: rule %d: invalid direction: %s", i,
+				r.Direction)
+		}
+		r.filter, err = ParsePacketFilter(r.Type, r.Subtype, r.Device)
+		if err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("load rewrite rules: rule %d", i))
+		}
+		for _, replacement := range r.Replace {
+			if err := replacement.validate(); err != nil {
+				return nil, errors.Wrap(err, fmt.Sprintf("load rewrite rules: rule %d", i))
+			}
+		}
+	}
+	return rules, nil
+}
+
+// Matches checks if the rule applies to a packet.
+func (r *RewriteRule) Matches(direction string, d *cbyge.DecodedPacket) bool {
+	if r.Direction != "" && r.Direction != direction {
+		return false
+	}
+	return r.filter == nil || r.filter.Matches(d)
+}
+
+// Apply modifies the packet in place, and returns false if it should be
+// dropped.
+func (r *RewriteRule) Apply(p *cbyge.Packet, d *cbyge.DecodedPacket) (bool, error) {
+	if r.Drop {
+		return false, nil
+	}
+	for name, value := range r.Set {
+		encoded, err := encodeFieldValue(d, name, value)
+		if err != nil {
+			return true, err
+		}
+		if err := d.SetField(p, name, encoded); err != nil {
+			return true, err
+		}
+	}
+	for _, replacement := range r.Replace {
+		if err := replacement.validate(); err != nil {
+			return true, err
+		}
+		p.Data = bytes.ReplaceAll(p.Data, replacement.Find, replacement.Replace)
+	}
+	return true, nil
+}
+
+func (b ByteReplacement) validate() error {
+	if len(b.Find) == 0 {
+		return errors.New("empty find sequence in replacement")
+	} else if len(b.Find) != len(b.Replace) {
+		return errors.New("replacement must be the same length as the find sequence")
+	}
+	return nil
+}
+
+// Rewrite applies every matching rule to a packet, in order, and returns
+// false if the packet should be dropped.
+//
+// If a rule cannot be applied, the remaining rules still are, and an error
+// describing the failure is returned.
+func Rewrite(rules []*RewriteRule, direction string, p *cbyge.Packet) (bool, error) {
+	var firstErr error
+	for i, r := range rules {
+		// Decode again for each rule, since earlier rules may move fields.
+		d := cbyge.DecodePacket(p)
+		if !r.Matches(direction, d) {
+			continue
+		}
+		keep, err := r.Apply(p, d)
+		if err != nil && firstErr == nil {
+			firstErr = errors.Wrap(err, fmt.Sprintf("rewrite rule %d", i))
+		}
+		if !keep {
+			return false, firstErr
+		}
+	}
+	return true, firstErr
+}
+
+func encodeFieldValue(d *cbyge.DecodedPacket, name string, value interface{}) ([]byte, error) {
+	f, ok := d.Field(name)
+	if !ok {
+		return nil, errors.New("packet has no field: " + name)
+	}
+	if f.Field.Kind != cbyge.FieldUint {
+		s, ok := value.(string)
+		if !ok {
+			return nil, errors.New("expected hex string for field: " + name)
+		}
+		return hex.DecodeString(s)
+	}
+	var n uint64
+	switch value := value.(type) {
+	case float64:
+		if value < 0 || value != float64(uint64(value)) {
+			return nil, errors.New("invalid value for field: " + name)
+		}
+		n = uint64(value)
+	case string:
+		var err error
+		n, err = strconv.ParseUint(value, 0, 64)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid value for field: "+name)
+		}
+	default:
+		return nil, errors.New("invalid value for field: " + name)
+	}
+	if len(f.Data) < 8 && n >= 1<<(8*uint(len(f.Data))) {
+		return nil, errors.Errorf("value for field %s does not fit in %d bytes", name, len(f.Data))
+	}
+	res := make([]byte, len(f.Data))
+	for i := len(res) - 1; i >= 0; i-- {
+		res[i] = byte(n)
+		n >>= 8
+	}
+	return res, nil
+}
@@ -0,0 +1,445 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/unixpickle/cbyge"
+)
+
+const maxV2RequestBody = 1 << 16
+
+// An APIError is the error object returned by all v2 endpoints.
+type APIError struct {
+	Status  int    `json:"status"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// RegisterV2 adds the /api/v2 endpoints to the default mux.
+func (s *Server) RegisterV2() {
+	s.handleV2("/api/v2/devices", map[string]http.HandlerFunc{
+		http.MethodGet: s.HandleV2Devices,
+	})
+	s.handleV2("/api/v2/devices/{id}", map[string]http.HandlerFunc{
+		http.MethodGet:   s.HandleV2Device,
+		http.MethodPatch: s.HandleV2PatchDevice,
+	})
+	s.handleV2("/api/v2/devices/{id}/metadata", map[string]http.HandlerFunc{
+		http.MethodGet: s.HandleV2DeviceMetadata,
+		http.MethodPut: s.HandleV2PutDeviceMetadata,
+	})
+	s.handleV2("/api/v2/groups", map[string]http.HandlerFunc{
+		http.MethodGet: s.HandleV2Groups,
+	})
+	s.handleV2("/api/v2/groups/{id}/actions", map[string]http.HandlerFunc{
+		http.MethodPost: s.HandleV2GroupAction,
+	})
+	s.handleV2("/api/v2/jobs/{id}", map[string]http.HandlerFunc{
+		http.MethodGet: s.HandleV2Job,
+	})
+	s.handleV2("/api/v2/openapi.json", map[string]http.HandlerFunc{
+		http.MethodGet: s.HandleV2OpenAPI,
+	})
+	http.Handle("/api/v2/", s.apiMetrics.Instrument("/api/v2/", http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			s.serveV2Error(w, http.StatusNotFound, "not_found", "no such endpoint")
+		},
+	)))
+}
+
+func (s *Server) handleV2(pattern string, methods map[string]http.HandlerFunc) {
+	allowed := make([]string, 0, len(methods))
+	for m := range methods {
+		allowed = append(allowed, m)
+	}
+	sort.Strings(allowed)
+	allowHeader := strings.Join(allowed, ", ")
+
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		h, ok := methods[r.Method]
+		if !ok {
+			w.Header().Set("allow", allowHeader)
+			s.serveV2Error(w, http.StatusMethodNotAllowed, "method_not_allowed",
+				"method "+r.Method+" is not allowed; use "+allowHeader)
+			return
+		}
+		role := RoleControl
+		if r.Method == http.MethodGet {
+			role = RoleReadOnly
+		}
+		s.AuthV2(role, h).ServeHTTP(w, r)
+	}
+	http.Handle(pattern, s.apiMetrics.Instrument(pattern, http.HandlerFunc(handler)))
+}
+
+// AuthV2 is like AuthRole, but does not accept the legacy "auth" parameter,
+// and reports failures as v2 error objects.
+func (s *Server) AuthV2(role Role, handler http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := s.authenticate(r, false)
+		if p == nil {
+			w.Header().Set("WWW-Authenticate", `Basic realm="bad credentials"`)
+			s.serveV2Error(w, http.StatusUnauthorized, "unauthorized", "invalid credentials")
+			return
+		}
+		if err := checkPermission(p, role, r); err != "" {
+			s.serveV2Error(w, http.StatusForbidden, "forbidden", err)
+			return
+		}
+		handler(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, p)))
+	})
+}
+
+func (s *Server) HandleV2Devices(w http.ResponseWriter, r *http.Request) {
+	var devs []*cbyge.ControllerDevice
+	var err error
+	if r.FormValue("refresh") == "1" {
+		devs, err = s.refreshDevices()
+	} else {
+		devs, err = s.getDevices()
+	}
+	if err != nil {
+		s.serveV2ControllerError(w, err)
+		return
+	}
+	devs = s.visibleDevices(r, s.filterDevices(r, devs))
+	s.sortDevices(devs)
+	if r.FormValue("update_status") == "1" {
+		ctrl, err := s.getController()
+		if err != nil {
+			s.serveV2ControllerError(w, err)
+			return
+		}
+		ctrl.DeviceStatuses(devs)
+	}
+	result := []interface{}{}
+	for _, d := range devs {
+		result = append(result, s.encodeV2Device(d, d.LastStatus()))
+	}
+	s.serveObject(w, http.StatusOK, map[string]interface{}{"devices": result})
+}
+
+func (s *Server) HandleV2Device(w http.ResponseWriter, r *http.Request) {
+	dev, ok := s.v2Device(w, r)
+	if !ok {
+		return
+	}
+	status := dev.LastStatus()
+	if r.FormValue("update_status") == "1" {
+		ctrl, err := s.getController()
+		if err != nil {
+			s.serveV2ControllerError(w, err)
+			return
+		}
+		status, _ = ctrl.DeviceStatus(dev)
+	}
+	s.serveObject(w, http.StatusOK, s.encodeV2Device(dev, status))
+}
+
+func (s *Server) HandleV2PatchDevice(w http.ResponseWriter, r *http.Request) {
+	dev, ok := s.v2Device(w, r)
+	if !ok {
+		return
+	}
+	var change cbyge.DeviceState
+	if !s.decodeV2Body(w, r, &change) {
+		return
+	}
+	ctrl, err := s.getController()
+	if err != nil {
+		s.serveV2ControllerError(w, err)
+		return
+	}
+	start := time.Now()
+	if r.FormValue("async") == "1" {
+		job := s.startJob(r, []string{dev.DeviceID()}, func(job *Job) {
+			err := ctrl.SetDeviceStateAsync(dev, change)
+			s.jobs.SetResult(job, 0, err)
+			s.audit(r, dev.DeviceID(), change, true, start, err)
+		})
+		obj := s.encodeV2Device(dev, dev.LastStatus())
+		obj["job"] = encodeV2JobRef(job)
+		s.serveObject(w, http.StatusAccepted, obj)
+		return
+	}
+	if r.FormValue("verify") == "1" {
+		result, err := ctrl.SetDeviceStateVerified(dev, change, nil)
+		s.audit(r, dev.DeviceID(), change, false, start, err)
+		if err != nil {
+			s.serveV2ControllerError(w, err)
+			return
+		}
+		obj := s.encodeV2Device(dev, result.Status)
+		obj["verification"] = map[string]interface{}{
+			"sends":       result.Sends,
+			"polls":       result.Polls,
+			"switches":    result.Switches,
+			"duration_ms": result.Duration.Milliseconds(),
+		}
+		s.serveObject(w, http.StatusOK, obj)
+		return
+	}
+	err = ctrl.SetDeviceState(dev, change)
+	s.audit(r, dev.DeviceID(), change, false, start, err)
+	if err != nil {
+		s.serveV2ControllerError(w, err)
+		return
+	}
+	status, err := ctrl.DeviceStatus(dev)
+	if err != nil {
+		s.serveV2ControllerError(w, err)
+		return
+	}
+	s.serveObject(w, http.StatusOK, s.encodeV2Device(dev, status))
+}
+
+func (s *Server) HandleV2DeviceMetadata(w http.ResponseWriter, r *http.Request) {
+	dev, ok := s.v2Device(w, r)
+	if !ok {
+		return
+	}
+	s.serveObject(w, http.StatusOK, s.metadata.Get(dev.DeviceID()))
+}
+
+// HandleV2PutDeviceMetadata replaces the metadata of a device.
+func (s *Server) HandleV2PutDeviceMetadata(w http.ResponseWriter, r *http.Request) {
+	if p := RequestPrincipal(r); p.Role < RoleAdmin {
+		s.serveV2Error(w, http.StatusForbidden, "forbidden",
+			"insufficient permissions: requires admin role")
+		return
+	}
+	dev, ok := s.v2Device(w, r)
+	if !ok {
+		return
+	}
+	var md DeviceMetadata
+	if !s.decodeV2JSON(w, r, &md) {
+		return
+	}
+	if err := s.metadata.Set(dev.DeviceID(), md); err != nil {
+		s.serveV2Error(w, http.StatusBadRequest, "invalid_body", err.Error())
+		return
+	}
+	s.serveObject(w, http.StatusOK, s.metadata.Get(dev.DeviceID()))
+}
+
+func (s *Server) HandleV2Groups(w http.ResponseWriter, r *http.Request) {
+	groups, err := s.getGroups()
+	if err != nil {
+		s.serveV2ControllerError(w, err)
+		return
+	}
+	p := RequestPrincipal(r)
+	result := []interface{}{}
+	for _, g := range groups {
+		if s.allowsGroup(p, g) {
+			result = append(result, s.encodeV2Group(p, g))
+		}
+	}
+	s.serveObject(w, http.StatusOK, map[string]interface{}{"groups": result})
+}
+
+func (s *Server) HandleV2GroupAction(w http.ResponseWriter, r *http.Request) {
+	groups, err := s.getGroups()
+	if err != nil {
+		s.serveV2ControllerError(w, err)
+		return
+	}
+	var group *cbyge.ControllerGroup
+	for _, g := range groups {
+		if g.GroupID() == r.PathValue("id") {
+			group = g
+		}
+	}
+	if group == nil {
+		s.serveV2Error(w, http.StatusNotFound, "not_found", "no group found with the given ID")
+		return
+	}
+	devs := s.filterDevices(r, group.Devices())
+	if len(devs) == 0 {
+		s.serveV2Error(w, http.StatusForbidden, "forbidden", "access denied for every device in the group")
+		return
+	}
+	var change cbyge.DeviceState
+	if !s.decodeV2Body(w, r, &change) {
+		return
+	}
+	ctrl, err := s.getController()
+	if err != nil {
+		s.serveV2ControllerError(w, err)
+		return
+	}
+	if r.FormValue("async") == "1" {
+		var ids []string
+		for _, d := range devs {
+			ids = append(ids, d.DeviceID())
+		}
+		job := s.startJob(r, ids, func(job *Job) {
+			for i, d := range devs {
+				start := time.Now()
+				err := ctrl.SetDeviceStateAsync(d, change)
+				s.jobs.SetResult(job, i, err)
+				s.audit(r, d.DeviceID(), change, true, start, err)
+			}
+		})
+		s.serveObject(w, http.StatusAccepted, map[string]interface{}{
+			"group": s.encodeV2Group(RequestPrincipal(r), group),
+			"job":   encodeV2JobRef(job),
+		})
+		return
+	}
+	results := []interface{}{}
+	for _, d := range devs {
+		result := map[string]interface{}{"id": d.DeviceID()}
+		start := time.Now()
+		err := ctrl.SetDeviceState(d, change)
+		s.audit(r, d.DeviceID(), change, false, start, err)
+		if err != nil {
+			result["error"] = v2ControllerError(err)
+		} else {
+			result["ok"] = true
+		}
+		results = append(results, result)
+	}
+	s.serveObject(w, http.StatusOK, map[string]interface{}{
+		"group":   s.encodeV2Group(RequestPrincipal(r), group),
+		"results": results,
+	})
+}
+
+func (s *Server) HandleV2Job(w http.ResponseWriter, r *http.Request) {
+	job := s.jobs.Get(r.PathValue("id"), RequestPrincipal(r))
+	if job == nil {
+		s.serveV2Error(w, http.StatusNotFound, "not_found", "no job found with the given ID")
+		return
+	}
+	s.serveObject(w, http.StatusOK, job)
+}
+
+func (s *Server) HandleV2OpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json")
+	w.Write([]byte(OpenAPIDocument))
+}
+
+// v2Device finds the device for the "id" path parameter, which is a device
+// selector (see Selector) that must match exactly one device.
+func (s *Server) v2Device(w http.ResponseWriter, r *http.Request) (*cbyge.ControllerDevice, bool) {
+	devs, err := s.resolveDevices(r, r.PathValue("id"))
+	if err != nil {
+		switch {
+		case errors.Is(err, errAccessDenied):
+			s.serveV2Error(w, http.StatusForbidden, "forbidden", "access denied for device")
+		case errors.Is(err, errInvalidSelector):
+			s.serveV2Error(w, http.StatusBadRequest, "invalid_selector", err.Error())
+		case errors.Is(err, errDeviceNotFound):
+			s.serveV2Error(w, http.StatusNotFound, "not_found", err.Error())
+		default:
+			s.serveV2ControllerError(w, err)
+		}
+		return nil, false
+	}
+	if len(devs) == 0 {
+		s.serveV2Error(w, http.StatusNotFound, "not_found", "selector matched no devices")
+		return nil, false
+	} else if len(devs) > 1 {
+		s.serveV2Error(w, http.StatusBadRequest, "ambiguous_selector",
+			fmt.Sprintf("selector matched %d devices", len(devs)))
+		return nil, false
+	}
+	return devs[0], true
+}
+
+func (s *Server) decodeV2Body(w http.ResponseWriter, r *http.Request,
+	change *cbyge.DeviceState) bool {
+	if !s.decodeV2JSON(w, r, change) {
+		return false
+	}
+	if err := change.Validate(); err != nil {
+		s.serveV2Error(w, http.StatusBadRequest, "invalid_body", err.Error())
+		return false
+	}
+	return true
+}
+
+func (s *Server) decodeV2JSON(w http.ResponseWriter, r *http.Request, obj interface{}) bool {
+	if !strings.HasPrefix(r.Header.Get("content-type"), "application/json") {
+		s.serveV2Error(w, http.StatusUnsupportedMediaType, "unsupported_media_type",
+			"request body must be application/json")
+		return false
+	}
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxV2RequestBody))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(obj); err != nil {
+		s.serveV2Error(w, http.StatusBadRequest, "invalid_body", err.Error())
+		return false
+	}
+	return true
+}
+
+func (s *Server) serveV2Error(w http.ResponseWriter, status int, code, msg string) {
+	s.serveObject(w, status, map[string]interface{}{
+		"error": &APIError{Status: status, Code: code, Message: msg},
+	})
+}
+
+func (s *Server) serveV2ControllerError(w http.ResponseWriter, err error) {
+	apiErr := v2ControllerError(err)
+	s.serveObject(w, apiErr.Status, map[string]interface{}{"error": apiErr})
+}
+
+func v2ControllerError(err error) *APIError {
+	switch {
+	case errors.Is(err, cbyge.UnreachableError):
+		return &APIError{Status: http.StatusBadGateway, Code: "unreachable", Message: err.Error()}
+	case errors.Is(err, cbyge.TimeoutError):
+		return &APIError{Status: http.StatusGatewayTimeout, Code: "timeout", Message: err.Error()}
+	case errors.Is(err, cbyge.UnverifiedError):
+		return &APIError{Status: http.StatusGatewayTimeout, Code: "unverified", Message: err.Error()}
+	case errors.Is(err, cbyge.RemoteCallError):
+		return &APIError{Status: http.StatusBadGateway, Code: "remote_error", Message: err.Error()}
+	}
+	return &APIError{
+		Status:  http.StatusInternalServerError,
+		Code:    "internal_error",
+		Message: err.Error(),
+	}
+}
+
+func (s *Server) encodeV2Device(d *cbyge.ControllerDevice, status cbyge.ControllerDeviceStatus) map[string]interface{} {
+	return map[string]interface{}{
+		"id":       d.DeviceID(),
+		"name":     d.Name(),
+		"status":   status.Encode(),
+		"metadata": s.metadata.Get(d.DeviceID()),
+	}
+}
+
+// encodeV2Group encodes a group, listing only the devices which the
+// principal may access.
+func (s *Server) encodeV2Group(p *Principal, g *cbyge.ControllerGroup) map[string]interface{} {
+	ids := []string{}
+	for _, d := range g.Devices() {
+		if s.allowsDevice(p, d) {
+			ids = append(ids, d.DeviceID())
+		}
+	}
+	return map[string]interface{}{
+		"id":         g.GroupID(),
+		"name":       g.Name(),
+		"device_ids": ids,
+	}
+}
+
+func encodeV2JobRef(job *Job) map[string]interface{} {
+	return map[string]interface{}{
+		"id":  job.ID,
+		"url": "/api/v2/jobs/" + job.ID,
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+//go:embed assets
+var embeddedAssets embed.FS
+
+// An AssetHandler serves the web UI, either from the assets embedded in the
+// binary or from a directory on disk.
+//
+// Every file is served with a content-based ETag, and browsers must
+// revalidate it on every use. Asset URLs are not fingerprinted, so this keeps
+// scripts and styles in sync with the pages after an upgrade, or after an
+// asset directory is edited.
+type AssetHandler struct {
+	fs     fs.FS
+	server http.Handler
+
+	etagLock sync.Mutex
+	etags    map[string]assetETag
+}
+
+type assetETag struct {
+	modTime time.Time
+	size    int64
+	etag    string
+}
+
+// NewAssetHandler creates an AssetHandler for the given directory, or for the
+// embedded assets if dir is "".
+func NewAssetHandler(dir string) *AssetHandler {
+	var fsys fs.FS
+	if dir == "" {
+		var err error
+		fsys, err = fs.Sub(embeddedAssets, "assets")
+		if err != nil {
+			panic(err)
+		}
+	} else {
+		fsys = os.DirFS(dir)
+	}
+	return &AssetHandler{
+		fs:     fsys,
+		server: http.FileServerFS(fsys),
+		etags:  map[string]assetETag{},
+	}
+}
+
+func (a *AssetHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+	if name == "" {
+		name = "index.html"
+	}
+	if etag, ok := a.etag(name); ok {
+		w.Header().Set("etag", etag)
+	}
+	w.Header().Set("cache-control", "no-cache")
+	if strings.HasSuffix(name, ".webmanifest") {
+		w.Header().Set("content-type", "application/manifest+json")
+	}
+	a.server.ServeHTTP(w, r)
+}
+
+// etag computes (or looks up) the ETag for a file, returning false if the
+// file cannot be read.
+func (a *AssetHandler) etag(name string) (string, bool) {
+	info, err := fs.Stat(a.fs, name)
+	if err != nil || info.IsDir() {
+		return "", false
+	}
+
+	a.etagLock.Lock()
+	cached, ok := a.etags[name]
+	a.etagLock.Unlock()
+	if ok && cached.modTime.Equal(info.ModTime()) && cached.size == info.Size() {
+		return cached.etag, true
+	}
+
+	f, err := a.fs.Open(name)
+	if err != nil {
+		return "", false
+	}
+	defer f.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", false
+	}
+	etag := `"` + hex.EncodeToString(hash.Sum(nil)[:16]) + `"`
+
+	a.etagLock.Lock()
+	a.etags[name] = assetETag{modTime: info.ModTime(), size: info.Size(), etag: etag}
+	a.etagLock.Unlock()
+	return etag, true
+}
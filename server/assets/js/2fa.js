@@ -6,7 +6,7 @@
     btn.addEventListener('click', () => {
         btn.classList.add('disabled');
         statusElement.textContent = 'Sending...'
-        fetch('/2fa/stage1').then(() => {
+        fetch('/2fa/stage1', {headers: {'X-CSRF-Token': csrfToken()}}).then(() => {
             btn.classList.remove('disabled');
             statusElement.classList.add('success');
             statusElement.textContent = 'Code sent. Check your email.';
@@ -17,6 +17,8 @@
         });
     });
 
+    document.getElementById('csrf-token').value = csrfToken();
+
     const errorMsg = new URL(window.location).searchParams.get('error');
     if (errorMsg) {
         statusElement.textContent = errorMsg;
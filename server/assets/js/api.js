@@ -35,10 +35,36 @@
             const url = '/api/device/set_rgb?id=' + encoded + '&r=' + r + '&g=' + g + '&b=' + b;
             return (await apiCall(url))[0];
         }
+
+        getWhoAmI() {
+            return apiCall('/api/whoami');
+        }
+
+        setMetadata(deviceID, metadata) {
+            const params = new URLSearchParams({
+                id: deviceID,
+                alias: metadata['alias'] || '',
+                tags: (metadata['tags'] || []).join(','),
+                icon: metadata['icon'] || '',
+                order: '' + (metadata['order'] || 0),
+                hidden: metadata['hidden'] ? '1' : '0',
+            });
+            return apiCall('/api/device/set_metadata?' + params.toString());
+        }
+
+        subscribe(onStatus) {
+            const source = new EventSource('/api/events');
+            source.addEventListener('status', (e) => {
+                const info = JSON.parse(e.data);
+                onStatus(info['id'], info['status']);
+            });
+            return source;
+        }
     }
 
     async function apiCall(url) {
-        return parseRemoteObject(await fetch(url));
+        const headers = {'X-CSRF-Token': csrfToken()};
+        return parseRemoteObject(await fetch(url, {headers: headers}));
     }
 
     async function parseRemoteObject(obj) {
@@ -152,9 +152,56 @@
         }
     }
 
+    class MetadataPopup extends ControlPopup {
+        constructor(name, metadata) {
+            super();
+
+            this.onMetadata = (_value) => null;
+
+            this.title.textContent = name;
+            this.aliasInput.value = metadata['alias'] || '';
+            this.tagsInput.value = (metadata['tags'] || []).join(', ');
+            this.iconInput.value = metadata['icon'] || '';
+            this.orderInput.value = metadata['order'] || 0;
+            this.hiddenInput.checked = !!metadata['hidden'];
+        }
+
+        createContent() {
+            this.title = makeElem('label', 'popup-title');
+            this.aliasInput = makeElem('input', 'popup-field', { placeholder: 'Alias' });
+            this.tagsInput = makeElem('input', 'popup-field', {
+                placeholder: 'Tags (comma separated)',
+            });
+            this.iconInput = makeElem('input', 'popup-field', { placeholder: 'Icon (e.g. an emoji)' });
+            this.orderInput = makeElem('input', 'popup-field', { type: 'number', placeholder: 'Order' });
+            this.hiddenInput = makeElem('input', '', { type: 'checkbox' });
+            const hiddenLabel = makeElem('label', 'popup-checkbox', {}, [
+                this.hiddenInput,
+                document.createTextNode(' Hidden'),
+            ]);
+            return [
+                this.title, this.aliasInput, this.tagsInput, this.iconInput, this.orderInput,
+                hiddenLabel,
+            ];
+        }
+
+        confirm() {
+            super.confirm();
+            const tags = this.tagsInput.value.split(',').map((x) => x.trim()).filter((x) => x);
+            this.onMetadata({
+                alias: this.aliasInput.value.trim(),
+                tags: tags,
+                icon: this.iconInput.value.trim(),
+                order: parseInt(this.orderInput.value) || 0,
+                hidden: this.hiddenInput.checked,
+            });
+        }
+    }
+
     window.controlPopups = {
         BrightnessPopup: BrightnessPopup,
         ColorPopup: ColorPopup,
+        MetadataPopup: MetadataPopup,
     }
 
 })();
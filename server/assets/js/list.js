@@ -4,6 +4,11 @@
         constructor() {
             this.element = document.getElementById('devices');
             this.devices = [];
+            this.canEdit = false;
+        }
+
+        reload() {
+            return lightAPI.getDevices().then((devs) => this.update(devs));
         }
 
         update(devices) {
@@ -12,12 +17,20 @@
             this.element.innerHTML = '';
 
             devices.forEach((info) => {
-                const device = new Device(info);
+                const device = new Device(info, this.canEdit);
                 this.element.appendChild(device.element);
                 this.devices.push(device);
             });
         }
 
+        receiveStatus(deviceID, status) {
+            this.devices.forEach((device) => {
+                if (device.info.id === deviceID) {
+                    device.receiveStatus(status);
+                }
+            });
+        }
+
         showError(err) {
             this.element.innerHTML = '';
             const errorElem = makeElem('div', 'devices-error', { textContent: err });
@@ -26,11 +39,17 @@
     }
 
     class Device {
-        constructor(info) {
+        constructor(info, canEdit) {
             this.info = info;
             this.status = null;
 
-            this.name = makeElem('label', 'device-name', { textContent: info.name });
+            const metadata = info['metadata'] || {};
+            const displayName = (metadata['icon'] ? metadata['icon'] + ' ' : '') +
+                (metadata['alias'] || info.name);
+            this.name = makeElem('label', 'device-name', { textContent: displayName });
+            this.tags = makeElem('label', 'device-tags', {
+                textContent: (metadata['tags'] || []).join(', '),
+            });
             this.onOff = makeElem('div', 'device-on-off');
             this.onOff.addEventListener('click', () => this.toggleOnOff());
 
@@ -50,13 +69,22 @@
             this.colorControls = makeElem('div', 'device-color-controls', {}, [
                 this.brightnessButton, this.colorButton,
             ]);
+            this.editControls = makeElem('div', 'device-edit-controls');
+            if (canEdit) {
+                // Offline devices can still be edited, so this button is
+                // not part of the color controls.
+                const editButton = makeElem('button', 'device-edit-button', { textContent: 'Edit' });
+                editButton.addEventListener('click', () => this.editMetadata());
+                this.editControls.appendChild(editButton);
+            }
 
             this.error = makeElem('label', 'device-error');
             this.error.style.display = 'none';
             this.loader = makeElem('div', 'loader');
 
             this.element = makeElem('div', 'device', {}, [
-                this.name, this.onOff, this.colorControls, this.error, this.loader,
+                this.name, this.tags, this.onOff, this.colorControls, this.editControls,
+                this.error, this.loader,
             ]);
 
             if (info['status']['is_online']) {
@@ -86,6 +114,16 @@
             }
         }
 
+        receiveStatus(status) {
+            if (this.element.classList.contains('device-loading')) {
+                // The pending call will update the status.
+                return;
+            }
+            if (status['is_online']) {
+                this.updateStatus(status);
+            }
+        }
+
         showError(err) {
             this.updateStatus(null);
             this.error.textContent = err;
@@ -133,6 +171,21 @@
             popup.open();
         }
 
+        editMetadata() {
+            const popup = new window.controlPopups.MetadataPopup(
+                this.info.name,
+                this.info['metadata'] || {},
+            );
+            popup.onMetadata = (metadata) => {
+                lightAPI.setMetadata(this.info.id, metadata).then(() => {
+                    return window.deviceList.reload();
+                }).catch((err) => {
+                    this.showError(err);
+                });
+            };
+            popup.open();
+        }
+
         doCall(promise) {
             this.element.classList.add('device-loading');
             this.element.classList.add('loading');
@@ -170,8 +223,12 @@
 
     window.addEventListener('load', () => {
         window.deviceList = new DeviceList();
-        lightAPI.getDevices().then((devs) => {
+        lightAPI.getWhoAmI().then((info) => {
+            window.deviceList.canEdit = (info['role'] === 'admin');
+            return lightAPI.getDevices();
+        }).then((devs) => {
             window.deviceList.update(devs);
+            lightAPI.subscribe((id, status) => window.deviceList.receiveStatus(id, status));
         }).catch((err) => {
             window.deviceList.showError(err);
         })
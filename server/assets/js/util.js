@@ -50,3 +50,8 @@ function toneColor(toneValue) {
     });
     return rgbToHex(rgb);
 }
+
+function csrfToken() {
+    const match = document.cookie.match(/(?:^|;\s*)cbyge_csrf=([^;]*)/);
+    return match ? decodeURIComponent(match[1]) : '';
+}
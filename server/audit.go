@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/unixpickle/cbyge"
+)
+
+const defaultAuditQueryLimit = 1000
+
+// An AuditEntry records a single attempt to change a device's state.
+type AuditEntry struct {
+	Time       time.Time          `json:"time"`
+	Principal  string             `json:"principal"`
+	RemoteAddr string             `json:"remote_addr"`
+	Endpoint   string             `json:"endpoint"`
+	DeviceID   string             `json:"device_id"`
+	Change     *cbyge.DeviceState `json:"change"`
+	Async      bool               `json:"async,omitempty"`
+	Result     string             `json:"result"`
+	Error      string             `json:"error,omitempty"`
+	LatencyMS  float64            `json:"latency_ms"`
+}
+
+// An AuditLog appends AuditEntries to a JSONL file, rotating the file once it
+// reaches a maximum size.
+//
+// Rotated files are named by appending ".1", ".2", etc. to the path, where
+// larger numbers are older.
+//
+// A nil *AuditLog discards all entries.
+type AuditLog struct {
+	lock     sync.Mutex
+	path     string
+	maxSize  int64
+	maxFiles int
+	file     *os.File
+	size     int64
+}
+
+// OpenAuditLog opens (or creates) an audit log file.
+//
+// If maxSize is positive, the file is rotated once it exceeds maxSize bytes,
+// and at most maxFiles rotated files are kept.
+func OpenAuditLog(path string, maxSize int64, maxFiles int) (*AuditLog, error) {
+	a := &AuditLog{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	if err := a.open(); err != nil {
+		return nil, errors.Wrap(err, "open audit log")
+	}
+	return a, nil
+}
+
+// Record appends an entry to the log.
+func (a *AuditLog) Record(e *AuditEntry) error {
+	if a == nil {
+		return nil
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return errors.Wrap(err, "record audit entry")
+	}
+	data = append(data, '\n')
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.maxSize > 0 && a.size > 0 && a.size+int64(len(data)) > a.maxSize {
+		if err := a.rotate(); err != nil {
+			return errors.Wrap(err, "record audit entry")
+		}
+	}
+	n, err := a.file.Write(data)
+	a.size += int64(n)
+	if err != nil {
+		return errors.Wrap(err, "record audit entry")
+	}
+	return nil
+}
+
+// Query reads the entries for a device (or all devices, if deviceID is empty)
+// within a time range, in chronological order.
+//
+// Zero times leave the corresponding end of the range open. If there are more
+// than limit entries, only the latest limit entries are returned.
+func (a *AuditLog) Query(deviceID string, since, until time.Time, limit int) ([]*AuditEntry, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	res := []*AuditEntry{}
+	for i := a.maxFiles; i >= 0; i-- {
+		f, err := os.Open(a.filePath(i))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, errors.Wrap(err, "query audit log")
+		}
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(nil, 1<<20)
+		for scanner.Scan() {
+			var entry AuditEntry
+			if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+				// Skip partially written lines.
+				continue
+			}
+			if deviceID != "" && entry.DeviceID != deviceID {
+				continue
+			}
+			if (!since.IsZero() && entry.Time.Before(since)) ||
+				(!until.IsZero() && entry.Time.After(until)) {
+				continue
+			}
+			res = append(res, &entry)
+			if limit > 0 && len(res) > limit {
+				res = res[1:]
+			}
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, errors.Wrap(err, "query audit log")
+		}
+	}
+	return res, nil
+}
+
+func (a *AuditLog) Close() error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.file.Close()
+}
+
+func (a *AuditLog) open() error {
+	f, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	a.file = f
+	a.size = info.Size()
+	return nil
+}
+
+func (a *AuditLog) rotate() error {
+	a.file.Close()
+	os.Remove(a.filePath(a.maxFiles))
+	for i := a.maxFiles - 1; i >= 0; i-- {
+		err := os.Rename(a.filePath(i), a.filePath(i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if a.maxFiles == 0 {
+		os.Remove(a.filePath(1))
+	}
+	return a.open()
+}
+
+func (a *AuditLog) filePath(index int) string {
+	if index == 0 {
+		return a.path
+	}
+	return fmt.Sprintf("%s.%d", a.path, index)
+}
+
+// audit records the outcome of a state change requested by r.
+func (s *Server) audit(r *http.Request, deviceID string, change cbyge.DeviceState, async bool,
+	start time.Time, err error) {
+	entry := &AuditEntry{
+		Time:       start,
+		RemoteAddr: r.RemoteAddr,
+		Endpoint:   r.Method + " " + r.URL.Path,
+		DeviceID:   deviceID,
+		Change:     &change,
+		Async:      async,
+		Result:     "ok",
+		LatencyMS:  float64(time.Since(start)) / float64(time.Millisecond),
+	}
+	if p := RequestPrincipal(r); p != nil {
+		entry.Principal = p.Name
+	}
+	if err != nil {
+		entry.Result = "error"
+		entry.Error = err.Error()
+	}
+	if err := s.auditLog.Record(entry); err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to write audit log:", err)
+	}
+}
+
+// HandleAudit queries the audit log.
+//
+// The optional "device" argument filters by device ID, and "since" and
+// "until" are RFC 3339 times bounding the range of entries.
+func (s *Server) HandleAudit(w http.ResponseWriter, r *http.Request) {
+	if s.auditLog == nil {
+		s.serveError(w, http.StatusNotFound, "audit log is not enabled (see the -audit-log flag)")
+		return
+	}
+	var times [2]time.Time
+	for i, name := range []string{"since", "until"} {
+		if value := r.FormValue(name); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				s.serveError(w, http.StatusBadRequest, "invalid '"+name+"': "+err.Error())
+				return
+			}
+			times[i] = t
+		}
+	}
+	limit := defaultAuditQueryLimit
+	if value := r.FormValue("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			s.serveError(w, http.StatusBadRequest, "invalid 'limit' argument")
+			return
+		}
+		limit = n
+	}
+	entries, err := s.auditLog.Query(r.FormValue("device"), times[0], times[1], limit)
+	if err != nil {
+		s.serveError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	s.serveObject(w, http.StatusOK, entries)
+}
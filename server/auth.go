@@ -0,0 +1,646 @@
+package main
+
+import (
+	"context"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/unixpickle/cbyge"
+)
+
+const (
+	SessionCookie = "cbyge_session"
+	CSRFCookie    = "cbyge_csrf"
+	CSRFHeader    = "X-CSRF-Token"
+	CSRFFormValue = "csrf_token"
+
+	passwordHashIterations = 100000
+)
+
+var errAccessDenied = errors.New("access denied")
+
+// A Role determines which endpoints a principal may use.
+//
+// Each role includes all of the permissions of the roles before it.
+type Role int
+
+const (
+	RoleReadOnly Role = iota
+	RoleControl
+	RoleAdmin
+)
+
+func ParseRole(s string) (Role, error) {
+	switch s {
+	case "read-only":
+		return RoleReadOnly, nil
+	case "control":
+		return RoleControl, nil
+	case "admin":
+		return RoleAdmin, nil
+	}
+	return 0, fmt.Errorf("unknown role: %#v (expected read-only, control, or admin)", s)
+}
+
+func (r Role) String() string {
+	switch r {
+	case RoleReadOnly:
+		return "read-only"
+	case RoleControl:
+		return "control"
+	case RoleAdmin:
+		return "admin"
+	}
+	return "unknown"
+}
+
+func (r Role) MarshalJSON() ([]byte, error) {
+	return json.Marshal(r.String())
+}
+
+func (r *Role) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	role, err := ParseRole(s)
+	if err != nil {
+		return err
+	}
+	*r = role
+	return nil
+}
+
+// An Allowlist restricts a principal to certain devices.
+//
+// Groups may be specified by group ID or by name. If both lists are empty,
+// all devices are allowed.
+type Allowlist struct {
+	Devices []string `json:"devices,omitempty"`
+	Groups  []string `json:"groups,omitempty"`
+}
+
+type UserConfig struct {
+	Name         string `json:"name"`
+	PasswordHash string `json:"password_hash"`
+	Role         Role   `json:"role"`
+	Allowlist
+}
+
+type APIKeyConfig struct {
+	Name    string `json:"name"`
+	KeyHash string `json:"key_hash"`
+	Role    Role   `json:"role"`
+	Allowlist
+}
+
+// AuthConfig lists the users and API keys which may access the server.
+type AuthConfig struct {
+	Users   []UserConfig   `json:"users"`
+	APIKeys []APIKeyConfig `json:"api_keys"`
+}
+
+// LoadAuthConfig reads and validates an AuthConfig from a JSON file.
+func LoadAuthConfig(path string) (*AuthConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "load auth config")
+	}
+	var config AuthConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, errors.Wrap(err, "load auth config")
+	}
+	if err := config.Validate(); err != nil {
+		return nil, errors.Wrap(err, "load auth config")
+	}
+	return &config, nil
+}
+
+// Validate checks that names are unique and hashes are well-formed.
+func (a *AuthConfig) Validate() error {
+	names := map[string]bool{}
+	for _, u := range a.Users {
+		if u.Name == "" {
+			return errors.New("user has no name")
+		}
+		if names[u.Name] {
+			return errors.New("duplicate user: " + u.Name)
+		}
+		names[u.Name] = true
+		if _, err := parseSecretHash(u.PasswordHash); err != nil {
+			return errors.Wrap(err, "user "+u.Name)
+		}
+	}
+	keyNames := map[string]bool{}
+	for _, k := range a.APIKeys {
+		if k.Name == "" {
+			return errors.New("API key has no name")
+		}
+		if keyNames[k.Name] {
+			return errors.New("duplicate API key: " + k.Name)
+		}
+		keyNames[k.Name] = true
+		if _, err := parseSecretHash(k.KeyHash); err != nil {
+			return errors.Wrap(err, "API key "+k.Name)
+		}
+	}
+	return nil
+}
+
+// A Principal is an authenticated user, API key, or legacy password holder.
+type Principal struct {
+	Name string
+	Role Role
+	Allowlist
+
+	// Set if the principal was authenticated with a session cookie.
+	session *Session
+}
+
+type principalKey struct{}
+
+// RequestPrincipal gets the principal which authenticated a request.
+func RequestPrincipal(r *http.Request) *Principal {
+	p, _ := r.Context().Value(principalKey{}).(*Principal)
+	return p
+}
+
+// A Session is a logged-in browser session.
+type Session struct {
+	Token     string
+	CSRFToken string
+	Principal *Principal
+	Expires   time.Time
+}
+
+// A SessionStore keeps track of browser sessions in memory.
+type SessionStore struct {
+	lock     sync.Mutex
+	sessions map[string]*Session
+}
+
+func NewSessionStore() *SessionStore {
+	return &SessionStore{sessions: map[string]*Session{}}
+}
+
+// Create starts a new session for a principal.
+func (s *SessionStore) Create(p *Principal) *Session {
+	session := &Session{
+		Token:     randomToken(),
+		CSRFToken: randomToken(),
+		Principal: p,
+		Expires:   time.Now().Add(SessionExpiration),
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for token, old := range s.sessions {
+		if time.Now().After(old.Expires) {
+			delete(s.sessions, token)
+		}
+	}
+	s.sessions[session.Token] = session
+	return session
+}
+
+// Get looks up an unexpired session, extending its expiration.
+func (s *SessionStore) Get(token string) *Session {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	session, ok := s.sessions[token]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(session.Expires) {
+		delete(s.sessions, token)
+		return nil
+	}
+	session.Expires = time.Now().Add(SessionExpiration)
+	return session
+}
+
+func (s *SessionStore) Delete(token string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.sessions, token)
+}
+
+// Auth requires a principal with at least read-only access.
+func (s *Server) Auth(handler http.HandlerFunc) http.Handler {
+	return s.AuthRole(RoleReadOnly, handler)
+}
+
+// AuthRole requires a principal with at least the given role.
+//
+// Principals authenticated by a session cookie must also provide a CSRF
+// token for any endpoint which requires more than read-only access.
+func (s *Server) AuthRole(role Role, handler http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := s.authenticate(r, true)
+		if p == nil {
+			if r.FormValue("auth") != "" {
+				s.serveError(w, http.StatusUnauthorized, "incorrect 'auth' parameter")
+				return
+			}
+			// Most likely a front-end request.
+			w.Header().Set("WWW-Authenticate", `Basic realm="bad credentials"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte("Unauthorised.\n"))
+			return
+		}
+		if err := checkPermission(p, role, r); err != "" {
+			s.serveError(w, http.StatusForbidden, err)
+			return
+		}
+		handler(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, p)))
+	})
+}
+
+// AuthPage is like Auth, but redirects browsers to the login page when users
+// are configured, and leaves the login page and its resources public.
+func (s *Server) AuthPage(handler http.HandlerFunc) http.Handler {
+	authed := s.Auth(handler)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isPublicPath(r.URL.Path) {
+			handler(w, r)
+			return
+		}
+		if !s.getConfig().NoAuth && s.hasUsers() && s.authenticate(r, false) == nil {
+			http.Redirect(w, r, "/login.html", http.StatusTemporaryRedirect)
+			return
+		}
+		authed.ServeHTTP(w, r)
+	})
+}
+
+// HandleLogin creates a browser session from a username and password.
+func (s *Server) HandleLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		s.serveError(w, http.StatusMethodNotAllowed, "login requires POST")
+		return
+	}
+	p := s.checkPassword(r.FormValue("username"), r.FormValue("password"))
+	if p == nil {
+		http.Redirect(w, r, "/login.html?error="+url.QueryEscape("incorrect username or password"),
+			http.StatusSeeOther)
+		return
+	}
+	session := s.sessions.Create(p)
+	secure := r.TLS != nil
+	http.SetCookie(w, &http.Cookie{
+		Name:     SessionCookie,
+		Value:    session.Token,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   secure,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.SetCookie(w, &http.Cookie{
+		Name:     CSRFCookie,
+		Value:    session.CSRFToken,
+		Path:     "/",
+		Secure:   secure,
+		SameSite: http.SameSiteStrictMode,
+	})
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// HandleLogout ends a browser session.
+//
+// Like other state-changing endpoints, it requires a POST with the session's
+// CSRF token, so that other sites cannot log users out.
+func (s *Server) HandleLogout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		s.serveError(w, http.StatusMethodNotAllowed, "logout requires POST")
+		return
+	}
+	if cookie, err := r.Cookie(SessionCookie); err == nil {
+		if session := s.sessions.Get(cookie.Value); session != nil {
+			if !checkCSRF(session, r) {
+				s.serveError(w, http.StatusForbidden, "missing or invalid CSRF token")
+				return
+			}
+			s.sessions.Delete(session.Token)
+		}
+	}
+	for _, name := range []string{SessionCookie, CSRFCookie} {
+		http.SetCookie(w, &http.Cookie{Name: name, Path: "/", MaxAge: -1})
+	}
+	http.Redirect(w, r, "/login.html", http.StatusSeeOther)
+}
+
+// authenticate finds the principal for a request, or returns nil.
+//
+// If allowQuery is true, the legacy "auth" parameter is accepted.
+func (s *Server) authenticate(r *http.Request, allowQuery bool) *Principal {
+	if s.getConfig().NoAuth {
+		return &Principal{Name: "anonymous", Role: RoleAdmin}
+	}
+	config := s.getAuthConfig()
+
+	if key := requestAPIKey(r); key != "" {
+		for _, k := range config.APIKeys {
+			if verifySecret(k.KeyHash, key) {
+				return &Principal{Name: "key:" + k.Name, Role: k.Role, Allowlist: k.Allowlist}
+			}
+		}
+		return nil
+	}
+
+	if cookie, err := r.Cookie(SessionCookie); err == nil {
+		if session := s.sessions.Get(cookie.Value); session != nil {
+			p := *session.Principal
+			p.session = session
+			return &p
+		}
+	}
+
+	if user, pass, ok := r.BasicAuth(); ok {
+		return s.checkPassword(user, pass)
+	}
+
+	if allowQuery {
+		if pass := r.FormValue("auth"); pass != "" {
+			return s.checkPassword("", pass)
+		}
+	}
+	return nil
+}
+
+// checkPassword authenticates a configured user, or the legacy web password
+// if no matching user exists.
+func (s *Server) checkPassword(user, pass string) *Principal {
+	config := s.getAuthConfig()
+	for _, u := range config.Users {
+		if u.Name == user {
+			if verifySecret(u.PasswordHash, pass) {
+				return &Principal{Name: u.Name, Role: u.Role, Allowlist: u.Allowlist}
+			}
+			return nil
+		}
+	}
+	webPassword := s.webPassword()
+	if webPassword != "" &&
+		subtle.ConstantTimeCompare([]byte(pass), []byte(webPassword)) == 1 {
+		return &Principal{Name: "admin", Role: RoleAdmin}
+	}
+	return nil
+}
+
+func (s *Server) getAuthConfig() *AuthConfig {
+	s.configLock.RLock()
+	defer s.configLock.RUnlock()
+	if s.authConfig == nil {
+		return &AuthConfig{}
+	}
+	return s.authConfig
+}
+
+// webPassword gets the legacy password which grants admin access.
+//
+// If no users are configured, it defaults to the account password.
+func (s *Server) webPassword() string {
+	s.configLock.RLock()
+	defer s.configLock.RUnlock()
+	if s.config.WebPassword == "" && len(s.authConfig.Users) == 0 {
+		return s.Password
+	}
+	return s.config.WebPassword
+}
+
+func (s *Server) hasUsers() bool {
+	return len(s.getAuthConfig().Users) > 0
+}
+
+// allowsDevice checks if a principal may see and control a device.
+func (s *Server) allowsDevice(p *Principal, d *cbyge.ControllerDevice) bool {
+	if p == nil {
+		return false
+	}
+	if len(p.Devices) == 0 && len(p.Groups) == 0 {
+		return true
+	}
+	for _, id := range p.Devices {
+		if id == d.DeviceID() {
+			return true
+		}
+	}
+	if len(p.Groups) == 0 {
+		return false
+	}
+	groups, err := s.getGroups()
+	if err != nil {
+		return false
+	}
+	for _, g := range groups {
+		if !containsString(p.Groups, g.GroupID()) && !containsString(p.Groups, g.Name()) {
+			continue
+		}
+		for _, gd := range g.Devices() {
+			if gd == d {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// allowsGroup checks if a principal may access any device in a group.
+func (s *Server) allowsGroup(p *Principal, g *cbyge.ControllerGroup) bool {
+	for _, d := range g.Devices() {
+		if s.allowsDevice(p, d) {
+			return true
+		}
+	}
+	return false
+}
+
+// getDeviceFor looks up a device by ID, failing if the request's principal
+// may not access it.
+func (s *Server) getDeviceFor(r *http.Request, id string) (*cbyge.ControllerDevice, error) {
+	dev, err := s.getDevice(id)
+	if err != nil {
+		return nil, err
+	}
+	if !s.allowsDevice(RequestPrincipal(r), dev) {
+		return nil, errors.Wrap(errAccessDenied, "device "+id)
+	}
+	return dev, nil
+}
+
+// filterDevices removes the devices which a request's principal may not
+// access.
+func (s *Server) filterDevices(r *http.Request, devs []*cbyge.ControllerDevice) []*cbyge.ControllerDevice {
+	p := RequestPrincipal(r)
+	res := []*cbyge.ControllerDevice{}
+	for _, d := range devs {
+		if s.allowsDevice(p, d) {
+			res = append(res, d)
+		}
+	}
+	return res
+}
+
+// serveDeviceError reports an error from getDeviceFor() or an operation on
+// the resulting device.
+func (s *Server) serveDeviceError(w http.ResponseWriter, err error) {
+	if errors.Cause(err) == errAccessDenied {
+		s.serveError(w, http.StatusForbidden, err.Error())
+	} else if errors.Cause(err) == errInvalidSelector {
+		s.serveError(w, http.StatusBadRequest, err.Error())
+	} else if errors.Cause(err) == errDeviceNotFound {
+		s.serveError(w, http.StatusNotFound, err.Error())
+	} else {
+		s.serveError(w, http.StatusInternalServerError, err.Error())
+	}
+}
+
+func checkPermission(p *Principal, role Role, r *http.Request) string {
+	if p.Role < role {
+		return "insufficient permissions: requires " + role.String() + " role"
+	}
+	if role > RoleReadOnly && p.session != nil && !checkCSRF(p.session, r) {
+		return "missing or invalid CSRF token"
+	}
+	return ""
+}
+
+// checkCSRF checks that a request carries a session's CSRF token, either in
+// a header or in a form value.
+func checkCSRF(session *Session, r *http.Request) bool {
+	token := r.Header.Get(CSRFHeader)
+	if token == "" {
+		token = r.PostFormValue(CSRFFormValue)
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(session.CSRFToken)) == 1
+}
+
+func requestAPIKey(r *http.Request) string {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	return ""
+}
+
+func isPublicPath(path string) bool {
+	if path == "/login.html" || path == "/favicon.ico" || path == "/manifest.webmanifest" {
+		return true
+	}
+	for _, prefix := range []string{"/css/", "/icons/", "/svg/"} {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// HashPassword creates a salted PBKDF2 hash of a password for use in an
+// AuthConfig.
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key, err := pbkdf2.Key(sha256.New, password, salt, passwordHashIterations, 32)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("pbkdf2-sha256$%d$%s$%s", passwordHashIterations,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// GenerateAPIKey creates a random API key and its hash.
+func GenerateAPIKey() (key, hash string) {
+	key = randomToken()
+	sum := sha256.Sum256([]byte(key))
+	return key, "sha256$" + hex.EncodeToString(sum[:])
+}
+
+type secretHash struct {
+	Kind       string
+	Iterations int
+	Salt       []byte
+	Hash       []byte
+}
+
+func parseSecretHash(s string) (*secretHash, error) {
+	parts := strings.Split(s, "$")
+	switch parts[0] {
+	case "sha256":
+		if len(parts) != 2 {
+			break
+		}
+		hash, err := hex.DecodeString(parts[1])
+		if err != nil || len(hash) != sha256.Size {
+			break
+		}
+		return &secretHash{Kind: parts[0], Hash: hash}, nil
+	case "pbkdf2-sha256":
+		if len(parts) != 4 {
+			break
+		}
+		iters, err := strconv.Atoi(parts[1])
+		if err != nil || iters < 1 {
+			break
+		}
+		salt, err1 := base64.RawStdEncoding.DecodeString(parts[2])
+		hash, err2 := base64.RawStdEncoding.DecodeString(parts[3])
+		if err1 != nil || err2 != nil || len(hash) == 0 {
+			break
+		}
+		return &secretHash{Kind: parts[0], Iterations: iters, Salt: salt, Hash: hash}, nil
+	}
+	return nil, errors.New("invalid secret hash (expected sha256$... or pbkdf2-sha256$...)")
+}
+
+func verifySecret(hash, secret string) bool {
+	parsed, err := parseSecretHash(hash)
+	if err != nil {
+		return false
+	}
+	var actual []byte
+	if parsed.Kind == "sha256" {
+		sum := sha256.Sum256([]byte(secret))
+		actual = sum[:]
+	} else {
+		actual, err = pbkdf2.Key(sha256.New, secret, parsed.Salt, parsed.Iterations,
+			len(parsed.Hash))
+		if err != nil {
+			return false
+		}
+	}
+	return subtle.ConstantTimeCompare(actual, parsed.Hash) == 1
+}
+
+func randomToken() string {
+	data := make([]byte, 24)
+	if _, err := rand.Read(data); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func containsString(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/unixpickle/cbyge"
+)
+
+// newTestServer creates a Server with the given users and API keys, whose
+// device list is replayed from a cassette. There are three devices: 1001 and
+// 1002 in the "Living Room" group (ID 555-1), and 1003 in "Kitchen" (555-2).
+//
+// The devices' switch IDs do not fit in 32 bits, so the controller never
+// connects to query their status.
+func newTestServer(t *testing.T, users []UserConfig, keys []APIKeyConfig) *Server {
+	cassette := &cbyge.Cassette{}
+	for _, x := range []*cbyge.CassetteInteraction{
+		{
+			Method:       "GET",
+			Path:         "/v2/user/123/subscribe/devices",
+			Status:       200,
+			ResponseBody: `[{"id":555,"name":"Home","product_id":"abc","is_online":true}]`,
+		},
+		{
+			Method: "GET",
+			Path:   "/v2/product/abc/device/555/property",
+			Status: 200,
+			ResponseBody: `{"bulbsArray":[` +
+				`{"deviceID":1001,"displayName":"Lamp","switchID":1099511627776},` +
+				`{"deviceID":1002,"displayName":"Ceiling","switchID":1099511627777},` +
+				`{"deviceID":1003,"displayName":"Stove Light","switchID":1099511627778}],` +
+				`"groupsArray":[` +
+				`{"groupID":1,"displayName":"Living Room","deviceIDArray":[1001,1002]},` +
+				`{"groupID":2,"displayName":"Kitchen","deviceIDArray":[1003]}]}`,
+		},
+	} {
+		cassette.Add(x)
+	}
+	api := httptest.NewServer(cassette)
+	t.Cleanup(api.Close)
+	cbyge.APIBaseURL = api.URL
+	t.Cleanup(func() {
+		cbyge.APIBaseURL = cbyge.DefaultAPIBaseURL
+	})
+
+	s := &Server{
+		Password:   "account-password",
+		metrics:    cbyge.NewMetrics(),
+		apiMetrics: NewAPIMetrics(),
+		events:     NewEventHub(),
+		sessions:   NewSessionStore(),
+		controller: cbyge.NewController(&cbyge.SessionInfo{UserID: 123, AccessToken: "t"}, 0),
+	}
+	config := DefaultConfig()
+	config.Users = users
+	config.APIKeys = keys
+	if err := s.applyConfig(config); err != nil {
+		t.Fatal(err)
+	}
+	var err error
+	s.metadata, err = OpenMetadataStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	devs, err := s.getDevices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devs) != 3 {
+		t.Fatalf("unexpected devices: %v", deviceIDs(devs))
+	}
+	return s
+}
+
+// withPrincipal attaches a principal to a request, as AuthRole does.
+func withPrincipal(r *http.Request, p *Principal) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), principalKey{}, p))
+}
+
+func TestCheckPassword(t *testing.T) {
+	hash, err := HashPassword("guest-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	guest := UserConfig{Name: "guest", PasswordHash: hash, Role: RoleControl,
+		Allowlist: Allowlist{Groups: []string{"Kitchen"}}}
+
+	testCases := []struct {
+		name        string
+		users       []UserConfig
+		webPassword string
+		user, pass  string
+
+		principal string
+		role      Role
+	}{
+		{"AccountPassword", nil, "", "", "account-password", "admin", RoleAdmin},
+		{"WrongAccountPassword", nil, "", "", "nope", "", 0},
+		{"WebPassword", nil, "web", "anyone", "web", "admin", RoleAdmin},
+		{"AccountPasswordWithWebPassword", nil, "web", "", "account-password", "", 0},
+		{"User", []UserConfig{guest}, "", "guest", "guest-password", "guest", RoleControl},
+		{"UserWrongPassword", []UserConfig{guest}, "web", "guest", "web", "", 0},
+		{"UnknownUser", []UserConfig{guest}, "", "other", "guest-password", "", 0},
+		{"AccountPasswordWithUsers", []UserConfig{guest}, "", "", "account-password", "", 0},
+		{"WebPasswordWithUsers", []UserConfig{guest}, "web", "", "web", "admin", RoleAdmin},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestServer(t, tc.users, nil)
+			s.config.WebPassword = tc.webPassword
+			p := s.checkPassword(tc.user, tc.pass)
+			if tc.principal == "" {
+				if p != nil {
+					t.Fatalf("unexpected principal: %+v", p)
+				}
+				return
+			}
+			if p == nil {
+				t.Fatal("expected a principal")
+			}
+			if p.Name != tc.principal || p.Role != tc.role {
+				t.Errorf("unexpected principal: %+v", p)
+			}
+			if tc.user == "guest" && !containsString(p.Groups, "Kitchen") {
+				t.Errorf("missing allowlist: %+v", p)
+			}
+		})
+	}
+}
+
+func TestCheckPermission(t *testing.T) {
+	session := &Session{CSRFToken: "csrf"}
+	testCases := []struct {
+		name      string
+		principal *Principal
+		role      Role
+		header    string
+		form      string
+		allowed   bool
+	}{
+		{"ReadOnlyReads", &Principal{Role: RoleReadOnly}, RoleReadOnly, "", "", true},
+		{"ReadOnlyControls", &Principal{Role: RoleReadOnly}, RoleControl, "", "", false},
+		{"ControlControls", &Principal{Role: RoleControl}, RoleControl, "", "", true},
+		{"ControlAdmin", &Principal{Role: RoleControl}, RoleAdmin, "", "", false},
+		{"AdminAdmin", &Principal{Role: RoleAdmin}, RoleAdmin, "", "", true},
+		{"SessionReadsWithoutCSRF", &Principal{Role: RoleAdmin, session: session}, RoleReadOnly,
+			"", "", true},
+		{"SessionWithoutCSRF", &Principal{Role: RoleAdmin, session: session}, RoleControl,
+			"", "", false},
+		{"SessionWrongCSRF", &Principal{Role: RoleAdmin, session: session}, RoleControl,
+			"other", "", false},
+		{"SessionCSRFHeader", &Principal{Role: RoleAdmin, session: session}, RoleControl,
+			"csrf", "", true},
+		{"SessionCSRFForm", &Principal{Role: RoleAdmin, session: session}, RoleAdmin,
+			"", "csrf", true},
+		{"SessionCSRFWrongRole", &Principal{Role: RoleReadOnly, session: session}, RoleControl,
+			"csrf", "", false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			form := url.Values{}
+			if tc.form != "" {
+				form.Set(CSRFFormValue, tc.form)
+			}
+			r := httptest.NewRequest("POST", "/api/device/set_on", strings.NewReader(form.Encode()))
+			r.Header.Set("content-type", "application/x-www-form-urlencoded")
+			if tc.header != "" {
+				r.Header.Set(CSRFHeader, tc.header)
+			}
+			msg := checkPermission(tc.principal, tc.role, r)
+			if (msg == "") != tc.allowed {
+				t.Errorf("expected allowed=%v, but got message %q", tc.allowed, msg)
+			}
+		})
+	}
+}
+
+func TestAuthRole(t *testing.T) {
+	controlKey, controlHash := GenerateAPIKey()
+	readKey, readHash := GenerateAPIKey()
+	s := newTestServer(t, nil, []APIKeyConfig{
+		{Name: "control", KeyHash: controlHash, Role: RoleControl},
+		{Name: "read", KeyHash: readHash, Role: RoleReadOnly},
+	})
+	session := s.sessions.Create(&Principal{Name: "user", Role: RoleControl})
+
+	testCases := []struct {
+		name      string
+		role      Role
+		setup     func(r *http.Request)
+		status    int
+		principal string
+	}{
+		{"NoCredentials", RoleReadOnly, func(r *http.Request) {}, http.StatusUnauthorized, ""},
+		{"APIKey", RoleControl, func(r *http.Request) {
+			r.Header.Set("X-API-Key", controlKey)
+		}, http.StatusOK, "key:control"},
+		{"BearerKey", RoleReadOnly, func(r *http.Request) {
+			r.Header.Set("Authorization", "Bearer "+readKey)
+		}, http.StatusOK, "key:read"},
+		{"KeyRole", RoleControl, func(r *http.Request) {
+			r.Header.Set("X-API-Key", readKey)
+		}, http.StatusForbidden, ""},
+		{"WrongKey", RoleReadOnly, func(r *http.Request) {
+			r.Header.Set("X-API-Key", "wrong")
+		}, http.StatusUnauthorized, ""},
+		{"WrongKeyWithPassword", RoleReadOnly, func(r *http.Request) {
+			r.Header.Set("X-API-Key", "wrong")
+			r.SetBasicAuth("", "account-password")
+		}, http.StatusUnauthorized, ""},
+		{"BasicAuth", RoleAdmin, func(r *http.Request) {
+			r.SetBasicAuth("", "account-password")
+		}, http.StatusOK, "admin"},
+		{"SessionRead", RoleReadOnly, func(r *http.Request) {
+			r.AddCookie(&http.Cookie{Name: SessionCookie, Value: session.Token})
+		}, http.StatusOK, "user"},
+		{"SessionWithoutCSRF", RoleControl, func(r *http.Request) {
+			r.AddCookie(&http.Cookie{Name: SessionCookie, Value: session.Token})
+		}, http.StatusForbidden, ""},
+		{"SessionWithCSRF", RoleControl, func(r *http.Request) {
+			r.AddCookie(&http.Cookie{Name: SessionCookie, Value: session.Token})
+			r.Header.Set(CSRFHeader, session.CSRFToken)
+		}, http.StatusOK, "user"},
+		{"UnknownSession", RoleReadOnly, func(r *http.Request) {
+			r.AddCookie(&http.Cookie{Name: SessionCookie, Value: "unknown"})
+		}, http.StatusUnauthorized, ""},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var principal string
+			handler := s.AuthRole(tc.role, func(w http.ResponseWriter, r *http.Request) {
+				principal = RequestPrincipal(r).Name
+			})
+			r := httptest.NewRequest("POST", "/api/test", nil)
+			tc.setup(r)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != tc.status {
+				t.Fatalf("expected status %d but got %d", tc.status, w.Code)
+			}
+			if principal != tc.principal {
+				t.Errorf("expected principal %q but got %q", tc.principal, principal)
+			}
+		})
+	}
+}
+
+func TestHandleLogout(t *testing.T) {
+	s := newTestServer(t, nil, nil)
+	session := s.sessions.Create(&Principal{Name: "user", Role: RoleReadOnly})
+	logout := func(method, csrf string) int {
+		r := httptest.NewRequest(method, "/auth/logout", nil)
+		r.AddCookie(&http.Cookie{Name: SessionCookie, Value: session.Token})
+		if csrf != "" {
+			r.Header.Set(CSRFHeader, csrf)
+		}
+		w := httptest.NewRecorder()
+		s.HandleLogout(w, r)
+		return w.Code
+	}
+	if code := logout("GET", session.CSRFToken); code != http.StatusMethodNotAllowed {
+		t.Errorf("unexpected status for GET: %d", code)
+	}
+	if code := logout("POST", ""); code != http.StatusForbidden {
+		t.Errorf("unexpected status without CSRF token: %d", code)
+	}
+	if code := logout("POST", "wrong"); code != http.StatusForbidden {
+		t.Errorf("unexpected status with wrong CSRF token: %d", code)
+	}
+	if s.sessions.Get(session.Token) == nil {
+		t.Fatal("session ended without a valid CSRF token")
+	}
+	if code := logout("POST", session.CSRFToken); code != http.StatusSeeOther {
+		t.Errorf("unexpected status: %d", code)
+	}
+	if s.sessions.Get(session.Token) != nil {
+		t.Error("session still exists after logout")
+	}
+}
+
+func TestAllowsDevice(t *testing.T) {
+	s := newTestServer(t, nil, nil)
+	groups, err := s.getGroups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		name      string
+		principal *Principal
+		devices   string
+		groups    string
+	}{
+		{"Nil", nil, "", ""},
+		{"Unrestricted", &Principal{}, "1001,1002,1003", "Living Room,Kitchen"},
+		{"Device", &Principal{Allowlist: Allowlist{Devices: []string{"1001"}}}, "1001",
+			"Living Room"},
+		{"GroupName", &Principal{Allowlist: Allowlist{Groups: []string{"Kitchen"}}}, "1003",
+			"Kitchen"},
+		{"GroupID", &Principal{Allowlist: Allowlist{Groups: []string{"555-1"}}}, "1001,1002",
+			"Living Room"},
+		{"DeviceAndGroup", &Principal{Allowlist: Allowlist{
+			Devices: []string{"1002"},
+			Groups:  []string{"Kitchen"},
+		}}, "1002,1003", "Living Room,Kitchen"},
+		{"UnknownGroup", &Principal{Allowlist: Allowlist{Groups: []string{"Garage"}}}, "", ""},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			devs, err := s.getDevices()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var allowed []string
+			for _, d := range devs {
+				if s.allowsDevice(tc.principal, d) {
+					allowed = append(allowed, d.DeviceID())
+				}
+			}
+			if strings.Join(allowed, ",") != tc.devices {
+				t.Errorf("expected devices %q but got %v", tc.devices, allowed)
+			}
+			var allowedGroups []string
+			for _, g := range groups {
+				if s.allowsGroup(tc.principal, g) {
+					allowedGroups = append(allowedGroups, g.Name())
+				}
+			}
+			if strings.Join(allowedGroups, ",") != tc.groups {
+				t.Errorf("expected groups %q but got %v", tc.groups, allowedGroups)
+			}
+		})
+	}
+}
+
+func TestEncodeV2Group(t *testing.T) {
+	s := newTestServer(t, nil, nil)
+	groups, err := s.getGroups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	livingRoom := groups[0]
+	testCases := []struct {
+		name      string
+		principal *Principal
+		expected  []string
+	}{
+		{"Unrestricted", &Principal{}, []string{"1001", "1002"}},
+		{"Device", &Principal{Allowlist: Allowlist{Devices: []string{"1001"}}}, []string{"1001"}},
+		{"Group", &Principal{Allowlist: Allowlist{Groups: []string{"Kitchen"}}}, []string{}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			encoded := s.encodeV2Group(tc.principal, livingRoom)
+			ids := encoded["device_ids"].([]string)
+			if strings.Join(ids, ",") != strings.Join(tc.expected, ",") {
+				t.Errorf("expected device IDs %v but got %v", tc.expected, ids)
+			}
+		})
+	}
+}
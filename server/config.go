@@ -0,0 +1,421 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/unixpickle/cbyge"
+)
+
+// ConfigEnvPrefix is prepended to the upper-case name of each flag (with
+// dashes replaced by underscores) to get the environment variable which
+// overrides it, e.g. CBYGE_WEB_PASSWORD for -web-password.
+const ConfigEnvPrefix = "CBYGE_"
+
+// Config is the configuration of the server.
+//
+// Settings are read from a JSON config file, then overridden by environment
+// variables, and finally by command-line flags.
+type Config struct {
+	Addr   string `json:"addr"`
+	Assets string `json:"assets"`
+
+	Email           string   `json:"email"`
+	Password        string   `json:"password"`
+	PasswordFile    string   `json:"password_file"`
+	SessionInfo     JSONText `json:"session_info"`
+	SessionInfoFile string   `json:"session_info_file"`
+
+	WebPassword     string         `json:"web_password"`
+	WebPasswordFile string         `json:"web_password_file"`
+	NoAuth          bool           `json:"no_auth"`
+	UsersFile       string         `json:"users_file"`
+	Users           []UserConfig   `json:"users"`
+	APIKeys         []APIKeyConfig `json:"api_keys"`
+
+	PollInterval Duration `json:"poll_interval"`
+	JobRetention Duration `json:"job_retention"`
+
+	AuditLog      string `json:"audit_log"`
+	AuditMaxSize  int64  `json:"audit_max_size"`
+	AuditMaxFiles int    `json:"audit_max_files"`
+
+	TLSCert       string `json:"tls_cert"`
+	TLSKey        string `json:"tls_key"`
+	TLSSelfSigned bool   `json:"tls_self_signed"`
+
+	ReadHeaderTimeout Duration `json:"read_header_timeout"`
+	ReadTimeout       Duration `json:"read_timeout"`
+	WriteTimeout      Duration `json:"write_timeout"`
+	IdleTimeout       Duration `json:"idle_timeout"`
+	ShutdownTimeout   Duration `json:"shutdown_timeout"`
+
+	StateFile    string `json:"state_file"`
+	MetadataFile string `json:"metadata_file"`
+}
+
+// DefaultConfig creates a config with default settings.
+func DefaultConfig() *Config {
+	return &Config{
+		Addr:          ":8080",
+		PollInterval:  Duration(time.Second * 30),
+		JobRetention:  Duration(time.Minute * 10),
+		AuditMaxSize:  10 << 20,
+		AuditMaxFiles: 5,
+
+		ReadHeaderTimeout: Duration(time.Second * 10),
+		ReadTimeout:       Duration(time.Second * 30),
+		WriteTimeout:      Duration(time.Minute * 2),
+		IdleTimeout:       Duration(time.Minute * 2),
+		ShutdownTimeout:   Duration(time.Second * 30),
+	}
+}
+
+// RegisterFlags adds a flag for each setting to fs, using the current values
+// as the defaults.
+func (c *Config) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.Addr, "addr", c.Addr, "address to listen on")
+	fs.StringVar(&c.Assets, "assets", c.Assets,
+		"serve the web UI from this directory instead of the embedded copy")
+	fs.StringVar(&c.Email, "email", c.Email, "C by GE account email")
+	fs.StringVar(&c.Password, "password", c.Password, "C by GE account password")
+	fs.StringVar(&c.PasswordFile, "password-file", c.PasswordFile,
+		"file containing the C by GE account password")
+	fs.Var(&c.SessionInfo, "sessinfo", "Cync session info from 2FA login")
+	fs.StringVar(&c.SessionInfoFile, "sessinfo-file", c.SessionInfoFile,
+		"file containing Cync session info from 2FA login")
+	fs.StringVar(&c.WebPassword, "web-password", c.WebPassword,
+		"password for basic auth, if different than the account password")
+	fs.StringVar(&c.WebPasswordFile, "web-password-file", c.WebPasswordFile,
+		"file containing the password for basic auth")
+	fs.BoolVar(&c.NoAuth, "no-auth", c.NoAuth, "do not require any password")
+	fs.StringVar(&c.UsersFile, "users", c.UsersFile, "JSON file listing users and API keys")
+	fs.Var(&c.PollInterval, "poll-interval",
+		"status polling interval while clients are listening for events (0 to disable)")
+	fs.Var(&c.JobRetention, "job-retention", "how long to remember finished async jobs")
+	fs.StringVar(&c.AuditLog, "audit-log", c.AuditLog,
+		"JSONL file to record device state changes in")
+	fs.Int64Var(&c.AuditMaxSize, "audit-max-size", c.AuditMaxSize,
+		"size in bytes at which to rotate the audit log (0 to disable rotation)")
+	fs.IntVar(&c.AuditMaxFiles, "audit-max-files", c.AuditMaxFiles,
+		"number of rotated audit logs to keep")
+	fs.StringVar(&c.TLSCert, "tls-cert", c.TLSCert,
+		"TLS certificate file (reloaded when it changes)")
+	fs.StringVar(&c.TLSKey, "tls-key", c.TLSKey, "TLS private key file")
+	fs.BoolVar(&c.TLSSelfSigned, "tls-self-signed", c.TLSSelfSigned,
+		"serve TLS with a self-signed certificate, creating -tls-cert and -tls-key if needed")
+	fs.Var(&c.ReadHeaderTimeout, "read-header-timeout", "timeout for reading request headers")
+	fs.Var(&c.ReadTimeout, "read-timeout", "timeout for reading requests")
+	fs.Var(&c.WriteTimeout, "write-timeout",
+		"timeout for writing responses (event streams are exempt)")
+	fs.Var(&c.IdleTimeout, "idle-timeout", "timeout for idle keep-alive connections")
+	fs.Var(&c.ShutdownTimeout, "shutdown-timeout",
+		"how long to wait for in-flight operations when shutting down")
+	fs.StringVar(&c.StateFile, "state-file", c.StateFile,
+		"file to keep state (such as the 2FA session) in across restarts")
+	fs.StringVar(&c.MetadataFile, "metadata-file", c.MetadataFile,
+		"JSON file to keep device aliases, tags, and ordering in")
+}
+
+// Validate checks that the config is complete and consistent.
+func (c *Config) Validate() error {
+	if c.Addr == "" {
+		return errors.New("missing listen address")
+	}
+	if c.SessionInfo == "" && (c.Email == "" || c.Password == "") {
+		return errors.New("must provide an email and password, or session info")
+	}
+	if c.SessionInfo != "" {
+		var info cbyge.SessionInfo
+		if err := json.Unmarshal([]byte(c.SessionInfo), &info); err != nil {
+			return errors.Wrap(err, "invalid session info")
+		}
+	}
+	if c.PollInterval < 0 {
+		return errors.New("poll interval must not be negative")
+	}
+	if c.JobRetention <= 0 {
+		return errors.New("job retention must be positive")
+	}
+	if c.AuditMaxSize < 0 || c.AuditMaxFiles < 0 {
+		return errors.New("audit log limits must not be negative")
+	}
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		return errors.New("TLS certificate and key must be specified together")
+	}
+	for _, timeout := range []Duration{c.ReadHeaderTimeout, c.ReadTimeout, c.WriteTimeout,
+		c.IdleTimeout, c.ShutdownTimeout} {
+		if timeout < 0 {
+			return errors.New("timeouts must not be negative")
+		}
+	}
+	return nil
+}
+
+// LoadAuthConfig combines the users and API keys from the config with those
+// from the users file, if there is one.
+func (c *Config) LoadAuthConfig() (*AuthConfig, error) {
+	res := &AuthConfig{
+		Users:   append([]UserConfig{}, c.Users...),
+		APIKeys: append([]APIKeyConfig{}, c.APIKeys...),
+	}
+	if c.UsersFile != "" {
+		fileConfig, err := LoadAuthConfig(c.UsersFile)
+		if err != nil {
+			return nil, err
+		}
+		res.Users = append(res.Users, fileConfig.Users...)
+		res.APIKeys = append(res.APIKeys, fileConfig.APIKeys...)
+	}
+	if err := res.Validate(); err != nil {
+		return nil, errors.Wrap(err, "load auth config")
+	}
+	return res, nil
+}
+
+// readSecretFiles replaces each secret which has a file setting with the
+// contents of that file, and then clears the file setting.
+//
+// This is done after each layer of the config is applied, so that a secret
+// file from one layer never overrides a secret from a later layer.
+func (c *Config) readSecretFiles() error {
+	for _, secret := range []struct {
+		path  *string
+		value *string
+	}{
+		{&c.PasswordFile, &c.Password},
+		{&c.WebPasswordFile, &c.WebPassword},
+		{&c.SessionInfoFile, (*string)(&c.SessionInfo)},
+	} {
+		if *secret.path == "" {
+			continue
+		}
+		data, err := os.ReadFile(*secret.path)
+		if err != nil {
+			return errors.Wrap(err, "read secret")
+		}
+		*secret.value = strings.TrimSpace(string(data))
+		*secret.path = ""
+	}
+	return nil
+}
+
+// A ConfigSource loads the config from a file, the environment, and a set of
+// command-line flags, so that it can be reloaded later.
+type ConfigSource struct {
+	// Path is the JSON config file, or "" to use the defaults.
+	Path string
+
+	// Flags maps the names of explicitly set command-line flags to their
+	// values.
+	Flags map[string]string
+}
+
+// NewConfigSource creates a ConfigSource using the flags which were set on
+// a parsed flag set.
+//
+// Only flags registered by Config.RegisterFlags are recorded.
+func NewConfigSource(path string, fs *flag.FlagSet) *ConfigSource {
+	configFlags := flag.NewFlagSet("config", flag.ContinueOnError)
+	DefaultConfig().RegisterFlags(configFlags)
+	res := &ConfigSource{Path: path, Flags: map[string]string{}}
+	fs.Visit(func(f *flag.Flag) {
+		if configFlags.Lookup(f.Name) != nil {
+			res.Flags[f.Name] = f.Value.String()
+		}
+	})
+	return res
+}
+
+// Load reads and validates the config.
+func (c *ConfigSource) Load() (*Config, error) {
+	config := DefaultConfig()
+	if c.Path != "" {
+		data, err := os.ReadFile(c.Path)
+		if err != nil {
+			return nil, errors.Wrap(err, "load config")
+		}
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(config); err != nil {
+			return nil, errors.Wrap(err, "load config "+c.Path)
+		}
+		if err := config.readSecretFiles(); err != nil {
+			return nil, errors.Wrap(err, "load config")
+		}
+	}
+
+	fs := flag.NewFlagSet("config", flag.ContinueOnError)
+	config.RegisterFlags(fs)
+	var envErr error
+	fs.VisitAll(func(f *flag.Flag) {
+		name := ConfigEnvPrefix + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+		if value, ok := os.LookupEnv(name); ok && envErr == nil {
+			if err := fs.Set(f.Name, value); err != nil {
+				envErr = errors.Wrap(err, "load config: environment variable "+name)
+			}
+		}
+	})
+	if envErr != nil {
+		return nil, envErr
+	}
+	if err := config.readSecretFiles(); err != nil {
+		return nil, errors.Wrap(err, "load config")
+	}
+	for name, value := range c.Flags {
+		if err := fs.Set(name, value); err != nil {
+			return nil, errors.Wrap(err, "load config: flag -"+name)
+		}
+	}
+
+	if err := config.readSecretFiles(); err != nil {
+		return nil, errors.Wrap(err, "load config")
+	}
+	if err := config.Validate(); err != nil {
+		return nil, errors.Wrap(err, "load config")
+	}
+	return config, nil
+}
+
+// getConfig gets the current config, which may be replaced by a reload.
+func (s *Server) getConfig() *Config {
+	s.configLock.RLock()
+	defer s.configLock.RUnlock()
+	return s.config
+}
+
+// applyConfig installs a new config.
+//
+// Settings which cannot be changed on a running server, such as the listen
+// address and account credentials, are ignored with a warning.
+func (s *Server) applyConfig(config *Config) error {
+	authConfig, err := config.LoadAuthConfig()
+	if err != nil {
+		return err
+	}
+
+	s.configLock.Lock()
+	old := s.config
+	if old != nil {
+		for _, setting := range []struct {
+			name     string
+			old, new interface{}
+		}{
+			{"addr", old.Addr, config.Addr},
+			{"assets", old.Assets, config.Assets},
+			{"email", old.Email, config.Email},
+			{"password", old.Password, config.Password},
+			{"session info", old.SessionInfo, config.SessionInfo},
+			{"audit log", old.AuditLog, config.AuditLog},
+			{"audit log size", old.AuditMaxSize, config.AuditMaxSize},
+			{"audit log files", old.AuditMaxFiles, config.AuditMaxFiles},
+			{"TLS certificate", old.TLSCert, config.TLSCert},
+			{"TLS key", old.TLSKey, config.TLSKey},
+			{"self-signed TLS", old.TLSSelfSigned, config.TLSSelfSigned},
+			{"read header timeout", old.ReadHeaderTimeout, config.ReadHeaderTimeout},
+			{"read timeout", old.ReadTimeout, config.ReadTimeout},
+			{"write timeout", old.WriteTimeout, config.WriteTimeout},
+			{"idle timeout", old.IdleTimeout, config.IdleTimeout},
+			{"state file", old.StateFile, config.StateFile},
+			{"metadata file", old.MetadataFile, config.MetadataFile},
+		} {
+			if setting.old != setting.new {
+				fmt.Fprintln(os.Stderr, "Changes to the "+setting.name+" require a restart.")
+			}
+		}
+	}
+	s.config = config
+	s.authConfig = authConfig
+	s.configLock.Unlock()
+
+	if s.jobs != nil {
+		s.jobs.SetRetention(time.Duration(config.JobRetention))
+	}
+	return nil
+}
+
+// reloadOnSignal reloads the config whenever the process receives SIGHUP.
+//
+// If the new config is invalid, the old one stays in effect.
+func (s *Server) reloadOnSignal(source *ConfigSource) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	go func() {
+		for range ch {
+			config, err := source.Load()
+			if err == nil {
+				err = s.applyConfig(config)
+			}
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "Failed to reload config:", err)
+			} else {
+				fmt.Fprintln(os.Stderr, "Reloaded config.")
+			}
+		}
+	}()
+}
+
+// A Duration is a time.Duration which is encoded in JSON and flags as a
+// string like "30s".
+type Duration time.Duration
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+func (d *Duration) Set(s string) error {
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return errors.New("duration must be a string like \"30s\"")
+	}
+	return d.Set(s)
+}
+
+// JSONText is a string holding a JSON document.
+//
+// In a config file, it may be written either as a string or as the JSON
+// value itself.
+type JSONText string
+
+func (j JSONText) String() string {
+	return string(j)
+}
+
+func (j *JSONText) Set(s string) error {
+	*j = JSONText(s)
+	return nil
+}
+
+func (j *JSONText) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*j = JSONText(s)
+		return nil
+	}
+	if !json.Valid(data) {
+		return errors.New("invalid JSON")
+	}
+	*j = JSONText(data)
+	return nil
+}
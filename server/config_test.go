@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestConfigSourceLoad(t *testing.T) {
+	dir := t.TempDir()
+	secretFile := func(name, value string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(value+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	fileSecret := secretFile("file_secret", "from-file-secret")
+	envSecret := secretFile("env_secret", "from-env-secret")
+	flagSecret := secretFile("flag_secret", "from-flag-secret")
+
+	testCases := []struct {
+		name   string
+		config map[string]interface{}
+		env    map[string]string
+		flags  map[string]string
+
+		password    string
+		webPassword string
+		addr        string
+	}{
+		{
+			name:        "Defaults",
+			config:      map[string]interface{}{"email": "a@b.c", "password": "p"},
+			password:    "p",
+			webPassword: "",
+			addr:        ":8080",
+		},
+		{
+			name:     "ConfigFile",
+			config:   map[string]interface{}{"email": "a@b.c", "password_file": fileSecret, "addr": ":1"},
+			password: "from-file-secret",
+			addr:     ":1",
+		},
+		{
+			name:     "EnvOverridesFile",
+			config:   map[string]interface{}{"email": "a@b.c", "password": "p", "addr": ":1"},
+			env:      map[string]string{"CBYGE_PASSWORD": "from-env", "CBYGE_ADDR": ":2"},
+			password: "from-env",
+			addr:     ":2",
+		},
+		{
+			name:     "FlagOverridesEnv",
+			config:   map[string]interface{}{"email": "a@b.c", "password": "p"},
+			env:      map[string]string{"CBYGE_PASSWORD": "from-env", "CBYGE_ADDR": ":2"},
+			flags:    map[string]string{"password": "from-flag", "addr": ":3"},
+			password: "from-flag",
+			addr:     ":3",
+		},
+		{
+			name:        "EnvOverridesSecretFile",
+			config:      map[string]interface{}{"email": "a@b.c", "password_file": fileSecret},
+			env:         map[string]string{"CBYGE_PASSWORD": "from-env"},
+			password:    "from-env",
+			webPassword: "",
+			addr:        ":8080",
+		},
+		{
+			name: "FlagOverridesSecretFiles",
+			config: map[string]interface{}{
+				"email":             "a@b.c",
+				"password_file":     fileSecret,
+				"web_password_file": fileSecret,
+			},
+			env:         map[string]string{"CBYGE_WEB_PASSWORD_FILE": envSecret},
+			flags:       map[string]string{"password": "from-flag", "web-password": "from-flag-web"},
+			password:    "from-flag",
+			webPassword: "from-flag-web",
+			addr:        ":8080",
+		},
+		{
+			name:        "EnvSecretFileOverridesFile",
+			config:      map[string]interface{}{"email": "a@b.c", "password": "p", "web_password": "w"},
+			env:         map[string]string{"CBYGE_WEB_PASSWORD_FILE": envSecret},
+			password:    "p",
+			webPassword: "from-env-secret",
+			addr:        ":8080",
+		},
+		{
+			name:     "FlagSecretFileOverridesEnv",
+			config:   map[string]interface{}{"email": "a@b.c"},
+			env:      map[string]string{"CBYGE_PASSWORD": "from-env"},
+			flags:    map[string]string{"password-file": flagSecret},
+			password: "from-flag-secret",
+			addr:     ":8080",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			for name, value := range tc.env {
+				t.Setenv(name, value)
+			}
+			data, err := json.Marshal(tc.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			path := filepath.Join(dir, tc.name+".json")
+			if err := os.WriteFile(path, data, 0600); err != nil {
+				t.Fatal(err)
+			}
+			source := &ConfigSource{Path: path, Flags: tc.flags}
+			config, err := source.Load()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if config.Password != tc.password {
+				t.Errorf("expected password %q but got %q", tc.password, config.Password)
+			}
+			if config.WebPassword != tc.webPassword {
+				t.Errorf("expected web password %q but got %q", tc.webPassword, config.WebPassword)
+			}
+			if config.Addr != tc.addr {
+				t.Errorf("expected address %q but got %q", tc.addr, config.Addr)
+			}
+		})
+	}
+}
+
+func TestConfigSourceLoadErrors(t *testing.T) {
+	dir := t.TempDir()
+	testCases := []struct {
+		name   string
+		config string
+		flags  map[string]string
+	}{
+		{"UnknownField", `{"email":"a@b.c","password":"p","bogus":1}`, nil},
+		{"MissingCredentials", `{"email":"a@b.c"}`, nil},
+		{"MissingSecretFile", `{"email":"a@b.c","password_file":"/nonexistent/file"}`, nil},
+		{"BadDuration", `{"email":"a@b.c","password":"p","poll_interval":30}`, nil},
+		{"BadFlag", `{"email":"a@b.c","password":"p"}`, map[string]string{"read-timeout": "x"}},
+		{"InvalidSessionInfo", `{"session_info":"{"}`, nil},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(dir, tc.name+".json")
+			if err := os.WriteFile(path, []byte(tc.config), 0600); err != nil {
+				t.Fatal(err)
+			}
+			source := &ConfigSource{Path: path, Flags: tc.flags}
+			if _, err := source.Load(); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
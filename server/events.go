@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/unixpickle/cbyge"
+)
+
+const (
+	eventKeepAliveInterval = time.Second * 15
+
+	// eventWriteTimeout replaces the server's write timeout for each message
+	// on an event stream, since the stream itself lasts indefinitely.
+	eventWriteTimeout = eventKeepAliveInterval * 2
+)
+
+// A ServerEvent is a message pushed to clients of the event stream.
+type ServerEvent struct {
+	Type string
+	Data interface{}
+
+	// DeviceID is set for events about a single device, which are only
+	// sent to principals that may access the device.
+	DeviceID string
+
+	// Principal is set for events which are only sent to the named
+	// principal and to admins.
+	Principal string
+}
+
+// An EventHub broadcasts ServerEvents to all subscribed clients.
+type EventHub struct {
+	lock        sync.Mutex
+	subscribers map[chan ServerEvent]bool
+	lastStatus  map[string]map[string]interface{}
+	done        chan struct{}
+	closed      bool
+}
+
+func NewEventHub() *EventHub {
+	return &EventHub{
+		subscribers: map[chan ServerEvent]bool{},
+		lastStatus:  map[string]map[string]interface{}{},
+		done:        make(chan struct{}),
+	}
+}
+
+// Close ends all event streams, e.g. when the server is shutting down.
+func (e *EventHub) Close() {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if !e.closed {
+		e.closed = true
+		close(e.done)
+	}
+}
+
+// Done returns a channel which is closed by Close().
+func (e *EventHub) Done() <-chan struct{} {
+	return e.done
+}
+
+// Subscribe creates a channel which receives all future events.
+//
+// Slow subscribers may miss events rather than blocking the hub.
+func (e *EventHub) Subscribe() chan ServerEvent {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	ch := make(chan ServerEvent, 64)
+	e.subscribers[ch] = true
+	return ch
+}
+
+func (e *EventHub) Unsubscribe(ch chan ServerEvent) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	delete(e.subscribers, ch)
+}
+
+// NumSubscribers gets the number of currently connected subscribers.
+func (e *EventHub) NumSubscribers() int {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return len(e.subscribers)
+}
+
+func (e *EventHub) Publish(eventType string, data interface{}) {
+	e.PublishEvent(ServerEvent{Type: eventType, Data: data})
+}
+
+func (e *EventHub) PublishEvent(event ServerEvent) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.publish(event)
+}
+
+// PublishStatus sends a "status" event for a device if its status differs
+// from the last one that was published.
+func (e *EventHub) PublishStatus(d *cbyge.ControllerDevice, status cbyge.ControllerDeviceStatus) {
+	encoded := status.Encode()
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if reflect.DeepEqual(e.lastStatus[d.DeviceID()], encoded) {
+		return
+	}
+	e.lastStatus[d.DeviceID()] = encoded
+	e.publish(ServerEvent{
+		Type: "status",
+		Data: map[string]interface{}{
+			"id":     d.DeviceID(),
+			"status": encoded,
+		},
+		DeviceID: d.DeviceID(),
+	})
+}
+
+func (e *EventHub) publish(event ServerEvent) {
+	for ch := range e.subscribers {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// HandleEvents streams events to the client using Server-Sent Events.
+func (s *Server) HandleEvents(w http.ResponseWriter, r *http.Request) {
+	rc := http.NewResponseController(w)
+	rc.SetWriteDeadline(time.Now().Add(eventWriteTimeout))
+	w.Header().Set("content-type", "text/event-stream")
+	w.Header().Set("cache-control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	ch := s.events.Subscribe()
+	defer s.events.Unsubscribe(ch)
+	s.startPolling()
+
+	keepAlive := time.NewTicker(eventKeepAliveInterval)
+	defer keepAlive.Stop()
+	for {
+		rc.SetWriteDeadline(time.Now().Add(eventWriteTimeout))
+		select {
+		case event := <-ch:
+			if event.Principal != "" && !canViewJob(RequestPrincipal(r), event.Principal) {
+				continue
+			}
+			if event.DeviceID != "" {
+				if _, err := s.getDeviceFor(r, event.DeviceID); err != nil {
+					continue
+				}
+			}
+			data, err := json.Marshal(event.Data)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case <-r.Context().Done():
+			return
+		case <-s.events.Done():
+			return
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// startPolling starts a background loop which polls device statuses while
+// there are event subscribers, if it is not already running.
+func (s *Server) startPolling() {
+	interval := time.Duration(s.getConfig().PollInterval)
+	if interval <= 0 {
+		return
+	}
+	s.pollLock.Lock()
+	defer s.pollLock.Unlock()
+	if s.polling {
+		return
+	}
+	s.polling = true
+	go s.pollLoop(interval)
+}
+
+func (s *Server) pollLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.pollLock.Lock()
+		if s.events.NumSubscribers() == 0 {
+			s.polling = false
+			s.pollLock.Unlock()
+			return
+		}
+		s.pollLock.Unlock()
+
+		ctrl, err := s.getController()
+		if err != nil {
+			continue
+		}
+		devs, err := s.getDevices()
+		if err != nil {
+			continue
+		}
+		// Statuses are published by the controller's status listener.
+		ctrl.DeviceStatuses(devs)
+	}
+}
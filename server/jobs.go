@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+	JobPartial   = "partial"
+)
+
+var errJobAborted = errors.New("job ended before the device was updated")
+
+// A Job tracks an asynchronous request which changes one or more devices.
+type Job struct {
+	ID        string
+	Kind      string
+	Principal string
+	Created   time.Time
+	Finished  time.Time
+
+	// Per-device outcomes, in the order the devices were requested.
+	DeviceIDs []string
+	Done      []bool
+	Errors    []error
+}
+
+// State summarizes the per-device outcomes of the job.
+func (j *Job) State() string {
+	if j.Finished.IsZero() {
+		return JobRunning
+	}
+	var numFailed int
+	for _, err := range j.Errors {
+		if err != nil {
+			numFailed++
+		}
+	}
+	if numFailed == 0 {
+		return JobSucceeded
+	} else if numFailed == len(j.Errors) {
+		return JobFailed
+	}
+	return JobPartial
+}
+
+func (j *Job) encode() map[string]interface{} {
+	devices := []interface{}{}
+	var numDone int
+	for i, id := range j.DeviceIDs {
+		obj := map[string]interface{}{"id": id, "status": "pending"}
+		if j.Done[i] {
+			numDone++
+			if j.Errors[i] != nil {
+				obj["status"] = "error"
+				obj["error"] = j.Errors[i].Error()
+			} else {
+				obj["status"] = "ok"
+			}
+		}
+		devices = append(devices, obj)
+	}
+	res := map[string]interface{}{
+		"id":       j.ID,
+		"kind":     j.Kind,
+		"state":    j.State(),
+		"created":  j.Created,
+		"progress": map[string]int{"done": numDone, "total": len(j.DeviceIDs)},
+		"devices":  devices,
+	}
+	if !j.Finished.IsZero() {
+		res["finished"] = j.Finished
+	}
+	return res
+}
+
+// A JobManager keeps track of running jobs and recently finished ones.
+//
+// Finished jobs are published to an EventHub as "job" events, and are
+// forgotten once they have been finished for the retention period.
+type JobManager struct {
+	running sync.WaitGroup
+
+	lock      sync.Mutex
+	jobs      map[string]*Job
+	retention time.Duration
+	events    *EventHub
+}
+
+func NewJobManager(retention time.Duration, events *EventHub) *JobManager {
+	return &JobManager{
+		jobs:      map[string]*Job{},
+		retention: retention,
+		events:    events,
+	}
+}
+
+func (j *JobManager) SetRetention(retention time.Duration) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	j.retention = retention
+}
+
+// Start creates a running job for the given devices.
+func (j *JobManager) Start(kind, principal string, deviceIDs []string) *Job {
+	job := &Job{
+		ID:        randomToken(),
+		Kind:      kind,
+		Principal: principal,
+		Created:   time.Now(),
+		DeviceIDs: deviceIDs,
+		Done:      make([]bool, len(deviceIDs)),
+		Errors:    make([]error, len(deviceIDs)),
+	}
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	j.expire()
+	j.jobs[job.ID] = job
+	return job
+}
+
+// SetResult records the outcome for the device at the given index.
+func (j *JobManager) SetResult(job *Job, index int, err error) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	job.Done[index] = true
+	job.Errors[index] = err
+}
+
+// SetAllResults records the same outcome for every device in the job.
+func (j *JobManager) SetAllResults(job *Job, err error) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	for i := range job.DeviceIDs {
+		job.Done[i] = true
+		job.Errors[i] = err
+	}
+}
+
+// Finish marks the job as finished and publishes it to subscribers.
+//
+// Devices without a result are marked as failed.
+func (j *JobManager) Finish(job *Job) {
+	j.lock.Lock()
+	for i, done := range job.Done {
+		if !done {
+			job.Done[i] = true
+			job.Errors[i] = errJobAborted
+		}
+	}
+	job.Finished = time.Now()
+	encoded := job.encode()
+	j.lock.Unlock()
+
+	j.events.PublishEvent(ServerEvent{
+		Type:      "job",
+		Data:      encoded,
+		Principal: job.Principal,
+	})
+}
+
+// Get looks up a job by ID and encodes it as a JSON object.
+//
+// Returns nil if the job does not exist or the principal may not view it.
+func (j *JobManager) Get(id string, p *Principal) map[string]interface{} {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	j.expire()
+	job, ok := j.jobs[id]
+	if !ok || !canViewJob(p, job.Principal) {
+		return nil
+	}
+	return job.encode()
+}
+
+// Wait waits for all running jobs to finish, or for ctx to be done.
+func (j *JobManager) Wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		j.running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (j *JobManager) expire() {
+	for id, job := range j.jobs {
+		if !job.Finished.IsZero() && time.Since(job.Finished) > j.retention {
+			delete(j.jobs, id)
+		}
+	}
+}
+
+func canViewJob(p *Principal, owner string) bool {
+	return p != nil && (p.Role == RoleAdmin || p.Name == owner)
+}
+
+// startJob runs f in the background as a job for the given devices.
+//
+// The function should call SetResult() or SetAllResults() on the job
+// manager as devices are updated.
+func (s *Server) startJob(r *http.Request, deviceIDs []string, f func(job *Job)) *Job {
+	var principal string
+	if p := RequestPrincipal(r); p != nil {
+		principal = p.Name
+	}
+	job := s.jobs.Start(r.URL.Path, principal, deviceIDs)
+	s.jobs.running.Add(1)
+	go func() {
+		defer s.jobs.running.Done()
+		defer s.jobs.Finish(job)
+		f(job)
+	}()
+	return job
+}
+
+// HandleJob reports the progress and outcome of an async job.
+func (s *Server) HandleJob(w http.ResponseWriter, r *http.Request) {
+	job := s.jobs.Get(r.PathValue("id"), RequestPrincipal(r))
+	if job == nil {
+		s.serveError(w, http.StatusNotFound, "no job found with the given ID")
+		return
+	}
+	s.serveObject(w, http.StatusOK, job)
+}
+
+func encodeJobRef(job *Job) map[string]interface{} {
+	return map[string]interface{}{
+		"job_id":  job.ID,
+		"job_url": "/api/jobs/" + job.ID,
+	}
+}
@@ -1,7 +1,7 @@
 package main
 
 import (
-	"crypto/subtle"
+	"bufio"
 	"encoding/json"
 	"errors"
 	"flag"
@@ -9,7 +9,6 @@ import (
 	"net/http"
 	"net/url"
 	"os"
-	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -22,79 +21,137 @@ import (
 const SessionExpiration = time.Hour / 2
 
 func main() {
-	s := &Server{}
-	var addr string
-	var assets string
-	flag.StringVar(&assets, "assets", "assets", "assets directory")
-	flag.StringVar(&addr, "addr", ":8080", "address to listen on")
-	flag.StringVar(&s.Email, "email", "", "C by GE account email")
-	flag.StringVar(&s.Password, "password", "", "C by GE account password")
-	flag.StringVar(&s.SessionInfo, "sessinfo", "", "Cync session info from 2FA login")
-	flag.StringVar(&s.WebPassword, "web-password", "",
-		"password for basic auth, if different than the account password")
-	flag.BoolVar(&s.NoAuth, "no-auth", false, "do not require any password")
+	s := &Server{
+		metrics:    cbyge.NewMetrics(),
+		apiMetrics: NewAPIMetrics(),
+		events:     NewEventHub(),
+		sessions:   NewSessionStore(),
+	}
+	var configPath string
+	var hashPassword bool
+	var genAPIKey bool
+	DefaultConfig().RegisterFlags(flag.CommandLine)
+	flag.StringVar(&configPath, "config", "",
+		"JSON config file (reloaded on SIGHUP; flags and "+ConfigEnvPrefix+"* variables override it)")
+	flag.BoolVar(&hashPassword, "hash-password", false,
+		"read a password from stdin and print its hash for the users file")
+	flag.BoolVar(&genAPIKey, "gen-api-key", false,
+		"print a new API key and its hash for the users file")
 	flag.Parse()
 
-	if s.SessionInfo == "" && (s.Email == "" || s.Password == "") {
-		essentials.Die("Must provide -email and -password flags, or the -sessinfo flag. See -help.")
+	if hashPassword {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			essentials.Die("Failed to read password:", err)
+		}
+		hash, err := HashPassword(strings.TrimRight(line, "\r\n"))
+		essentials.Must(err)
+		fmt.Println(hash)
+		return
+	} else if genAPIKey {
+		key, hash := GenerateAPIKey()
+		fmt.Println("key: " + key)
+		fmt.Println("hash: " + hash)
+		return
+	}
+
+	source := NewConfigSource(configPath, flag.CommandLine)
+	config, err := source.Load()
+	if err != nil {
+		essentials.Die(err, "(see -help)")
+	}
+	s.Email = config.Email
+	s.Password = config.Password
+	s.SessionInfo = string(config.SessionInfo)
+	s.jobs = NewJobManager(time.Duration(config.JobRetention), s.events)
+	if err := s.applyConfig(config); err != nil {
+		essentials.Die(err)
+	}
+	s.reloadOnSignal(source)
+	if err := s.loadState(); err != nil {
+		essentials.Die(err)
+	}
+	s.metadata, err = OpenMetadataStore(config.MetadataFile)
+	if err != nil {
+		essentials.Die(err)
 	}
 
-	if s.WebPassword == "" {
-		s.WebPassword = s.Password
+	if config.AuditLog != "" {
+		auditLog, err := OpenAuditLog(config.AuditLog, config.AuditMaxSize, config.AuditMaxFiles)
+		if err != nil {
+			essentials.Die(err)
+		}
+		s.auditLog = auditLog
 	}
 
-	http.Handle("/", s.Auth(s.Redirect2FA(http.FileServer(http.Dir(assets)).ServeHTTP).ServeHTTP))
-	http.Handle("/2fa/stage1", s.Auth(s.Handle2FAStage1))
-	http.Handle("/2fa/stage2", s.Auth(s.Handle2FAStage2))
-	http.Handle("/api/devices", s.Auth(s.HandleDevices))
-	http.Handle("/api/device/status", s.Auth(s.HandleDeviceStatus))
-	http.Handle("/api/device/set_on", s.Auth(s.HandleDeviceSetOn))
-	http.Handle("/api/device/blast_on", s.Auth(s.HandleDeviceBlastOn))
-	http.Handle("/api/device/set_color_tone", s.Auth(s.HandleDeviceSetColorTone))
-	http.Handle("/api/device/set_rgb", s.Auth(s.HandleDeviceSetRGB))
-	http.Handle("/api/device/set_brightness", s.Auth(s.HandleDeviceSetBrightness))
-	http.ListenAndServe(addr, nil)
+	http.Handle("/", s.AuthPage(s.Redirect2FA(NewAssetHandler(config.Assets).ServeHTTP).ServeHTTP))
+	http.Handle("/metrics", s.AuthRole(RoleAdmin, s.HandleMetrics))
+	http.HandleFunc("/auth/login", s.HandleLogin)
+	http.HandleFunc("/auth/logout", s.HandleLogout)
+	s.HandleAPI("/2fa/stage1", RoleAdmin, s.Handle2FAStage1)
+	s.HandleAPI("/2fa/stage2", RoleAdmin, s.Handle2FAStage2)
+	s.HandleAPI("/api/audit", RoleAdmin, s.HandleAudit)
+	s.HandleAPI("/api/jobs/{id}", RoleReadOnly, s.HandleJob)
+	s.HandleAPI("/api/whoami", RoleReadOnly, s.HandleWhoAmI)
+	s.HandleAPI("/api/devices", RoleReadOnly, s.HandleDevices)
+	s.HandleAPIStream("/api/events", RoleReadOnly, s.HandleEvents)
+	s.HandleAPI("/api/device/status", RoleReadOnly, s.HandleDeviceStatus)
+	s.HandleAPI("/api/device/set_on", RoleControl, s.HandleDeviceSetOn)
+	s.HandleAPI("/api/device/blast_on", RoleControl, s.HandleDeviceBlastOn)
+	s.HandleAPI("/api/device/set_color_tone", RoleControl, s.HandleDeviceSetColorTone)
+	s.HandleAPI("/api/device/set_rgb", RoleControl, s.HandleDeviceSetRGB)
+	s.HandleAPI("/api/device/set_brightness", RoleControl, s.HandleDeviceSetBrightness)
+	s.HandleAPI("/api/device/set_state", RoleControl, s.HandleDeviceSetState)
+	s.HandleAPI("/api/device/metadata", RoleReadOnly, s.HandleDeviceMetadata)
+	s.HandleAPI("/api/device/set_metadata", RoleAdmin, s.HandleDeviceSetMetadata)
+	s.RegisterV2()
+
+	if err := s.Serve(config); err != nil {
+		essentials.Die(err)
+	}
 }
 
 type Server struct {
+	// Account credentials, which are fixed for the lifetime of the server.
 	Email       string
 	Password    string
 	SessionInfo string
 
-	WebPassword string
-	NoAuth      bool
+	configLock sync.RWMutex
+	config     *Config
+	authConfig *AuthConfig
+	sessions   *SessionStore
 
 	devicesLock sync.Mutex
 	devices     []*cbyge.ControllerDevice
+	groups      []*cbyge.ControllerGroup
 
 	controllerLock sync.Mutex
 	sessionInfo    *cbyge.SessionInfo
 	controller     *cbyge.Controller
+
+	metrics    *cbyge.Metrics
+	apiMetrics *APIMetrics
+
+	metadata *MetadataStore
+	auditLog *AuditLog
+	jobs     *JobManager
+
+	events   *EventHub
+	pollLock sync.Mutex
+	polling  bool
 }
 
-func (s *Server) Auth(handler http.HandlerFunc) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if s.NoAuth {
-			handler(w, r)
-			return
-		}
-		pass := r.FormValue("auth")
-
-		if pass == "" {
-			// Most likely a front-end request.
-			_, pass, ok := r.BasicAuth()
-			if !ok || subtle.ConstantTimeCompare([]byte(pass), []byte(s.WebPassword)) != 1 {
-				w.Header().Set("WWW-Authenticate", `Basic realm="bad credentials"`)
-				w.WriteHeader(http.StatusUnauthorized)
-				w.Write([]byte("Unauthorised.\n"))
-				return
-			}
-		} else if subtle.ConstantTimeCompare([]byte(pass), []byte(s.WebPassword)) != 1 {
-			s.serveError(w, http.StatusUnauthorized, "incorrect 'auth' parameter")
-			return
-		}
-		handler(w, r)
-	})
+// HandleAPI registers an authenticated API endpoint on the default mux,
+// recording request metrics under the endpoint's path.
+func (s *Server) HandleAPI(path string, role Role, handler http.HandlerFunc) {
+	http.Handle(path, s.apiMetrics.Instrument(path, s.AuthRole(role, handler)))
+}
+
+// HandleAPIStream is like HandleAPI, but for long-lived streams, which are
+// counted but not timed.
+func (s *Server) HandleAPIStream(path string, role Role, handler http.HandlerFunc) {
+	http.Handle(path, s.apiMetrics.InstrumentStream(path, s.AuthRole(role, handler)))
 }
 
 func (s *Server) Redirect2FA(handler http.HandlerFunc) http.Handler {
@@ -130,10 +187,25 @@ func (s *Server) Handle2FAStage2(w http.ResponseWriter, r *http.Request) {
 		s.controllerLock.Lock()
 		s.sessionInfo = session
 		s.controllerLock.Unlock()
+		if err := s.saveState(); err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to save state:", err)
+		}
 		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
 	}
 }
 
+// HandleWhoAmI describes the principal making the request, so that the UI
+// can hide controls the principal cannot use.
+func (s *Server) HandleWhoAmI(w http.ResponseWriter, r *http.Request) {
+	p := RequestPrincipal(r)
+	s.serveObject(w, http.StatusOK, map[string]interface{}{
+		"name":    p.Name,
+		"role":    p.Role,
+		"devices": p.Devices,
+		"groups":  p.Groups,
+	})
+}
+
 func (s *Server) HandleDevices(w http.ResponseWriter, r *http.Request) {
 	var devs []*cbyge.ControllerDevice
 	var err error
@@ -146,9 +218,8 @@ func (s *Server) HandleDevices(w http.ResponseWriter, r *http.Request) {
 		s.serveError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
-	sort.Slice(devs, func(i, j int) bool {
-		return strings.Compare(devs[i].DeviceID(), devs[j].DeviceID()) < 0
-	})
+	devs = s.visibleDevices(r, s.filterDevices(r, devs))
+	s.sortDevices(devs)
 	statuses := make([]cbyge.ControllerDeviceStatus, len(devs))
 	for i, d := range devs {
 		statuses[i] = d.LastStatus()
@@ -164,15 +235,27 @@ func (s *Server) HandleDevices(w http.ResponseWriter, r *http.Request) {
 	data := []map[string]interface{}{}
 	for i, d := range devs {
 		data = append(data, map[string]interface{}{
-			"id":     d.DeviceID(),
-			"name":   d.Name(),
-			"status": encodeStatus(statuses[i]),
+			"id":       d.DeviceID(),
+			"name":     d.Name(),
+			"status":   statuses[i].Encode(),
+			"metadata": s.metadata.Get(d.DeviceID()),
 		})
 	}
 	s.serveObject(w, http.StatusOK, data)
 }
 
+// HandleDeviceStatus gets the status of every device in the "id" argument,
+// which is a device selector (see Selector).
 func (s *Server) HandleDeviceStatus(w http.ResponseWriter, r *http.Request) {
+	devs, err := s.resolveDevices(r, r.FormValue("id"))
+	if err != nil {
+		s.serveDeviceError(w, err)
+		return
+	}
+	s.serveStatuses(w, devs)
+}
+
+func (s *Server) serveStatuses(w http.ResponseWriter, devs []*cbyge.ControllerDevice) {
 	ctrl, err := s.getController()
 	if err != nil {
 		s.serveError(w, http.StatusInternalServerError, err.Error())
@@ -180,34 +263,24 @@ func (s *Server) HandleDeviceStatus(w http.ResponseWriter, r *http.Request) {
 	}
 
 	statuses := []map[string]interface{}{}
-	for _, id := range strings.Split(r.FormValue("id"), ",") {
-		dev, err := s.getDevice(id)
-		if err != nil {
-			s.serveError(w, http.StatusInternalServerError, err.Error())
-			return
-		}
+	for _, dev := range devs {
 		status, err := ctrl.DeviceStatus(dev)
 		if err != nil {
 			s.serveError(w, http.StatusInternalServerError, err.Error())
 			return
 		}
-		statuses = append(statuses, encodeStatus(status))
+		statuses = append(statuses, status.Encode())
 	}
 
 	s.serveObject(w, http.StatusOK, statuses)
 }
 
 func (s *Server) HandleDeviceSetOn(w http.ResponseWriter, r *http.Request) {
-	s.handleSetter(w, r, func(c *cbyge.Controller, d *cbyge.ControllerDevice, async bool) error {
-		if async {
-			return c.SetDeviceStatusAsync(d, r.FormValue("on") == "1")
-		}
-		return c.SetDeviceStatus(d, r.FormValue("on") == "1")
-	})
+	on := r.FormValue("on") == "1"
+	s.handleSetter(w, r, cbyge.DeviceState{On: &on})
 }
 
 func (s *Server) HandleDeviceBlastOn(w http.ResponseWriter, r *http.Request) {
-	ids := strings.Split(r.FormValue("id"), ",")
 	status := r.FormValue("on") == "1"
 	numSwitches := 3
 
@@ -220,30 +293,43 @@ func (s *Server) HandleDeviceBlastOn(w http.ResponseWriter, r *http.Request) {
 		numSwitches = n
 	}
 
-	runFunc := func() error {
+	async := r.FormValue("async") == "1"
+	change := cbyge.DeviceState{On: &status}
+	devs, err := s.resolveDevices(r, r.FormValue("id"))
+	if err != nil {
+		s.audit(r, r.FormValue("id"), change, async, time.Now(), err)
+		s.serveDeviceError(w, err)
+		return
+	}
+	if s.serveSelection(w, r, devs) {
+		return
+	}
+	runFunc := func() (err error) {
+		start := time.Now()
+		defer func() {
+			for _, d := range devs {
+				s.audit(r, d.DeviceID(), change, async, start, err)
+			}
+		}()
 		ctrl, err := s.getController()
 		if err != nil {
 			return err
 		}
-		var devs []*cbyge.ControllerDevice
-		var statuses []bool
-		for _, id := range ids {
-			dev, err := s.getDevice(id)
-			if err != nil {
-				return err
-			}
-			devs = append(devs, dev)
-			statuses = append(statuses, status)
+		statuses := make([]bool, len(devs))
+		for i := range statuses {
+			statuses[i] = status
 		}
 		return ctrl.BlastDeviceStatuses(devs, statuses, numSwitches)
 	}
-	if r.FormValue("async") == "1" {
-		go runFunc()
-		s.serveObject(w, http.StatusOK, map[string]interface{}{})
+	if async {
+		job := s.startJob(r, deviceIDs(devs), func(job *Job) {
+			s.jobs.SetAllResults(job, runFunc())
+		})
+		s.serveObject(w, http.StatusOK, encodeJobRef(job))
 	} else {
 		err := runFunc()
 		if err != nil {
-			s.serveError(w, http.StatusInternalServerError, err.Error())
+			s.serveDeviceError(w, err)
 		} else {
 			s.serveObject(w, http.StatusOK, map[string]interface{}{})
 		}
@@ -259,17 +345,12 @@ func (s *Server) HandleDeviceSetColorTone(w http.ResponseWriter, r *http.Request
 		s.serveError(w, http.StatusBadRequest, "tone out of range [0, 100]")
 		return
 	}
-	s.handleSetter(w, r, func(c *cbyge.Controller, d *cbyge.ControllerDevice, async bool) error {
-		if async {
-			return c.SetDeviceCTAsync(d, tone)
-		}
-		return c.SetDeviceCT(d, tone)
-	})
+	s.handleSetter(w, r, cbyge.DeviceState{ColorTone: &tone})
 }
 
 func (s *Server) HandleDeviceSetRGB(w http.ResponseWriter, r *http.Request) {
-	var values []uint8
-	for _, k := range []string{"r", "g", "b"} {
+	var values [3]uint8
+	for i, k := range []string{"r", "g", "b"} {
 		value, err := strconv.Atoi(r.FormValue(k))
 		if err != nil {
 			s.serveError(w, http.StatusBadRequest, "invalid '"+k+"': "+err.Error())
@@ -278,14 +359,9 @@ func (s *Server) HandleDeviceSetRGB(w http.ResponseWriter, r *http.Request) {
 			s.serveError(w, http.StatusBadRequest, "invalid '"+k+"': out of range")
 			return
 		}
-		values = append(values, uint8(value))
+		values[i] = uint8(value)
 	}
-	s.handleSetter(w, r, func(c *cbyge.Controller, d *cbyge.ControllerDevice, async bool) error {
-		if async {
-			return c.SetDeviceRGBAsync(d, values[0], values[1], values[2])
-		}
-		return c.SetDeviceRGB(d, values[0], values[1], values[2])
-	})
+	s.handleSetter(w, r, cbyge.DeviceState{RGB: &values})
 }
 
 func (s *Server) HandleDeviceSetBrightness(w http.ResponseWriter, r *http.Request) {
@@ -297,33 +373,90 @@ func (s *Server) HandleDeviceSetBrightness(w http.ResponseWriter, r *http.Reques
 		s.serveError(w, http.StatusBadRequest, "brightness out of range [1, 100]")
 		return
 	}
-	s.handleSetter(w, r, func(c *cbyge.Controller, d *cbyge.ControllerDevice, async bool) error {
-		if async {
-			return c.SetDeviceLumAsync(d, lum)
-		}
-		return c.SetDeviceLum(d, lum)
-	})
+	s.handleSetter(w, r, cbyge.DeviceState{Brightness: &lum})
 }
 
-func (s *Server) handleSetter(w http.ResponseWriter, r *http.Request,
-	f func(c *cbyge.Controller, d *cbyge.ControllerDevice, async bool) error) {
-	if r.FormValue("async") == "1" {
-		ids := strings.Split(r.FormValue("id"), ",")
-		go func() {
-			ctrl, err := s.getController()
+func (s *Server) HandleDeviceSetState(w http.ResponseWriter, r *http.Request) {
+	var state cbyge.DeviceState
+	if on := r.FormValue("on"); on != "" {
+		value := on == "1"
+		state.On = &value
+	}
+	for _, field := range []struct {
+		name  string
+		value **int
+	}{
+		{"brightness", &state.Brightness},
+		{"color_tone", &state.ColorTone},
+	} {
+		if r.FormValue(field.name) == "" {
+			continue
+		}
+		value, err := strconv.Atoi(r.FormValue(field.name))
+		if err != nil {
+			s.serveError(w, http.StatusBadRequest, "invalid '"+field.name+"': "+err.Error())
+			return
+		}
+		*field.value = &value
+	}
+	if r.FormValue("r") != "" || r.FormValue("g") != "" || r.FormValue("b") != "" {
+		var rgb [3]uint8
+		for i, k := range []string{"r", "g", "b"} {
+			value, err := strconv.Atoi(r.FormValue(k))
 			if err != nil {
+				s.serveError(w, http.StatusBadRequest, "invalid '"+k+"': "+err.Error())
+				return
+			} else if value < 0 || value > 0xff {
+				s.serveError(w, http.StatusBadRequest, "invalid '"+k+"': out of range")
 				return
 			}
-			for _, id := range ids {
-				// Ignore errors; apply the change to as many
-				// devices as possible in async mode.
-				dev, err := s.getDevice(id)
+			rgb[i] = uint8(value)
+		}
+		state.RGB = &rgb
+	}
+	if err := state.Validate(); err != nil {
+		s.serveError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	s.handleSetter(w, r, state)
+}
+
+// handleSetter applies a state change to every device in the "id" argument,
+// which is a device selector (see Selector).
+//
+// If "async" is 1, the change is applied in the background. If "verify" is 1,
+// the device statuses are polled until they reflect the change. If "dry_run"
+// is 1, the selected devices are returned without changing them. Every
+// attempt is recorded in the audit log.
+func (s *Server) handleSetter(w http.ResponseWriter, r *http.Request, state cbyge.DeviceState) {
+	async := r.FormValue("async") == "1"
+	devs, err := s.resolveDevices(r, r.FormValue("id"))
+	if err != nil {
+		s.audit(r, r.FormValue("id"), state, async, time.Now(), err)
+		s.serveDeviceError(w, err)
+		return
+	}
+	if s.serveSelection(w, r, devs) {
+		return
+	}
+
+	if async {
+		job := s.startJob(r, deviceIDs(devs), func(job *Job) {
+			start := time.Now()
+			ctrl, ctrlErr := s.getController()
+			for i, dev := range devs {
+				// Apply the change to as many devices as possible in
+				// async mode, recording errors in the job.
+				err := ctrlErr
 				if err == nil {
-					f(ctrl, dev, true)
+					err = ctrl.SetDeviceStateAsync(dev, state)
 				}
+				s.jobs.SetResult(job, i, err)
+				s.audit(r, dev.DeviceID(), state, true, start, err)
+				start = time.Now()
 			}
-		}()
-		s.serveObject(w, http.StatusOK, []interface{}{})
+		})
+		s.serveObject(w, http.StatusOK, encodeJobRef(job))
 		return
 	}
 
@@ -333,21 +466,23 @@ func (s *Server) handleSetter(w http.ResponseWriter, r *http.Request,
 		return
 	}
 
-	for _, id := range strings.Split(r.FormValue("id"), ",") {
-		dev, err := s.getDevice(id)
-		if err != nil {
-			s.serveError(w, http.StatusInternalServerError, err.Error())
-			return
+	verify := r.FormValue("verify") == "1"
+	for _, dev := range devs {
+		start := time.Now()
+		if verify {
+			_, err = ctrl.SetDeviceStateVerified(dev, state, nil)
+		} else {
+			err = ctrl.SetDeviceState(dev, state)
 		}
-		err = f(ctrl, dev, false)
+		s.audit(r, dev.DeviceID(), state, false, start, err)
 		if err != nil {
-			s.serveError(w, http.StatusInternalServerError, err.Error())
+			s.serveDeviceError(w, err)
 			return
 		}
 	}
 
 	// Return the new device statuses.
-	s.HandleDeviceStatus(w, r)
+	s.serveStatuses(w, devs)
 }
 
 func (s *Server) serveError(w http.ResponseWriter, code int, err string) {
@@ -376,7 +511,7 @@ func (s *Server) getDevice(id string) (*cbyge.ControllerDevice, error) {
 			return d, nil
 		}
 	}
-	return nil, errors.New("no device found with the given ID")
+	return nil, errDeviceNotFound
 }
 
 func (s *Server) getDevices() ([]*cbyge.ControllerDevice, error) {
@@ -389,18 +524,29 @@ func (s *Server) getDevices() ([]*cbyge.ControllerDevice, error) {
 	return s.refreshDevices()
 }
 
+func (s *Server) getGroups() ([]*cbyge.ControllerGroup, error) {
+	if _, err := s.getDevices(); err != nil {
+		return nil, err
+	}
+	s.devicesLock.Lock()
+	defer s.devicesLock.Unlock()
+	return s.groups, nil
+}
+
 func (s *Server) refreshDevices() ([]*cbyge.ControllerDevice, error) {
 	ctrl, err := s.getController()
 	if err != nil {
 		return nil, err
 	}
-	devs, err := ctrl.Devices()
+	devs, groups, err := ctrl.DevicesAndGroups()
 	if err != nil {
 		return nil, err
 	}
 	s.devicesLock.Lock()
 	s.devices = devs
+	s.groups = groups
 	s.devicesLock.Unlock()
+	s.metrics.SetDevices(devs)
 	return devs, nil
 }
 
@@ -426,16 +572,16 @@ func (s *Server) getController() (*cbyge.Controller, error) {
 	}
 
 	s.controller = cbyge.NewController(s.sessionInfo, 0)
+	s.controller.SetLogger(s.metrics)
+	s.controller.SetTracer(s.metrics)
+	s.controller.AddStatusListener(s.events.PublishStatus)
 	return s.controller, nil
 }
 
-func encodeStatus(s cbyge.ControllerDeviceStatus) map[string]interface{} {
-	return map[string]interface{}{
-		"is_online":  s.IsOnline,
-		"is_on":      s.IsOn,
-		"brightness": s.Brightness,
-		"color_tone": s.ColorTone,
-		"use_rgb":    s.UseRGB,
-		"rgb":        s.RGB,
+func deviceIDs(devs []*cbyge.ControllerDevice) []string {
+	res := make([]string, len(devs))
+	for i, d := range devs {
+		res[i] = d.DeviceID()
 	}
+	return res
 }
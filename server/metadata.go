@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/unixpickle/cbyge"
+)
+
+const maxMetadataField = 64
+
+var tagPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// DeviceMetadata is local information about a device, which is not stored
+// in the C by GE cloud.
+type DeviceMetadata struct {
+	Alias  string   `json:"alias,omitempty"`
+	Tags   []string `json:"tags,omitempty"`
+	Icon   string   `json:"icon,omitempty"`
+	Order  int      `json:"order,omitempty"`
+	Hidden bool     `json:"hidden,omitempty"`
+}
+
+// Validate checks that the metadata can be used in device selectors.
+func (d *DeviceMetadata) Validate() error {
+	if len(d.Alias) > maxMetadataField || len(d.Icon) > maxMetadataField {
+		return errors.New("alias and icon must be at most " +
+			strconv.Itoa(maxMetadataField) + " bytes")
+	}
+	if strings.ContainsAny(d.Alias, ",: \t") || strings.HasPrefix(d.Alias, "!") {
+		return errors.New("alias may not contain commas, colons, or spaces, " +
+			"or start with '!'")
+	}
+	for _, tag := range d.Tags {
+		if len(tag) > maxMetadataField || !tagPattern.MatchString(tag) {
+			return errors.New("invalid tag: " + strconv.Quote(tag) +
+				" (use lowercase letters, digits, dashes, and underscores)")
+		}
+	}
+	return nil
+}
+
+// HasTag checks if the metadata includes a tag.
+func (d *DeviceMetadata) HasTag(tag string) bool {
+	return containsString(d.Tags, tag)
+}
+
+// A MetadataStore keeps DeviceMetadata for every device, optionally saving
+// it to a JSON file.
+type MetadataStore struct {
+	lock    sync.RWMutex
+	path    string
+	devices map[string]DeviceMetadata
+}
+
+// OpenMetadataStore loads metadata from a file, which is created if it does
+// not exist. If path is "", metadata is only kept in memory.
+func OpenMetadataStore(path string) (*MetadataStore, error) {
+	m := &MetadataStore{path: path, devices: map[string]DeviceMetadata{}}
+	if path == "" {
+		return m, nil
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return m, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "open metadata")
+	}
+	if err := json.Unmarshal(data, &m.devices); err != nil {
+		return nil, errors.Wrap(err, "open metadata")
+	}
+	return m, nil
+}
+
+// Get gets the metadata for a device, which is empty if none has been set.
+func (m *MetadataStore) Get(deviceID string) DeviceMetadata {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.devices[deviceID]
+}
+
+// Set replaces the metadata for a device and saves the store.
+//
+// Aliases must be unique (ignoring case) across devices.
+func (m *MetadataStore) Set(deviceID string, md DeviceMetadata) error {
+	if err := md.Validate(); err != nil {
+		return err
+	}
+	md.Tags = uniqueSorted(md.Tags)
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if md.Alias != "" {
+		for id, other := range m.devices {
+			if id != deviceID && strings.EqualFold(other.Alias, md.Alias) {
+				return errors.New("alias is already used by device " + id)
+			}
+		}
+	}
+	old, hadOld := m.devices[deviceID]
+	if md.Alias == "" && md.Tags == nil && md.Icon == "" && md.Order == 0 && !md.Hidden {
+		delete(m.devices, deviceID)
+	} else {
+		m.devices[deviceID] = md
+	}
+	if err := m.save(); err != nil {
+		if hadOld {
+			m.devices[deviceID] = old
+		} else {
+			delete(m.devices, deviceID)
+		}
+		return err
+	}
+	return nil
+}
+
+func (m *MetadataStore) save() error {
+	if m.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(m.devices, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "save metadata")
+	}
+	tmpPath := m.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return errors.Wrap(err, "save metadata")
+	}
+	if err := os.Rename(tmpPath, m.path); err != nil {
+		return errors.Wrap(err, "save metadata")
+	}
+	return nil
+}
+
+// sortDevices sorts devices by their custom order, and then by ID.
+func (s *Server) sortDevices(devs []*cbyge.ControllerDevice) {
+	sort.SliceStable(devs, func(i, j int) bool {
+		o1 := s.metadata.Get(devs[i].DeviceID()).Order
+		o2 := s.metadata.Get(devs[j].DeviceID()).Order
+		if o1 != o2 {
+			return o1 < o2
+		}
+		return devs[i].DeviceID() < devs[j].DeviceID()
+	})
+}
+
+// visibleDevices removes hidden devices unless the request has the
+// "hidden=1" argument.
+func (s *Server) visibleDevices(r *http.Request, devs []*cbyge.ControllerDevice) []*cbyge.ControllerDevice {
+	if r.FormValue("hidden") == "1" {
+		return devs
+	}
+	res := []*cbyge.ControllerDevice{}
+	for _, d := range devs {
+		if !s.metadata.Get(d.DeviceID()).Hidden {
+			res = append(res, d)
+		}
+	}
+	return res
+}
+
+func (s *Server) HandleDeviceMetadata(w http.ResponseWriter, r *http.Request) {
+	dev, err := s.getDeviceFor(r, r.FormValue("id"))
+	if err != nil {
+		s.serveDeviceError(w, err)
+		return
+	}
+	s.serveObject(w, http.StatusOK, s.metadata.Get(dev.DeviceID()))
+}
+
+// HandleDeviceSetMetadata replaces the metadata of a device.
+//
+// The "tags" argument is a comma-separated list, and omitted arguments are
+// cleared.
+func (s *Server) HandleDeviceSetMetadata(w http.ResponseWriter, r *http.Request) {
+	dev, err := s.getDeviceFor(r, r.FormValue("id"))
+	if err != nil {
+		s.serveDeviceError(w, err)
+		return
+	}
+	md := DeviceMetadata{
+		Alias:  strings.TrimSpace(r.FormValue("alias")),
+		Icon:   strings.TrimSpace(r.FormValue("icon")),
+		Hidden: r.FormValue("hidden") == "1",
+	}
+	for _, tag := range strings.Split(r.FormValue("tags"), ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			md.Tags = append(md.Tags, tag)
+		}
+	}
+	if order := r.FormValue("order"); order != "" {
+		md.Order, err = strconv.Atoi(order)
+		if err != nil {
+			s.serveError(w, http.StatusBadRequest, "invalid 'order': "+err.Error())
+			return
+		}
+	}
+	if err := s.metadata.Set(dev.DeviceID(), md); err != nil {
+		s.serveError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	s.serveObject(w, http.StatusOK, s.metadata.Get(dev.DeviceID()))
+}
+
+func uniqueSorted(list []string) []string {
+	if len(list) == 0 {
+		return nil
+	}
+	seen := map[string]bool{}
+	var res []string
+	for _, x := range list {
+		if !seen[x] {
+			seen[x] = true
+			res = append(res, x)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
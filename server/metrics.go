@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/unixpickle/cbyge"
+)
+
+// APIMetrics counts and times requests to the server's endpoints.
+type APIMetrics struct {
+	lock      sync.Mutex
+	requests  map[apiMetricsKey]uint64
+	latencies map[string]*cbyge.Histogram
+	streams   map[string]int
+}
+
+type apiMetricsKey struct {
+	Endpoint string
+	Code     int
+}
+
+func NewAPIMetrics() *APIMetrics {
+	return &APIMetrics{
+		requests:  map[apiMetricsKey]uint64{},
+		latencies: map[string]*cbyge.Histogram{},
+		streams:   map[string]int{},
+	}
+}
+
+// Instrument wraps a handler to record metrics under the given endpoint name.
+func (a *APIMetrics) Instrument(endpoint string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w, code: http.StatusOK}
+		h.ServeHTTP(sw, r)
+		a.record(endpoint, sw.code, time.Since(start))
+	})
+}
+
+// InstrumentStream is like Instrument, but for long-lived streams such as
+// Server-Sent Events, whose durations would skew the latency histogram.
+//
+// Requests are counted when they end, and the number of open streams is
+// tracked as a gauge instead of timing them.
+func (a *APIMetrics) InstrumentStream(endpoint string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		a.lock.Lock()
+		a.streams[endpoint]++
+		a.lock.Unlock()
+
+		sw := &statusWriter{ResponseWriter: w, code: http.StatusOK}
+		h.ServeHTTP(sw, r)
+
+		a.lock.Lock()
+		a.streams[endpoint]--
+		a.requests[apiMetricsKey{Endpoint: endpoint, Code: sw.code}]++
+		a.lock.Unlock()
+	})
+}
+
+func (a *APIMetrics) record(endpoint string, code int, d time.Duration) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.requests[apiMetricsKey{Endpoint: endpoint, Code: code}]++
+	h, ok := a.latencies[endpoint]
+	if !ok {
+		h = cbyge.NewHistogram(cbyge.DefaultLatencyBuckets)
+		a.latencies[endpoint] = h
+	}
+	h.Observe(d.Seconds())
+}
+
+func (a *APIMetrics) WritePrometheus(w *bufio.Writer) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	keys := make([]apiMetricsKey, 0, len(a.requests))
+	for k := range a.requests {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Endpoint != keys[j].Endpoint {
+			return keys[i].Endpoint < keys[j].Endpoint
+		}
+		return keys[i].Code < keys[j].Code
+	})
+	cbyge.WritePrometheusHeader(w, "cbyge_api_requests_total", "counter",
+		"Requests to the server API by endpoint and status code.")
+	for _, k := range keys {
+		fmt.Fprintf(w, "cbyge_api_requests_total{endpoint=%s,code=%s} %d\n",
+			cbyge.PrometheusLabel(k.Endpoint), cbyge.PrometheusLabel(strconv.Itoa(k.Code)),
+			a.requests[k])
+	}
+
+	endpoints := make([]string, 0, len(a.latencies))
+	for e := range a.latencies {
+		endpoints = append(endpoints, e)
+	}
+	sort.Strings(endpoints)
+	cbyge.WritePrometheusHeader(w, "cbyge_api_request_duration_seconds", "histogram",
+		"Latency of requests to the server API.")
+	for _, e := range endpoints {
+		a.latencies[e].WritePrometheus(w, "cbyge_api_request_duration_seconds",
+			"endpoint="+cbyge.PrometheusLabel(e))
+	}
+
+	endpoints = endpoints[:0]
+	for e := range a.streams {
+		endpoints = append(endpoints, e)
+	}
+	sort.Strings(endpoints)
+	cbyge.WritePrometheusHeader(w, "cbyge_api_open_streams", "gauge",
+		"Open event streams by endpoint.")
+	for _, e := range endpoints {
+		fmt.Fprintf(w, "cbyge_api_open_streams{endpoint=%s} %d\n", cbyge.PrometheusLabel(e),
+			a.streams[e])
+	}
+}
+
+type statusWriter struct {
+	http.ResponseWriter
+	code int
+}
+
+func (s *statusWriter) WriteHeader(code int) {
+	s.code = code
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusWriter) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+func (s *Server) HandleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "text/plain; version=0.0.4")
+	bw := bufio.NewWriter(w)
+	s.apiMetrics.WritePrometheus(bw)
+	bw.Flush()
+	s.metrics.WritePrometheus(w)
+}
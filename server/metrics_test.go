@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAPIMetricsStream(t *testing.T) {
+	metrics := NewAPIMetrics()
+	started := make(chan struct{})
+	finish := make(chan struct{})
+	stream := metrics.InstrumentStream("/api/events", http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+			<-finish
+		},
+	))
+	api := metrics.Instrument("/api/devices", http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusTeapot)
+		},
+	))
+	api.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/devices", nil))
+
+	done := make(chan struct{})
+	go func() {
+		stream.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/events", nil))
+		close(done)
+	}()
+	<-started
+
+	output := func() string {
+		var res strings.Builder
+		w := bufio.NewWriter(&res)
+		metrics.WritePrometheus(w)
+		w.Flush()
+		return res.String()
+	}
+	expectLines := func(out string, present bool, lines ...string) {
+		for _, line := range lines {
+			if strings.Contains(out, line) != present {
+				t.Errorf("expected presence=%v for line %q in output:\n%s", present, line, out)
+			}
+		}
+	}
+
+	out := output()
+	expectLines(out, true,
+		`cbyge_api_open_streams{endpoint="/api/events"} 1`,
+		`cbyge_api_requests_total{endpoint="/api/devices",code="418"} 1`,
+		`cbyge_api_request_duration_seconds_count{endpoint="/api/devices"} 1`,
+	)
+	expectLines(out, false, `endpoint="/api/events",code=`)
+
+	close(finish)
+	<-done
+	out = output()
+	expectLines(out, true,
+		`cbyge_api_open_streams{endpoint="/api/events"} 0`,
+		`cbyge_api_requests_total{endpoint="/api/events",code="200"} 1`,
+	)
+	expectLines(out, false, `cbyge_api_request_duration_seconds_count{endpoint="/api/events"}`)
+}
@@ -0,0 +1,373 @@
+package main
+
+// OpenAPIDocument describes the /api/v2 endpoints.
+const OpenAPIDocument = `{
+  "openapi": "3.0.3",
+  "info": {
+    "title": "cbyge server",
+    "version": "2.0.0",
+    "description": "REST API for controlling C by GE devices."
+  },
+  "servers": [{"url": "/api/v2"}],
+  "security": [{"basicAuth": []}, {"apiKey": []}, {"bearerAuth": []}],
+  "paths": {
+    "/devices": {
+      "get": {
+        "summary": "List devices",
+        "parameters": [
+          {"$ref": "#/components/parameters/UpdateStatus"},
+          {
+            "name": "refresh",
+            "in": "query",
+            "description": "Set to 1 to re-enumerate devices from the cloud.",
+            "schema": {"type": "string", "enum": ["1"]}
+          },
+          {
+            "name": "hidden",
+            "in": "query",
+            "description": "Set to 1 to include hidden devices.",
+            "schema": {"type": "string", "enum": ["1"]}
+          }
+        ],
+        "responses": {
+          "200": {
+            "description": "All devices.",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "type": "object",
+                  "properties": {
+                    "devices": {"type": "array", "items": {"$ref": "#/components/schemas/Device"}}
+                  }
+                }
+              }
+            }
+          },
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/devices/{id}": {
+      "parameters": [{"$ref": "#/components/parameters/DeviceID"}],
+      "get": {
+        "summary": "Get a device",
+        "parameters": [{"$ref": "#/components/parameters/UpdateStatus"}],
+        "responses": {
+          "200": {"$ref": "#/components/responses/Device"},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "patch": {
+        "summary": "Change a device's state",
+        "parameters": [
+          {"$ref": "#/components/parameters/Async"},
+          {
+            "name": "verify",
+            "in": "query",
+            "description": "Set to 1 to poll the device until it reports the new state. The response then includes a verification object.",
+            "schema": {"type": "string", "enum": ["1"]}
+          }
+        ],
+        "requestBody": {"$ref": "#/components/requestBodies/DeviceChange"},
+        "responses": {
+          "200": {"$ref": "#/components/responses/Device"},
+          "202": {
+            "description": "The change was started in the background.",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "allOf": [
+                    {"$ref": "#/components/schemas/Device"},
+                    {"type": "object", "properties": {"job": {"$ref": "#/components/schemas/JobRef"}}}
+                  ]
+                }
+              }
+            }
+          },
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/devices/{id}/metadata": {
+      "parameters": [{"$ref": "#/components/parameters/DeviceID"}],
+      "get": {
+        "summary": "Get a device's local metadata",
+        "responses": {
+          "200": {"$ref": "#/components/responses/Metadata"},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "put": {
+        "summary": "Replace a device's local metadata (admin only)",
+        "requestBody": {
+          "required": true,
+          "content": {
+            "application/json": {"schema": {"$ref": "#/components/schemas/Metadata"}}
+          }
+        },
+        "responses": {
+          "200": {"$ref": "#/components/responses/Metadata"},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/jobs/{id}": {
+      "get": {
+        "summary": "Get the progress and outcome of an async change",
+        "parameters": [
+          {
+            "name": "id",
+            "in": "path",
+            "required": true,
+            "schema": {"type": "string"}
+          }
+        ],
+        "responses": {
+          "200": {
+            "description": "The job.",
+            "content": {
+              "application/json": {"schema": {"$ref": "#/components/schemas/Job"}}
+            }
+          },
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/groups": {
+      "get": {
+        "summary": "List groups",
+        "responses": {
+          "200": {
+            "description": "All groups.",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "type": "object",
+                  "properties": {
+                    "groups": {"type": "array", "items": {"$ref": "#/components/schemas/Group"}}
+                  }
+                }
+              }
+            }
+          },
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/groups/{id}/actions": {
+      "post": {
+        "summary": "Change the state of every device in a group",
+        "parameters": [
+          {
+            "name": "id",
+            "in": "path",
+            "required": true,
+            "schema": {"type": "string"}
+          },
+          {"$ref": "#/components/parameters/Async"}
+        ],
+        "requestBody": {"$ref": "#/components/requestBodies/DeviceChange"},
+        "responses": {
+          "200": {
+            "description": "Per-device results.",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "type": "object",
+                  "properties": {
+                    "group": {"$ref": "#/components/schemas/Group"},
+                    "results": {
+                      "type": "array",
+                      "items": {
+                        "type": "object",
+                        "properties": {
+                          "id": {"type": "string"},
+                          "ok": {"type": "boolean"},
+                          "error": {"$ref": "#/components/schemas/Error"}
+                        }
+                      }
+                    }
+                  }
+                }
+              }
+            }
+          },
+          "202": {
+            "description": "The action was started in the background.",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "type": "object",
+                  "properties": {
+                    "group": {"$ref": "#/components/schemas/Group"},
+                    "job": {"$ref": "#/components/schemas/JobRef"}
+                  }
+                }
+              }
+            }
+          },
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    }
+  },
+  "components": {
+    "securitySchemes": {
+      "basicAuth": {"type": "http", "scheme": "basic"},
+      "apiKey": {"type": "apiKey", "in": "header", "name": "X-API-Key"},
+      "bearerAuth": {"type": "http", "scheme": "bearer"}
+    },
+    "parameters": {
+      "DeviceID": {
+        "name": "id",
+        "in": "path",
+        "required": true,
+        "description": "A device selector, such as a device ID, alias:NAME or tag:NAME, which must match exactly one device.",
+        "schema": {"type": "string"}
+      },
+      "UpdateStatus": {
+        "name": "update_status",
+        "in": "query",
+        "description": "Set to 1 to fetch fresh statuses from the devices.",
+        "schema": {"type": "string", "enum": ["1"]}
+      },
+      "Async": {
+        "name": "async",
+        "in": "query",
+        "description": "Set to 1 to return before the change takes effect.",
+        "schema": {"type": "string", "enum": ["1"]}
+      }
+    },
+    "requestBodies": {
+      "DeviceChange": {
+        "required": true,
+        "content": {
+          "application/json": {"schema": {"$ref": "#/components/schemas/DeviceChange"}}
+        }
+      }
+    },
+    "responses": {
+      "Metadata": {
+        "description": "A device's metadata.",
+        "content": {
+          "application/json": {"schema": {"$ref": "#/components/schemas/Metadata"}}
+        }
+      },
+      "Device": {
+        "description": "A device.",
+        "content": {
+          "application/json": {"schema": {"$ref": "#/components/schemas/Device"}}
+        }
+      },
+      "Error": {
+        "description": "An error.",
+        "content": {
+          "application/json": {
+            "schema": {
+              "type": "object",
+              "properties": {"error": {"$ref": "#/components/schemas/Error"}}
+            }
+          }
+        }
+      }
+    },
+    "schemas": {
+      "Status": {
+        "type": "object",
+        "properties": {
+          "is_online": {"type": "boolean"},
+          "is_on": {"type": "boolean"},
+          "brightness": {"type": "integer", "minimum": 0, "maximum": 100},
+          "color_tone": {"type": "integer", "minimum": 0, "maximum": 255},
+          "use_rgb": {"type": "boolean"},
+          "rgb": {"type": "array", "items": {"type": "integer"}, "minItems": 3, "maxItems": 3}
+        }
+      },
+      "Device": {
+        "type": "object",
+        "properties": {
+          "id": {"type": "string"},
+          "name": {"type": "string"},
+          "status": {"$ref": "#/components/schemas/Status"},
+          "metadata": {"$ref": "#/components/schemas/Metadata"}
+        }
+      },
+      "Metadata": {
+        "type": "object",
+        "additionalProperties": false,
+        "properties": {
+          "alias": {"type": "string", "maxLength": 64},
+          "tags": {"type": "array", "items": {"type": "string", "pattern": "^[a-z0-9][a-z0-9_-]*$"}},
+          "icon": {"type": "string", "maxLength": 64},
+          "order": {"type": "integer"},
+          "hidden": {"type": "boolean"}
+        }
+      },
+      "Group": {
+        "type": "object",
+        "properties": {
+          "id": {"type": "string"},
+          "name": {"type": "string"},
+          "device_ids": {"type": "array", "items": {"type": "string"}, "description": "The devices in the group which the caller may access."}
+        }
+      },
+      "DeviceChange": {
+        "type": "object",
+        "additionalProperties": false,
+        "minProperties": 1,
+        "properties": {
+          "on": {"type": "boolean"},
+          "brightness": {"type": "integer", "minimum": 1, "maximum": 100},
+          "color_tone": {"type": "integer", "minimum": 0, "maximum": 100},
+          "rgb": {
+            "type": "array",
+            "items": {"type": "integer", "minimum": 0, "maximum": 255},
+            "minItems": 3,
+            "maxItems": 3
+          }
+        }
+      },
+      "JobRef": {
+        "type": "object",
+        "properties": {
+          "id": {"type": "string"},
+          "url": {"type": "string"}
+        }
+      },
+      "Job": {
+        "type": "object",
+        "properties": {
+          "id": {"type": "string"},
+          "kind": {"type": "string"},
+          "state": {"type": "string", "enum": ["running", "succeeded", "failed", "partial"]},
+          "created": {"type": "string", "format": "date-time"},
+          "finished": {"type": "string", "format": "date-time"},
+          "progress": {
+            "type": "object",
+            "properties": {"done": {"type": "integer"}, "total": {"type": "integer"}}
+          },
+          "devices": {
+            "type": "array",
+            "items": {
+              "type": "object",
+              "properties": {
+                "id": {"type": "string"},
+                "status": {"type": "string", "enum": ["pending", "ok", "error"]},
+                "error": {"type": "string"}
+              }
+            }
+          }
+        }
+      },
+      "Error": {
+        "type": "object",
+        "properties": {
+          "status": {"type": "integer"},
+          "code": {"type": "string"},
+          "message": {"type": "string"}
+        }
+      }
+    }
+  }
+}
+`
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"unicode"
+
+	"github.com/pkg/errors"
+	"github.com/unixpickle/cbyge"
+)
+
+var (
+	errInvalidSelector = errors.New("invalid selector")
+	errDeviceNotFound  = errors.New("no device found with the given ID")
+)
+
+// A Selector picks out a set of devices.
+//
+// The selector syntax is a comma-separated list of alternatives, each of
+// which is a space-separated list of terms that must all match. A term may be
+// negated with a leading "!". The terms are:
+//
+//	all           every device
+//	ID or id:ID   the device with the given ID
+//	alias:NAME    the device with the given alias
+//	tag:NAME      devices with the given tag
+//	room:NAME     devices in the group with the given name or ID
+//	name=NAME     devices whose name or alias is NAME (ignoring case)
+//	name~=TEXT    devices whose name or alias contains TEXT (ignoring case)
+//	online        devices which were online at the last status update
+//	is_on         devices which were on at the last status update
+//
+// For example, "tag:outdoor !is_on,room:Kitchen" selects the outdoor devices
+// which are off, as well as the devices in the kitchen.
+//
+// Values containing spaces or commas may be double quoted, as in
+// room:"Living Room", and a backslash escapes the next character, either
+// inside or outside of quotes.
+type Selector [][]selectorTerm
+
+type selectorTerm struct {
+	Negate bool
+	Kind   string
+	Value  string
+}
+
+// explicit checks if the term names a specific device, in which case it is
+// an error for the device not to exist or not to be accessible.
+func (s selectorTerm) explicit() bool {
+	return !s.Negate && (s.Kind == "id" || s.Kind == "alias")
+}
+
+// ParseSelector parses the selector syntax described on Selector.
+func ParseSelector(spec string) (Selector, error) {
+	alternatives, err := splitSelector(spec)
+	if err != nil {
+		return nil, err
+	}
+	var res Selector
+	for _, alternative := range alternatives {
+		var terms []selectorTerm
+		for _, field := range alternative {
+			term, err := parseSelectorTerm(field)
+			if err != nil {
+				return nil, err
+			}
+			terms = append(terms, term)
+		}
+		if len(terms) == 0 {
+			return nil, errors.Wrap(errInvalidSelector, "empty selector")
+		}
+		res = append(res, terms)
+	}
+	return res, nil
+}
+
+// splitSelector splits a selector into alternatives and their terms,
+// removing quotes and escapes.
+func splitSelector(spec string) ([][]string, error) {
+	var res [][]string
+	var fields []string
+	var field strings.Builder
+	var inField, quoted, escaped bool
+	endField := func() {
+		if inField {
+			fields = append(fields, field.String())
+			field.Reset()
+			inField = false
+		}
+	}
+	for _, ch := range spec {
+		switch {
+		case escaped:
+			field.WriteRune(ch)
+			escaped = false
+		case ch == '\\':
+			inField, escaped = true, true
+		case ch == '"':
+			inField, quoted = true, !quoted
+		case quoted:
+			field.WriteRune(ch)
+		case ch == ',':
+			endField()
+			res = append(res, fields)
+			fields = nil
+		case unicode.IsSpace(ch):
+			endField()
+		default:
+			inField = true
+			field.WriteRune(ch)
+		}
+	}
+	if quoted || escaped {
+		return nil, errors.Wrap(errInvalidSelector, "unterminated quote or escape")
+	}
+	endField()
+	return append(res, fields), nil
+}
+
+func parseSelectorTerm(field string) (selectorTerm, error) {
+	var term selectorTerm
+	if strings.HasPrefix(field, "!") {
+		term.Negate = true
+		field = field[1:]
+	}
+	switch {
+	case field == "all" || field == "online" || field == "is_on":
+		term.Kind = field
+	case strings.HasPrefix(field, "name~="):
+		term.Kind, term.Value = "name~=", strings.TrimPrefix(field, "name~=")
+	case strings.HasPrefix(field, "name="):
+		term.Kind, term.Value = "name=", strings.TrimPrefix(field, "name=")
+	case strings.Contains(field, ":"):
+		idx := strings.Index(field, ":")
+		term.Kind, term.Value = field[:idx], field[idx+1:]
+		switch term.Kind {
+		case "id", "alias", "tag", "room":
+		default:
+			return term, errors.Wrap(errInvalidSelector, "unknown selector: "+term.Kind)
+		}
+	default:
+		term.Kind, term.Value = "id", field
+	}
+	if term.Value == "" && term.Kind != "all" && term.Kind != "online" && term.Kind != "is_on" {
+		return term, errors.Wrap(errInvalidSelector, "missing value for selector: "+term.Kind)
+	}
+	return term, nil
+}
+
+// deviceSnapshot is the information needed to evaluate a selector, which is
+// gathered once per request.
+type deviceSnapshot struct {
+	server *Server
+	groups []*cbyge.ControllerGroup
+}
+
+func (d *deviceSnapshot) matches(term selectorTerm, dev *cbyge.ControllerDevice) bool {
+	return d.matchesPositive(term, dev) != term.Negate
+}
+
+func (d *deviceSnapshot) matchesPositive(term selectorTerm, dev *cbyge.ControllerDevice) bool {
+	md := d.server.metadata.Get(dev.DeviceID())
+	switch term.Kind {
+	case "all":
+		return true
+	case "id":
+		return dev.DeviceID() == term.Value
+	case "alias":
+		return md.Alias != "" && strings.EqualFold(md.Alias, term.Value)
+	case "tag":
+		return md.HasTag(term.Value)
+	case "room":
+		for _, g := range d.groups {
+			if g.GroupID() != term.Value && !strings.EqualFold(g.Name(), term.Value) {
+				continue
+			}
+			for _, gd := range g.Devices() {
+				if gd == dev {
+					return true
+				}
+			}
+		}
+		return false
+	case "name=":
+		return strings.EqualFold(dev.Name(), term.Value) || strings.EqualFold(md.Alias, term.Value)
+	case "name~=":
+		value := strings.ToLower(term.Value)
+		return strings.Contains(strings.ToLower(dev.Name()), value) ||
+			strings.Contains(strings.ToLower(md.Alias), value)
+	case "online":
+		return dev.LastStatus().IsOnline
+	case "is_on":
+		status := dev.LastStatus()
+		return status.IsOnline && status.IsOn
+	}
+	return false
+}
+
+// resolveDevices evaluates a selector (see Selector) against the current
+// device list.
+//
+// Devices named by ID or alias must exist and be accessible to the request's
+// principal, while other terms only match the devices the principal may
+// access. Each device is included once. Alternatives are evaluated in order,
+// so a list of IDs yields the devices in the same order.
+func (s *Server) resolveDevices(r *http.Request, spec string) ([]*cbyge.ControllerDevice, error) {
+	selector, err := ParseSelector(spec)
+	if err != nil {
+		return nil, err
+	}
+	devs, err := s.getDevices()
+	if err != nil {
+		return nil, err
+	}
+	groups, err := s.getGroups()
+	if err != nil {
+		return nil, err
+	}
+	devs = append([]*cbyge.ControllerDevice{}, devs...)
+	s.sortDevices(devs)
+	snapshot := &deviceSnapshot{server: s, groups: groups}
+	p := RequestPrincipal(r)
+
+	res := []*cbyge.ControllerDevice{}
+	seen := map[*cbyge.ControllerDevice]bool{}
+	for _, terms := range selector {
+		for _, term := range terms {
+			if !term.explicit() {
+				continue
+			}
+			var found bool
+			for _, d := range devs {
+				if snapshot.matches(term, d) {
+					found = true
+					if !s.allowsDevice(p, d) {
+						return nil, errors.Wrap(errAccessDenied, "device "+d.DeviceID())
+					}
+				}
+			}
+			if !found && term.Kind == "alias" {
+				return nil, errors.Wrap(errDeviceNotFound, "alias "+term.Value)
+			} else if !found {
+				return nil, errDeviceNotFound
+			}
+		}
+	DeviceLoop:
+		for _, d := range devs {
+			if seen[d] || !s.allowsDevice(p, d) {
+				continue
+			}
+			for _, term := range terms {
+				if !snapshot.matches(term, d) {
+					continue DeviceLoop
+				}
+			}
+			seen[d] = true
+			res = append(res, d)
+		}
+	}
+	return res, nil
+}
+
+// serveSelection handles the "dry_run" argument of bulk commands, and
+// rejects selectors that matched no devices.
+//
+// It returns true if a response was written, in which case the command
+// should not be run.
+func (s *Server) serveSelection(w http.ResponseWriter, r *http.Request,
+	devs []*cbyge.ControllerDevice) bool {
+	if r.FormValue("dry_run") == "1" {
+		result := []interface{}{}
+		for _, d := range devs {
+			result = append(result, map[string]interface{}{
+				"id":       d.DeviceID(),
+				"name":     d.Name(),
+				"metadata": s.metadata.Get(d.DeviceID()),
+			})
+		}
+		s.serveObject(w, http.StatusOK, map[string]interface{}{
+			"dry_run": true,
+			"devices": result,
+		})
+		return true
+	}
+	if len(devs) == 0 {
+		s.serveError(w, http.StatusNotFound, "selector matched no devices")
+		return true
+	}
+	return false
+}
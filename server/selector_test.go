@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseSelector(t *testing.T) {
+	term := func(negate bool, kind, value string) selectorTerm {
+		return selectorTerm{Negate: negate, Kind: kind, Value: value}
+	}
+	testCases := []struct {
+		spec     string
+		expected Selector
+	}{
+		{"1001", Selector{{term(false, "id", "1001")}}},
+		{"id:1001,1002", Selector{{term(false, "id", "1001")}, {term(false, "id", "1002")}}},
+		{"all !is_on", Selector{{term(false, "all", ""), term(true, "is_on", "")}}},
+		{" tag:outdoor  online ", Selector{{term(false, "tag", "outdoor"), term(false, "online", "")}}},
+		{`room:"Living Room"`, Selector{{term(false, "room", "Living Room")}}},
+		{`room:Living\ Room`, Selector{{term(false, "room", "Living Room")}}},
+		{`name="a, b" !alias:x`, Selector{{term(false, "name=", "a, b"), term(true, "alias", "x")}}},
+		{`name~="say \"hi\""`, Selector{{term(false, "name~=", `say "hi"`)}}},
+		{`"id:1,2"`, Selector{{term(false, "id", "1,2")}}},
+		{`alias:""x`, Selector{{term(false, "alias", "x")}}},
+	}
+	for _, tc := range testCases {
+		actual, err := ParseSelector(tc.spec)
+		if err != nil {
+			t.Errorf("%s: %v", tc.spec, err)
+		} else if !reflect.DeepEqual(actual, tc.expected) {
+			t.Errorf("%s: expected %+v but got %+v", tc.spec, tc.expected, actual)
+		}
+	}
+
+	for _, spec := range []string{
+		"",
+		"1001,",
+		",1001",
+		"tag:",
+		"!",
+		`room:"Living Room`,
+		`room:Living\`,
+		"color:red",
+		`""`,
+	} {
+		if _, err := ParseSelector(spec); !errors.Is(err, errInvalidSelector) {
+			t.Errorf("%q: expected invalid selector error, but got %v", spec, err)
+		}
+	}
+}
+
+func TestResolveDevices(t *testing.T) {
+	s := newTestServer(t, nil, nil)
+	for id, md := range map[string]DeviceMetadata{
+		"1001": {Alias: "reading", Tags: []string{"lamp"}, Order: 2},
+		"1002": {Tags: []string{"lamp", "overhead"}, Order: 1},
+	} {
+		if err := s.metadata.Set(id, md); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	unrestricted := &Principal{Role: RoleAdmin}
+	kitchenOnly := &Principal{Role: RoleControl, Allowlist: Allowlist{Groups: []string{"Kitchen"}}}
+	testCases := []struct {
+		name      string
+		principal *Principal
+		spec      string
+		expected  string
+		err       error
+	}{
+		{"All", unrestricted, "all", "1003,1002,1001", nil},
+		{"IDOrder", unrestricted, "1003,1001", "1003,1001", nil},
+		{"Duplicates", unrestricted, "1001,1001,all", "1001,1003,1002", nil},
+		{"Alias", unrestricted, "alias:READING", "1001", nil},
+		{"Tag", unrestricted, "tag:lamp !tag:overhead", "1001", nil},
+		{"RoomName", unrestricted, `room:"living room"`, "1002,1001", nil},
+		{"RoomID", unrestricted, "room:555-2", "1003", nil},
+		{"Name", unrestricted, "name=ceiling,name=Reading", "1002,1001", nil},
+		{"NameContains", unrestricted, `name~="light"`, "1003", nil},
+		{"Offline", unrestricted, "online", "", nil},
+		{"NotOn", unrestricted, "!is_on room:Kitchen", "1003", nil},
+		{"NoMatches", unrestricted, "tag:missing", "", nil},
+		{"UnknownID", unrestricted, "1004", "", errDeviceNotFound},
+		{"UnknownAlias", unrestricted, "alias:nope", "", errDeviceNotFound},
+		{"NegatedUnknownID", unrestricted, "all !1004", "1003,1002,1001", nil},
+		{"Invalid", unrestricted, "color:red", "", errInvalidSelector},
+		{"RestrictedAll", kitchenOnly, "all", "1003", nil},
+		{"RestrictedTag", kitchenOnly, "tag:lamp", "", nil},
+		{"RestrictedID", kitchenOnly, "1003,1001", "", errAccessDenied},
+		{"RestrictedAlias", kitchenOnly, "alias:reading", "", errAccessDenied},
+		{"RestrictedNegated", kitchenOnly, "all !1001", "1003", nil},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := withPrincipal(httptest.NewRequest("GET", "/api/v2/devices", nil), tc.principal)
+			devs, err := s.resolveDevices(r, tc.spec)
+			if tc.err != nil {
+				if !errors.Is(err, tc.err) {
+					t.Fatalf("expected error %v but got %v", tc.err, err)
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if ids := strings.Join(deviceIDs(devs), ","); ids != tc.expected {
+				t.Errorf("expected %q but got %q", tc.expected, ids)
+			}
+		})
+	}
+}
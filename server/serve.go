@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/unixpickle/cbyge"
+)
+
+// ServerState is persisted across restarts in the state file.
+type ServerState struct {
+	SessionInfo *cbyge.SessionInfo `json:"session_info,omitempty"`
+}
+
+// Serve runs the HTTP(S) server until it fails or the process receives
+// SIGINT or SIGTERM.
+//
+// On a signal, the server stops accepting connections, closes event streams,
+// waits for in-flight requests and async jobs to finish (up to the shutdown
+// timeout), and saves its state.
+func (s *Server) Serve(config *Config) error {
+	tlsConfig, err := config.TLSConfig()
+	if err != nil {
+		return err
+	}
+	server := &http.Server{
+		Addr:              config.Addr,
+		TLSConfig:         tlsConfig,
+		ReadHeaderTimeout: time.Duration(config.ReadHeaderTimeout),
+		ReadTimeout:       time.Duration(config.ReadTimeout),
+		WriteTimeout:      time.Duration(config.WriteTimeout),
+		IdleTimeout:       time.Duration(config.IdleTimeout),
+	}
+	server.RegisterOnShutdown(s.events.Close)
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	serveErr := make(chan error, 1)
+	go func() {
+		if tlsConfig != nil {
+			serveErr <- server.ListenAndServeTLS("", "")
+		} else {
+			serveErr <- server.ListenAndServe()
+		}
+	}()
+
+	select {
+	case err := <-serveErr:
+		return errors.Wrap(err, "serve")
+	case <-ctx.Done():
+	}
+	cancel()
+
+	fmt.Fprintln(os.Stderr, "Shutting down...")
+	timeout := time.Duration(config.ShutdownTimeout)
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), timeout)
+	defer shutdownCancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to finish in-flight requests:", err)
+	}
+	if err := s.jobs.Wait(shutdownCtx); err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to finish async jobs:", err)
+	}
+	if err := s.saveState(); err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to save state:", err)
+	}
+	if s.auditLog != nil {
+		s.auditLog.Close()
+	}
+	return nil
+}
+
+// loadState restores the state saved by a previous run, if there is any.
+func (s *Server) loadState() error {
+	path := s.getConfig().StateFile
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return errors.Wrap(err, "load state")
+	}
+	var state ServerState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return errors.Wrap(err, "load state")
+	}
+	s.controllerLock.Lock()
+	defer s.controllerLock.Unlock()
+	if s.SessionInfo == "" && s.sessionInfo == nil {
+		s.sessionInfo = state.SessionInfo
+	}
+	return nil
+}
+
+// saveState writes the server's state to the state file, if there is one.
+func (s *Server) saveState() error {
+	path := s.getConfig().StateFile
+	if path == "" {
+		return nil
+	}
+	s.controllerLock.Lock()
+	state := ServerState{SessionInfo: s.sessionInfo}
+	s.controllerLock.Unlock()
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return errors.Wrap(err, "save state")
+	}
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return errors.Wrap(err, "save state")
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return errors.Wrap(err, "save state")
+	}
+	return nil
+}
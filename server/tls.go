@@ -0,0 +1,195 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const selfSignedValidity = time.Hour * 24 * 365 * 5
+
+// A CertReloader serves a TLS certificate from a pair of files, reloading it
+// whenever either file changes.
+type CertReloader struct {
+	certPath string
+	keyPath  string
+
+	lock       sync.Mutex
+	cert       *tls.Certificate
+	certMod    time.Time
+	keyMod     time.Time
+	lastReport time.Time
+}
+
+// NewCertReloader loads the certificate and returns a reloader for it.
+func NewCertReloader(certPath, keyPath string) (*CertReloader, error) {
+	c := &CertReloader{certPath: certPath, keyPath: keyPath}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+//
+// If the files have changed but cannot be loaded, for example because only
+// one of them has been replaced so far, the previous certificate is used.
+func (c *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	certInfo, err1 := os.Stat(c.certPath)
+	keyInfo, err2 := os.Stat(c.keyPath)
+	if err1 == nil && err2 == nil &&
+		(!certInfo.ModTime().Equal(c.certMod) || !keyInfo.ModTime().Equal(c.keyMod)) {
+		if err := c.reloadLocked(); err != nil && time.Since(c.lastReport) > time.Minute {
+			c.lastReport = time.Now()
+			fmt.Fprintln(os.Stderr, "Failed to reload TLS certificate:", err)
+		}
+	}
+	return c.cert, nil
+}
+
+func (c *CertReloader) reload() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.reloadLocked()
+}
+
+func (c *CertReloader) reloadLocked() error {
+	certInfo, err := os.Stat(c.certPath)
+	if err != nil {
+		return errors.Wrap(err, "load TLS certificate")
+	}
+	keyInfo, err := os.Stat(c.keyPath)
+	if err != nil {
+		return errors.Wrap(err, "load TLS certificate")
+	}
+	cert, err := tls.LoadX509KeyPair(c.certPath, c.keyPath)
+	if err != nil {
+		return errors.Wrap(err, "load TLS certificate")
+	}
+	c.cert = &cert
+	c.certMod = certInfo.ModTime()
+	c.keyMod = keyInfo.ModTime()
+	return nil
+}
+
+// TLSConfig creates the TLS config for the server, or returns nil if TLS is
+// disabled.
+//
+// With self-signed certificates, the certificate is written to the cert and
+// key paths if they are set and do not exist yet, so that browsers only need
+// to trust it once. Otherwise, a new certificate is created on every start.
+func (c *Config) TLSConfig() (*tls.Config, error) {
+	if c.TLSCert == "" && c.TLSKey == "" && !c.TLSSelfSigned {
+		return nil, nil
+	}
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		return nil, errors.New("TLS certificate and key must be specified together")
+	}
+	if c.TLSSelfSigned {
+		if c.TLSCert == "" {
+			cert, err := selfSignedCert()
+			if err != nil {
+				return nil, err
+			}
+			return &tls.Config{Certificates: []tls.Certificate{*cert}}, nil
+		}
+		if _, err := os.Stat(c.TLSCert); os.IsNotExist(err) {
+			if err := writeSelfSignedCert(c.TLSCert, c.TLSKey); err != nil {
+				return nil, err
+			}
+		}
+	}
+	reloader, err := NewCertReloader(c.TLSCert, c.TLSKey)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{GetCertificate: reloader.GetCertificate}, nil
+}
+
+func selfSignedCert() (*tls.Certificate, error) {
+	certPEM, keyPEM, err := generateSelfSigned()
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, errors.Wrap(err, "generate self-signed certificate")
+	}
+	return &cert, nil
+}
+
+func writeSelfSignedCert(certPath, keyPath string) error {
+	certPEM, keyPEM, err := generateSelfSigned()
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(keyPath, keyPEM, 0600); err != nil {
+		return errors.Wrap(err, "write self-signed certificate")
+	}
+	if err := os.WriteFile(certPath, certPEM, 0644); err != nil {
+		return errors.Wrap(err, "write self-signed certificate")
+	}
+	return nil
+}
+
+// generateSelfSigned creates a certificate for localhost, the machine's
+// hostname, and all of its IP addresses.
+func generateSelfSigned() (certPEM, keyPEM []byte, err error) {
+	defer func() {
+		if err != nil {
+			err = errors.Wrap(err, "generate self-signed certificate")
+		}
+	}()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "cbyge server"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(selfSignedValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{"localhost"},
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		template.DNSNames = append(template.DNSNames, hostname)
+	}
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok {
+				template.IPAddresses = append(template.IPAddresses, ipNet.IP)
+			}
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
@@ -0,0 +1,51 @@
+package cbyge
+
+import (
+	"context"
+	"log/slog"
+)
+
+// A SlogLogger is a Logger which forwards events to a *slog.Logger.
+type SlogLogger struct {
+	Logger *slog.Logger
+}
+
+// NewSlogLogger creates a Logger that writes to l.
+//
+// If l is nil, slog.Default() is used.
+func NewSlogLogger(l *slog.Logger) *SlogLogger {
+	if l == nil {
+		l = slog.Default()
+	}
+	return &SlogLogger{Logger: l}
+}
+
+// Log writes the event to the underlying slog.Logger.
+func (s *SlogLogger) Log(e *Event) {
+	level := slogLevel(e.Level)
+	ctx := context.Background()
+	if !s.Logger.Enabled(ctx, level) {
+		return
+	}
+	attrs := make([]slog.Attr, 0, len(e.Attrs)+2)
+	attrs = append(attrs, slog.String("event", string(e.Kind)))
+	for _, a := range e.Attrs {
+		attrs = append(attrs, slog.Any(a.Key, a.Value))
+	}
+	if e.Err != nil {
+		attrs = append(attrs, slog.String("error", e.Err.Error()))
+	}
+	s.Logger.LogAttrs(ctx, level, e.Message, attrs...)
+}
+
+func slogLevel(l LogLevel) slog.Level {
+	switch l {
+	case LogLevelDebug:
+		return slog.LevelDebug
+	case LogLevelWarn:
+		return slog.LevelWarn
+	case LogLevelError:
+		return slog.LevelError
+	}
+	return slog.LevelInfo
+}
@@ -0,0 +1,80 @@
+package cbyge
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"testing"
+)
+
+func TestSlogLogger(t *testing.T) {
+	testCases := []struct {
+		name  string
+		event *Event
+		want  map[string]interface{}
+	}{
+		{
+			name:  "Filtered",
+			event: &Event{Level: LogLevelDebug, Kind: EventPacketSend, Message: "sending packet"},
+		},
+		{
+			name: "Info",
+			event: &Event{
+				Level:   LogLevelInfo,
+				Kind:    EventConnect,
+				Message: "connected",
+				Attrs:   []Attr{{"host", "example.com:23778"}},
+			},
+			want: map[string]interface{}{
+				"level": "INFO",
+				"msg":   "connected",
+				"event": "connect",
+				"host":  "example.com:23778",
+			},
+		},
+		{
+			name: "Error",
+			event: &Event{
+				Level:   LogLevelError,
+				Kind:    EventAuth,
+				Message: "authentication failed",
+				Err:     errors.New("credentials not recognized"),
+				Attrs:   []Attr{{"user_id", 5}},
+			},
+			want: map[string]interface{}{
+				"level":   "ERROR",
+				"msg":     "authentication failed",
+				"event":   "auth",
+				"user_id": 5.0,
+				"error":   "credentials not recognized",
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			handler := slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelInfo})
+			NewSlogLogger(slog.New(handler)).Log(tc.event)
+			if tc.want == nil {
+				if buf.Len() != 0 {
+					t.Fatalf("unexpected output: %s", buf.String())
+				}
+				return
+			}
+			var obj map[string]interface{}
+			if err := json.Unmarshal(buf.Bytes(), &obj); err != nil {
+				t.Fatal(err)
+			}
+			delete(obj, "time")
+			if len(obj) != len(tc.want) {
+				t.Errorf("expected %v but got %v", tc.want, obj)
+			}
+			for key, value := range tc.want {
+				if obj[key] != value {
+					t.Errorf("key %s: expected %v but got %v", key, value, obj[key])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package cbyge
+
+import "time"
+
+// SwitchHealth records how reliably a switch has relayed commands and status
+// requests to devices.
+type SwitchHealth struct {
+	Successes   int
+	Failures    int
+	LastSuccess time.Time
+	LastFailure time.Time
+}
+
+// Healthy checks if the switch's last request succeeded.
+//
+// Switches which have not been used yet are considered healthy.
+func (s SwitchHealth) Healthy() bool {
+	return !s.LastFailure.After(s.LastSuccess)
+}
+
+// DeviceSwitchInfo describes the switches through which a device can be
+// reached.
+type DeviceSwitchInfo struct {
+	// Current is the switch that commands for the device are sent through.
+	// It is only valid if Switches is non-empty.
+	Current uint32
+
+	// IsOwnSwitch is true if Current is the device's own switch, rather than
+	// one relaying commands over the mesh.
+	IsOwnSwitch bool
+
+	// Switches lists every switch known to reach the device, in the order
+	// that they are used for fail-over.
+	Switches []uint32
+
+	// Health is the health of the Current switch.
+	Health SwitchHealth
+}
+
+// DeviceSwitchInfo gets the switches that can reach a device, as discovered
+// by previous calls to DeviceStatuses().
+func (c *Controller) DeviceSwitchInfo(d *ControllerDevice) DeviceSwitchInfo {
+	c.switchMappingLock.RLock()
+	defer c.switchMappingLock.RUnlock()
+	var res DeviceSwitchInfo
+	res.Switches = append(res.Switches, c.switches[d.deviceID]...)
+	if len(res.Switches) > 0 {
+		res.Current = res.Switches[c.switchIndices[d.deviceID]]
+		res.IsOwnSwitch = d.isSwitch(res.Current)
+		if h := c.switchHealth[res.Current]; h != nil {
+			res.Health = *h
+		}
+	}
+	return res
+}
+
+// SwitchHealth gets the health of a switch.
+func (c *Controller) SwitchHealth(switchID uint32) SwitchHealth {
+	c.switchMappingLock.RLock()
+	defer c.switchMappingLock.RUnlock()
+	if h := c.switchHealth[switchID]; h != nil {
+		return *h
+	}
+	return SwitchHealth{}
+}
+
+func (c *Controller) recordSwitchResult(switchID uint32, success bool) {
+	c.switchMappingLock.Lock()
+	defer c.switchMappingLock.Unlock()
+	c.recordSwitchResultLocked(switchID, success)
+}
+
+func (c *Controller) recordSwitchResultLocked(switchID uint32, success bool) {
+	h := c.switchHealth[switchID]
+	if h == nil {
+		h = &SwitchHealth{}
+		c.switchHealth[switchID] = h
+	}
+	if success {
+		h.Successes++
+		h.LastSuccess = time.Now()
+	} else {
+		h.Failures++
+		h.LastFailure = time.Now()
+	}
+}
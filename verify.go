@@ -0,0 +1,219 @@
+package cbyge
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	DefaultVerifyPollInterval = time.Second / 2
+	DefaultVerifyResendAfter  = 3
+	DefaultVerifyTolerance    = 1
+)
+
+// VerifyOptions configures a verified write.
+//
+// Zero values are replaced by defaults.
+type VerifyOptions struct {
+	// Timeout is the total time to wait for the device to report the new
+	// state. Defaults to three times the Controller's timeout.
+	Timeout time.Duration
+
+	// PollInterval is the delay between status queries.
+	PollInterval time.Duration
+
+	// ResendAfter is the number of non-matching status queries after which
+	// the change is sent again through a different switch.
+	ResendAfter int
+
+	// Tolerance is the maximum difference allowed between requested and
+	// reported brightness, color tone, and RGB values.
+	Tolerance int
+
+	// ExactMatch requires reported values to equal the requested ones,
+	// overriding Tolerance.
+	ExactMatch bool
+}
+
+// A VerifyResult describes the outcome of a verified write.
+type VerifyResult struct {
+	// Verified is true if the device reported the requested state.
+	Verified bool
+
+	// Sends is the number of times the change was sent, and Polls is the
+	// number of status queries made.
+	Sends int
+	Polls int
+
+	// Switches lists the switch used for each send.
+	Switches []uint32
+
+	// Status is the last status reported by the device, if any.
+	Status ControllerDeviceStatus
+
+	Duration time.Duration
+}
+
+// Matches checks if a device status reflects all of the attributes in the
+// state, allowing values to differ by up to tolerance.
+func (d *DeviceState) Matches(status ControllerDeviceStatus, tolerance int) bool {
+	if !status.IsOnline {
+		return false
+	}
+	if d.On != nil && status.IsOn != *d.On {
+		return false
+	}
+	if d.On != nil && !*d.On {
+		// Other attributes may not be reported while the device is off.
+		return true
+	}
+	if d.Brightness != nil && !withinTolerance(int(status.Brightness), *d.Brightness, tolerance) {
+		return false
+	}
+	if d.ColorTone != nil {
+		if status.UseRGB || !withinTolerance(int(status.ColorTone), *d.ColorTone, tolerance) {
+			return false
+		}
+	}
+	if d.RGB != nil {
+		if !status.UseRGB {
+			return false
+		}
+		for i, x := range d.RGB {
+			if !withinTolerance(int(status.RGB[i]), int(x), tolerance) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// SetDeviceStateVerified is like SetDeviceState, but polls the device's
+// status until it reports the requested state, or until a deadline passes.
+//
+// If the device does not report the new state after a few polls, the change
+// is sent again through a different switch.
+//
+// If opts is nil, default options are used.
+//
+// A result is returned even if an error occurs. If the deadline passes, the
+// error wraps UnverifiedError.
+func (c *Controller) SetDeviceStateVerified(d *ControllerDevice, state DeviceState,
+	opts *VerifyOptions) (result *VerifyResult, err error) {
+	var o VerifyOptions
+	if opts != nil {
+		o = *opts
+	}
+	if o.Timeout == 0 {
+		o.Timeout = c.timeout * 3
+	}
+	if o.PollInterval == 0 {
+		o.PollInterval = DefaultVerifyPollInterval
+	}
+	if o.ResendAfter == 0 {
+		o.ResendAfter = DefaultVerifyResendAfter
+	}
+	if o.ExactMatch {
+		o.Tolerance = 0
+	} else if o.Tolerance == 0 {
+		o.Tolerance = DefaultVerifyTolerance
+	}
+
+	attrs := append([]Attr{{"device", d.deviceID}}, state.attrs()...)
+	span := c.startSpan("SetDeviceStateVerified", attrs...)
+	start := time.Now()
+	result = &VerifyResult{}
+	defer func() {
+		result.Duration = time.Since(start)
+		span.SetAttrs(Attr{"sends", result.Sends}, Attr{"polls", result.Polls},
+			Attr{"verified", result.Verified})
+		span.End(err)
+	}()
+
+	if err := state.Validate(); err != nil {
+		return result, errors.Wrap(err, "set device state verified")
+	}
+
+	deadline := start.Add(o.Timeout)
+	needsSend := true
+	sendFailed := false
+	failedPolls := 0
+	for {
+		if needsSend {
+			if switchID, err := c.currentSwitch(d); err == nil {
+				result.Switches = append(result.Switches, switchID)
+			}
+			result.Sends++
+			span.AddEvent("send", Attr{"attempt", result.Sends})
+			// Other errors are ignored, since the change may have
+			// taken effect anyway; polling will tell.
+			err := c.setDeviceState(d, state, true)
+			if errors.Is(err, UnreachableError) {
+				return result, errors.Wrap(err, "set device state verified")
+			}
+			// A failed send has already moved on to the next switch.
+			sendFailed = err != nil
+			needsSend = false
+			failedPolls = 0
+		}
+
+		if time.Now().Add(o.PollInterval).After(deadline) {
+			return result, errors.Wrap(UnverifiedError, "set device state verified")
+		}
+		time.Sleep(o.PollInterval)
+
+		result.Polls++
+		// Failed polls are counted below, so that each attempt records at
+		// most one switch failure.
+		status, err := c.deviceStatus(d, false)
+		if err == nil {
+			result.Status = status
+			if state.Matches(status, o.Tolerance) {
+				result.Verified = true
+				return result, nil
+			}
+		}
+		failedPolls++
+		if failedPolls >= o.ResendAfter {
+			// Try a different route to the device.
+			if !sendFailed {
+				c.switchFailed(d)
+			}
+			needsSend = true
+		}
+	}
+}
+
+// SetDeviceStatusVerified is like SetDeviceStatus, but verifies the change
+// as described in SetDeviceStateVerified.
+func (c *Controller) SetDeviceStatusVerified(d *ControllerDevice, status bool,
+	opts *VerifyOptions) (*VerifyResult, error) {
+	return c.SetDeviceStateVerified(d, DeviceState{On: &status}, opts)
+}
+
+// SetDeviceLumVerified is like SetDeviceLum, but verifies the change as
+// described in SetDeviceStateVerified.
+func (c *Controller) SetDeviceLumVerified(d *ControllerDevice, lum int,
+	opts *VerifyOptions) (*VerifyResult, error) {
+	return c.SetDeviceStateVerified(d, DeviceState{Brightness: &lum}, opts)
+}
+
+// SetDeviceCTVerified is like SetDeviceCT, but verifies the change as
+// described in SetDeviceStateVerified.
+func (c *Controller) SetDeviceCTVerified(d *ControllerDevice, ct int,
+	opts *VerifyOptions) (*VerifyResult, error) {
+	return c.SetDeviceStateVerified(d, DeviceState{ColorTone: &ct}, opts)
+}
+
+// SetDeviceRGBVerified is like SetDeviceRGB, but verifies the change as
+// described in SetDeviceStateVerified.
+func (c *Controller) SetDeviceRGBVerified(d *ControllerDevice, r, g, b uint8,
+	opts *VerifyOptions) (*VerifyResult, error) {
+	return c.SetDeviceStateVerified(d, DeviceState{RGB: &[3]uint8{r, g, b}}, opts)
+}
+
+func withinTolerance(actual, expected, tolerance int) bool {
+	diff := actual - expected
+	return diff >= -tolerance && diff <= tolerance
+}
@@ -0,0 +1,116 @@
+package cbyge
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestDeviceStateMatches(t *testing.T) {
+	lum := 50
+	on := true
+	off := false
+	status := ControllerDeviceStatus{
+		StatusPaginatedResponse: StatusPaginatedResponse{IsOn: true, Brightness: 51},
+		IsOnline:                true,
+	}
+	testCases := []struct {
+		name      string
+		state     DeviceState
+		status    ControllerDeviceStatus
+		tolerance int
+		match     bool
+	}{
+		{"WithinTolerance", DeviceState{Brightness: &lum}, status, 1, true},
+		{"Exact", DeviceState{Brightness: &lum}, status, 0, false},
+		{"On", DeviceState{On: &on, Brightness: &lum}, status, 1, true},
+		{"Off", DeviceState{On: &off}, status, 1, false},
+		{"Offline", DeviceState{On: &on}, ControllerDeviceStatus{}, 1, false},
+	}
+	for _, tc := range testCases {
+		if tc.state.Matches(tc.status, tc.tolerance) != tc.match {
+			t.Errorf("%s: expected match=%v", tc.name, tc.match)
+		}
+	}
+}
+
+func TestSetDeviceStateVerifiedFailures(t *testing.T) {
+	testCases := []struct {
+		name       string
+		sendStatus byte
+
+		// failures computes the expected number of switch failures from
+		// the number of sends.
+		failures func(sends int) int
+	}{
+		{"SendFails", 1, func(sends int) int { return sends }},
+		{"NeverMatches", 0, func(sends int) int { return sends - 1 }},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			server := &fakeServer{Respond: func(p *Packet) []*Packet {
+				if IsStatusPaginatedResponse(p) {
+					return respondDeviceStatus(p)
+				}
+				return respondStatus(tc.sendStatus)(p)
+			}}
+			ctrl, dev := testController(server)
+			switches := []uint32{0x1234, 0x5678}
+			ctrl.switches[dev.deviceID] = switches
+
+			lum := 80
+			result, err := ctrl.SetDeviceStateVerified(dev, DeviceState{Brightness: &lum},
+				&VerifyOptions{
+					Timeout:      time.Millisecond * 500,
+					PollInterval: time.Millisecond * 10,
+					ResendAfter:  2,
+					ExactMatch:   true,
+				})
+			if !errors.Is(err, UnverifiedError) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if result.Sends < 2 {
+				t.Fatalf("expected a resend, but got %d sends", result.Sends)
+			}
+			var failures int
+			for _, id := range switches {
+				failures += ctrl.SwitchHealth(id).Failures
+			}
+			if expected := tc.failures(result.Sends); failures != expected {
+				t.Errorf("expected %d failures for %d sends, but got %d", expected,
+					result.Sends, failures)
+			}
+		})
+	}
+}
+
+func TestSetDeviceStateVerifiedExact(t *testing.T) {
+	server := &fakeServer{Respond: func(p *Packet) []*Packet {
+		if IsStatusPaginatedResponse(p) {
+			// Reports a brightness of 50.
+			return respondDeviceStatus(p)
+		}
+		return respondStatus(0)(p)
+	}}
+	testCases := []struct {
+		name     string
+		opts     VerifyOptions
+		verified bool
+	}{
+		{"DefaultTolerance", VerifyOptions{}, true},
+		{"ExactMatch", VerifyOptions{ExactMatch: true}, false},
+		{"ExactMatchIgnoresTolerance", VerifyOptions{ExactMatch: true, Tolerance: 5}, false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctrl, dev := testController(server)
+			tc.opts.Timeout = time.Millisecond * 200
+			tc.opts.PollInterval = time.Millisecond * 10
+			lum := 49
+			result, _ := ctrl.SetDeviceStateVerified(dev, DeviceState{Brightness: &lum}, &tc.opts)
+			if result.Verified != tc.verified {
+				t.Errorf("expected verified=%v", tc.verified)
+			}
+		})
+	}
+}
@@ -0,0 +1,272 @@
+-- Wireshark dissector for the C by GE protocol.
+-- Code generated by cmd/gen-dissector from cbyge.Protocol. DO NOT EDIT.
+
+local proto = Proto("cbyge", "C by GE")
+
+local packet_types = {
+  [1] = "auth",
+  [4] = "sync",
+  [7] = "pipe",
+  [8] = "pipe_sync",
+}
+
+local f_type = ProtoField.uint8("cbyge.type", "Type", base.DEC, packet_types, 0xf0)
+local f_response = ProtoField.bool("cbyge.response", "Response", 8, nil, 0x08)
+local f_length = ProtoField.uint32("cbyge.length", "Length", base.DEC)
+local f_records = ProtoField.none("cbyge.records", "Records")
+local f_auth_request_user_id = ProtoField.uint32("cbyge.auth.request.user_id", "User ID", base.DEC, nil)
+local f_auth_request_code_length = ProtoField.uint8("cbyge.auth.request.code_length", "Authorize code length", base.DEC, nil)
+local f_auth_request_code = ProtoField.string("cbyge.auth.request.code", "Authorize code")
+local f_auth_response_status = ProtoField.uint16("cbyge.auth.response.status", "Status", base.DEC, { [0] = "ok" })
+local f_pipe_switch_id = ProtoField.uint32("cbyge.pipe.switch_id", "Switch ID", base.HEX, nil)
+local f_pipe_seq = ProtoField.uint16("cbyge.pipe.seq", "Sequence number", base.DEC, nil)
+local f_pipe_marker = ProtoField.uint8("cbyge.pipe.marker", "Marker", base.HEX, nil)
+local f_pipe_subtype = ProtoField.uint8("cbyge.pipe.subtype", "Subtype", base.HEX, nil)
+local f_pipe_payload_length = ProtoField.uint8("cbyge.pipe.payload_length", "Payload length", base.DEC, nil)
+local f_pipe_ack_switch_id = ProtoField.uint32("cbyge.pipe_ack.switch_id", "Switch ID", base.HEX, nil)
+local f_pipe_ack_seq = ProtoField.uint16("cbyge.pipe_ack.seq", "Sequence number", base.DEC, nil)
+local f_pipe_ack_status = ProtoField.uint8("cbyge.pipe_ack.status", "Status", base.DEC, { [0] = "ok" })
+local f_set_status_request_device = ProtoField.uint16("cbyge.set_status.request.device", "Device index", base.DEC, nil)
+local f_set_status_request_on = ProtoField.uint8("cbyge.set_status.request.on", "On", base.DEC, { [0] = "off", [1] = "on" })
+local f_set_lum_request_device = ProtoField.uint16("cbyge.set_lum.request.device", "Device index", base.DEC, nil)
+local f_set_lum_request_brightness = ProtoField.uint8("cbyge.set_lum.request.brightness", "Brightness", base.DEC, nil)
+local f_set_ct_request_device = ProtoField.uint16("cbyge.set_ct.request.device", "Device index", base.DEC, nil)
+local f_set_ct_request_mode = ProtoField.uint8("cbyge.set_ct.request.mode", "Mode", base.DEC, { [4] = "rgb", [5] = "tone" })
+local f_set_ct_request_color_tone = ProtoField.uint8("cbyge.set_ct.request.color_tone", "Color tone", base.DEC, nil)
+local f_set_ct_request_rgb = ProtoField.bytes("cbyge.set_ct.request.rgb", "RGB")
+local f_get_status_paginated_status_device = ProtoField.uint8("cbyge.get_status_paginated.status.device", "Device index", base.DEC, nil)
+local f_get_status_paginated_status_on = ProtoField.uint8("cbyge.get_status_paginated.status.on", "On", base.DEC, { [0] = "off", [1] = "on" })
+local f_get_status_paginated_status_brightness = ProtoField.uint8("cbyge.get_status_paginated.status.brightness", "Brightness", base.DEC, nil)
+local f_get_status_paginated_status_color_tone = ProtoField.uint8("cbyge.get_status_paginated.status.color_tone", "Color tone", base.DEC, { [254] = "rgb" })
+local f_get_status_paginated_status_rgb = ProtoField.bytes("cbyge.get_status_paginated.status.rgb", "RGB")
+
+local request_fields = {
+  [1] = {
+    { field = f_auth_request_user_id, name = "user_id", kind = "uint", offset = 1, size = 4 },
+    { field = f_auth_request_code_length, name = "code_length", kind = "uint", offset = 6, size = 1 },
+    { field = f_auth_request_code, name = "code", kind = "string", offset = 7, size = 0, size_field = "code_length" },
+  },
+}
+
+local response_fields = {
+  [1] = {
+    { field = f_auth_response_status, name = "status", kind = "uint", offset = 0, size = 2 },
+  },
+}
+
+local pipe_header = {
+  { field = f_pipe_switch_id, name = "switch_id", kind = "uint", offset = 0, size = 4 },
+  { field = f_pipe_seq, name = "seq", kind = "uint", offset = 4, size = 2 },
+  { field = f_pipe_marker, name = "marker", kind = "uint", offset = 7, size = 1 },
+  { field = f_pipe_subtype, name = "subtype", kind = "uint", offset = 13, size = 1 },
+  { field = f_pipe_payload_length, name = "payload_length", kind = "uint", offset = 14, size = 1 },
+}
+local pipe_ack = {
+  { field = f_pipe_ack_switch_id, name = "switch_id", kind = "uint", offset = 0, size = 4 },
+  { field = f_pipe_ack_seq, name = "seq", kind = "uint", offset = 4, size = 2 },
+  { field = f_pipe_ack_status, name = "status", kind = "uint", offset = -1, size = 1 },
+}
+
+local pipe_types = {
+  [0xd0] = {
+    name = "set_status",
+    request = {
+      { field = f_set_status_request_device, name = "device", kind = "uint", offset = 5, size = 2 },
+      { field = f_set_status_request_on, name = "on", kind = "uint", offset = 11, size = 1 },
+    },
+  },
+  [0xd2] = {
+    name = "set_lum",
+    request = {
+      { field = f_set_lum_request_device, name = "device", kind = "uint", offset = 5, size = 2 },
+      { field = f_set_lum_request_brightness, name = "brightness", kind = "uint", offset = 11, size = 1 },
+    },
+  },
+  [0xe2] = {
+    name = "set_ct",
+    request = {
+      { field = f_set_ct_request_device, name = "device", kind = "uint", offset = 5, size = 2 },
+      { field = f_set_ct_request_mode, name = "mode", kind = "uint", offset = 11, size = 1 },
+      { field = f_set_ct_request_color_tone, name = "color_tone", kind = "uint", offset = 12, size = 1, when = "mode", when_value = 5 },
+      { field = f_set_ct_request_rgb, name = "rgb", kind = "bytes", offset = 12, size = 3, when = "mode", when_value = 4 },
+    },
+  },
+  [0xdb] = {
+    name = "get_status",
+  },
+  [0x52] = {
+    name = "get_status_paginated",
+    records = {
+      name = "status",
+      offset = 6,
+      size = 24,
+      fields = {
+        { field = f_get_status_paginated_status_device, name = "device", kind = "uint", offset = 1, size = 1 },
+        { field = f_get_status_paginated_status_on, name = "on", kind = "uint", offset = 9, size = 1 },
+        { field = f_get_status_paginated_status_brightness, name = "brightness", kind = "uint", offset = 13, size = 1 },
+        { field = f_get_status_paginated_status_color_tone, name = "color_tone", kind = "uint", offset = 17, size = 1 },
+        { field = f_get_status_paginated_status_rgb, name = "rgb", kind = "bytes", offset = 21, size = 3 },
+      },
+    },
+  },
+}
+
+proto.fields = {
+  f_type,
+  f_response,
+  f_length,
+  f_records,
+  f_auth_request_user_id,
+  f_auth_request_code_length,
+  f_auth_request_code,
+  f_auth_response_status,
+  f_pipe_switch_id,
+  f_pipe_seq,
+  f_pipe_marker,
+  f_pipe_subtype,
+  f_pipe_payload_length,
+  f_pipe_ack_switch_id,
+  f_pipe_ack_seq,
+  f_pipe_ack_status,
+  f_set_status_request_device,
+  f_set_status_request_on,
+  f_set_lum_request_device,
+  f_set_lum_request_brightness,
+  f_set_ct_request_device,
+  f_set_ct_request_mode,
+  f_set_ct_request_color_tone,
+  f_set_ct_request_rgb,
+  f_get_status_paginated_status_device,
+  f_get_status_paginated_status_on,
+  f_get_status_paginated_status_brightness,
+  f_get_status_paginated_status_color_tone,
+  f_get_status_paginated_status_rgb,
+}
+
+local PORT = 23778
+local HEADER_SIZE = 5
+local RESPONSE_FLAG = 0x08
+local PIPE_TYPE = 7
+local PIPE_HEADER_SIZE = 15
+local PIPE_PAYLOAD_OFFSET = 15
+
+-- Add the fields in defs to a tree, for a structure at [start, stop) in buf.
+-- Returns the values of the integer fields by name.
+local function dissect_fields(buf, tree, start, stop, defs)
+  local values = {}
+  for _, d in ipairs(defs) do
+    local offset = d.offset
+    if offset < 0 then
+      offset = stop - start + offset
+    end
+    local size = d.size
+    if d.size_field ~= nil then
+      size = values[d.size_field] or 0
+    elseif size == 0 then
+      size = stop - start - offset
+    end
+    local present = d.when == nil or values[d.when] == d.when_value
+    if present and offset >= 0 and size > 0 and start + offset + size <= stop then
+      local range = buf(start + offset, size)
+      tree:add(d.field, range)
+      if d.kind == "uint" and size <= 4 then
+        values[d.name] = range:uint()
+      end
+    end
+  end
+  return values
+end
+
+-- Dissect one packet, returning a summary for the info column.
+local function dissect_packet(buf, tree)
+  local type_byte = buf(0, 1):uint()
+  local packet_type = bit.rshift(type_byte, 4)
+  local is_response = bit.band(type_byte, RESPONSE_FLAG) ~= 0
+  local length = buf(1, 4):uint()
+  local stop = HEADER_SIZE + length
+
+  local item = tree:add(proto, buf(0, stop))
+  item:add(f_type, buf(0, 1))
+  item:add(f_response, buf(0, 1))
+  item:add(f_length, buf(1, 4))
+
+  local summary = packet_types[packet_type] or ("type " .. packet_type)
+  if is_response then
+    summary = summary .. " response"
+  end
+  local defs = request_fields[packet_type]
+  if is_response then
+    defs = response_fields[packet_type]
+  end
+  if defs ~= nil then
+    dissect_fields(buf, item, HEADER_SIZE, stop, defs)
+  end
+
+  if packet_type == PIPE_TYPE and length >= PIPE_HEADER_SIZE then
+    local header = dissect_fields(buf, item, HEADER_SIZE, stop, pipe_header)
+    local payload_start = HEADER_SIZE + PIPE_PAYLOAD_OFFSET
+    local payload_stop = math.min(stop, payload_start + header.payload_length)
+    local sub = pipe_types[header.subtype]
+    if sub == nil then
+      return summary .. string.format(" 0x%02x", header.subtype)
+    end
+    summary = summary .. " " .. sub.name .. " seq=" .. header.seq
+    local sub_defs = sub.request
+    if is_response then
+      sub_defs = sub.response
+    end
+    if sub_defs ~= nil then
+      local values = dissect_fields(buf, item, payload_start, payload_stop, sub_defs)
+      for _, d in ipairs(sub_defs) do
+        if values[d.name] ~= nil then
+          summary = summary .. " " .. d.name .. "=" .. values[d.name]
+        end
+      end
+    end
+    local records = sub.records
+    if is_response and records ~= nil then
+      local offset = payload_start + records.offset
+      local count = 0
+      while offset + records.size <= payload_stop do
+        local subtree = item:add(f_records, buf(offset, records.size))
+        subtree:set_text(records.name .. " " .. count)
+        dissect_fields(buf, subtree, offset, offset + records.size, records.fields)
+        offset = offset + records.size
+        count = count + 1
+      end
+      summary = summary .. " (" .. count .. " records)"
+    end
+  elseif packet_type == PIPE_TYPE then
+    local values = dissect_fields(buf, item, HEADER_SIZE, stop, pipe_ack)
+    if values.seq ~= nil then
+      summary = summary .. " ack seq=" .. values.seq
+    end
+  end
+  return summary
+end
+
+function proto.dissector(buf, pinfo, tree)
+  pinfo.cols.protocol = "CBYGE"
+  local offset = 0
+  local summaries = {}
+  while offset < buf:len() do
+    local remaining = buf:len() - offset
+    if remaining < HEADER_SIZE then
+      pinfo.desegment_offset = offset
+      pinfo.desegment_len = DESEGMENT_ONE_MORE_SEGMENT
+      return
+    end
+    local length = buf(offset + 1, 4):uint()
+    if remaining < HEADER_SIZE + length then
+      pinfo.desegment_offset = offset
+      pinfo.desegment_len = HEADER_SIZE + length - remaining
+      return
+    end
+    local packet = buf(offset, HEADER_SIZE + length):tvb()
+    summaries[#summaries + 1] = dissect_packet(packet, tree)
+    offset = offset + HEADER_SIZE + length
+  end
+  pinfo.cols.info = table.concat(summaries, "; ")
+end
+
+DissectorTable.get("tcp.port"):add(PORT, proto)